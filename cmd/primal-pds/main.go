@@ -23,11 +23,17 @@ import (
 	"github.com/primal-host/primal-pds/internal/auth"
 	"github.com/primal-host/primal-pds/internal/config"
 	"github.com/primal-host/primal-pds/internal/database"
+	"github.com/primal-host/primal-pds/internal/deletion"
 	"github.com/primal-host/primal-pds/internal/domain"
 	"github.com/primal-host/primal-pds/internal/events"
+	"github.com/primal-host/primal-pds/internal/handles"
 	"github.com/primal-host/primal-pds/internal/identity"
+	"github.com/primal-host/primal-pds/internal/keystore"
+	"github.com/primal-host/primal-pds/internal/oauth"
+	"github.com/primal-host/primal-pds/internal/plcdir"
 	"github.com/primal-host/primal-pds/internal/repo"
 	"github.com/primal-host/primal-pds/internal/server"
+	"github.com/primal-host/primal-pds/internal/webhook"
 )
 
 func main() {
@@ -61,6 +67,60 @@ func main() {
 	defer mgmtDB.Close()
 	log.Println("Management database connected, schema bootstrapped")
 
+	// Serve the embedded PLC directory, if configured, before anything
+	// that talks to plcEndpoint.
+	if cfg.PLCDirectoryAddr != "" {
+		plcDir := plcdir.NewServer(plcdir.NewStore(mgmtDB))
+		go func() {
+			if err := plcDir.Start(ctx, cfg.PLCDirectoryAddr); err != nil {
+				log.Fatalf("PLC directory error: %v", err)
+			}
+		}()
+	}
+
+	// Open the keystore for server-held keys.
+	var keys *keystore.Store
+	if cfg.KeySecret != "" {
+		keys, err = keystore.New(mgmtDB, cfg.KeySecret)
+		if err != nil {
+			log.Fatalf("Failed to open keystore: %v", err)
+		}
+	}
+
+	// Load the PDS rotation key that controls the did:plc identities
+	// this server creates, generating it on first start.
+	var rotationKey string
+	if cfg.PLCEndpoint != "" {
+		rotationKey, err = keys.Load(ctx, keystore.RotationKey, cfg.RotationKey)
+		if err != nil {
+			log.Fatalf("Failed to load PLC rotation key: %v", err)
+		}
+		rotationDIDKey, err := account.SigningDIDKey(rotationKey)
+		if err != nil {
+			log.Fatalf("Invalid PLC rotation key: %v", err)
+		}
+		log.Printf("PLC rotation key loaded: %s", rotationDIDKey)
+	}
+
+	// Load the key of the PDS's service DID, generating it on first
+	// start.
+	var serviceKey string
+	if cfg.ServiceURL != "" {
+		if keys == nil {
+			log.Println("WARNING: No keySecret in config, the service DID has no key and its document is not served")
+		} else {
+			serviceKey, err = keys.Load(ctx, keystore.ServiceKey, cfg.ServiceKey)
+			if err != nil {
+				log.Fatalf("Failed to load service key: %v", err)
+			}
+			serviceDIDKey, err := account.SigningDIDKey(serviceKey)
+			if err != nil {
+				log.Fatalf("Invalid service key: %v", err)
+			}
+			log.Printf("Service key loaded for %s: %s", identity.ServiceDID(cfg.ServiceURL), serviceDIDKey)
+		}
+	}
+
 	// Initialize pool manager for tenant databases.
 	pools := database.NewPoolManager(cfg.ConnBase())
 	defer pools.Close()
@@ -121,26 +181,78 @@ func main() {
 	defer evtMgr.Shutdown()
 	log.Println("Event manager initialized")
 
-	// Initialize JWT manager for session auth.
-	jwtSecret := cfg.JWTSecret
-	if jwtSecret == "" {
-		jwtSecret = auth.GenerateSecret()
-		log.Println("WARNING: No jwtSecret in config, tokens won't survive restart")
+	// Start the sequencer that moves tenant commit outboxes into the
+	// firehose.
+	sequencer := events.NewSequencer(evtMgr, pools)
+	go sequencer.Run(ctx)
+	log.Println("Sequencer started")
+
+	// Start the webhook dispatcher that delivers commits to subscribed
+	// endpoints.
+	dispatcher := webhook.NewDispatcher(webhook.NewStore(mgmtDB), evtMgr)
+	go dispatcher.Run(ctx)
+	log.Println("Webhook dispatcher started")
+
+	// Start the worker that purges deleted accounts.
+	deletions := deletion.NewStore(mgmtDB, keys)
+	deleter := deletion.NewWorker(deletions, pools, evtMgr, cfg.PLCEndpoint, rotationKey)
+	go deleter.Run(ctx)
+	log.Println("Deletion worker started")
+
+	// Start the registrar that publishes did:plc operations to the PLC
+	// directory.
+	var registrar *identity.Registrar
+	if cfg.PLCEndpoint != "" {
+		registrar = identity.NewRegistrar(pools, cfg.PLCEndpoint)
+		go registrar.Run(ctx)
+		log.Println("PLC registrar started")
+	}
+
+	// Start the verifier that periodically re-checks custom-domain
+	// handles against DNS and HTTPS.
+	resolver := handles.NewNetResolver()
+	go handles.NewVerifier(handles.NewStore(mgmtDB), resolver).Run(ctx)
+	log.Println("Handle verifier started")
+
+	// Resolve other servers' DIDs and handles, caching the results in
+	// the management database.
+	identityCache := identity.NewCache(mgmtDB)
+	go identityCache.Run(ctx)
+	dir := identity.NewResolver(identity.NewNetDIDTransport(cfg.PLCEndpoint), resolver, identityCache)
+
+	// Initialize JWT manager for session auth, with its signing keys in
+	// the management database when they can be kept encrypted.
+	var jwtKeys *auth.KeyStore
+	if keys != nil {
+		jwtKeys = auth.NewKeyStore(mgmtDB, keys)
+	} else {
+		log.Println("WARNING: No keySecret in config, session tokens won't survive restart")
 	}
-	jwtMgr := auth.NewJWTManager(jwtSecret, cfg.ServiceURL)
+	if cfg.JWTSecret != "" {
+		log.Println("Note: jwtSecret is deprecated; tokens signed with it are accepted until they expire")
+	}
+	jwtMgr, err := auth.NewJWTManager(ctx, jwtKeys, auth.NewSessionStore(mgmtDB), cfg.JWTKeyAlg, cfg.ServiceURL, identity.ServiceDID(cfg.ServiceURL), cfg.JWTSecret)
+	if err != nil {
+		log.Fatalf("Failed to initialize JWT manager: %v", err)
+	}
+	go jwtMgr.Run(ctx)
 	log.Println("JWT manager initialized")
 
+	// OAuth authorization requests and DPoP proof replay records.
+	oauthStore := oauth.NewStore(mgmtDB)
+	go oauthStore.Run(ctx)
+
 	// Announce to Bluesky relay on startup.
 	if cfg.ServiceURL != "" {
 		go func() {
-			if err := identity.AnnounceToRelay(ctx, "https://bsky.network", cfg.ServiceURL); err != nil {
+			if err := identity.AnnounceToRelay(ctx, "https://bsky.network", cfg.ServiceURL, serviceKey); err != nil {
 				log.Printf("Warning: relay announcement failed: %v", err)
 			}
 		}()
 	}
 
 	// Start the HTTP server (blocks until context is cancelled).
-	srv := server.New(cfg, mgmtDB, pools, domains, repos, evtMgr, jwtMgr)
+	srv := server.New(cfg, mgmtDB, pools, domains, repos, evtMgr, sequencer, dispatcher, deletions, deleter, registrar, rotationKey, serviceKey, resolver, dir, jwtMgr, oauthStore)
 	if err := srv.Start(ctx); err != nil {
 		log.Fatalf("Server error: %v", err)
 	}
@@ -8,19 +8,23 @@
 //   - user:  regular account
 //
 // Statuses control the account's operational state:
-//   - active:    fully functional
-//   - suspended: can post locally but data is not synced to relays
-//   - disabled:  data preserved but cannot create new content
-//   - removed:   tombstone row; all associated data is deleted
+//   - active:      fully functional
+//   - suspended:   can post locally but data is not synced to relays
+//   - disabled:    data preserved but cannot create new content
+//   - deactivated: like disabled, but set by the account holder, who
+//     can still log in and reactivate
+//   - removed:     tombstone row; all associated data is deleted
 package account
 
 import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/primal-host/primal-pds/internal/database"
 	"github.com/primal-host/primal-pds/internal/repo"
 )
@@ -42,10 +46,11 @@ const (
 
 // Valid statuses.
 const (
-	StatusActive    = "active"
-	StatusSuspended = "suspended"
-	StatusDisabled  = "disabled"
-	StatusRemoved   = "removed"
+	StatusActive      = "active"
+	StatusSuspended   = "suspended"
+	StatusDisabled    = "disabled"
+	StatusDeactivated = "deactivated"
+	StatusRemoved     = "removed"
 )
 
 // Account represents a user account hosted under a domain.
@@ -57,6 +62,7 @@ type Account struct {
 	SigningKey string    `json:"signingKey,omitempty"`
 	Role       string    `json:"role"`
 	Status     string    `json:"status"`
+	PLCStatus  string    `json:"plcStatus"`
 	CreatedAt  time.Time `json:"createdAt"`
 	UpdatedAt  time.Time `json:"updatedAt"`
 }
@@ -67,7 +73,16 @@ type CreateParams struct {
 	Email           string
 	Password        string // plaintext, will be hashed
 	Role            string // defaults to "user" if empty
-	ServiceEndpoint string // when set, derive proper did:plc from signing key
+	DIDMethod       string // DIDMethodPLC (default) or DIDMethodWeb
+	ServiceEndpoint string // when set, derive proper did:plc (needs RotationKey)
+	RotationKey     string // PDS rotation key (multibase private key) for did:plc
+	RecoveryKey     string // optional user-held recovery rotation key (did:key)
+
+	// DID, if set, is an existing DID the account is moving here with
+	// from another PDS. No DID is generated or registered; the account
+	// starts deactivated until its repo is imported and the DID
+	// document points at this server.
+	DID string
 }
 
 // Store provides account CRUD operations backed by PostgreSQL.
@@ -84,8 +99,20 @@ func NewStore(db *database.DB) *Store {
 // and stores the account. Returns the created Account (password excluded)
 // and the plaintext password if it was auto-generated.
 //
-// When ServiceEndpoint is set, a proper did:plc is derived from the
-// signing key. Otherwise a random DID is generated.
+// When ServiceEndpoint is set, a proper did:plc is derived, controlled
+// by RotationKey and RecoveryKey (see GeneratePLCDID), and its signed
+// genesis operation is queued for submission
+// to the PLC directory in the same transaction; the account starts with
+// plc_status "pending". Otherwise a random did:plc is generated, which
+// no directory knows of; its plc_status is "unregistered".
+//
+// With DIDMethod "web" the account instead gets did:web:<handle>, which
+// the PDS serves itself; this suits domain owners whose identity is
+// their domain.
+//
+// With DID set the account keeps that DID and starts deactivated; a
+// did:plc is recorded as registered, since it is already in the
+// directory.
 func (s *Store) Create(ctx context.Context, p CreateParams) (*Account, error) {
 	hash, err := HashPassword(p.Password)
 	if err != nil {
@@ -97,14 +124,28 @@ func (s *Store) Create(ctx context.Context, p CreateParams) (*Account, error) {
 		return nil, fmt.Errorf("account: create signing key: %w", err)
 	}
 
-	// Generate DID — either proper PLC or random.
+	// Generate DID — did:web, proper PLC or random.
 	var did string
-	if p.ServiceEndpoint != "" {
-		did, _, err = GeneratePLCDID(signingKey, p.Handle, p.ServiceEndpoint)
+	var genesis *PLCOperation
+	plcStatus := PLCStatusNone
+	status := StatusActive
+	switch {
+	case p.DID != "":
+		did = NormalizeDID(p.DID)
+		status = StatusDeactivated
+		if strings.HasPrefix(did, "did:plc:") {
+			plcStatus = PLCStatusRegistered
+		}
+	case p.DIDMethod == DIDMethodWeb:
+		did = WebDID(p.Handle)
+	case p.ServiceEndpoint != "":
+		plcStatus = PLCStatusPending
+		did, genesis, err = GeneratePLCDID(signingKey, p.RotationKey, p.RecoveryKey, p.Handle, p.ServiceEndpoint)
 		if err != nil {
 			return nil, fmt.Errorf("account: create plc did: %w", err)
 		}
-	} else {
+	default:
+		plcStatus = PLCStatusUnregistered
 		did, err = GenerateDID()
 		if err != nil {
 			return nil, fmt.Errorf("account: create: %w", err)
@@ -116,16 +157,32 @@ func (s *Store) Create(ctx context.Context, p CreateParams) (*Account, error) {
 		role = RoleUser
 	}
 
+	tx, err := s.db.Pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("account: create begin: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
 	var a Account
-	err = s.db.Pool.QueryRow(ctx,
-		`INSERT INTO accounts (did, handle, email, password, signing_key, role)
-		 VALUES ($1, $2, $3, $4, $5, $6)
-		 RETURNING id, did, handle, email, COALESCE(signing_key, ''), role, status, created_at, updated_at`,
-		did, p.Handle, p.Email, hash, signingKey, role,
-	).Scan(&a.ID, &a.DID, &a.Handle, &a.Email, &a.SigningKey, &a.Role, &a.Status, &a.CreatedAt, &a.UpdatedAt)
+	err = tx.QueryRow(ctx,
+		`INSERT INTO accounts (did, handle, email, password, signing_key, role, status, plc_status)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		 RETURNING id, did, handle, email, COALESCE(signing_key, ''), role, status, plc_status, created_at, updated_at`,
+		did, p.Handle, p.Email, hash, signingKey, role, status, plcStatus,
+	).Scan(&a.ID, &a.DID, &a.Handle, &a.Email, &a.SigningKey, &a.Role, &a.Status, &a.PLCStatus, &a.CreatedAt, &a.UpdatedAt)
 	if err != nil {
 		return nil, fmt.Errorf("account: create %q: %w", p.Handle, err)
 	}
+
+	if genesis != nil {
+		if err := queuePLCOp(ctx, tx, did, genesis); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("account: create commit %q: %w", p.Handle, err)
+	}
 	return &a, nil
 }
 
@@ -134,10 +191,10 @@ func (s *Store) Create(ctx context.Context, p CreateParams) (*Account, error) {
 func (s *Store) GetByHandle(ctx context.Context, handle string) (*Account, error) {
 	var a Account
 	err := s.db.Pool.QueryRow(ctx,
-		`SELECT id, did, handle, email, COALESCE(signing_key, ''), role, status, created_at, updated_at
+		`SELECT id, did, handle, email, COALESCE(signing_key, ''), role, status, plc_status, created_at, updated_at
 		 FROM accounts WHERE handle = $1`,
 		handle,
-	).Scan(&a.ID, &a.DID, &a.Handle, &a.Email, &a.SigningKey, &a.Role, &a.Status, &a.CreatedAt, &a.UpdatedAt)
+	).Scan(&a.ID, &a.DID, &a.Handle, &a.Email, &a.SigningKey, &a.Role, &a.Status, &a.PLCStatus, &a.CreatedAt, &a.UpdatedAt)
 	if errors.Is(err, pgx.ErrNoRows) {
 		return nil, fmt.Errorf("%w: %s", ErrNotFound, handle)
 	}
@@ -150,12 +207,13 @@ func (s *Store) GetByHandle(ctx context.Context, handle string) (*Account, error
 // GetByDID returns an account by its DID.
 // Returns ErrNotFound if no account matches.
 func (s *Store) GetByDID(ctx context.Context, did string) (*Account, error) {
+	did = NormalizeDID(did)
 	var a Account
 	err := s.db.Pool.QueryRow(ctx,
-		`SELECT id, did, handle, email, COALESCE(signing_key, ''), role, status, created_at, updated_at
+		`SELECT id, did, handle, email, COALESCE(signing_key, ''), role, status, plc_status, created_at, updated_at
 		 FROM accounts WHERE did = $1`,
 		did,
-	).Scan(&a.ID, &a.DID, &a.Handle, &a.Email, &a.SigningKey, &a.Role, &a.Status, &a.CreatedAt, &a.UpdatedAt)
+	).Scan(&a.ID, &a.DID, &a.Handle, &a.Email, &a.SigningKey, &a.Role, &a.Status, &a.PLCStatus, &a.CreatedAt, &a.UpdatedAt)
 	if errors.Is(err, pgx.ErrNoRows) {
 		return nil, fmt.Errorf("%w: %s", ErrNotFound, did)
 	}
@@ -168,7 +226,7 @@ func (s *Store) GetByDID(ctx context.Context, did string) (*Account, error) {
 // List returns all accounts in the tenant database ordered by handle.
 func (s *Store) List(ctx context.Context) ([]Account, error) {
 	rows, err := s.db.Pool.Query(ctx,
-		`SELECT id, did, handle, email, COALESCE(signing_key, ''), role, status, created_at, updated_at
+		`SELECT id, did, handle, email, COALESCE(signing_key, ''), role, status, plc_status, created_at, updated_at
 		 FROM accounts ORDER BY handle`)
 	if err != nil {
 		return nil, fmt.Errorf("account: list: %w", err)
@@ -178,7 +236,7 @@ func (s *Store) List(ctx context.Context) ([]Account, error) {
 	accounts := []Account{}
 	for rows.Next() {
 		var a Account
-		if err := rows.Scan(&a.ID, &a.DID, &a.Handle, &a.Email, &a.SigningKey, &a.Role, &a.Status, &a.CreatedAt, &a.UpdatedAt); err != nil {
+		if err := rows.Scan(&a.ID, &a.DID, &a.Handle, &a.Email, &a.SigningKey, &a.Role, &a.Status, &a.PLCStatus, &a.CreatedAt, &a.UpdatedAt); err != nil {
 			return nil, fmt.Errorf("account: list scan: %w", err)
 		}
 		accounts = append(accounts, a)
@@ -204,9 +262,9 @@ func (s *Store) UpdateStatus(ctx context.Context, handle, status string) (*Accou
 	err := s.db.Pool.QueryRow(ctx,
 		`UPDATE accounts SET status = $1, updated_at = NOW()
 		 WHERE handle = $2
-		 RETURNING id, did, handle, email, COALESCE(signing_key, ''), role, status, created_at, updated_at`,
+		 RETURNING id, did, handle, email, COALESCE(signing_key, ''), role, status, plc_status, created_at, updated_at`,
 		status, handle,
-	).Scan(&a.ID, &a.DID, &a.Handle, &a.Email, &a.SigningKey, &a.Role, &a.Status, &a.CreatedAt, &a.UpdatedAt)
+	).Scan(&a.ID, &a.DID, &a.Handle, &a.Email, &a.SigningKey, &a.Role, &a.Status, &a.PLCStatus, &a.CreatedAt, &a.UpdatedAt)
 	if errors.Is(err, pgx.ErrNoRows) {
 		return nil, fmt.Errorf("%w: %s", ErrNotFound, handle)
 	}
@@ -216,6 +274,29 @@ func (s *Store) UpdateStatus(ctx context.Context, handle, status string) (*Accou
 	return &a, nil
 }
 
+// UpdateHandle changes the handle of the account with the given DID.
+// Returns ErrHandleTaken if another account in the tenant has it.
+func (s *Store) UpdateHandle(ctx context.Context, did, handle string) (*Account, error) {
+	var a Account
+	err := s.db.Pool.QueryRow(ctx,
+		`UPDATE accounts SET handle = $1, updated_at = NOW()
+		 WHERE did = $2
+		 RETURNING id, did, handle, email, COALESCE(signing_key, ''), role, status, plc_status, created_at, updated_at`,
+		handle, did,
+	).Scan(&a.ID, &a.DID, &a.Handle, &a.Email, &a.SigningKey, &a.Role, &a.Status, &a.PLCStatus, &a.CreatedAt, &a.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, did)
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return nil, fmt.Errorf("%w: %s", ErrHandleTaken, handle)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("account: update handle %s: %w", did, err)
+	}
+	return &a, nil
+}
+
 // UpdateRole changes an account's role within its domain. The owner role
 // cannot be assigned or removed through this method — it is set only
 // during domain creation.
@@ -237,9 +318,9 @@ func (s *Store) UpdateRole(ctx context.Context, handle, role string) (*Account,
 	err = s.db.Pool.QueryRow(ctx,
 		`UPDATE accounts SET role = $1, updated_at = NOW()
 		 WHERE handle = $2
-		 RETURNING id, did, handle, email, COALESCE(signing_key, ''), role, status, created_at, updated_at`,
+		 RETURNING id, did, handle, email, COALESCE(signing_key, ''), role, status, plc_status, created_at, updated_at`,
 		role, handle,
-	).Scan(&a.ID, &a.DID, &a.Handle, &a.Email, &a.SigningKey, &a.Role, &a.Status, &a.CreatedAt, &a.UpdatedAt)
+	).Scan(&a.ID, &a.DID, &a.Handle, &a.Email, &a.SigningKey, &a.Role, &a.Status, &a.PLCStatus, &a.CreatedAt, &a.UpdatedAt)
 	if errors.Is(err, pgx.ErrNoRows) {
 		return nil, fmt.Errorf("%w: %s", ErrNotFound, handle)
 	}
@@ -296,10 +377,10 @@ func (s *Store) VerifyPassword(ctx context.Context, handle, password string) (*A
 	var a Account
 	var hash string
 	err := s.db.Pool.QueryRow(ctx,
-		`SELECT id, did, handle, email, password, COALESCE(signing_key, ''), role, status, created_at, updated_at
+		`SELECT id, did, handle, email, password, COALESCE(signing_key, ''), role, status, plc_status, created_at, updated_at
 		 FROM accounts WHERE handle = $1`,
 		handle,
-	).Scan(&a.ID, &a.DID, &a.Handle, &a.Email, &hash, &a.SigningKey, &a.Role, &a.Status, &a.CreatedAt, &a.UpdatedAt)
+	).Scan(&a.ID, &a.DID, &a.Handle, &a.Email, &hash, &a.SigningKey, &a.Role, &a.Status, &a.PLCStatus, &a.CreatedAt, &a.UpdatedAt)
 	if errors.Is(err, pgx.ErrNoRows) {
 		return nil, fmt.Errorf("%w: %s", ErrNotFound, handle)
 	}
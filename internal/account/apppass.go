@@ -0,0 +1,190 @@
+package account
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// MaxAppPasswords is how many app passwords an account may hold.
+const MaxAppPasswords = 25
+
+// App password errors.
+var (
+	ErrAppPasswordExists  = errors.New("account: app password name already in use")
+	ErrAppPasswordLimit   = errors.New("account: too many app passwords")
+	ErrAppPasswordInvalid = errors.New("account: invalid app password name")
+)
+
+// AppPassword is a password an account holder hands to a third-party
+// client instead of the account password. Its sessions can't manage
+// the account; unless privileged, they can't reach private data such as
+// direct messages either.
+type AppPassword struct {
+	Name       string    `json:"name"`
+	Privileged bool      `json:"privileged"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// appPasswordPattern matches the passwords CreateAppPassword generates,
+// e.g. "abcd-efgh-ijkl-mnop".
+var appPasswordPattern = regexp.MustCompile(`^[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}$`)
+
+// IsAppPasswordFormat reports whether password is shaped like an app
+// password, so other passwords needn't be checked against app passwords.
+func IsAppPasswordFormat(password string) bool {
+	return appPasswordPattern.MatchString(password)
+}
+
+// appPasswordPrefix returns the first group of an app password. It is
+// stored next to the hash so a login is checked against only the hashes
+// it could match rather than every one the account holds; the other
+// three groups keep 60 bits of the password secret.
+func appPasswordPrefix(password string) string {
+	return password[:4]
+}
+
+// CreateAppPassword adds an app password named name to the account and
+// returns it with its plaintext password, which is not stored.
+func (s *Store) CreateAppPassword(ctx context.Context, did, name string, privileged bool) (*AppPassword, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 100 {
+		return nil, "", ErrAppPasswordInvalid
+	}
+
+	const alphabet = "abcdefghijklmnopqrstuvwxyz234567"
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", fmt.Errorf("account: generate app password: %w", err)
+	}
+	var sb strings.Builder
+	for i, v := range b {
+		if i > 0 && i%4 == 0 {
+			sb.WriteByte('-')
+		}
+		sb.WriteByte(alphabet[int(v)%len(alphabet)])
+	}
+	password := sb.String()
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var count int
+	if err := s.db.Pool.QueryRow(ctx,
+		`SELECT COUNT(*) FROM app_passwords WHERE did = $1`, did,
+	).Scan(&count); err != nil {
+		return nil, "", fmt.Errorf("account: count app passwords of %s: %w", did, err)
+	}
+	if count >= MaxAppPasswords {
+		return nil, "", ErrAppPasswordLimit
+	}
+
+	ap := AppPassword{Name: name, Privileged: privileged}
+	err = s.db.Pool.QueryRow(ctx,
+		`INSERT INTO app_passwords (did, name, prefix, password, privileged)
+		 VALUES ($1, $2, $3, $4, $5)
+		 RETURNING created_at`,
+		did, name, appPasswordPrefix(password), hash, privileged,
+	).Scan(&ap.CreatedAt)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return nil, "", fmt.Errorf("%w: %s", ErrAppPasswordExists, name)
+		}
+		return nil, "", fmt.Errorf("account: create app password for %s: %w", did, err)
+	}
+	return &ap, password, nil
+}
+
+// ListAppPasswords returns the account's app passwords, newest first.
+func (s *Store) ListAppPasswords(ctx context.Context, did string) ([]AppPassword, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT name, privileged, created_at FROM app_passwords
+		 WHERE did = $1 ORDER BY created_at DESC`,
+		did,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("account: list app passwords of %s: %w", did, err)
+	}
+	defer rows.Close()
+
+	passwords := []AppPassword{}
+	for rows.Next() {
+		var ap AppPassword
+		if err := rows.Scan(&ap.Name, &ap.Privileged, &ap.CreatedAt); err != nil {
+			return nil, fmt.Errorf("account: list app passwords scan: %w", err)
+		}
+		passwords = append(passwords, ap)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("account: list app passwords of %s: %w", did, err)
+	}
+	return passwords, nil
+}
+
+// RevokeAppPassword deletes the app password named name.
+func (s *Store) RevokeAppPassword(ctx context.Context, did, name string) error {
+	tag, err := s.db.Pool.Exec(ctx,
+		`DELETE FROM app_passwords WHERE did = $1 AND name = $2`, did, name)
+	if err != nil {
+		return fmt.Errorf("account: revoke app password of %s: %w", did, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: app password %s", ErrNotFound, name)
+	}
+	return nil
+}
+
+// VerifyAppPassword checks password against the app passwords of the
+// account with the given handle, returning the account and the app
+// password it matched. Only app passwords with the same prefix are
+// compared, which is usually one.
+func (s *Store) VerifyAppPassword(ctx context.Context, handle, password string) (*Account, *AppPassword, error) {
+	if !IsAppPasswordFormat(password) {
+		return nil, nil, fmt.Errorf("account: invalid password for %q", handle)
+	}
+	acct, err := s.GetByHandle(ctx, handle)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT name, password, privileged, created_at FROM app_passwords
+		 WHERE did = $1 AND prefix = $2`,
+		acct.DID, appPasswordPrefix(password),
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("account: verify app password %q: %w", handle, err)
+	}
+	var hashes []string
+	var candidates []AppPassword
+	for rows.Next() {
+		var ap AppPassword
+		var hash string
+		if err := rows.Scan(&ap.Name, &hash, &ap.Privileged, &ap.CreatedAt); err != nil {
+			rows.Close()
+			return nil, nil, fmt.Errorf("account: verify app password scan: %w", err)
+		}
+		hashes = append(hashes, hash)
+		candidates = append(candidates, ap)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("account: verify app password %q: %w", handle, err)
+	}
+
+	for i, hash := range hashes {
+		if CheckPassword(hash, password) == nil {
+			return acct, &candidates[i], nil
+		}
+	}
+	return nil, nil, fmt.Errorf("account: invalid password for %q", handle)
+}
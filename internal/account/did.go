@@ -22,3 +22,26 @@ func GenerateDID() (string, error) {
 	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
 	return "did:plc:" + strings.ToLower(encoded), nil
 }
+
+// DID methods an account can be created with.
+const (
+	DIDMethodPLC = "plc"
+	DIDMethodWeb = "web"
+)
+
+// WebDID returns the did:web identifier for a hostname, such as a
+// domain owner's "did:web:1440.news". Its DID document is served from
+// https://<hostname>/.well-known/did.json.
+func WebDID(hostname string) string {
+	return "did:web:" + strings.ToLower(hostname)
+}
+
+// NormalizeDID returns did in the form accounts are stored under.
+// did:web hostnames are case-insensitive and stored in lower case;
+// other DIDs are returned unchanged.
+func NormalizeDID(did string) string {
+	if strings.HasPrefix(did, "did:web:") {
+		return strings.ToLower(did)
+	}
+	return did
+}
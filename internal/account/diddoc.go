@@ -34,7 +34,18 @@ type Service struct {
 // parameters. The signing key multibase is the private key — the public
 // key is derived from it for the verificationMethod.
 func BuildDIDDocument(did, handle, signingKeyMultibase, domainName string) (*DIDDocument, error) {
-	privKey, err := repo.ParseKey(signingKeyMultibase)
+	return buildDIDDocument(did, []string{"at://" + handle}, signingKeyMultibase, "https://"+domainName)
+}
+
+// BuildServiceDIDDocument constructs the DID document of the PDS itself:
+// its service key as the #atproto verification method and its public
+// URL as the #atproto_pds service. It has no handle.
+func BuildServiceDIDDocument(did, serviceKeyMultibase, serviceURL string) (*DIDDocument, error) {
+	return buildDIDDocument(did, []string{}, serviceKeyMultibase, serviceURL)
+}
+
+func buildDIDDocument(did string, alsoKnownAs []string, keyMultibase, endpoint string) (*DIDDocument, error) {
+	privKey, err := repo.ParseKey(keyMultibase)
 	if err != nil {
 		return nil, fmt.Errorf("diddoc: parse signing key: %w", err)
 	}
@@ -52,7 +63,7 @@ func BuildDIDDocument(did, handle, signingKeyMultibase, domainName string) (*DID
 			"https://w3id.org/security/suites/secp256k1-2019/v1",
 		},
 		ID:          did,
-		AlsoKnownAs: []string{"at://" + handle},
+		AlsoKnownAs: alsoKnownAs,
 		VerificationMethod: []VerificationMethod{
 			{
 				ID:                 did + "#atproto",
@@ -65,7 +76,7 @@ func BuildDIDDocument(did, handle, signingKeyMultibase, domainName string) (*DID
 			{
 				ID:              "#atproto_pds",
 				Type:            "AtprotoPersonalDataServer",
-				ServiceEndpoint: "https://" + domainName,
+				ServiceEndpoint: endpoint,
 			},
 		},
 	}, nil
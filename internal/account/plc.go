@@ -5,33 +5,44 @@ import (
 	"crypto/sha256"
 	"encoding/base32"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
 	"strings"
 
-	cbg "github.com/whyrusleeping/cbor-gen"
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/atproto/atdata"
 
 	"github.com/primal-host/primal-pds/internal/repo"
 )
 
-// PLCOperation represents a did:plc genesis operation. This is the
-// unsigned operation that gets CBOR-encoded to derive the DID.
-type PLCOperation struct {
-	Type               string     `json:"type"`
-	RotationKeys       []string   `json:"rotationKeys"`
-	VerificationMethod PLCVerify  `json:"verificationMethods"`
-	AlsoKnownAs        []string   `json:"alsoKnownAs"`
-	Services           PLCService `json:"services"`
-}
+// PLC operation types.
+const (
+	PLCOpTypeOperation = "plc_operation"
+	PLCOpTypeTombstone = "plc_tombstone"
+)
 
-// PLCVerify holds the atproto verification method.
-type PLCVerify struct {
-	Atproto string `json:"atproto"`
+// PLCOperation represents a did:plc operation. Prev is the CID of the
+// operation it follows, or nil for the genesis operation; Sig is empty
+// until the operation is signed. The DID itself is derived from the
+// signed genesis operation. A plc_tombstone carries only Type, Prev and
+// Sig.
+type PLCOperation struct {
+	Type                string                 `json:"type"`
+	RotationKeys        []string               `json:"rotationKeys"`
+	VerificationMethods map[string]string      `json:"verificationMethods"`
+	AlsoKnownAs         []string               `json:"alsoKnownAs"`
+	Services            map[string]PLCEndpoint `json:"services"`
+	Prev                *string                `json:"prev"`
+	Sig                 string                 `json:"sig,omitempty"`
 }
 
-// PLCService holds the PDS service endpoint.
-type PLCService struct {
-	AtprotoPDS PLCEndpoint `json:"atproto_pds"`
-}
+// Well-known verificationMethods and services entries.
+const (
+	PLCVerificationAtproto = "atproto"
+	PLCServiceAtprotoPDS   = "atproto_pds"
+)
 
 // PLCEndpoint holds a service type and endpoint URL.
 type PLCEndpoint struct {
@@ -39,49 +50,72 @@ type PLCEndpoint struct {
 	Endpoint string `json:"endpoint"`
 }
 
-// GeneratePLCDID derives a proper did:plc from a signing key, handle,
-// and service endpoint. The process is:
-//  1. Construct unsigned genesis operation
-//  2. DAG-CBOR encode it (canonical sorted keys)
+// GeneratePLCDID derives a proper did:plc for a new account. The
+// account's signing key becomes its atproto verification method; the
+// DID is controlled by its rotation keys, which are the PDS's rotation
+// key and, if recoveryDIDKey is set, a recovery key held by the user.
+// The recovery key is listed first: rotation keys earlier in the list
+// take precedence, so its holder can override operations signed by
+// this server.
+//
+// The process is:
+//  1. Construct the genesis operation and sign it with the PDS rotation key
+//  2. DAG-CBOR encode the signed operation
 //  3. SHA-256 hash
 //  4. Truncate to 15 bytes
 //  5. base32 lowercase no padding
 //  6. Prefix with "did:plc:"
 //
-// Returns the DID and the genesis operation for optional PLC directory
-// registration.
-func GeneratePLCDID(signingKeyMultibase, handle, serviceEndpoint string) (string, *PLCOperation, error) {
-	privKey, err := repo.ParseKey(signingKeyMultibase)
+// Returns the DID and the signed genesis operation, which must be
+// submitted to the PLC directory unchanged for the DID to resolve.
+func GeneratePLCDID(signingKeyMultibase, rotationKeyMultibase, recoveryDIDKey, handle, serviceEndpoint string) (string, *PLCOperation, error) {
+	didKey, err := SigningDIDKey(signingKeyMultibase)
 	if err != nil {
-		return "", nil, fmt.Errorf("plc: parse key: %w", err)
+		return "", nil, err
 	}
-
-	pubKey, err := privKey.PublicKey()
+	rotationDIDKey, err := SigningDIDKey(rotationKeyMultibase)
 	if err != nil {
-		return "", nil, fmt.Errorf("plc: derive public key: %w", err)
+		return "", nil, err
 	}
 
-	didKey := pubKey.DIDKey()
+	rotationKeys := []string{rotationDIDKey}
+	if recoveryDIDKey != "" && recoveryDIDKey != rotationDIDKey {
+		rotationKeys = []string{recoveryDIDKey, rotationDIDKey}
+	}
 
 	op := &PLCOperation{
-		Type:         "plc_operation",
-		RotationKeys: []string{didKey},
-		VerificationMethod: PLCVerify{
-			Atproto: didKey,
+		Type:         PLCOpTypeOperation,
+		RotationKeys: rotationKeys,
+		VerificationMethods: map[string]string{
+			PLCVerificationAtproto: didKey,
 		},
 		AlsoKnownAs: []string{"at://" + handle},
-		Services: PLCService{
-			AtprotoPDS: PLCEndpoint{
+		Services: map[string]PLCEndpoint{
+			PLCServiceAtprotoPDS: {
 				Type:     "AtprotoPersonalDataServer",
 				Endpoint: serviceEndpoint,
 			},
 		},
 	}
 
-	// DAG-CBOR encode the operation as a map with sorted keys.
+	op.Sig, err = SignPLCOperation(op, rotationKeyMultibase)
+	if err != nil {
+		return "", nil, err
+	}
+
+	did, err := PLCDIDFromGenesis(op)
+	if err != nil {
+		return "", nil, err
+	}
+	return did, op, nil
+}
+
+// PLCDIDFromGenesis returns the did:plc named by a signed genesis
+// operation.
+func PLCDIDFromGenesis(op *PLCOperation) (string, error) {
 	cborBytes, err := CborEncodePLCOp(op)
 	if err != nil {
-		return "", nil, fmt.Errorf("plc: cbor encode: %w", err)
+		return "", fmt.Errorf("plc: cbor encode: %w", err)
 	}
 
 	// SHA-256 hash and truncate to 15 bytes.
@@ -90,106 +124,113 @@ func GeneratePLCDID(signingKeyMultibase, handle, serviceEndpoint string) (string
 
 	// base32 lowercase, no padding.
 	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(truncated)
-	did := "did:plc:" + strings.ToLower(encoded)
-
-	return did, op, nil
+	return "did:plc:" + strings.ToLower(encoded), nil
 }
 
-// CborEncodePLCOp encodes a PLC operation as a CBOR map with sorted
-// string keys, matching the canonical DAG-CBOR encoding used by the
-// PLC directory for DID derivation.
+// CborEncodePLCOp encodes a PLC operation in canonical DAG-CBOR form,
+// as used by the PLC directory for signatures, operation CIDs and DID
+// derivation. The sig field is included only when set.
 func CborEncodePLCOp(op *PLCOperation) ([]byte, error) {
-	var buf bytes.Buffer
-	cw := cbg.NewCborWriter(&buf)
-
-	// Map with 5 entries
-	if err := cw.WriteMajorTypeHeader(cbg.MajMap, 5); err != nil {
-		return nil, err
-	}
+	return atdata.MarshalCBOR(op.dataModel())
+}
 
-	// Keys in DAG-CBOR sorted order: alsoKnownAs, rotationKeys, services, type, verificationMethods
+// MarshalJSON encodes the operation in the JSON form the PLC directory
+// accepts.
+func (op *PLCOperation) MarshalJSON() ([]byte, error) {
+	return json.Marshal(op.dataModel())
+}
 
-	// alsoKnownAs
-	if err := writeTextString(cw, "alsoKnownAs"); err != nil {
-		return nil, err
+// dataModel returns the operation as a generic map, the shape shared by
+// its DAG-CBOR and JSON encodings.
+func (op *PLCOperation) dataModel() map[string]any {
+	var prev any
+	if op.Prev != nil {
+		prev = *op.Prev
 	}
-	if err := cw.WriteMajorTypeHeader(cbg.MajArray, uint64(len(op.AlsoKnownAs))); err != nil {
-		return nil, err
+	m := map[string]any{
+		"type": op.Type,
+		"prev": prev,
 	}
-	for _, aka := range op.AlsoKnownAs {
-		if err := writeTextString(cw, aka); err != nil {
-			return nil, err
+	if op.Type != PLCOpTypeTombstone {
+		methods := make(map[string]any, len(op.VerificationMethods))
+		for k, v := range op.VerificationMethods {
+			methods[k] = v
 		}
-	}
-
-	// rotationKeys
-	if err := writeTextString(cw, "rotationKeys"); err != nil {
-		return nil, err
-	}
-	if err := cw.WriteMajorTypeHeader(cbg.MajArray, uint64(len(op.RotationKeys))); err != nil {
-		return nil, err
-	}
-	for _, k := range op.RotationKeys {
-		if err := writeTextString(cw, k); err != nil {
-			return nil, err
+		services := make(map[string]any, len(op.Services))
+		for k, v := range op.Services {
+			services[k] = map[string]any{
+				"type":     v.Type,
+				"endpoint": v.Endpoint,
+			}
 		}
+		m["rotationKeys"] = nonNil(op.RotationKeys)
+		m["verificationMethods"] = methods
+		m["alsoKnownAs"] = nonNil(op.AlsoKnownAs)
+		m["services"] = services
 	}
-
-	// services (nested map)
-	if err := writeTextString(cw, "services"); err != nil {
-		return nil, err
-	}
-	if err := cw.WriteMajorTypeHeader(cbg.MajMap, 1); err != nil {
-		return nil, err
-	}
-	if err := writeTextString(cw, "atproto_pds"); err != nil {
-		return nil, err
-	}
-	if err := cw.WriteMajorTypeHeader(cbg.MajMap, 2); err != nil {
-		return nil, err
-	}
-	if err := writeTextString(cw, "endpoint"); err != nil {
-		return nil, err
-	}
-	if err := writeTextString(cw, op.Services.AtprotoPDS.Endpoint); err != nil {
-		return nil, err
-	}
-	if err := writeTextString(cw, "type"); err != nil {
-		return nil, err
-	}
-	if err := writeTextString(cw, op.Services.AtprotoPDS.Type); err != nil {
-		return nil, err
+	if op.Sig != "" {
+		m["sig"] = op.Sig
 	}
+	return m
+}
 
-	// type
-	if err := writeTextString(cw, "type"); err != nil {
-		return nil, err
-	}
-	if err := writeTextString(cw, op.Type); err != nil {
-		return nil, err
+// nonNil returns s, or an empty slice if s is nil, so it encodes as an
+// empty array rather than null.
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
 	}
+	return s
+}
 
-	// verificationMethods (nested map)
-	if err := writeTextString(cw, "verificationMethods"); err != nil {
-		return nil, err
+// NextPLCOperation returns an unsigned plc_operation that follows prev
+// (whose CID is prevCID) and carries over its contents. The caller
+// applies its changes and signs the result.
+func NextPLCOperation(prev *PLCOperation, prevCID string) *PLCOperation {
+	next := &PLCOperation{
+		Type:                PLCOpTypeOperation,
+		RotationKeys:        append([]string(nil), prev.RotationKeys...),
+		VerificationMethods: make(map[string]string, len(prev.VerificationMethods)),
+		AlsoKnownAs:         append([]string(nil), prev.AlsoKnownAs...),
+		Services:            make(map[string]PLCEndpoint, len(prev.Services)),
+		Prev:                &prevCID,
 	}
-	if err := cw.WriteMajorTypeHeader(cbg.MajMap, 1); err != nil {
-		return nil, err
+	for k, v := range prev.VerificationMethods {
+		next.VerificationMethods[k] = v
 	}
-	if err := writeTextString(cw, "atproto"); err != nil {
-		return nil, err
+	for k, v := range prev.Services {
+		next.Services[k] = v
 	}
-	if err := writeTextString(cw, op.VerificationMethod.Atproto); err != nil {
-		return nil, err
+	return next
+}
+
+// NewPLCTombstone returns an unsigned plc_tombstone that follows the
+// operation with CID prevCID.
+func NewPLCTombstone(prevCID string) *PLCOperation {
+	return &PLCOperation{
+		Type: PLCOpTypeTombstone,
+		Prev: &prevCID,
 	}
+}
 
-	return buf.Bytes(), nil
+// SamePLCState reports whether two operations publish the same DID
+// document, ignoring their position in the log and signatures.
+func SamePLCState(a, b *PLCOperation) bool {
+	ac, bc := *a, *b
+	ac.Prev, bc.Prev = nil, nil
+	ac.Sig, bc.Sig = "", ""
+	ab, errA := CborEncodePLCOp(&ac)
+	bb, errB := CborEncodePLCOp(&bc)
+	return errA == nil && errB == nil && bytes.Equal(ab, bb)
 }
 
-// SignPLCOperation signs a PLC genesis operation with the given private key
-// and returns the base64url-encoded signature (no padding).
+// SignPLCOperation signs the unsigned form of a PLC operation with the
+// given private key and returns the base64url-encoded signature (no
+// padding). Any existing signature on op is ignored.
 func SignPLCOperation(op *PLCOperation, signingKeyMultibase string) (string, error) {
-	cborBytes, err := CborEncodePLCOp(op)
+	unsigned := *op
+	unsigned.Sig = ""
+	cborBytes, err := CborEncodePLCOp(&unsigned)
 	if err != nil {
 		return "", fmt.Errorf("plc sign: cbor encode: %w", err)
 	}
@@ -207,11 +248,91 @@ func SignPLCOperation(op *PLCOperation, signingKeyMultibase string) (string, err
 	return base64.RawURLEncoding.EncodeToString(sig), nil
 }
 
-// writeTextString writes a CBOR text string (major type 3).
-func writeTextString(cw *cbg.CborWriter, s string) error {
-	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(s))); err != nil {
-		return err
+// PLCSigner returns the index in rotationKeys (did:keys) of the key
+// that signed op, or -1 if none of them did.
+func PLCSigner(op *PLCOperation, rotationKeys []string) int {
+	sig, err := base64.RawURLEncoding.DecodeString(op.Sig)
+	if err != nil || len(sig) == 0 {
+		return -1
+	}
+	unsigned := *op
+	unsigned.Sig = ""
+	cborBytes, err := CborEncodePLCOp(&unsigned)
+	if err != nil {
+		return -1
+	}
+	for i, k := range rotationKeys {
+		pub, err := atcrypto.ParsePublicDIDKey(k)
+		if err != nil {
+			continue
+		}
+		if pub.HashAndVerify(cborBytes, sig) == nil {
+			return i
+		}
+	}
+	return -1
+}
+
+// SigningDIDKey returns the did:key of a multibase-encoded private key,
+// as published in PLC rotationKeys and verificationMethods.
+func SigningDIDKey(signingKeyMultibase string) (string, error) {
+	privKey, err := repo.ParseKey(signingKeyMultibase)
+	if err != nil {
+		return "", fmt.Errorf("plc: parse key: %w", err)
+	}
+	pubKey, err := privKey.PublicKey()
+	if err != nil {
+		return "", fmt.Errorf("plc: derive public key: %w", err)
+	}
+	return pubKey.DIDKey(), nil
+}
+
+// ErrInvalidRecoveryKey is returned for a recovery key that is not a
+// valid did:key.
+var ErrInvalidRecoveryKey = errors.New("account: recovery key must be a did:key")
+
+// ValidateRecoveryKey checks that a user-supplied recovery rotation key
+// is a did:key of a supported curve.
+func ValidateRecoveryKey(didKey string) error {
+	if _, err := atcrypto.ParsePublicDIDKey(didKey); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRecoveryKey, err)
+	}
+	return nil
+}
+
+// ErrNoRotationKey is returned when none of the keys this server holds
+// may sign operations for a DID.
+var ErrNoRotationKey = errors.New("plc: no usable rotation key")
+
+// ChooseRotationKey returns the first of keys (multibase private keys)
+// whose did:key is among op's rotation keys, for signing the operation
+// that follows op. Empty keys are skipped.
+func ChooseRotationKey(op *PLCOperation, keys ...string) (string, error) {
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		didKey, err := SigningDIDKey(key)
+		if err != nil {
+			return "", err
+		}
+		if slices.Contains(op.RotationKeys, didKey) {
+			return key, nil
+		}
+	}
+	return "", ErrNoRotationKey
+}
+
+// PLCOperationCID returns the CID the PLC directory assigns to a signed
+// operation; later operations reference it as their prev.
+func PLCOperationCID(op *PLCOperation) (string, error) {
+	cborBytes, err := CborEncodePLCOp(op)
+	if err != nil {
+		return "", fmt.Errorf("plc cid: cbor encode: %w", err)
+	}
+	c, err := repo.ComputeCID(cborBytes)
+	if err != nil {
+		return "", fmt.Errorf("plc cid: %w", err)
 	}
-	_, err := cw.Write([]byte(s))
-	return err
+	return c.String(), nil
 }
@@ -0,0 +1,326 @@
+package account
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// PLC registration statuses of an account (accounts.plc_status).
+const (
+	PLCStatusNone         = "none"         // not a did:plc
+	PLCStatusUnregistered = "unregistered" // random local did:plc, never published
+	PLCStatusPending      = "pending"      // operations waiting to be submitted
+	PLCStatusRegistered   = "registered"   // every operation accepted by the directory
+	PLCStatusFailed       = "failed"       // submission gave up; resubmit to retry
+)
+
+// PLC operation statuses (plc_operations.status). Nullified operations
+// were accepted but later overridden by a higher-priority rotation key;
+// the directory keeps them in its audit log but they no longer count.
+const (
+	PLCOpPending   = "pending"
+	PLCOpSubmitted = "submitted"
+	PLCOpFailed    = "failed"
+	PLCOpNullified = "nullified"
+)
+
+// PLCOp is a signed PLC operation queued for, or already accepted by,
+// the PLC directory. Together a DID's operations form the local copy of
+// its PLC operation log.
+type PLCOp struct {
+	ID          int64           `json:"id"`
+	DID         string          `json:"did"`
+	CID         string          `json:"cid"`
+	Operation   json.RawMessage `json:"operation"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	LastError   string          `json:"lastError,omitempty"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	SubmittedAt *time.Time      `json:"submittedAt,omitempty"`
+}
+
+// QueuePLCOp records a signed operation for submission and marks the
+// account's PLC status pending.
+func (s *Store) QueuePLCOp(ctx context.Context, did string, op *PLCOperation) error {
+	tx, err := s.db.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("account: queue plc op begin: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := queuePLCOp(ctx, tx, did, op); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("account: queue plc op commit: %w", err)
+	}
+	return nil
+}
+
+// queuePLCOp records a signed operation for submission. It runs inside
+// the caller's transaction so the operation is queued atomically with
+// the change it publishes.
+func queuePLCOp(ctx context.Context, tx pgx.Tx, did string, op *PLCOperation) error {
+	opCID, err := PLCOperationCID(op)
+	if err != nil {
+		return fmt.Errorf("account: queue plc op: %w", err)
+	}
+	data, err := json.Marshal(op)
+	if err != nil {
+		return fmt.Errorf("account: queue plc op: marshal: %w", err)
+	}
+	_, err = tx.Exec(ctx,
+		`INSERT INTO plc_operations (did, cid, operation) VALUES ($1, $2, $3)`,
+		did, opCID, data)
+	if err != nil {
+		return fmt.Errorf("account: queue plc op for %s: %w", did, err)
+	}
+	_, err = tx.Exec(ctx,
+		`UPDATE accounts SET plc_status = $1, updated_at = NOW() WHERE did = $2`,
+		PLCStatusPending, did)
+	if err != nil {
+		return fmt.Errorf("account: queue plc op for %s: %w", did, err)
+	}
+	return nil
+}
+
+const plcOpColumns = `id, did, cid, operation, status, attempts, last_error, created_at, submitted_at`
+
+func scanPLCOps(rows pgx.Rows) ([]PLCOp, error) {
+	defer rows.Close()
+	var ops []PLCOp
+	for rows.Next() {
+		var op PLCOp
+		if err := rows.Scan(&op.ID, &op.DID, &op.CID, &op.Operation, &op.Status,
+			&op.Attempts, &op.LastError, &op.CreatedAt, &op.SubmittedAt); err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	return ops, rows.Err()
+}
+
+// DuePLCOps returns pending operations whose next attempt time has
+// passed. Only the oldest unsubmitted operation of each DID is returned,
+// since the directory accepts a DID's operations only in order.
+func (s *Store) DuePLCOps(ctx context.Context, limit int) ([]PLCOp, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT `+plcOpColumns+` FROM plc_operations p
+		 WHERE status = $1 AND next_attempt_at <= NOW()
+		   AND NOT EXISTS (SELECT 1 FROM plc_operations e
+		                   WHERE e.did = p.did AND e.id < p.id AND e.status IN ($1, $2))
+		 ORDER BY id LIMIT $3`,
+		PLCOpPending, PLCOpFailed, limit)
+	if err != nil {
+		return nil, fmt.Errorf("account: query due plc ops: %w", err)
+	}
+	ops, err := scanPLCOps(rows)
+	if err != nil {
+		return nil, fmt.Errorf("account: scan due plc ops: %w", err)
+	}
+	return ops, nil
+}
+
+// ListPLCOps returns a DID's operations, oldest first.
+func (s *Store) ListPLCOps(ctx context.Context, did string) ([]PLCOp, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT `+plcOpColumns+` FROM plc_operations WHERE did = $1 ORDER BY id`, did)
+	if err != nil {
+		return nil, fmt.Errorf("account: list plc ops for %s: %w", did, err)
+	}
+	ops, err := scanPLCOps(rows)
+	if err != nil {
+		return nil, fmt.Errorf("account: scan plc ops for %s: %w", did, err)
+	}
+	return ops, nil
+}
+
+// MarkPLCOpSubmitted records that the directory accepted an operation.
+// Once a DID has nothing left to submit, its account is marked
+// registered.
+func (s *Store) MarkPLCOpSubmitted(ctx context.Context, op *PLCOp) error {
+	tx, err := s.db.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("account: mark plc op begin: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx,
+		`UPDATE plc_operations SET status = $1, last_error = '', submitted_at = NOW()
+		 WHERE id = $2`, PLCOpSubmitted, op.ID)
+	if err != nil {
+		return fmt.Errorf("account: mark plc op %d submitted: %w", op.ID, err)
+	}
+	if err := markRegistered(ctx, tx, op.DID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("account: mark plc op commit: %w", err)
+	}
+	return nil
+}
+
+// markRegistered marks an account registered once none of its
+// operations are waiting to be submitted.
+func markRegistered(ctx context.Context, tx pgx.Tx, did string) error {
+	_, err := tx.Exec(ctx,
+		`UPDATE accounts SET plc_status = $1, updated_at = NOW()
+		 WHERE did = $2 AND NOT EXISTS (
+		     SELECT 1 FROM plc_operations WHERE did = $2 AND status IN ($3, $4))`,
+		PLCStatusRegistered, did, PLCOpPending, PLCOpFailed)
+	if err != nil {
+		return fmt.Errorf("account: mark %s registered: %w", did, err)
+	}
+	return nil
+}
+
+// MarkPLCOpFailed records a failed submission. When next is nil the
+// operation is given up on and the account marked failed; otherwise it
+// is retried at next.
+func (s *Store) MarkPLCOpFailed(ctx context.Context, op *PLCOp, attempts int, cause error, next *time.Time) error {
+	tx, err := s.db.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("account: mark plc op begin: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	status := PLCOpPending
+	retryAt := time.Now()
+	if next != nil {
+		retryAt = *next
+	} else {
+		status = PLCOpFailed
+	}
+	_, err = tx.Exec(ctx,
+		`UPDATE plc_operations SET status = $1, attempts = $2, last_error = $3, next_attempt_at = $4
+		 WHERE id = $5`, status, attempts, cause.Error(), retryAt, op.ID)
+	if err != nil {
+		return fmt.Errorf("account: mark plc op %d failed: %w", op.ID, err)
+	}
+	if next == nil {
+		_, err = tx.Exec(ctx,
+			`UPDATE accounts SET plc_status = $1, updated_at = NOW() WHERE did = $2`,
+			PLCStatusFailed, op.DID)
+		if err != nil {
+			return fmt.Errorf("account: mark %s plc failed: %w", op.DID, err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("account: mark plc op commit: %w", err)
+	}
+	return nil
+}
+
+// ErrNothingToSubmit is returned by ResubmitPLC when a DID has no
+// unsubmitted PLC operations.
+var ErrNothingToSubmit = errors.New("account: no plc operations to submit")
+
+// ResubmitPLC requeues a DID's unsubmitted operations, including ones
+// that were given up on, for immediate submission with a fresh attempt
+// count. It returns the updated account.
+func (s *Store) ResubmitPLC(ctx context.Context, did string) (*Account, error) {
+	tx, err := s.db.Pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("account: resubmit plc begin: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx,
+		`UPDATE plc_operations SET status = $1, attempts = 0, next_attempt_at = NOW()
+		 WHERE did = $2 AND status IN ($1, $3)`, PLCOpPending, did, PLCOpFailed)
+	if err != nil {
+		return nil, fmt.Errorf("account: resubmit plc for %s: %w", did, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNothingToSubmit, did)
+	}
+	_, err = tx.Exec(ctx,
+		`UPDATE accounts SET plc_status = $1, updated_at = NOW() WHERE did = $2`,
+		PLCStatusPending, did)
+	if err != nil {
+		return nil, fmt.Errorf("account: resubmit plc for %s: %w", did, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("account: resubmit plc commit: %w", err)
+	}
+	return s.GetByDID(ctx, did)
+}
+
+// ErrNoPLCLog is returned by LastPLCOp when no operations are recorded
+// for a DID.
+var ErrNoPLCLog = errors.New("account: no plc operations recorded")
+
+// LastPLCOp returns the newest operation of a DID's log that still
+// counts: the one the next operation must follow. Queued operations
+// count, so updates can be chained before earlier ones are submitted.
+func (s *Store) LastPLCOp(ctx context.Context, did string) (*PLCOp, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT `+plcOpColumns+` FROM plc_operations
+		 WHERE did = $1 AND status <> $2
+		 ORDER BY id DESC LIMIT 1`, did, PLCOpNullified)
+	if err != nil {
+		return nil, fmt.Errorf("account: last plc op for %s: %w", did, err)
+	}
+	ops, err := scanPLCOps(rows)
+	if err != nil {
+		return nil, fmt.Errorf("account: scan last plc op for %s: %w", did, err)
+	}
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoPLCLog, did)
+	}
+	return &ops[0], nil
+}
+
+// PLCLogEntry is an operation as reported by the PLC directory's audit
+// log.
+type PLCLogEntry struct {
+	CID       string
+	Operation json.RawMessage
+	Nullified bool
+	CreatedAt time.Time
+}
+
+// SyncPLCLog merges the directory's audit log for a DID into the local
+// copy: operations missing locally are recorded as submitted (or
+// nullified), and local operations the directory has since nullified
+// are marked so. Entries must be in log order.
+func (s *Store) SyncPLCLog(ctx context.Context, did string, entries []PLCLogEntry) error {
+	tx, err := s.db.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("account: sync plc log begin: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	for _, e := range entries {
+		status := PLCOpSubmitted
+		if e.Nullified {
+			status = PLCOpNullified
+		}
+		_, err := tx.Exec(ctx,
+			`INSERT INTO plc_operations (did, cid, operation, status, created_at, submitted_at)
+			 VALUES ($1, $2, $3, $4, $5, $5)
+			 ON CONFLICT (did, cid) DO UPDATE
+			 SET status = EXCLUDED.status,
+			     submitted_at = COALESCE(plc_operations.submitted_at, EXCLUDED.submitted_at)`,
+			did, e.CID, e.Operation, status, e.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("account: sync plc log for %s: %w", did, err)
+		}
+	}
+	if err := markRegistered(ctx, tx, did); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("account: sync plc log commit: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package account
+
+import "errors"
+
+// Status policy errors. They map to the AccountDeactivated and
+// AccountTakedown XRPC errors.
+var (
+	ErrAccountDeactivated = errors.New("account: deactivated")
+	ErrAccountTakedown    = errors.New("account: taken down")
+)
+
+// CanWrite reports whether an account with the given status may change
+// its repository or upload blobs. Suspended accounts may still write;
+// their commits are just not synced to relays.
+func CanWrite(status string) error {
+	switch status {
+	case StatusDisabled, StatusDeactivated:
+		return ErrAccountDeactivated
+	case StatusRemoved:
+		return ErrAccountTakedown
+	}
+	return nil
+}
+
+// CanLogin reports whether an account with the given status may create
+// or refresh a session. It follows CanWrite — a session is useless to an
+// account that cannot write — except that self-deactivated accounts may
+// log in, since they need a session to reactivate or delete themselves.
+func CanLogin(status string) error {
+	if status == StatusDeactivated {
+		return nil
+	}
+	return CanWrite(status)
+}
+
+// CanImport reports whether an account with the given status may upload
+// blobs and import its repository. It follows CanLogin: an account
+// moving here from another PDS is deactivated until the move is
+// complete and must still be able to bring its data.
+func CanImport(status string) error {
+	return CanLogin(status)
+}
+
+// Syncs reports whether an account's repository is served to external
+// consumers (relays, public firehose and sync endpoints).
+func Syncs(status string) bool {
+	return status == StatusActive
+}
+
+// HostingStatus maps a status to the atproto account hosting state used
+// in #account events and sync errors: whether the repo is active and,
+// if not, the reason ("suspended", "deactivated" or "takendown").
+func HostingStatus(status string) (active bool, reason string) {
+	switch status {
+	case StatusActive:
+		return true, ""
+	case StatusSuspended:
+		return false, "suspended"
+	case StatusDisabled, StatusDeactivated:
+		return false, "deactivated"
+	default:
+		return false, "takendown"
+	}
+}
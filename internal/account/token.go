@@ -0,0 +1,84 @@
+package account
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Email token purposes. An account holds at most one live token per
+// purpose; requesting a new one replaces the old.
+const (
+	PurposeDeleteAccount = "delete_account"
+	PurposePLCOperation  = "plc_operation"
+)
+
+// EmailTokenTTL is how long an emailed token stays valid.
+const EmailTokenTTL = 15 * time.Minute
+
+// Email token errors. They map to the InvalidToken and ExpiredToken
+// XRPC errors.
+var (
+	ErrInvalidToken = errors.New("account: invalid token")
+	ErrExpiredToken = errors.New("account: token expired")
+)
+
+// tokenAlphabet excludes characters that are easily confused when a
+// token is copied by hand from an email.
+const tokenAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// CreateEmailToken issues a token for the given purpose, replacing any
+// earlier one. Tokens look like "ABCDE-FGHJK".
+func (s *Store) CreateEmailToken(ctx context.Context, did, purpose string) (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("account: generate token: %w", err)
+	}
+	var sb strings.Builder
+	for i, v := range b {
+		if i == 5 {
+			sb.WriteByte('-')
+		}
+		sb.WriteByte(tokenAlphabet[int(v)%len(tokenAlphabet)])
+	}
+	token := sb.String()
+
+	_, err := s.db.Pool.Exec(ctx,
+		`INSERT INTO email_tokens (did, purpose, token, expires_at)
+		 VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (did, purpose) DO UPDATE
+		 SET token = EXCLUDED.token, expires_at = EXCLUDED.expires_at, created_at = NOW()`,
+		did, purpose, token, time.Now().Add(EmailTokenTTL),
+	)
+	if err != nil {
+		return "", fmt.Errorf("account: store token for %s: %w", did, err)
+	}
+	return token, nil
+}
+
+// ConsumeEmailToken checks a token and, if it matches, deletes it so it
+// cannot be used again. Matching is case-insensitive.
+func (s *Store) ConsumeEmailToken(ctx context.Context, did, purpose, token string) error {
+	var expiresAt time.Time
+	err := s.db.Pool.QueryRow(ctx,
+		`DELETE FROM email_tokens
+		 WHERE did = $1 AND purpose = $2 AND token = $3
+		 RETURNING expires_at`,
+		did, purpose, strings.ToUpper(strings.TrimSpace(token)),
+	).Scan(&expiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrInvalidToken
+	}
+	if err != nil {
+		return fmt.Errorf("account: consume token for %s: %w", did, err)
+	}
+	if time.Now().After(expiresAt) {
+		return ErrExpiredToken
+	}
+	return nil
+}
@@ -1,33 +1,68 @@
 // Package auth provides JWT token management for AT Protocol session
 // authentication. Access tokens (2h TTL) authorize XRPC calls, refresh
 // tokens (90d TTL) obtain new token pairs.
+//
+// Tokens are signed with ES256 or ES256K by the newest key of a key set
+// kept in the management database, and name that key in their kid
+// header. Rotating adds a key that signs from then on; the keys it
+// replaces keep verifying until every token they signed has expired.
+//
+// Each token pair belongs to a session recorded by a SessionStore and
+// names it in its jti claim, so sessions can be revoked. Refreshing
+// exchanges the refresh token for the next of its session; presenting
+// an exchanged one again revokes the session.
 package auth
 
 import (
-	"crypto/rand"
-	"encoding/hex"
+	"context"
+	"errors"
 	"fmt"
+	"log"
+	"slices"
+	"sync"
 	"time"
 
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	_ "github.com/bluesky-social/indigo/atproto/auth" // registers the atcrypto ES256/ES256K jwt methods
 	"github.com/golang-jwt/jwt/v5"
 )
 
-// Token scopes matching the AT Protocol specification.
+// Token scopes matching the AT Protocol specification. Access tokens
+// carry ScopeAccess, or one of the app password scopes when the session
+// was started with an app password.
 const (
-	ScopeAccess  = "com.atproto.access"
-	ScopeRefresh = "com.atproto.refresh"
+	ScopeAccess            = "com.atproto.access"
+	ScopeRefresh           = "com.atproto.refresh"
+	ScopeAppPass           = "com.atproto.appPass"
+	ScopeAppPassPrivileged = "com.atproto.appPassPrivileged"
 )
 
-// Token lifetimes.
+// Token lifetimes. OAuth access tokens are bound to a DPoP key but
+// still kept short.
 const (
-	AccessTTL  = 2 * time.Hour
-	RefreshTTL = 90 * 24 * time.Hour
+	AccessTTL      = 2 * time.Hour
+	OAuthAccessTTL = 30 * time.Minute
+	RefreshTTL     = 90 * 24 * time.Hour
 )
 
+// keyReloadInterval limits how often a token with an unknown kid makes
+// the manager reload the key set, which another instance may have
+// rotated.
+const keyReloadInterval = time.Minute
+
 // Claims extends the standard JWT claims with an AT Protocol scope.
+// Access tokens issued to OAuth clients also name the client and the
+// DPoP key they are bound to.
 type Claims struct {
 	jwt.RegisteredClaims
-	Scope string `json:"scope"`
+	Scope        string        `json:"scope"`
+	ClientID     string        `json:"client_id,omitempty"`
+	Confirmation *Confirmation `json:"cnf,omitempty"`
+}
+
+// Confirmation binds a token to a DPoP key by its JWK thumbprint.
+type Confirmation struct {
+	JKT string `json:"jkt"`
 }
 
 // TokenPair holds an access/refresh JWT pair returned on login or refresh.
@@ -36,55 +71,302 @@ type TokenPair struct {
 	RefreshJwt string `json:"refreshJwt"`
 }
 
-// JWTManager signs and validates JWT tokens using HS256.
+// JWTManager signs and validates session tokens.
 type JWTManager struct {
-	secret []byte
-	issuer string
+	store    *KeyStore // nil keeps the key set in memory only
+	sessions *SessionStore
+	alg      string
+	issuer   string
+	audience string
+	legacy   []byte // HS256 secret of tokens issued before key rotation
+
+	mu         sync.RWMutex
+	keys       []SigningKey // newest first
+	lastReload time.Time
+}
+
+// NewJWTManager creates a manager that signs tokens with alg, naming
+// issuer and audience (the service DID). If store has no active key for
+// alg, one is created. Sessions are recorded in sessions.
+//
+// With a nil store the key set lives in memory and tokens don't survive
+// a restart. A non-empty legacySecret keeps HS256 tokens signed with it
+// valid until they expire; no new tokens are signed with it.
+func NewJWTManager(ctx context.Context, store *KeyStore, sessions *SessionStore, alg, issuer, audience, legacySecret string) (*JWTManager, error) {
+	if !ValidAlg(alg) {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownAlg, alg)
+	}
+	m := &JWTManager{
+		store:    store,
+		sessions: sessions,
+		alg:      alg,
+		issuer:   issuer,
+		audience: audience,
+	}
+	if legacySecret != "" {
+		m.legacy = []byte(legacySecret)
+	}
+	if err := m.reload(ctx); err != nil {
+		return nil, err
+	}
+	if k := m.signingKey(); k == nil || k.Alg != alg {
+		if _, err := m.Rotate(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Rotate makes a new key the signing key and retires the previous one,
+// which keeps verifying the tokens it signed. It returns the new kid.
+func (m *JWTManager) Rotate(ctx context.Context) (string, error) {
+	if m.store == nil {
+		k, err := newSigningKey(m.alg)
+		if err != nil {
+			return "", err
+		}
+		m.mu.Lock()
+		now := time.Now()
+		for i := range m.keys {
+			if m.keys[i].RetiredAt == nil {
+				m.keys[i].RetiredAt = &now
+			}
+		}
+		m.keys = append([]SigningKey{*k}, m.keys...)
+		m.mu.Unlock()
+		return k.KID, nil
+	}
+
+	k, err := m.store.Rotate(ctx, m.alg)
+	if err != nil {
+		return "", err
+	}
+	if err := m.reload(ctx); err != nil {
+		return "", err
+	}
+	return k.KID, nil
+}
+
+// Run rotates the signing key once it is older than KeyRotationInterval
+// and drops keys and sessions no token can still need, checking hourly
+// until ctx is cancelled. It also picks up rotations made by other
+// instances.
+func (m *JWTManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(keyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := m.maintain(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+}
+
+func (m *JWTManager) maintain(ctx context.Context) error {
+	if n, err := m.sessions.Prune(ctx); err != nil {
+		return err
+	} else if n > 0 {
+		log.Printf("Sessions: pruned %d expired refresh tokens", n)
+	}
+
+	if m.store != nil {
+		if n, err := m.store.Prune(ctx); err != nil {
+			return err
+		} else if n > 0 {
+			log.Printf("JWT keys: pruned %d expired keys", n)
+		}
+		if err := m.reload(ctx); err != nil {
+			return err
+		}
+	} else {
+		m.pruneMemory()
+	}
+
+	if k := m.signingKey(); k == nil || time.Since(k.CreatedAt) >= KeyRotationInterval {
+		kid, err := m.Rotate(ctx)
+		if err != nil {
+			return err
+		}
+		log.Printf("JWT keys: rotated, now signing with %s", kid)
+	}
+	return nil
+}
+
+// reload replaces the key set with the store's.
+func (m *JWTManager) reload(ctx context.Context) error {
+	if m.store == nil {
+		return nil
+	}
+	keys, err := m.store.List(ctx)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.keys = keys
+	m.lastReload = time.Now()
+	m.mu.Unlock()
+	return nil
+}
+
+// pruneMemory drops in-memory keys retired longer ago than any token
+// they signed can live.
+func (m *JWTManager) pruneMemory() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cutoff := time.Now().Add(-keyRetention)
+	kept := m.keys[:0]
+	for _, k := range m.keys {
+		if k.RetiredAt == nil || k.RetiredAt.After(cutoff) {
+			kept = append(kept, k)
+		}
+	}
+	m.keys = kept
+}
+
+// signingKey returns the newest active key, or nil if there is none.
+func (m *JWTManager) signingKey() *SigningKey {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for i := range m.keys {
+		if m.keys[i].RetiredAt == nil {
+			k := m.keys[i]
+			return &k
+		}
+	}
+	return nil
+}
+
+// verifyKey returns the key named kid, reloading the key set once if
+// it is unknown and the last reload isn't recent.
+func (m *JWTManager) verifyKey(ctx context.Context, kid string) (*SigningKey, error) {
+	find := func() *SigningKey {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		for i := range m.keys {
+			if m.keys[i].KID == kid {
+				k := m.keys[i]
+				return &k
+			}
+		}
+		return nil
+	}
+
+	if k := find(); k != nil {
+		return k, nil
+	}
+	m.mu.RLock()
+	stale := m.store != nil && time.Since(m.lastReload) >= keyReloadInterval
+	m.mu.RUnlock()
+	if stale {
+		if err := m.reload(ctx); err != nil {
+			return nil, err
+		}
+		if k := find(); k != nil {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("auth: unknown signing key %q", kid)
 }
 
-// NewJWTManager creates a manager with the given HMAC secret and issuer URL.
-func NewJWTManager(secret, issuer string) *JWTManager {
-	return &JWTManager{
-		secret: []byte(secret),
-		issuer: issuer,
+// CreateSession starts a session and returns its first token pair.
+// sess gives the DID and the scope of its access tokens; for a login
+// with an app password also its name, and for an OAuth client the
+// client and DPoP key the tokens are bound to.
+func (m *JWTManager) CreateSession(ctx context.Context, sess *Session) (*TokenPair, error) {
+	first := *sess
+	first.Family = newTokenID()
+	return m.issue(ctx, &first)
+}
+
+// Session returns the session of the token jti.
+func (m *JWTManager) Session(ctx context.Context, jti string) (*Session, error) {
+	return m.sessions.Get(ctx, jti)
+}
+
+// RefreshSession exchanges the refresh token jti of did for the next
+// token pair of its session. It returns ErrTokenReused, having revoked
+// the session, if the token was exchanged before, and ErrSessionRevoked
+// if the session is over. A refresh token without a jti predates
+// sessions and starts a new one.
+func (m *JWTManager) RefreshSession(ctx context.Context, did, jti string) (*TokenPair, error) {
+	if jti == "" {
+		return m.CreateSession(ctx, &Session{DID: did, Scope: ScopeAccess})
 	}
+	sess, err := m.sessions.Use(ctx, jti)
+	if err != nil {
+		return nil, err
+	}
+	if sess.DID != did {
+		return nil, ErrSessionRevoked
+	}
+	return m.issue(ctx, sess)
+}
+
+// RevokeSession ends the session of the token jti. Tokens without a jti
+// have no session and can't be revoked.
+func (m *JWTManager) RevokeSession(ctx context.Context, jti string) error {
+	if jti == "" {
+		return nil
+	}
+	sess, err := m.sessions.Get(ctx, jti)
+	if errors.Is(err, ErrSessionRevoked) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = m.sessions.RevokeFamily(ctx, sess.Family)
+	return err
+}
+
+// RevokeAppPassword ends the sessions of did started with the app
+// password named name.
+func (m *JWTManager) RevokeAppPassword(ctx context.Context, did, name string) (int64, error) {
+	return m.sessions.RevokeAppPassword(ctx, did, name)
 }
 
-// GenerateSecret returns a random 32-byte hex string for use as a JWT secret.
-func GenerateSecret() string {
-	b := make([]byte, 32)
-	_, _ = rand.Read(b)
-	return hex.EncodeToString(b)
+// RevokeAll ends every session of did and returns how many there were.
+func (m *JWTManager) RevokeAll(ctx context.Context, did string) (int64, error) {
+	return m.sessions.RevokeDID(ctx, did)
 }
 
-// CreateTokenPair generates an access/refresh token pair for the given DID.
-func (m *JWTManager) CreateTokenPair(did string) (*TokenPair, error) {
+// issue records a new refresh token of the session of prev and signs
+// it and its access token, both with its jti.
+func (m *JWTManager) issue(ctx context.Context, prev *Session) (*TokenPair, error) {
+	key := m.signingKey()
+	if key == nil {
+		return nil, fmt.Errorf("auth: no signing key")
+	}
 	now := time.Now()
+	sess := &Session{
+		JTI:         newTokenID(),
+		Family:      prev.Family,
+		DID:         prev.DID,
+		Scope:       prev.Scope,
+		AppPassword: prev.AppPassword,
+		ClientID:    prev.ClientID,
+		DPoPJKT:     prev.DPoPJKT,
+		ExpiresAt:   now.Add(RefreshTTL),
+	}
+	if err := m.sessions.Create(ctx, sess); err != nil {
+		return nil, err
+	}
 
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{
-		RegisteredClaims: jwt.RegisteredClaims{
-			Subject:   did,
-			Issuer:    m.issuer,
-			IssuedAt:  jwt.NewNumericDate(now),
-			ExpiresAt: jwt.NewNumericDate(now.Add(AccessTTL)),
-		},
-		Scope: ScopeAccess,
-	})
-	accessStr, err := accessToken.SignedString(m.secret)
+	accessTTL := AccessTTL
+	if sess.ClientID != "" {
+		accessTTL = OAuthAccessTTL
+	}
+	accessStr, err := m.sign(key, sess, sess.Scope, now, accessTTL)
 	if err != nil {
 		return nil, fmt.Errorf("auth: sign access token: %w", err)
 	}
-
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{
-		RegisteredClaims: jwt.RegisteredClaims{
-			Subject:   did,
-			Issuer:    m.issuer,
-			IssuedAt:  jwt.NewNumericDate(now),
-			ExpiresAt: jwt.NewNumericDate(now.Add(RefreshTTL)),
-		},
-		Scope: ScopeRefresh,
-	})
-	refreshStr, err := refreshToken.SignedString(m.secret)
+	refreshStr, err := m.sign(key, sess, ScopeRefresh, now, RefreshTTL)
 	if err != nil {
 		return nil, fmt.Errorf("auth: sign refresh token: %w", err)
 	}
@@ -95,43 +377,130 @@ func (m *JWTManager) CreateTokenPair(did string) (*TokenPair, error) {
 	}, nil
 }
 
+func (m *JWTManager) sign(key *SigningKey, sess *Session, scope string, now time.Time, ttl time.Duration) (string, error) {
+	claims := &Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        sess.JTI,
+			Subject:   sess.DID,
+			Issuer:    m.issuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+		Scope: scope,
+	}
+	if m.audience != "" {
+		claims.Audience = jwt.ClaimStrings{m.audience}
+	}
+	oauthAccess := sess.ClientID != "" && scope != ScopeRefresh
+	if oauthAccess {
+		claims.ClientID = sess.ClientID
+		claims.Confirmation = &Confirmation{JKT: sess.DPoPJKT}
+	}
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Alg), claims)
+	token.Header["kid"] = key.KID
+	if oauthAccess {
+		token.Header["typ"] = "at+jwt"
+	}
+	return token.SignedString(key.Key)
+}
+
 // ValidateAccessToken parses and validates a JWT access token, returning
-// the subject DID. Returns an error if the token is invalid, expired, or
-// has the wrong scope.
-func (m *JWTManager) ValidateAccessToken(tokenStr string) (string, error) {
-	return m.validate(tokenStr, ScopeAccess)
+// the subject DID and the token's scope. Returns an error if the token
+// is invalid, expired, or has the wrong scope, or its session was
+// revoked.
+func (m *JWTManager) ValidateAccessToken(ctx context.Context, tokenStr string) (did, scope string, err error) {
+	claims, err := m.validate(ctx, tokenStr, func(c *Claims) bool {
+		return c.Confirmation == nil &&
+			(c.Scope == ScopeAccess || c.Scope == ScopeAppPass || c.Scope == ScopeAppPassPrivileged)
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return claims.Subject, claims.Scope, nil
 }
 
 // ValidateRefreshToken parses and validates a JWT refresh token, returning
-// the subject DID. Returns an error if the token is invalid, expired, or
-// has the wrong scope.
-func (m *JWTManager) ValidateRefreshToken(tokenStr string) (string, error) {
-	return m.validate(tokenStr, ScopeRefresh)
+// the subject DID and the token's jti. Returns an error if the token is
+// invalid, expired, or has the wrong scope, or its session was revoked.
+// Whether it was already exchanged is only checked by RefreshSession.
+func (m *JWTManager) ValidateRefreshToken(ctx context.Context, tokenStr string) (did, jti string, err error) {
+	claims, err := m.validate(ctx, tokenStr, func(c *Claims) bool {
+		return c.Scope == ScopeRefresh
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return claims.Subject, claims.ID, nil
+}
+
+// ValidateOAuthToken parses and validates an access token issued to an
+// OAuth client. The caller must check that the request's DPoP proof was
+// made with the key in its cnf claim.
+func (m *JWTManager) ValidateOAuthToken(ctx context.Context, tokenStr string) (*Claims, error) {
+	return m.validate(ctx, tokenStr, func(c *Claims) bool {
+		return c.ClientID != "" && c.Confirmation != nil && c.Confirmation.JKT != "" && c.Scope != ScopeRefresh
+	})
 }
 
-func (m *JWTManager) validate(tokenStr, expectedScope string) (string, error) {
+// validate checks a token's signature, audience and session, and that
+// accept approves its kind (scope and binding).
+func (m *JWTManager) validate(ctx context.Context, tokenStr string, accept func(*Claims) bool) (*Claims, error) {
+	legacy := false
 	token, err := jwt.ParseWithClaims(tokenStr, &Claims{}, func(t *jwt.Token) (any, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("auth: unexpected signing method: %v", t.Header["alg"])
+		alg := t.Method.Alg()
+		if alg == jwt.SigningMethodHS256.Alg() {
+			if m.legacy == nil {
+				return nil, fmt.Errorf("auth: HS256 tokens are no longer accepted")
+			}
+			legacy = true
+			return m.legacy, nil
 		}
-		return m.secret, nil
-	})
+
+		kid, _ := t.Header["kid"].(string)
+		if kid == "" {
+			return nil, fmt.Errorf("auth: missing kid")
+		}
+		key, err := m.verifyKey(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		if key.Alg != alg {
+			return nil, fmt.Errorf("auth: key %s is %s, token is %s", kid, key.Alg, alg)
+		}
+		pub, err := key.Key.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		return atcrypto.PublicKey(pub), nil
+	}, jwt.WithValidMethods([]string{AlgES256, AlgES256K, jwt.SigningMethodHS256.Alg()}))
 	if err != nil {
-		return "", fmt.Errorf("auth: invalid token: %w", err)
+		return nil, fmt.Errorf("auth: invalid token: %w", err)
 	}
 
 	claims, ok := token.Claims.(*Claims)
 	if !ok || !token.Valid {
-		return "", fmt.Errorf("auth: invalid token claims")
+		return nil, fmt.Errorf("auth: invalid token claims")
+	}
+
+	if !accept(claims) {
+		return nil, fmt.Errorf("auth: wrong kind of token (scope %q)", claims.Scope)
 	}
 
-	if claims.Scope != expectedScope {
-		return "", fmt.Errorf("auth: wrong scope: got %q, want %q", claims.Scope, expectedScope)
+	// Legacy tokens predate the aud claim.
+	if !legacy && m.audience != "" && !slices.Contains(claims.Audience, m.audience) {
+		return nil, fmt.Errorf("auth: wrong audience: %v", claims.Audience)
 	}
 
 	if claims.Subject == "" {
-		return "", fmt.Errorf("auth: missing subject")
+		return nil, fmt.Errorf("auth: missing subject")
+	}
+
+	// Tokens without a jti predate sessions and live until they expire.
+	if claims.ID != "" {
+		if err := m.sessions.Active(ctx, claims.ID); err != nil {
+			return nil, err
+		}
 	}
 
-	return claims.Subject, nil
+	return claims, nil
 }
@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func kidOf(t *testing.T, token string) string {
+	t.Helper()
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &Claims{})
+	if err != nil {
+		t.Fatalf("parse %s: %v", token, err)
+	}
+	kid, _ := parsed.Header["kid"].(string)
+	return kid
+}
+
+func TestRetiredKeyVerifies(t *testing.T) {
+	ctx := context.Background()
+	for _, keys := range []*KeyStore{nil, NewMemoryKeyStore()} {
+		m := newTestManager(t, keys, NewMemorySessionStore(), "")
+		old := login(t, m)
+
+		kid, err := m.Rotate(ctx)
+		if err != nil {
+			t.Fatalf("Rotate: %v", err)
+		}
+		if did, _, err := m.ValidateAccessToken(ctx, old.AccessJwt); err != nil || did != testDID {
+			t.Errorf("token of the retired key = %q, %v; want %s", did, err, testDID)
+		}
+		if got := kidOf(t, login(t, m).AccessJwt); got != kid {
+			t.Errorf("new token kid = %s, want the rotated key %s", got, kid)
+		}
+	}
+}
+
+func TestReloadOnUnknownKid(t *testing.T) {
+	ctx := context.Background()
+	keys, sessions := NewMemoryKeyStore(), NewMemorySessionStore()
+	a := newTestManager(t, keys, sessions, "")
+	b := newTestManager(t, keys, sessions, "")
+
+	// a rotates; b hasn't seen the new key yet.
+	if _, err := a.Rotate(ctx); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	token := login(t, a).AccessJwt
+
+	// b reloaded when it was created, so it doesn't reload again yet.
+	if _, _, err := b.ValidateAccessToken(ctx, token); err == nil {
+		t.Fatal("unknown kid right after a reload: want error")
+	}
+	b.mu.Lock()
+	b.lastReload = time.Now().Add(-keyReloadInterval)
+	b.mu.Unlock()
+	if _, _, err := b.ValidateAccessToken(ctx, token); err != nil {
+		t.Errorf("unknown kid after the reload interval: %v", err)
+	}
+}
+
+func TestTokenKeyMismatch(t *testing.T) {
+	ctx := context.Background()
+	m := newTestManager(t, nil, NewMemorySessionStore(), "")
+	kid := kidOf(t, login(t, m).AccessJwt)
+
+	p256, err := atcrypto.GeneratePrivateKeyP256()
+	if err != nil {
+		t.Fatalf("GeneratePrivateKeyP256: %v", err)
+	}
+	claims := &Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   testDID,
+			Audience:  jwt.ClaimStrings{testAudience},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		Scope: ScopeAccess,
+	}
+	sign := func(alg, kid string, key any) string {
+		token := jwt.NewWithClaims(jwt.GetSigningMethod(alg), claims)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		s, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+		return s
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"ES256 under an ES256K kid", sign(AlgES256, kid, p256)},
+		{"missing kid", sign(AlgES256, "", p256)},
+		{"unknown kid", sign(AlgES256, "0123456789abcdef", p256)},
+	}
+	for _, tt := range tests {
+		if _, _, err := m.ValidateAccessToken(ctx, tt.token); err == nil {
+			t.Errorf("%s: want error", tt.name)
+		}
+	}
+}
+
+func TestLegacyHS256(t *testing.T) {
+	ctx := context.Background()
+	const secret = "legacy-secret"
+	legacy := func(secret string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Subject:   testDID,
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			},
+			Scope: ScopeAccess,
+		})
+		s, err := token.SignedString([]byte(secret))
+		if err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+		return s
+	}
+
+	with := newTestManager(t, nil, NewMemorySessionStore(), secret)
+	if did, _, err := with.ValidateAccessToken(ctx, legacy(secret)); err != nil || did != testDID {
+		t.Errorf("legacy token with jwtSecret set = %q, %v; want %s", did, err, testDID)
+	}
+	if _, _, err := with.ValidateAccessToken(ctx, legacy("another-secret")); err == nil {
+		t.Error("legacy token signed with another secret: want error")
+	}
+
+	without := newTestManager(t, nil, NewMemorySessionStore(), "")
+	if _, _, err := without.ValidateAccessToken(ctx, legacy(secret)); err == nil {
+		t.Error("legacy token without jwtSecret: want error")
+	}
+	// An empty HMAC secret must not verify either.
+	if _, _, err := without.ValidateAccessToken(ctx, legacy("")); err == nil {
+		t.Error("legacy token with an empty secret: want error")
+	}
+}
+
+func TestTokenKinds(t *testing.T) {
+	ctx := context.Background()
+	m := newTestManager(t, nil, NewMemorySessionStore(), "")
+	pair := login(t, m)
+
+	if _, _, err := m.ValidateAccessToken(ctx, pair.RefreshJwt); err == nil {
+		t.Error("refresh token as access token: want error")
+	}
+	if _, _, err := m.ValidateRefreshToken(ctx, pair.AccessJwt); err == nil {
+		t.Error("access token as refresh token: want error")
+	}
+
+	// Same keys and sessions, but known by another service DID.
+	other, err := NewJWTManager(ctx, nil, m.sessions, AlgES256K, "https://other.example.com", "did:web:other.example.com", "")
+	if err != nil {
+		t.Fatalf("NewJWTManager: %v", err)
+	}
+	other.keys = m.keys
+	if _, _, err := other.ValidateAccessToken(ctx, pair.AccessJwt); err == nil {
+		t.Error("token for another audience: want error")
+	}
+}
@@ -0,0 +1,260 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/primal-host/primal-pds/internal/database"
+	"github.com/primal-host/primal-pds/internal/keystore"
+	"github.com/primal-host/primal-pds/internal/repo"
+)
+
+// Session token signing algorithms.
+const (
+	AlgES256  = "ES256"  // NIST P-256
+	AlgES256K = "ES256K" // secp256k1
+)
+
+// Key rotation schedule.
+const (
+	// KeyRotationInterval is how long a key signs tokens before Run
+	// replaces it.
+	KeyRotationInterval = 30 * 24 * time.Hour
+
+	// keyRetention is how long a retired key still verifies tokens:
+	// long enough for every token it signed to expire.
+	keyRetention = RefreshTTL
+
+	// keyCheckInterval is how often Run reloads, rotates and prunes keys.
+	keyCheckInterval = time.Hour
+)
+
+// ErrUnknownAlg is returned for a signing algorithm other than ES256
+// and ES256K.
+var ErrUnknownAlg = errors.New("auth: unsupported signing algorithm")
+
+// SigningKey is one key of the session key set. The newest key that is
+// not retired signs new tokens; retired keys only verify.
+type SigningKey struct {
+	KID       string
+	Alg       string
+	Key       atcrypto.PrivateKeyExportable
+	CreatedAt time.Time
+	RetiredAt *time.Time
+}
+
+// ValidAlg reports whether alg is a supported signing algorithm.
+func ValidAlg(alg string) bool {
+	return alg == AlgES256 || alg == AlgES256K
+}
+
+// newSigningKey generates a key for alg with a random kid.
+func newSigningKey(alg string) (*SigningKey, error) {
+	var key atcrypto.PrivateKeyExportable
+	var err error
+	switch alg {
+	case AlgES256:
+		key, err = atcrypto.GeneratePrivateKeyP256()
+	case AlgES256K:
+		key, err = atcrypto.GeneratePrivateKeyK256()
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownAlg, alg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("auth: generate %s key: %w", alg, err)
+	}
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return &SigningKey{
+		KID:       hex.EncodeToString(b),
+		Alg:       alg,
+		Key:       key,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// KeyStore keeps the session key set in the management database, each
+// private key encrypted by the keystore, or in memory for tests.
+type KeyStore struct {
+	rows keyRows
+}
+
+// NewKeyStore creates a KeyStore.
+func NewKeyStore(db *database.ManagementDB, keys *keystore.Store) *KeyStore {
+	return &KeyStore{rows: &dbKeys{db: db, keys: keys}}
+}
+
+// NewMemoryKeyStore creates a KeyStore kept in memory, for tests that
+// share a key set between managers.
+func NewMemoryKeyStore() *KeyStore {
+	return &KeyStore{rows: &memKeys{}}
+}
+
+// keyRows keeps the session key set.
+type keyRows interface {
+	// list returns the keys not retired before cutoff, newest first.
+	list(ctx context.Context, cutoff time.Time) ([]SigningKey, error)
+
+	// add retires every key and adds k, atomically.
+	add(ctx context.Context, k *SigningKey) error
+
+	// prune deletes keys retired at or before cutoff and returns how
+	// many there were.
+	prune(ctx context.Context, cutoff time.Time) (int64, error)
+}
+
+// List returns the keys that may still verify tokens, newest first.
+func (s *KeyStore) List(ctx context.Context) ([]SigningKey, error) {
+	return s.rows.list(ctx, time.Now().Add(-keyRetention))
+}
+
+// Rotate adds a new key for alg and retires every other key in one
+// transaction, so exactly one key signs at a time.
+func (s *KeyStore) Rotate(ctx context.Context, alg string) (*SigningKey, error) {
+	k, err := newSigningKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.rows.add(ctx, k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Prune deletes keys retired long enough ago that no token they signed
+// is still valid, and returns how many there were.
+func (s *KeyStore) Prune(ctx context.Context) (int64, error) {
+	return s.rows.prune(ctx, time.Now().Add(-keyRetention))
+}
+
+// dbKeys keeps the key set in the management database's jwt_keys table.
+type dbKeys struct {
+	db   *database.ManagementDB
+	keys *keystore.Store
+}
+
+// sealName binds a sealed key to its kid.
+func sealName(kid string) string {
+	return "jwt/" + kid
+}
+
+func (d *dbKeys) list(ctx context.Context, cutoff time.Time) ([]SigningKey, error) {
+	rows, err := d.db.Pool.Query(ctx,
+		`SELECT kid, alg, ciphertext, created_at, retired_at FROM jwt_keys
+		 WHERE retired_at IS NULL OR retired_at > $1
+		 ORDER BY created_at DESC`,
+		cutoff,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("auth: list keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []SigningKey
+	for rows.Next() {
+		var k SigningKey
+		var sealed []byte
+		if err := rows.Scan(&k.KID, &k.Alg, &sealed, &k.CreatedAt, &k.RetiredAt); err != nil {
+			return nil, fmt.Errorf("auth: list keys scan: %w", err)
+		}
+		plain, err := d.keys.Open(sealName(k.KID), sealed)
+		if err != nil {
+			return nil, fmt.Errorf("auth: key %s: %w", k.KID, err)
+		}
+		if k.Key, err = repo.ParseKey(string(plain)); err != nil {
+			return nil, fmt.Errorf("auth: key %s: %w", k.KID, err)
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("auth: list keys: %w", err)
+	}
+	return keys, nil
+}
+
+func (d *dbKeys) add(ctx context.Context, k *SigningKey) error {
+	sealed, err := d.keys.Seal(sealName(k.KID), []byte(k.Key.Multibase()))
+	if err != nil {
+		return err
+	}
+
+	tx, err := d.db.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("auth: rotate begin: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx,
+		`UPDATE jwt_keys SET retired_at = NOW() WHERE retired_at IS NULL`); err != nil {
+		return fmt.Errorf("auth: retire keys: %w", err)
+	}
+	if _, err := tx.Exec(ctx,
+		`INSERT INTO jwt_keys (kid, alg, ciphertext, created_at) VALUES ($1, $2, $3, $4)`,
+		k.KID, k.Alg, sealed, k.CreatedAt); err != nil {
+		return fmt.Errorf("auth: insert key: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("auth: rotate commit: %w", err)
+	}
+	return nil
+}
+
+func (d *dbKeys) prune(ctx context.Context, cutoff time.Time) (int64, error) {
+	tag, err := d.db.Pool.Exec(ctx,
+		`DELETE FROM jwt_keys WHERE retired_at <= $1`, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("auth: prune keys: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// memKeys keeps the key set in memory, newest first.
+type memKeys struct {
+	mu   sync.Mutex
+	keys []SigningKey
+}
+
+func (m *memKeys) list(ctx context.Context, cutoff time.Time) ([]SigningKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []SigningKey
+	for _, k := range m.keys {
+		if k.RetiredAt == nil || k.RetiredAt.After(cutoff) {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+func (m *memKeys) add(ctx context.Context, k *SigningKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for i := range m.keys {
+		if m.keys[i].RetiredAt == nil {
+			m.keys[i].RetiredAt = &now
+		}
+	}
+	m.keys = append([]SigningKey{*k}, m.keys...)
+	return nil
+}
+
+func (m *memKeys) prune(ctx context.Context, cutoff time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.keys[:0]
+	for _, k := range m.keys {
+		if k.RetiredAt == nil || k.RetiredAt.After(cutoff) {
+			kept = append(kept, k)
+		}
+	}
+	n := int64(len(m.keys) - len(kept))
+	m.keys = kept
+	return n, nil
+}
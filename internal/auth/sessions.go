@@ -0,0 +1,372 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/primal-host/primal-pds/internal/database"
+)
+
+// Session errors.
+var (
+	// ErrSessionRevoked is returned for a token whose session was
+	// revoked, or has expired and been pruned.
+	ErrSessionRevoked = errors.New("auth: session revoked")
+
+	// ErrTokenReused is returned when a refresh token that was already
+	// exchanged is presented again. The whole session is revoked, as
+	// either the client or whoever holds a copy of the token is not
+	// its rightful owner.
+	ErrTokenReused = errors.New("auth: refresh token reused")
+)
+
+// Session is one refresh token. Each refreshSession exchanges it for
+// the next in its family, which runs from a login until the session is
+// revoked; the token pair signed with it shares its jti.
+type Session struct {
+	JTI    string `json:"jti"`
+	Family string `json:"family"`
+	DID    string `json:"did"`
+	Scope  string `json:"scope"`
+	// AppPassword names the app password the session was started
+	// with, if any.
+	AppPassword string `json:"appPassword,omitempty"`
+	// ClientID and DPoPJKT name the OAuth client of an OAuth session
+	// and the thumbprint of the DPoP key its tokens are bound to.
+	ClientID  string     `json:"clientId,omitempty"`
+	DPoPJKT   string     `json:"dpopJkt,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt,omitempty"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// SessionStore records sessions in the management database, or in
+// memory for tests.
+type SessionStore struct {
+	rows sessionRows
+}
+
+// NewSessionStore creates a SessionStore.
+func NewSessionStore(db *database.ManagementDB) *SessionStore {
+	return &SessionStore{rows: &dbSessions{db: db}}
+}
+
+// NewMemorySessionStore creates a SessionStore kept in memory, for tests.
+func NewMemorySessionStore() *SessionStore {
+	return &SessionStore{rows: &memSessions{sessions: make(map[string]*Session)}}
+}
+
+// sessionRows keeps the refresh tokens of every session.
+type sessionRows interface {
+	create(ctx context.Context, sess *Session) error
+
+	// use marks jti as exchanged and returns it, or returns nil if it
+	// isn't live or was exchanged before.
+	use(ctx context.Context, jti string) (*Session, error)
+
+	// get returns the token jti, or nil if there is none.
+	get(ctx context.Context, jti string) (*Session, error)
+
+	// The revoke methods revoke the live tokens of a family, of a DID or
+	// of a DID's app password. revokeFamily returns the number of
+	// tokens, the others the number of families.
+	revokeFamily(ctx context.Context, family string) (int64, error)
+	revokeDID(ctx context.Context, did string) (int64, error)
+	revokeAppPassword(ctx context.Context, did, name string) (int64, error)
+
+	// prune deletes expired tokens and returns how many there were.
+	prune(ctx context.Context) (int64, error)
+}
+
+// newTokenID returns a random jti or family id.
+func newTokenID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Create records the refresh token sess.
+func (s *SessionStore) Create(ctx context.Context, sess *Session) error {
+	return s.rows.create(ctx, sess)
+}
+
+// Use marks the refresh token jti as exchanged and returns it. A token
+// used before revokes its whole family and returns ErrTokenReused.
+func (s *SessionStore) Use(ctx context.Context, jti string) (*Session, error) {
+	sess, err := s.rows.use(ctx, jti)
+	if err != nil || sess != nil {
+		return sess, err
+	}
+
+	sess, err = s.Get(ctx, jti)
+	if err != nil {
+		return nil, err
+	}
+	if sess.RevokedAt == nil && sess.UsedAt != nil {
+		if _, err := s.RevokeFamily(ctx, sess.Family); err != nil {
+			return nil, err
+		}
+		return nil, ErrTokenReused
+	}
+	return nil, ErrSessionRevoked
+}
+
+// Get returns the session of jti. It returns ErrSessionRevoked if there
+// is none.
+func (s *SessionStore) Get(ctx context.Context, jti string) (*Session, error) {
+	sess, err := s.rows.get(ctx, jti)
+	if err != nil {
+		return nil, err
+	}
+	if sess == nil {
+		return nil, ErrSessionRevoked
+	}
+	return sess, nil
+}
+
+// Active returns nil if the session of jti is neither revoked nor
+// expired, and ErrSessionRevoked otherwise.
+func (s *SessionStore) Active(ctx context.Context, jti string) error {
+	sess, err := s.Get(ctx, jti)
+	if err != nil {
+		return err
+	}
+	if sess.RevokedAt != nil || !sess.ExpiresAt.After(time.Now()) {
+		return ErrSessionRevoked
+	}
+	return nil
+}
+
+// RevokeFamily revokes every token of a session and returns how many
+// were still live.
+func (s *SessionStore) RevokeFamily(ctx context.Context, family string) (int64, error) {
+	return s.rows.revokeFamily(ctx, family)
+}
+
+// RevokeDID revokes every session of did and returns how many there
+// were.
+func (s *SessionStore) RevokeDID(ctx context.Context, did string) (int64, error) {
+	return s.rows.revokeDID(ctx, did)
+}
+
+// RevokeAppPassword revokes every session of did started with the app
+// password named name and returns how many there were.
+func (s *SessionStore) RevokeAppPassword(ctx context.Context, did, name string) (int64, error) {
+	return s.rows.revokeAppPassword(ctx, did, name)
+}
+
+// Prune deletes expired tokens and returns how many there were.
+func (s *SessionStore) Prune(ctx context.Context) (int64, error) {
+	return s.rows.prune(ctx)
+}
+
+// dbSessions keeps sessions in the management database's sessions table.
+type dbSessions struct {
+	db *database.ManagementDB
+}
+
+const sessionColumns = `jti, family, did, scope, app_password, client_id, dpop_jkt, created_at, expires_at, used_at, revoked_at`
+
+func (d *dbSessions) create(ctx context.Context, sess *Session) error {
+	_, err := d.db.Pool.Exec(ctx,
+		`INSERT INTO sessions (jti, family, did, scope, app_password, client_id, dpop_jkt, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		sess.JTI, sess.Family, sess.DID, sess.Scope, sess.AppPassword, sess.ClientID, sess.DPoPJKT, sess.ExpiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("auth: create session: %w", err)
+	}
+	return nil
+}
+
+func (d *dbSessions) use(ctx context.Context, jti string) (*Session, error) {
+	sess, err := scanSession(d.db.Pool.QueryRow(ctx,
+		`UPDATE sessions SET used_at = NOW()
+		 WHERE jti = $1 AND used_at IS NULL AND revoked_at IS NULL AND expires_at > NOW()
+		 RETURNING `+sessionColumns,
+		jti,
+	))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("auth: use session: %w", err)
+	}
+	return sess, nil
+}
+
+func (d *dbSessions) get(ctx context.Context, jti string) (*Session, error) {
+	sess, err := scanSession(d.db.Pool.QueryRow(ctx,
+		`SELECT `+sessionColumns+` FROM sessions WHERE jti = $1`,
+		jti,
+	))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("auth: get session: %w", err)
+	}
+	return sess, nil
+}
+
+func (d *dbSessions) revokeFamily(ctx context.Context, family string) (int64, error) {
+	tag, err := d.db.Pool.Exec(ctx,
+		`UPDATE sessions SET revoked_at = NOW() WHERE family = $1 AND revoked_at IS NULL`,
+		family,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("auth: revoke session: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (d *dbSessions) revokeDID(ctx context.Context, did string) (int64, error) {
+	var n int64
+	err := d.db.Pool.QueryRow(ctx,
+		`WITH revoked AS (
+		     UPDATE sessions SET revoked_at = NOW()
+		     WHERE did = $1 AND revoked_at IS NULL
+		     RETURNING family
+		 )
+		 SELECT COUNT(DISTINCT family) FROM revoked`,
+		did,
+	).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("auth: revoke sessions of %s: %w", did, err)
+	}
+	return n, nil
+}
+
+func (d *dbSessions) revokeAppPassword(ctx context.Context, did, name string) (int64, error) {
+	var n int64
+	err := d.db.Pool.QueryRow(ctx,
+		`WITH revoked AS (
+		     UPDATE sessions SET revoked_at = NOW()
+		     WHERE did = $1 AND app_password = $2 AND revoked_at IS NULL
+		     RETURNING family
+		 )
+		 SELECT COUNT(DISTINCT family) FROM revoked`,
+		did, name,
+	).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("auth: revoke app password sessions of %s: %w", did, err)
+	}
+	return n, nil
+}
+
+func (d *dbSessions) prune(ctx context.Context) (int64, error) {
+	tag, err := d.db.Pool.Exec(ctx, `DELETE FROM sessions WHERE expires_at <= NOW()`)
+	if err != nil {
+		return 0, fmt.Errorf("auth: prune sessions: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+func scanSession(row pgx.Row) (*Session, error) {
+	var sess Session
+	if err := row.Scan(&sess.JTI, &sess.Family, &sess.DID, &sess.Scope, &sess.AppPassword,
+		&sess.ClientID, &sess.DPoPJKT, &sess.CreatedAt,
+		&sess.ExpiresAt, &sess.UsedAt, &sess.RevokedAt); err != nil {
+		return nil, err
+	}
+	return &sess, nil
+}
+
+// memSessions keeps sessions in memory.
+type memSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func (m *memSessions) create(ctx context.Context, sess *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sessions[sess.JTI]; ok {
+		return fmt.Errorf("auth: create session: duplicate jti %s", sess.JTI)
+	}
+	stored := *sess
+	stored.CreatedAt = time.Now()
+	m.sessions[sess.JTI] = &stored
+	return nil
+}
+
+func (m *memSessions) use(ctx context.Context, jti string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sess, ok := m.sessions[jti]
+	now := time.Now()
+	if !ok || sess.UsedAt != nil || sess.RevokedAt != nil || !sess.ExpiresAt.After(now) {
+		return nil, nil
+	}
+	sess.UsedAt = &now
+	out := *sess
+	return &out, nil
+}
+
+func (m *memSessions) get(ctx context.Context, jti string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sess, ok := m.sessions[jti]
+	if !ok {
+		return nil, nil
+	}
+	out := *sess
+	return &out, nil
+}
+
+// revoke revokes the live tokens match accepts and returns how many
+// tokens and families there were.
+func (m *memSessions) revoke(match func(*Session) bool) (tokens, families int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	seen := map[string]bool{}
+	for _, sess := range m.sessions {
+		if sess.RevokedAt != nil || !match(sess) {
+			continue
+		}
+		sess.RevokedAt = &now
+		tokens++
+		if !seen[sess.Family] {
+			seen[sess.Family] = true
+			families++
+		}
+	}
+	return tokens, families
+}
+
+func (m *memSessions) revokeFamily(ctx context.Context, family string) (int64, error) {
+	n, _ := m.revoke(func(sess *Session) bool { return sess.Family == family })
+	return n, nil
+}
+
+func (m *memSessions) revokeDID(ctx context.Context, did string) (int64, error) {
+	_, n := m.revoke(func(sess *Session) bool { return sess.DID == did })
+	return n, nil
+}
+
+func (m *memSessions) revokeAppPassword(ctx context.Context, did, name string) (int64, error) {
+	_, n := m.revoke(func(sess *Session) bool { return sess.DID == did && sess.AppPassword == name })
+	return n, nil
+}
+
+func (m *memSessions) prune(ctx context.Context) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	now := time.Now()
+	for jti, sess := range m.sessions {
+		if !sess.ExpiresAt.After(now) {
+			delete(m.sessions, jti)
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+const (
+	testDID      = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	testAudience = "did:web:pds.example.com"
+)
+
+// newTestManager returns a JWTManager over keys (nil for an in-memory
+// key set) and sessions.
+func newTestManager(t *testing.T, keys *KeyStore, sessions *SessionStore, legacySecret string) *JWTManager {
+	t.Helper()
+	m, err := NewJWTManager(context.Background(), keys, sessions, AlgES256K, "https://pds.example.com", testAudience, legacySecret)
+	if err != nil {
+		t.Fatalf("NewJWTManager: %v", err)
+	}
+	return m
+}
+
+func login(t *testing.T, m *JWTManager) *TokenPair {
+	t.Helper()
+	pair, err := m.CreateSession(context.Background(), &Session{DID: testDID, Scope: ScopeAccess})
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	return pair
+}
+
+func TestRefreshRotation(t *testing.T) {
+	ctx := context.Background()
+	m := newTestManager(t, nil, NewMemorySessionStore(), "")
+	first := login(t, m)
+
+	did, jti, err := m.ValidateRefreshToken(ctx, first.RefreshJwt)
+	if err != nil {
+		t.Fatalf("ValidateRefreshToken: %v", err)
+	}
+	second, err := m.RefreshSession(ctx, did, jti)
+	if err != nil {
+		t.Fatalf("RefreshSession: %v", err)
+	}
+	_, jti2, err := m.ValidateRefreshToken(ctx, second.RefreshJwt)
+	if err != nil {
+		t.Fatalf("ValidateRefreshToken(second): %v", err)
+	}
+	if jti2 == jti {
+		t.Fatal("refresh returned the same jti")
+	}
+
+	// The first access token stays valid until it expires; only its
+	// refresh token is spent.
+	if _, _, err := m.ValidateAccessToken(ctx, first.AccessJwt); err != nil {
+		t.Errorf("access token after its refresh token was exchanged: %v", err)
+	}
+	if _, _, err := m.ValidateAccessToken(ctx, second.AccessJwt); err != nil {
+		t.Errorf("new access token: %v", err)
+	}
+
+	// Replaying the exchanged token revokes the whole family.
+	if _, err := m.RefreshSession(ctx, did, jti); !errors.Is(err, ErrTokenReused) {
+		t.Fatalf("reused refresh token: err = %v, want ErrTokenReused", err)
+	}
+	if _, _, err := m.ValidateAccessToken(ctx, first.AccessJwt); !errors.Is(err, ErrSessionRevoked) {
+		t.Errorf("first access token after reuse: err = %v, want ErrSessionRevoked", err)
+	}
+	if _, _, err := m.ValidateAccessToken(ctx, second.AccessJwt); !errors.Is(err, ErrSessionRevoked) {
+		t.Errorf("second access token after reuse: err = %v, want ErrSessionRevoked", err)
+	}
+	if _, _, err := m.ValidateRefreshToken(ctx, second.RefreshJwt); !errors.Is(err, ErrSessionRevoked) {
+		t.Errorf("second refresh token after reuse: err = %v, want ErrSessionRevoked", err)
+	}
+	if _, err := m.RefreshSession(ctx, did, jti2); !errors.Is(err, ErrSessionRevoked) {
+		t.Errorf("refresh of a revoked family: err = %v, want ErrSessionRevoked", err)
+	}
+}
+
+func TestRefreshOtherDID(t *testing.T) {
+	ctx := context.Background()
+	m := newTestManager(t, nil, NewMemorySessionStore(), "")
+	_, jti, err := m.ValidateRefreshToken(ctx, login(t, m).RefreshJwt)
+	if err != nil {
+		t.Fatalf("ValidateRefreshToken: %v", err)
+	}
+	if _, err := m.RefreshSession(ctx, "did:plc:aaaaaaaaaaaaaaaaaaaaaaaa", jti); !errors.Is(err, ErrSessionRevoked) {
+		t.Errorf("refresh for another DID: err = %v, want ErrSessionRevoked", err)
+	}
+}
+
+func TestRevokeSessions(t *testing.T) {
+	ctx := context.Background()
+	m := newTestManager(t, nil, NewMemorySessionStore(), "")
+	password := login(t, m)
+	app, err := m.CreateSession(ctx, &Session{DID: testDID, Scope: ScopeAppPass, AppPassword: "client"})
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+
+	if n, err := m.RevokeAppPassword(ctx, testDID, "client"); err != nil || n != 1 {
+		t.Fatalf("RevokeAppPassword = %d, %v; want 1", n, err)
+	}
+	if _, _, err := m.ValidateAccessToken(ctx, app.AccessJwt); !errors.Is(err, ErrSessionRevoked) {
+		t.Errorf("app password session after revoke: err = %v, want ErrSessionRevoked", err)
+	}
+	if _, _, err := m.ValidateAccessToken(ctx, password.AccessJwt); err != nil {
+		t.Errorf("password session after revoking an app password: %v", err)
+	}
+
+	if n, err := m.RevokeAll(ctx, testDID); err != nil || n != 1 {
+		t.Fatalf("RevokeAll = %d, %v; want 1", n, err)
+	}
+	if _, _, err := m.ValidateAccessToken(ctx, password.AccessJwt); !errors.Is(err, ErrSessionRevoked) {
+		t.Errorf("password session after RevokeAll: err = %v, want ErrSessionRevoked", err)
+	}
+}
@@ -82,3 +82,56 @@ func (s *Store) Get(ctx context.Context, pool *pgxpool.Pool, did, cidStr string)
 	}
 	return data, mimeType, nil
 }
+
+// CountPresent returns how many of the given blob CIDs are stored for a
+// DID.
+func (s *Store) CountPresent(ctx context.Context, pool *pgxpool.Pool, did string, cids []string) (int, error) {
+	if len(cids) == 0 {
+		return 0, nil
+	}
+	var n int
+	err := pool.QueryRow(ctx,
+		`SELECT COUNT(*) FROM blobs WHERE did = $1 AND cid = ANY($2)`,
+		did, cids,
+	).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("blob: count: %w", err)
+	}
+	return n, nil
+}
+
+// Missing returns those of the given blob CIDs that are not stored for
+// a DID, in the order given.
+func (s *Store) Missing(ctx context.Context, pool *pgxpool.Pool, did string, cids []string) ([]string, error) {
+	if len(cids) == 0 {
+		return nil, nil
+	}
+	rows, err := pool.Query(ctx,
+		`SELECT cid FROM blobs WHERE did = $1 AND cid = ANY($2)`,
+		did, cids,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("blob: missing: %w", err)
+	}
+	defer rows.Close()
+
+	present := map[string]bool{}
+	for rows.Next() {
+		var c string
+		if err := rows.Scan(&c); err != nil {
+			return nil, fmt.Errorf("blob: missing scan: %w", err)
+		}
+		present[c] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("blob: missing: %w", err)
+	}
+
+	var missing []string
+	for _, c := range cids {
+		if !present[c] {
+			missing = append(missing, c)
+		}
+	}
+	return missing, nil
+}
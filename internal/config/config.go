@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"strings"
 )
 
 // Config holds all application configuration loaded from db.json.
@@ -45,18 +46,79 @@ type Config struct {
 	// signing key. When empty, random DIDs are generated (local-only).
 	PLCEndpoint string `json:"plcEndpoint,omitempty"`
 
+	// PLCDirectoryAddr, if set, is a listen address (e.g., ":2582") on
+	// which an embedded PLC directory is served. It stands in for
+	// plc.directory on networks that can't reach it, such as staging
+	// and CI; point plcEndpoint at it (e.g., "http://localhost:2582").
+	// Its operations are kept in the management database.
+	PLCDirectoryAddr string `json:"plcDirectoryAddr,omitempty"`
+
+	// KeySecret encrypts the private keys the server holds for itself,
+	// such as the PLC rotation key, in the management database.
+	// Required when plcEndpoint is set. Changing it makes stored keys
+	// unreadable.
+	KeySecret string `json:"keySecret,omitempty"`
+
+	// RotationKey is an optional multibase-encoded private key to use as
+	// the PDS's PLC rotation key. When empty, a secp256k1 key is
+	// generated on first start. Either way it is kept encrypted with
+	// keySecret and listed as a rotation key of every did:plc the server
+	// creates, separately from the accounts' repo signing keys. It is
+	// only imported when no key is stored; startup fails if it differs
+	// from the stored key.
+	RotationKey string `json:"rotationKey,omitempty"`
+
+	// ServiceKey is an optional multibase-encoded private key to use as
+	// the key of the PDS's service DID (the did:web derived from
+	// serviceURL). When empty, a key is generated on first start. It is
+	// kept encrypted with keySecret; without keySecret the service DID
+	// has no key and its document is not served. Like rotationKey it is
+	// only imported when no key is stored.
+	ServiceKey string `json:"serviceKey,omitempty"`
+
 	// ServiceURL is the public URL of this PDS (e.g., "https://pds.primal.host").
 	// Used as JWT issuer and to derive did:web for describeServer.
 	ServiceURL string `json:"serviceURL,omitempty"`
 
-	// JWTSecret is the HMAC secret for signing JWT tokens. If empty, a
-	// random secret is generated on startup (tokens won't survive restart).
+	// JWTKeyAlg is the algorithm of session token signing keys: "ES256"
+	// (default) or "ES256K". The keys are generated and rotated by the
+	// server and kept encrypted with keySecret; without keySecret they
+	// live in memory and sessions don't survive a restart.
+	JWTKeyAlg string `json:"jwtKeyAlg,omitempty"`
+
+	// JWTSecret is the HMAC secret that signed session tokens before
+	// signing keys were introduced. Deprecated: tokens signed with it are
+	// still accepted until they expire, but no new ones are issued.
 	JWTSecret string `json:"jwtSecret,omitempty"`
 
+	// ModerationDIDs are the DIDs of moderation services, such as an
+	// AppView's or a labeler's, that may fetch blobs of taken-down and
+	// deactivated accounts with a service auth token, to review them.
+	ModerationDIDs []string `json:"moderationDids,omitempty"`
+
 	// RegistrationOpen controls whether com.atproto.server.createAccount
 	// is open to the public. When false, only admin key holders can create
 	// accounts through the standard AT Protocol endpoint.
 	RegistrationOpen bool `json:"registrationOpen,omitempty"`
+
+	// SMTPAddr is the SMTP relay host:port used for account emails such
+	// as deletion confirmations. When empty, requests that need an email
+	// are refused unless MailLog is set.
+	SMTPAddr string `json:"smtpAddr,omitempty"`
+
+	// MailLog writes account emails to the log when SMTPAddr is empty.
+	// Their codes confirm account deletion and identity changes, so
+	// anyone who can read the log could use them; it is meant for
+	// development only.
+	MailLog bool `json:"mailLog,omitempty"`
+
+	// SMTPUser and SMTPPass enable PLAIN auth with the SMTP relay.
+	SMTPUser string `json:"smtpUser,omitempty"`
+	SMTPPass string `json:"smtpPass,omitempty"`
+
+	// MailFrom is the sender address for account emails
+	// (e.g., "PDS <noreply@pds.primal.host>").
+	MailFrom string `json:"mailFrom,omitempty"`
 }
 
 // Load reads and parses configuration from the given file path.
@@ -76,6 +138,9 @@ func Load(path string) (*Config, error) {
 	if cfg.ListenAddr == "" {
 		cfg.ListenAddr = ":3000"
 	}
+	if cfg.JWTKeyAlg == "" {
+		cfg.JWTKeyAlg = "ES256"
+	}
 
 	if err := cfg.validate(); err != nil {
 		return nil, err
@@ -99,6 +164,21 @@ func (c *Config) validate() error {
 		return fmt.Errorf("config: traefikConfigDir is required")
 	case c.AdminKey == "":
 		return fmt.Errorf("config: adminKey is required")
+	case c.PLCEndpoint != "" && c.KeySecret == "":
+		return fmt.Errorf("config: keySecret is required when plcEndpoint is set")
+	case c.RotationKey != "" && c.KeySecret == "":
+		return fmt.Errorf("config: keySecret is required when rotationKey is set")
+	case c.ServiceKey != "" && c.KeySecret == "":
+		return fmt.Errorf("config: keySecret is required when serviceKey is set")
+	case c.JWTKeyAlg != "ES256" && c.JWTKeyAlg != "ES256K":
+		return fmt.Errorf("config: jwtKeyAlg must be ES256 or ES256K")
+	case c.SMTPAddr != "" && c.MailFrom == "":
+		return fmt.Errorf("config: mailFrom is required when smtpAddr is set")
+	}
+	for _, did := range c.ModerationDIDs {
+		if !strings.HasPrefix(did, "did:") {
+			return fmt.Errorf("config: moderationDids: %q is not a DID", did)
+		}
 	}
 	return nil
 }
@@ -3,6 +3,7 @@ package database
 import (
 	"context"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -108,7 +109,12 @@ func (m *ManagementDB) DeleteDIDRouting(ctx context.Context, did string) error {
 }
 
 // LookupDIDDomain returns the domain for a DID from the routing table.
+// did:web hostnames are matched case-insensitively, as they are routed
+// in lower case.
 func (m *ManagementDB) LookupDIDDomain(ctx context.Context, did string) (string, error) {
+	if strings.HasPrefix(did, "did:web:") {
+		did = strings.ToLower(did)
+	}
 	var domainName string
 	err := m.Pool.QueryRow(ctx,
 		`SELECT domain FROM did_routing WHERE did = $1`, did,
@@ -141,6 +147,18 @@ func (pm *PoolManager) Get(domainName string) *pgxpool.Pool {
 	return pm.pools[domainName]
 }
 
+// All returns a snapshot of the registered tenant pools keyed by domain.
+// The map is a copy, so callers may run queries without holding the lock.
+func (pm *PoolManager) All() map[string]*pgxpool.Pool {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	out := make(map[string]*pgxpool.Pool, len(pm.pools))
+	for name, pool := range pm.pools {
+		out[name] = pool
+	}
+	return out
+}
+
 // Add opens a connection pool for a tenant database, bootstraps the
 // tenant schema, and registers it in the pool manager.
 func (pm *PoolManager) Add(ctx context.Context, domainName, dbName string) error {
@@ -27,7 +27,8 @@ CREATE TABLE IF NOT EXISTS did_routing (
 );
 
 -- firehose_events: Sequenced event log for the com.atproto.sync.subscribeRepos
--- firehose. Each row is a CBOR-encoded commit event. The BIGSERIAL seq column
+-- firehose. Each row is a CBOR-encoded #commit or #account message
+-- (event_type "commit" or "account"). The BIGSERIAL seq column
 -- provides a monotonically increasing cursor for replay.
 CREATE TABLE IF NOT EXISTS firehose_events (
     seq        BIGSERIAL PRIMARY KEY,
@@ -37,6 +38,239 @@ CREATE TABLE IF NOT EXISTS firehose_events (
     created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 );
 CREATE INDEX IF NOT EXISTS idx_firehose_events_seq ON firehose_events(seq);
+
+-- rev identifies the repo revision of a commit event. The unique index
+-- lets the sequencer re-deliver an outbox row after a crash without
+-- sequencing the same commit twice.
+ALTER TABLE firehose_events ADD COLUMN IF NOT EXISTS rev VARCHAR(50);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_firehose_events_did_rev ON firehose_events(did, rev);
+
+-- domain records the hosted domain the event's DID was routed to when it
+-- was sequenced, so consumers can filter by tenant without a lookup.
+ALTER TABLE firehose_events ADD COLUMN IF NOT EXISTS domain VARCHAR(253) NOT NULL DEFAULT '';
+
+-- withheld marks commits from accounts that are not synced to relays
+-- (e.g. suspended). They are kept for the hosting operator's own
+-- streams but skipped on the public firehose.
+ALTER TABLE firehose_events ADD COLUMN IF NOT EXISTS withheld BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- created_at lets timestamp cursors be mapped to a seq. It is the time
+-- the sequencing transaction started, so it is not monotonic with seq.
+CREATE INDEX IF NOT EXISTS idx_firehose_events_created_at ON firehose_events(created_at);
+
+-- webhooks: Outbound HTTP subscriptions to a domain's commits. When
+-- collections is non-empty only ops in those collections are delivered.
+-- The secret signs each delivery (HMAC-SHA256) so receivers can verify it.
+CREATE TABLE IF NOT EXISTS webhooks (
+    id          SERIAL PRIMARY KEY,
+    domain      VARCHAR(253) NOT NULL REFERENCES domains(domain) ON DELETE CASCADE,
+    url         TEXT NOT NULL,
+    secret      VARCHAR(255) NOT NULL,
+    collections TEXT[] NOT NULL DEFAULT '{}',
+    status      VARCHAR(20) NOT NULL DEFAULT 'active',
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_webhooks_domain ON webhooks(domain);
+
+-- webhook_deliveries: One row per (webhook, firehose event). Pending rows
+-- are retried with exponential backoff until delivered or, after too many
+-- failures, moved to the "dead" (dead-letter) status.
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id              BIGSERIAL PRIMARY KEY,
+    webhook_id      INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    seq             BIGINT NOT NULL,
+    payload         JSONB NOT NULL,
+    status          VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts        INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    response_code   INTEGER NOT NULL DEFAULT 0,
+    last_error      TEXT NOT NULL DEFAULT '',
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at      TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (webhook_id, seq)
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(next_attempt_at) WHERE status = 'pending';
+
+-- webhook_cursor: The last firehose seq the webhook dispatcher has fanned
+-- out into deliveries. Single row.
+CREATE TABLE IF NOT EXISTS webhook_cursor (
+    id   BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    seq  BIGINT NOT NULL
+);
+
+-- account_deletions: Deletion jobs, kept afterwards as tombstones. A row
+-- is written when an account is deleted; the deletion worker purges the
+-- account's repo blocks, blobs and (if purge_events) its commit events,
+-- announces the deletion on the firehose, tombstones a did:plc, and then
+-- marks the job done. The row is never removed, so the handle and DID
+-- cannot be silently reused. sealed_signing_key holds the account's
+-- signing key encrypted with the keystore, kept only until the PLC
+-- tombstone has been submitted.
+CREATE TABLE IF NOT EXISTS account_deletions (
+    did                VARCHAR(255) PRIMARY KEY,
+    handle             VARCHAR(253) NOT NULL,
+    domain             VARCHAR(253) NOT NULL,
+    sealed_signing_key BYTEA,
+    purge_events       BOOLEAN NOT NULL DEFAULT FALSE,
+    status             VARCHAR(20) NOT NULL DEFAULT 'pending',
+    announced          BOOLEAN NOT NULL DEFAULT FALSE,
+    plc_tombstoned     BOOLEAN NOT NULL DEFAULT FALSE,
+    attempts           INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at    TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_error         TEXT NOT NULL DEFAULT '',
+    created_at         TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    completed_at       TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS idx_account_deletions_handle ON account_deletions(handle);
+CREATE INDEX IF NOT EXISTS idx_account_deletions_pending ON account_deletions(next_attempt_at) WHERE status = 'pending';
+
+-- custom_handles: Handle→DID index of handles outside the hosted domains
+-- (e.g. "alice.example.com"), which an account claims by publishing its
+-- DID in a _atproto DNS TXT record or at /.well-known/atproto-did on the
+-- handle's domain. domain is the hosted domain (tenant) the account
+-- lives in. Handles are re-verified periodically; after repeated
+-- failures status becomes 'invalid' and the handle stops resolving here
+-- until it verifies again.
+CREATE TABLE IF NOT EXISTS custom_handles (
+    handle      VARCHAR(253) PRIMARY KEY,
+    did         VARCHAR(255) UNIQUE NOT NULL,
+    domain      VARCHAR(253) NOT NULL REFERENCES domains(domain) ON DELETE CASCADE,
+    status      VARCHAR(20) NOT NULL DEFAULT 'valid',
+    failures    INTEGER NOT NULL DEFAULT 0,
+    last_error  TEXT NOT NULL DEFAULT '',
+    verified_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    checked_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_custom_handles_domain ON custom_handles(domain);
+CREATE INDEX IF NOT EXISTS idx_custom_handles_checked ON custom_handles(checked_at);
+
+-- handle_holds: Handles an account has just given up. For a cooldown
+-- period after a handle change the old handle stays reserved for its
+-- previous owner, so links and caches that still use it cannot be
+-- captured by another account; the previous owner may take it back.
+CREATE TABLE IF NOT EXISTS handle_holds (
+    handle      VARCHAR(253) PRIMARY KEY,
+    did         VARCHAR(255) NOT NULL,
+    domain      VARCHAR(253) NOT NULL REFERENCES domains(domain) ON DELETE CASCADE,
+    expires_at  TIMESTAMPTZ NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_handle_holds_expires ON handle_holds(expires_at);
+
+-- server_keys: Private keys held by the server itself rather than by an
+-- account, such as the PLC rotation key ("plc_rotation"). ciphertext is
+-- the AES-256-GCM nonce and sealed multibase key, encrypted under the
+-- configured keySecret; did_key is the public half, kept in the clear
+-- for reference.
+CREATE TABLE IF NOT EXISTS server_keys (
+    name        VARCHAR(100) PRIMARY KEY,
+    did_key     VARCHAR(255) NOT NULL,
+    ciphertext  BYTEA NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- plc_directory: Operation log of the embedded PLC directory, a
+-- stand-in for plc.directory used in staging and tests. Rows are in
+-- submission order (seq); a recovery operation marks the operations it
+-- overrides as nullified rather than removing them, as the audit log
+-- must still show them.
+CREATE TABLE IF NOT EXISTS plc_directory (
+    seq         BIGSERIAL PRIMARY KEY,
+    did         VARCHAR(255) NOT NULL,
+    cid         VARCHAR(100) UNIQUE NOT NULL,
+    operation   JSONB NOT NULL,
+    nullified   BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_plc_directory_did ON plc_directory(did, seq);
+
+-- identity_cache: Recent results of resolving other servers'
+-- identities: DID documents (kind 'did', keyed by DID) and the DIDs
+-- handles declare (kind 'handle', keyed by handle). Entries are used
+-- until expires_at and pruned after.
+CREATE TABLE IF NOT EXISTS identity_cache (
+    kind        VARCHAR(20) NOT NULL,
+    key         VARCHAR(255) NOT NULL,
+    value       TEXT NOT NULL,
+    expires_at  TIMESTAMPTZ NOT NULL,
+    updated_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (kind, key)
+);
+CREATE INDEX IF NOT EXISTS idx_identity_cache_expires ON identity_cache(expires_at);
+
+-- jwt_keys: Keys that sign session tokens, named by the kid header of
+-- the tokens they sign. The one key with no retired_at signs; retired
+-- keys still verify until the tokens they signed have expired, then
+-- are pruned. ciphertext is sealed under keySecret like server_keys.
+CREATE TABLE IF NOT EXISTS jwt_keys (
+    kid         VARCHAR(64) PRIMARY KEY,
+    alg         VARCHAR(10) NOT NULL,
+    ciphertext  BYTEA NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    retired_at  TIMESTAMPTZ
+);
+
+-- sessions: Refresh tokens, keyed by the jti they share with their
+-- access token. A family is one login session: refreshSession marks its
+-- current token used and adds the next one. Presenting a used token
+-- again revokes the whole family, as does deleteSession. Rows are kept
+-- until the token expires, so reuse is still detected.
+CREATE TABLE IF NOT EXISTS sessions (
+    jti         VARCHAR(64) PRIMARY KEY,
+    family      VARCHAR(64) NOT NULL,
+    did         VARCHAR(255) NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at  TIMESTAMPTZ NOT NULL,
+    used_at     TIMESTAMPTZ,
+    revoked_at  TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_family ON sessions(family);
+CREATE INDEX IF NOT EXISTS idx_sessions_did ON sessions(did);
+CREATE INDEX IF NOT EXISTS idx_sessions_expires ON sessions(expires_at);
+
+-- scope is the scope of the session's access tokens: com.atproto.access
+-- for a login with the account password, com.atproto.appPass or
+-- com.atproto.appPassPrivileged for one with the app password named by
+-- app_password. Revoking an app password revokes its sessions.
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS scope VARCHAR(50) NOT NULL DEFAULT 'com.atproto.access';
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS app_password VARCHAR(100) NOT NULL DEFAULT '';
+
+-- client_id and dpop_jkt are set for sessions granted to an OAuth
+-- client: its client_id and the thumbprint of the DPoP key its tokens
+-- are bound to. Refreshing requires the same client and key.
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS client_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS dpop_jkt VARCHAR(64) NOT NULL DEFAULT '';
+
+-- oauth_requests: Pushed OAuth authorization requests, named by the id
+-- in their request_uri. When the account holder approves one, did and
+-- code are set and expires_at is moved to the code's expiry; exchanging
+-- the code deletes the row.
+CREATE TABLE IF NOT EXISTS oauth_requests (
+    id              VARCHAR(64) PRIMARY KEY,
+    client_id       TEXT NOT NULL,
+    redirect_uri    TEXT NOT NULL,
+    scope           TEXT NOT NULL,
+    state           TEXT NOT NULL DEFAULT '',
+    code_challenge  VARCHAR(128) NOT NULL,
+    login_hint      TEXT NOT NULL DEFAULT '',
+    dpop_jkt        VARCHAR(64) NOT NULL DEFAULT '',
+    did             VARCHAR(255) NOT NULL DEFAULT '',
+    code            VARCHAR(64) UNIQUE,
+    expires_at      TIMESTAMPTZ NOT NULL,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_oauth_requests_expires ON oauth_requests(expires_at);
+
+-- oauth_jtis: jtis of DPoP proofs and client assertions, kept until
+-- the proof would be too old anyway, so none is accepted twice.
+CREATE TABLE IF NOT EXISTS oauth_jtis (
+    jti         TEXT PRIMARY KEY,
+    expires_at  TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_oauth_jtis_expires ON oauth_jtis(expires_at);
 `
 
 // TenantSchema contains the SQL statements for per-domain tenant databases.
@@ -56,6 +290,8 @@ const TenantSchema = `
 --   active    — normal operation, fully functional.
 --   suspended — can still post locally but will not sync to relays.
 --   disabled  — data preserved but cannot create new posts.
+--   deactivated — like disabled, but self-initiated; the account holder
+--               can still log in and reactivate.
 --   removed   — row kept as tombstone; all associated data is deleted.
 CREATE TABLE IF NOT EXISTS accounts (
     id          SERIAL PRIMARY KEY,
@@ -99,4 +335,80 @@ CREATE TABLE IF NOT EXISTS blobs (
     created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
     PRIMARY KEY (did, cid)
 );
+
+-- commit_outbox: Commits waiting to be sequenced into the management
+-- firehose_events table. Rows are written in the same transaction as the
+-- repo_roots update, so a commit can never be applied without also being
+-- queued for announcement. The sequencer drains rows in id order and
+-- deletes each one once it has been sequenced.
+CREATE TABLE IF NOT EXISTS commit_outbox (
+    id          BIGSERIAL PRIMARY KEY,
+    did         VARCHAR(255) NOT NULL,
+    commit_cid  VARCHAR(255) NOT NULL,
+    rev         VARCHAR(50) NOT NULL,
+    prev_rev    VARCHAR(50) NOT NULL DEFAULT '',
+    prev_data   VARCHAR(255) NOT NULL DEFAULT '',
+    ops         JSONB NOT NULL,
+    diff_car    BYTEA NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- email_tokens: Single-use confirmation codes sent to an account's
+-- email address (e.g. to confirm account deletion). One live token per
+-- purpose; issuing a new one replaces the old.
+CREATE TABLE IF NOT EXISTS email_tokens (
+    did         VARCHAR(255) NOT NULL REFERENCES accounts(did) ON DELETE CASCADE,
+    purpose     VARCHAR(50) NOT NULL,
+    token       VARCHAR(20) NOT NULL,
+    expires_at  TIMESTAMPTZ NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (did, purpose)
+);
+
+-- app_passwords: Passwords an account holder hands to third-party
+-- clients instead of the account password, stored as bcrypt hashes.
+-- prefix is the password's first group, kept in the clear so a login
+-- only checks the hashes it could match. Their sessions can't manage the
+-- account; privileged ones may also reach private data such as direct
+-- messages.
+CREATE TABLE IF NOT EXISTS app_passwords (
+    did         VARCHAR(255) NOT NULL REFERENCES accounts(did) ON DELETE CASCADE,
+    name        VARCHAR(100) NOT NULL,
+    prefix      VARCHAR(4) NOT NULL,
+    password    VARCHAR(255) NOT NULL,
+    privileged  BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (did, name)
+);
+
+-- plc_status tracks publication of a did:plc to the PLC directory:
+-- none (not a did:plc), unregistered (random local did:plc), pending,
+-- registered or failed.
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS plc_status VARCHAR(20) NOT NULL DEFAULT 'none';
+
+-- plc_operations: Signed PLC operations for each account's DID, written
+-- in the same transaction as the change they publish. Pending rows are
+-- submitted to the PLC directory in id order per DID and retried with
+-- backoff; after too many failures they are marked failed until an
+-- operator resubmits them. The log outlives the account: deleting it
+-- drops only the operations never submitted, and the tombstone is
+-- recorded after them.
+CREATE TABLE IF NOT EXISTS plc_operations (
+    id              BIGSERIAL PRIMARY KEY,
+    did             VARCHAR(255) NOT NULL,
+    cid             VARCHAR(255) NOT NULL,
+    operation       JSONB NOT NULL,
+    status          VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts        INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_error      TEXT NOT NULL DEFAULT '',
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    submitted_at    TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS idx_plc_operations_did ON plc_operations(did, id);
+CREATE INDEX IF NOT EXISTS idx_plc_operations_due ON plc_operations(next_attempt_at) WHERE status = 'pending';
+
+-- Operations are identified by CID within a DID's log, so entries copied
+-- from the directory's audit log are recorded only once.
+CREATE UNIQUE INDEX IF NOT EXISTS idx_plc_operations_did_cid ON plc_operations(did, cid);
 `
@@ -0,0 +1,221 @@
+// Package deletion carries out account deletions. Deleting an account
+// queues a job in the management database; a worker then purges the
+// account's repository data, announces the deletion on the firehose and
+// tombstones its did:plc. Jobs survive restarts and are retried until
+// they finish, and finished jobs are kept as tombstones that stop the
+// handle and DID from being reused.
+package deletion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/primal-host/primal-pds/internal/database"
+	"github.com/primal-host/primal-pds/internal/keystore"
+	"github.com/primal-host/primal-pds/internal/worker"
+)
+
+// Job statuses.
+const (
+	StatusPending = "pending"
+	StatusDone    = "done"
+)
+
+// ErrNotFound is returned when no deletion record exists for a DID.
+var ErrNotFound = errors.New("deletion: not found")
+
+// Job is a queued or completed account deletion.
+type Job struct {
+	DID           string     `json:"did"`
+	Handle        string     `json:"handle"`
+	Domain        string     `json:"domain"`
+	SigningKey    string     `json:"-"` // kept sealed in the database
+	PurgeEvents   bool       `json:"purgeEvents"`
+	Status        string     `json:"status"`
+	Announced     bool       `json:"announced"`
+	PLCTombstoned bool       `json:"plcTombstoned"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"lastError,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	CompletedAt   *time.Time `json:"completedAt,omitempty"`
+}
+
+// Store provides deletion job persistence in the management DB.
+type Store struct {
+	db   *database.ManagementDB
+	keys *keystore.Store
+}
+
+// NewStore creates a deletion Store. A job's signing key is encrypted
+// with keys until the job no longer needs it; with no keystore it is
+// not kept at all, as there is then no PLC directory to tombstone in.
+func NewStore(db *database.ManagementDB, keys *keystore.Store) *Store {
+	return &Store{db: db, keys: keys}
+}
+
+const jobColumns = `did, handle, domain, sealed_signing_key, purge_events, status,
+	announced, plc_tombstoned, attempts, last_error, created_at, completed_at`
+
+// sealName binds a sealed signing key to its job's DID.
+func sealName(did string) string {
+	return "deletion:" + did
+}
+
+func (s *Store) scanJob(row pgx.Row) (*Job, error) {
+	var j Job
+	var sealed []byte
+	err := row.Scan(&j.DID, &j.Handle, &j.Domain, &sealed, &j.PurgeEvents, &j.Status,
+		&j.Announced, &j.PLCTombstoned, &j.Attempts, &j.LastError, &j.CreatedAt, &j.CompletedAt)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) > 0 && s.keys != nil {
+		plain, err := s.keys.Open(sealName(j.DID), sealed)
+		if err != nil {
+			return nil, err
+		}
+		j.SigningKey = string(plain)
+	}
+	return &j, nil
+}
+
+// Queue records a pending deletion. Queuing a DID that already has a
+// record is a no-op, so a deletion interrupted part-way can be retried.
+func (s *Store) Queue(ctx context.Context, j *Job) error {
+	var sealed []byte
+	if s.keys != nil && j.SigningKey != "" {
+		var err error
+		if sealed, err = s.keys.Seal(sealName(j.DID), []byte(j.SigningKey)); err != nil {
+			return fmt.Errorf("deletion: queue %s: %w", j.DID, err)
+		}
+	}
+	_, err := s.db.Pool.Exec(ctx,
+		`INSERT INTO account_deletions (did, handle, domain, sealed_signing_key, purge_events)
+		 VALUES ($1, $2, $3, $4, $5)
+		 ON CONFLICT (did) DO NOTHING`,
+		j.DID, j.Handle, j.Domain, sealed, j.PurgeEvents)
+	if err != nil {
+		return fmt.Errorf("deletion: queue %s: %w", j.DID, err)
+	}
+	return nil
+}
+
+// Get returns the deletion record for a DID.
+func (s *Store) Get(ctx context.Context, did string) (*Job, error) {
+	j, err := s.scanJob(s.db.Pool.QueryRow(ctx,
+		`SELECT `+jobColumns+` FROM account_deletions WHERE did = $1`, did))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, did)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("deletion: get %s: %w", did, err)
+	}
+	return j, nil
+}
+
+// List returns a domain's deletion records, newest first.
+func (s *Store) List(ctx context.Context, domainName string) ([]Job, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT `+jobColumns+` FROM account_deletions
+		 WHERE domain = $1 ORDER BY created_at DESC`, domainName)
+	if err != nil {
+		return nil, fmt.Errorf("deletion: list: %w", err)
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		j, err := s.scanJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("deletion: list scan: %w", err)
+		}
+		jobs = append(jobs, *j)
+	}
+	return jobs, rows.Err()
+}
+
+// IsReserved reports whether a handle or DID belonged to a deleted
+// account. Either argument may be empty.
+func (s *Store) IsReserved(ctx context.Context, handle, did string) (bool, error) {
+	var reserved bool
+	err := s.db.Pool.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM account_deletions
+		 WHERE ($1 <> '' AND handle = $1) OR ($2 <> '' AND did = $2))`,
+		handle, did,
+	).Scan(&reserved)
+	if err != nil {
+		return false, fmt.Errorf("deletion: check reserved: %w", err)
+	}
+	return reserved, nil
+}
+
+// due returns pending jobs whose next attempt time has passed.
+func (s *Store) due(ctx context.Context, limit int) ([]Job, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT `+jobColumns+` FROM account_deletions
+		 WHERE status = $1 AND next_attempt_at <= NOW()
+		 ORDER BY created_at LIMIT $2`, StatusPending, limit)
+	if err != nil {
+		return nil, fmt.Errorf("deletion: query due: %w", err)
+	}
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		j, err := s.scanJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("deletion: scan due: %w", err)
+		}
+		jobs = append(jobs, *j)
+	}
+	return jobs, rows.Err()
+}
+
+// markAnnounced records that the #account deletion event was emitted.
+func (s *Store) markAnnounced(ctx context.Context, did string) error {
+	_, err := s.db.Pool.Exec(ctx,
+		`UPDATE account_deletions SET announced = TRUE WHERE did = $1`, did)
+	if err != nil {
+		return fmt.Errorf("deletion: mark announced %s: %w", did, err)
+	}
+	return nil
+}
+
+// markTombstoned records that the PLC tombstone was accepted and drops
+// the signing key, which is no longer needed.
+func (s *Store) markTombstoned(ctx context.Context, did string) error {
+	_, err := s.db.Pool.Exec(ctx,
+		`UPDATE account_deletions SET plc_tombstoned = TRUE, sealed_signing_key = NULL WHERE did = $1`, did)
+	if err != nil {
+		return fmt.Errorf("deletion: mark tombstoned %s: %w", did, err)
+	}
+	return nil
+}
+
+// markDone completes a job.
+func (s *Store) markDone(ctx context.Context, did string) error {
+	_, err := s.db.Pool.Exec(ctx,
+		`UPDATE account_deletions
+		 SET status = $1, sealed_signing_key = NULL, last_error = '', completed_at = NOW()
+		 WHERE did = $2`, StatusDone, did)
+	if err != nil {
+		return fmt.Errorf("deletion: mark done %s: %w", did, err)
+	}
+	return nil
+}
+
+// markFailed records a failed attempt and schedules the next one.
+func (s *Store) markFailed(ctx context.Context, did string, attempts int, cause error) error {
+	_, err := s.db.Pool.Exec(ctx,
+		`UPDATE account_deletions
+		 SET attempts = $1, last_error = $2, next_attempt_at = $3
+		 WHERE did = $4`,
+		attempts, cause.Error(), time.Now().Add(worker.Backoff(attempts, retryBase, retryMax)), did)
+	if err != nil {
+		return fmt.Errorf("deletion: mark failed %s: %w", did, err)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package deletion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/primal-host/primal-pds/internal/account"
+	"github.com/primal-host/primal-pds/internal/database"
+	"github.com/primal-host/primal-pds/internal/events"
+	"github.com/primal-host/primal-pds/internal/identity"
+	"github.com/primal-host/primal-pds/internal/worker"
+)
+
+// Worker tuning.
+const (
+	// workerInterval is how often pending jobs are checked when no
+	// Notify arrives.
+	workerInterval = 30 * time.Second
+
+	// workerBatch is the number of jobs processed per pass.
+	workerBatch = 20
+
+	// retryBase and retryMax bound the delay between failed attempts.
+	retryBase = time.Minute
+	retryMax  = 6 * time.Hour
+)
+
+// Worker processes pending deletion jobs. Every step is idempotent and
+// progress is recorded as it goes, so a job interrupted by a crash or a
+// failing PLC directory is safely resumed on a later pass.
+type Worker struct {
+	store       *Store
+	pools       *database.PoolManager
+	events      *events.Manager
+	plcEndpoint string
+	rotationKey string
+	wake        *worker.Waker
+}
+
+// NewWorker creates a deletion Worker. plcEndpoint may be empty, in
+// which case DIDs are not tombstoned. Tombstones are signed with the
+// PDS rotation key, or with the account's signing key for DIDs created
+// before the server held one.
+func NewWorker(store *Store, pools *database.PoolManager, evts *events.Manager, plcEndpoint, rotationKey string) *Worker {
+	return &Worker{
+		store:       store,
+		pools:       pools,
+		events:      evts,
+		plcEndpoint: plcEndpoint,
+		rotationKey: rotationKey,
+		wake:        worker.NewWaker(),
+	}
+}
+
+// Notify wakes the worker after a job is queued.
+func (w *Worker) Notify() {
+	w.wake.Notify()
+}
+
+// Run processes jobs until ctx is cancelled.
+func (w *Worker) Run(ctx context.Context) {
+	w.wake.Loop(ctx, workerInterval, w.processDue)
+}
+
+// processDue runs every due job once.
+func (w *Worker) processDue(ctx context.Context) {
+	jobs, err := w.store.due(ctx, workerBatch)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Warning: deletion: %v", err)
+		}
+		return
+	}
+
+	for i := range jobs {
+		j := &jobs[i]
+		if err := w.process(ctx, j); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Warning: deletion of %s (attempt %d): %v", j.DID, j.Attempts+1, err)
+			if err := w.store.markFailed(ctx, j.DID, j.Attempts+1, err); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+			continue
+		}
+		log.Printf("Account purged: %s (%s)", j.Handle, j.DID)
+	}
+}
+
+// process runs the remaining steps of a job.
+func (w *Worker) process(ctx context.Context, j *Job) error {
+	if err := w.purgeTenant(ctx, j); err != nil {
+		return err
+	}
+
+	if !j.Announced {
+		if err := w.events.EmitAccount(ctx, j.DID, j.Domain, false, "deleted"); err != nil {
+			return err
+		}
+		if err := w.store.markAnnounced(ctx, j.DID); err != nil {
+			return err
+		}
+	}
+
+	if j.PurgeEvents {
+		// The #account event just emitted stays, so consumers replaying
+		// from an old cursor still learn of the deletion.
+		_, err := w.store.db.Pool.Exec(ctx,
+			`DELETE FROM firehose_events WHERE did = $1 AND event_type = 'commit'`, j.DID)
+		if err != nil {
+			return fmt.Errorf("deletion: purge events: %w", err)
+		}
+	}
+
+	if !j.PLCTombstoned && w.plcEndpoint != "" && strings.HasPrefix(j.DID, "did:plc:") {
+		err := identity.TombstoneDID(ctx, w.plcEndpoint, j.DID, w.rotationKey, j.SigningKey)
+		if errors.Is(err, account.ErrNoRotationKey) {
+			// The DID's rotation keys have moved elsewhere; whoever
+			// controls it now decides its fate.
+			log.Printf("Warning: not tombstoning %s: %v", j.DID, err)
+		} else if err != nil {
+			return err
+		}
+		if err := w.recordPLCLog(ctx, j); err != nil {
+			return err
+		}
+		if err := w.store.markTombstoned(ctx, j.DID); err != nil {
+			return err
+		}
+	}
+
+	return w.store.markDone(ctx, j.DID)
+}
+
+// purgeTenant deletes the account and everything stored for it in its
+// tenant database. If the domain has since been removed, its database
+// is already gone and there is nothing to do.
+func (w *Worker) purgeTenant(ctx context.Context, j *Job) error {
+	pool := w.pools.Get(j.Domain)
+	if pool == nil {
+		return nil
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("deletion: begin: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	for _, table := range []string{"commit_outbox", "blobs", "repo_blocks", "accounts"} {
+		if _, err := tx.Exec(ctx, `DELETE FROM `+table+` WHERE did = $1`, j.DID); err != nil {
+			return fmt.Errorf("deletion: purge %s: %w", table, err)
+		}
+	}
+	// The PLC operation log is kept, but operations not yet submitted
+	// must not reach the directory after the account is gone.
+	_, err = tx.Exec(ctx,
+		`DELETE FROM plc_operations WHERE did = $1 AND status IN ($2, $3)`,
+		j.DID, account.PLCOpPending, account.PLCOpFailed)
+	if err != nil {
+		return fmt.Errorf("deletion: purge plc_operations: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("deletion: commit purge: %w", err)
+	}
+	return nil
+}
+
+// recordPLCLog copies the directory's log for the job's DID, tombstone
+// included, into the local operation log of its tenant database.
+func (w *Worker) recordPLCLog(ctx context.Context, j *Job) error {
+	pool := w.pools.Get(j.Domain)
+	if pool == nil {
+		return nil
+	}
+	accounts := account.NewStore(&database.DB{Pool: pool})
+	if err := identity.SyncLog(ctx, w.plcEndpoint, accounts, j.DID); err != nil {
+		return fmt.Errorf("deletion: record plc log: %w", err)
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package events
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
@@ -13,9 +14,17 @@ import (
 	"github.com/ipfs/go-cid"
 )
 
+// MaxEventBlocksBytes is the size limit of a #commit message's blocks,
+// from the subscribeRepos lexicon. A commit over it is emitted with
+// tooBig set and without its blocks and ops; consumers fall back to
+// com.atproto.sync.getRepo. The lexicon's limit on ops needs no check
+// here, since repo.MaxCommitOps already keeps commits under it.
+const MaxEventBlocksBytes = 2_000_000
+
 // CommitInfo carries everything needed to build a firehose commit event.
 type CommitInfo struct {
 	DID       string
+	Domain    string // hosted domain the DID is routed to
 	Rev       string
 	PrevRev   string
 	CommitCID string
@@ -23,6 +32,7 @@ type CommitInfo struct {
 	DiffCAR   []byte
 	Ops       []OpInfo
 	Time      time.Time
+	Withheld  bool // account is not synced to relays (e.g. suspended)
 }
 
 // OpInfo describes a single record mutation.
@@ -33,10 +43,27 @@ type OpInfo struct {
 	Prev   *cid.Cid // previous record CID (nil for create)
 }
 
+// Event is a sequenced firehose event as delivered to subscribers.
+// Exactly one of Commit, Account and Identity is set. The message and frame are
+// shared between subscribers and must not be modified.
+type Event struct {
+	Seq      int64
+	Time     time.Time // when the event was sequenced
+	DID      string
+	Domain   string
+	Withheld bool // only delivered to operator streams
+	Commit   *atproto.SyncSubscribeRepos_Commit
+	Account  *atproto.SyncSubscribeRepos_Account
+	Identity *atproto.SyncSubscribeRepos_Identity
+	Frame    []byte // pre-serialized wire frame (header + message)
+}
+
 // subscriber represents a connected firehose consumer.
 type subscriber struct {
-	ch   chan []byte
-	done chan struct{}
+	ch       chan *Event
+	done     chan struct{}
+	domain   string // when set, only events for this domain are delivered
+	withheld bool   // whether withheld events are delivered
 }
 
 // Manager handles event sequencing, persistence, and fan-out to
@@ -59,7 +86,8 @@ func NewManager(persister *Persister) *Manager {
 }
 
 // Emit persists a commit event and broadcasts the wire frame to all
-// subscribers. Returns error only if persistence fails.
+// subscribers. Returns error only if persistence fails. Emitting a commit
+// that was already sequenced is a no-op, so callers may safely retry.
 func (m *Manager) Emit(ctx context.Context, info *CommitInfo) error {
 	// Build the SyncSubscribeRepos_Commit.
 	commitCID, err := cid.Decode(info.CommitCID)
@@ -109,8 +137,18 @@ func (m *Manager) Emit(ctx context.Context, info *CommitInfo) error {
 		TooBig:   false,
 	}
 
+	// Oversized commits are announced without their contents.
+	if len(info.DiffCAR) > MaxEventBlocksBytes {
+		commit.TooBig = true
+		commit.Blocks = lexutil.LexBytes{}
+		commit.Ops = []*atproto.SyncSubscribeRepos_RepoOp{}
+	}
+
 	// Persist to get sequence number.
-	seq, err := m.persister.Persist(ctx, "commit", info.DID, commit)
+	seq, seqTime, err := m.persister.Persist(ctx, info.DID, info.Domain, info.Withheld, commit)
+	if errors.Is(err, errAlreadySequenced) {
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("events: persist: %w", err)
 	}
@@ -123,17 +161,129 @@ func (m *Manager) Emit(ctx context.Context, info *CommitInfo) error {
 	}
 
 	// Broadcast to subscribers.
-	m.broadcast(frame)
+	m.broadcast(&Event{
+		Seq:      seq,
+		Time:     seqTime,
+		DID:      info.DID,
+		Domain:   info.Domain,
+		Withheld: info.Withheld,
+		Commit:   commit,
+		Frame:    frame,
+	})
 	return nil
 }
 
-// Subscribe returns a channel of pre-serialized CBOR frames. If since
-// is non-nil, events after that cursor are replayed before live frames.
-// The returned cancel function must be called when the subscriber is done.
-func (m *Manager) Subscribe(ctx context.Context, since *int64) (<-chan []byte, func(), error) {
+// EmitAccount persists and broadcasts an #account event announcing a
+// change in whether the account's repo is available. status is the
+// atproto reason (e.g. "deactivated", "takendown") and is ignored when
+// active is true.
+func (m *Manager) EmitAccount(ctx context.Context, did, domainName string, active bool, status string) error {
+	acct := &atproto.SyncSubscribeRepos_Account{
+		Did:    did,
+		Active: active,
+		Time:   time.Now().UTC().Format(time.RFC3339),
+	}
+	if !active && status != "" {
+		acct.Status = &status
+	}
+
+	seq, seqTime, err := m.persister.Persist(ctx, did, domainName, false, acct)
+	if err != nil {
+		return fmt.Errorf("events: persist account: %w", err)
+	}
+	acct.Seq = seq
+
+	frame, err := encodeFrame(acct)
+	if err != nil {
+		return fmt.Errorf("events: encode frame: %w", err)
+	}
+
+	m.broadcast(&Event{
+		Seq:     seq,
+		Time:    seqTime,
+		DID:     did,
+		Domain:  domainName,
+		Account: acct,
+		Frame:   frame,
+	})
+	return nil
+}
+
+// EmitIdentity persists and broadcasts an #identity event telling
+// consumers to refresh their cached identity for did, e.g. after a
+// handle change. handle is the account's current handle.
+func (m *Manager) EmitIdentity(ctx context.Context, did, domainName, handle string) error {
+	ident := &atproto.SyncSubscribeRepos_Identity{
+		Did:  did,
+		Time: time.Now().UTC().Format(time.RFC3339),
+	}
+	if handle != "" {
+		ident.Handle = &handle
+	}
+
+	seq, seqTime, err := m.persister.Persist(ctx, did, domainName, false, ident)
+	if err != nil {
+		return fmt.Errorf("events: persist identity: %w", err)
+	}
+	ident.Seq = seq
+
+	frame, err := encodeFrame(ident)
+	if err != nil {
+		return fmt.Errorf("events: encode frame: %w", err)
+	}
+
+	m.broadcast(&Event{
+		Seq:      seq,
+		Time:     seqTime,
+		DID:      did,
+		Domain:   domainName,
+		Identity: ident,
+		Frame:    frame,
+	})
+	return nil
+}
+
+// Replay calls fn for every stored event with seq > since, in order,
+// including withheld ones. Unlike Subscribe it does not wait for live
+// events.
+func (m *Manager) Replay(ctx context.Context, since int64, fn func(evt *Event) error) error {
+	return m.persister.Replay(ctx, since, "", true, fn)
+}
+
+// LatestSeq returns the most recently assigned sequence number, or 0 if
+// no events have been sequenced.
+func (m *Manager) LatestSeq(ctx context.Context) (int64, error) {
+	return m.persister.LatestSeq(ctx)
+}
+
+// CursorAt returns the sequence number of the last event sequenced at or
+// before t, for consumers that resume from a timestamp rather than a seq.
+func (m *Manager) CursorAt(ctx context.Context, t time.Time) (int64, error) {
+	return m.persister.SeqAt(ctx, t)
+}
+
+// Subscribe returns a channel of public sequenced events; withheld
+// events are skipped. If since is non-nil, events after that cursor are
+// replayed before live events. The returned cancel function must be
+// called when the subscriber is done.
+func (m *Manager) Subscribe(ctx context.Context, since *int64) (<-chan *Event, func(), error) {
+	return m.subscribe(ctx, "", false, since)
+}
+
+// SubscribeDomain is like Subscribe but only delivers events for DIDs
+// routed to domainName, including withheld ones, since it serves the
+// domain's operators. Cursors are ordinary firehose seq numbers; events
+// for other domains are skipped, so consecutive events may have gaps.
+func (m *Manager) SubscribeDomain(ctx context.Context, domainName string, since *int64) (<-chan *Event, func(), error) {
+	return m.subscribe(ctx, domainName, true, since)
+}
+
+func (m *Manager) subscribe(ctx context.Context, domainName string, withheld bool, since *int64) (<-chan *Event, func(), error) {
 	sub := &subscriber{
-		ch:   make(chan []byte, 256),
-		done: make(chan struct{}),
+		ch:       make(chan *Event, 256),
+		done:     make(chan struct{}),
+		domain:   domainName,
+		withheld: withheld,
 	}
 
 	// Register subscriber BEFORE replay so we don't miss events between
@@ -152,9 +302,9 @@ func (m *Manager) Subscribe(ctx context.Context, since *int64) (<-chan []byte, f
 	// Replay historical events if cursor provided.
 	if since != nil {
 		go func() {
-			err := m.persister.Replay(ctx, *since, func(frame []byte) error {
+			err := m.persister.Replay(ctx, *since, domainName, withheld, func(evt *Event) error {
 				select {
-				case sub.ch <- frame:
+				case sub.ch <- evt:
 					return nil
 				case <-sub.done:
 					return fmt.Errorf("subscriber cancelled")
@@ -182,15 +332,21 @@ func (m *Manager) Shutdown() {
 	}
 }
 
-// broadcast sends a frame to all subscribers. Slow consumers whose
+// broadcast sends an event to all subscribers. Slow consumers whose
 // buffers are full get their channel closed (they should reconnect).
-func (m *Manager) broadcast(frame []byte) {
+func (m *Manager) broadcast(evt *Event) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	for sub := range m.subs {
+		if sub.domain != "" && sub.domain != evt.Domain {
+			continue
+		}
+		if evt.Withheld && !sub.withheld {
+			continue
+		}
 		select {
-		case sub.ch <- frame:
+		case sub.ch <- evt:
 		default:
 			// Slow consumer — close their channel so they reconnect.
 			close(sub.ch)
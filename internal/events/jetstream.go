@@ -0,0 +1,159 @@
+package events
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	atproto "github.com/bluesky-social/indigo/api/atproto"
+	car "github.com/ipld/go-car"
+	"github.com/primal-host/primal-pds/internal/repo"
+)
+
+// JetstreamEvent is the JSON form of a single record operation, in the
+// shape used by Bluesky's Jetstream service. One firehose commit yields
+// one JetstreamEvent per op.
+type JetstreamEvent struct {
+	DID      string             `json:"did"`
+	TimeUS   int64              `json:"time_us"`
+	Kind     string             `json:"kind"`
+	Commit   *JetstreamCommit   `json:"commit,omitempty"`
+	Account  *JetstreamAccount  `json:"account,omitempty"`
+	Identity *JetstreamIdentity `json:"identity,omitempty"`
+}
+
+// JetstreamCommit describes the record operation in a JetstreamEvent.
+// Record and CID are omitted for deletes and for tooBig commits, whose
+// blocks are not carried on the firehose.
+type JetstreamCommit struct {
+	Rev        string         `json:"rev"`
+	Operation  string         `json:"operation"`
+	Collection string         `json:"collection"`
+	RKey       string         `json:"rkey"`
+	Record     map[string]any `json:"record,omitempty"`
+	CID        string         `json:"cid,omitempty"`
+}
+
+// JetstreamAccount is the payload of an "account" JetstreamEvent.
+type JetstreamAccount struct {
+	Active bool    `json:"active"`
+	DID    string  `json:"did"`
+	Seq    int64   `json:"seq"`
+	Status *string `json:"status,omitempty"`
+	Time   string  `json:"time"`
+}
+
+// JetstreamIdentity is the payload of an "identity" JetstreamEvent.
+type JetstreamIdentity struct {
+	DID    string  `json:"did"`
+	Handle *string `json:"handle,omitempty"`
+	Seq    int64   `json:"seq"`
+	Time   string  `json:"time"`
+}
+
+// JetstreamEvents converts a firehose event to Jetstream form. A commit
+// has its records decoded from the diff CAR and yields one JetstreamEvent
+// per op; an #account or #identity event yields a single "account" or
+// "identity" event. time_us is
+// the sequencing time, which is also what Jetstream cursors are compared
+// against.
+func JetstreamEvents(evt *Event) ([]JetstreamEvent, error) {
+	if a := evt.Account; a != nil {
+		return []JetstreamEvent{{
+			DID:    evt.DID,
+			TimeUS: evt.Time.UnixMicro(),
+			Kind:   "account",
+			Account: &JetstreamAccount{
+				Active: a.Active,
+				DID:    a.Did,
+				Seq:    a.Seq,
+				Status: a.Status,
+				Time:   a.Time,
+			},
+		}}, nil
+	}
+
+	if id := evt.Identity; id != nil {
+		return []JetstreamEvent{{
+			DID:    evt.DID,
+			TimeUS: evt.Time.UnixMicro(),
+			Kind:   "identity",
+			Identity: &JetstreamIdentity{
+				DID:    id.Did,
+				Handle: id.Handle,
+				Seq:    id.Seq,
+				Time:   id.Time,
+			},
+		}}, nil
+	}
+
+	commit := evt.Commit
+	if commit == nil {
+		return nil, nil
+	}
+
+	blocks, err := carBlocks(commit)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]JetstreamEvent, 0, len(commit.Ops))
+	for _, op := range commit.Ops {
+		collection, rkey, ok := strings.Cut(op.Path, "/")
+		if !ok {
+			return nil, fmt.Errorf("jetstream: invalid op path %q", op.Path)
+		}
+
+		jc := &JetstreamCommit{
+			Rev:        commit.Rev,
+			Operation:  op.Action,
+			Collection: collection,
+			RKey:       rkey,
+		}
+		if op.Cid != nil {
+			c := op.Cid.String()
+			jc.CID = c
+			if raw, ok := blocks[c]; ok {
+				rec, err := repo.DecodeRecord(raw)
+				if err != nil {
+					return nil, fmt.Errorf("jetstream: decode record %s: %w", op.Path, err)
+				}
+				jc.Record = rec
+			}
+		}
+
+		out = append(out, JetstreamEvent{
+			DID:    evt.DID,
+			TimeUS: evt.Time.UnixMicro(),
+			Kind:   "commit",
+			Commit: jc,
+		})
+	}
+	return out, nil
+}
+
+// carBlocks reads the diff CAR of a commit into a map keyed by CID string.
+func carBlocks(commit *atproto.SyncSubscribeRepos_Commit) (map[string][]byte, error) {
+	blocks := map[string][]byte{}
+	if len(commit.Blocks) == 0 {
+		return blocks, nil
+	}
+
+	cr, err := car.NewCarReader(bytes.NewReader(commit.Blocks))
+	if err != nil {
+		return nil, fmt.Errorf("jetstream: read car header: %w", err)
+	}
+	for {
+		blk, err := cr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("jetstream: read car block: %w", err)
+		}
+		blocks[blk.Cid().String()] = blk.RawData()
+	}
+	return blocks, nil
+}
@@ -5,15 +5,30 @@ package events
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	atproto "github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/events"
 	cbg "github.com/whyrusleeping/cbor-gen"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// errAlreadySequenced is returned by Persist when a commit with the same
+// DID and rev is already in firehose_events. This happens when the
+// sequencer re-delivers an outbox row after a crash.
+var errAlreadySequenced = errors.New("persist: commit already sequenced")
+
+// Event types stored in firehose_events.event_type.
+const (
+	typeCommit   = "commit"
+	typeAccount  = "account"
+	typeIdentity = "identity"
+)
+
 // Persister stores firehose events in the management database.
 type Persister struct {
 	pool *pgxpool.Pool
@@ -24,82 +39,182 @@ func NewPersister(pool *pgxpool.Pool) *Persister {
 	return &Persister{pool: pool}
 }
 
-// Persist inserts a commit event into firehose_events and returns the
-// assigned sequence number. The BIGSERIAL column provides monotonic ordering.
-func (p *Persister) Persist(ctx context.Context, eventType, did string, commit *atproto.SyncSubscribeRepos_Commit) (int64, error) {
-	// CBOR-encode the commit payload for storage.
+// Persist inserts an event into firehose_events and returns the assigned
+// sequence number and time. The BIGSERIAL column provides monotonic
+// ordering. payload must be a #commit, #account or #identity message. Withheld
+// events are kept for operators but not replayed to public consumers.
+// Returns errAlreadySequenced if a commit's (did, rev) is already stored.
+func (p *Persister) Persist(ctx context.Context, did, domainName string, withheld bool, payload cbg.CBORMarshaler) (int64, time.Time, error) {
+	var eventType string
+	var rev *string
+	switch v := payload.(type) {
+	case *atproto.SyncSubscribeRepos_Commit:
+		eventType, rev = typeCommit, &v.Rev
+	case *atproto.SyncSubscribeRepos_Account:
+		eventType = typeAccount
+	case *atproto.SyncSubscribeRepos_Identity:
+		eventType = typeIdentity
+	default:
+		return 0, time.Time{}, fmt.Errorf("persist: unsupported payload %T", payload)
+	}
+
+	// CBOR-encode the payload for storage.
 	var buf bytes.Buffer
-	if err := commit.MarshalCBOR(&buf); err != nil {
-		return 0, fmt.Errorf("persist: marshal commit: %w", err)
+	if err := payload.MarshalCBOR(&buf); err != nil {
+		return 0, time.Time{}, fmt.Errorf("persist: marshal %s: %w", eventType, err)
+	}
+
+	var seq int64
+	var createdAt time.Time
+	err := p.pool.QueryRow(ctx,
+		`INSERT INTO firehose_events (event_type, did, domain, rev, withheld, payload)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 ON CONFLICT (did, rev) DO NOTHING
+		 RETURNING seq, created_at`,
+		eventType, did, domainName, rev, withheld, buf.Bytes(),
+	).Scan(&seq, &createdAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, time.Time{}, errAlreadySequenced
 	}
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("persist: insert event: %w", err)
+	}
+	return seq, createdAt, nil
+}
 
+// LatestSeq returns the highest assigned seq, or 0 if there is none.
+func (p *Persister) LatestSeq(ctx context.Context) (int64, error) {
 	var seq int64
 	err := p.pool.QueryRow(ctx,
-		`INSERT INTO firehose_events (event_type, did, payload)
-		 VALUES ($1, $2, $3)
-		 RETURNING seq`,
-		eventType, did, buf.Bytes(),
+		`SELECT COALESCE(MAX(seq), 0) FROM firehose_events`,
 	).Scan(&seq)
 	if err != nil {
-		return 0, fmt.Errorf("persist: insert event: %w", err)
+		return 0, fmt.Errorf("persist: latest seq: %w", err)
+	}
+	return seq, nil
+}
+
+// SeqAt returns the highest seq such that every event up to it was
+// sequenced at or before t, or 0 if there is none. Timestamps are not
+// monotonic with seq, so this stops before the first event in seq order
+// that is newer than t; replaying from it skips no later event.
+func (p *Persister) SeqAt(ctx context.Context, t time.Time) (int64, error) {
+	var seq int64
+	err := p.pool.QueryRow(ctx,
+		`SELECT COALESCE(
+			(SELECT MIN(seq) - 1 FROM firehose_events WHERE created_at > $1),
+			(SELECT MAX(seq) FROM firehose_events),
+			0)`, t,
+	).Scan(&seq)
+	if err != nil {
+		return 0, fmt.Errorf("persist: seq at %s: %w", t, err)
 	}
 	return seq, nil
 }
 
 // Replay reads events with seq > since, deserializes each one, sets the
 // correct seq, serializes as a wire-format frame (header + payload), and
-// calls fn for each frame. Used for cursor-based replay on WebSocket connect.
-func (p *Persister) Replay(ctx context.Context, since int64, fn func(frame []byte) error) error {
-	rows, err := p.pool.Query(ctx,
-		`SELECT seq, payload FROM firehose_events
-		 WHERE seq > $1 ORDER BY seq ASC`, since)
+// calls fn for each event. Used for cursor-based replay on WebSocket connect.
+// When domainName is set, only events sequenced for that domain are
+// replayed, so an account that moves domains does not take its history
+// with it. Withheld events are skipped unless
+// withheld is true.
+func (p *Persister) Replay(ctx context.Context, since int64, domainName string, withheld bool, fn func(evt *Event) error) error {
+	var rows pgx.Rows
+	var err error
+	if domainName == "" {
+		rows, err = p.pool.Query(ctx,
+			`SELECT seq, event_type, did, domain, withheld, payload, created_at FROM firehose_events
+			 WHERE seq > $1 AND ($2 OR NOT withheld) ORDER BY seq ASC`, since, withheld)
+	} else {
+		rows, err = p.pool.Query(ctx,
+			`SELECT seq, event_type, did, domain, withheld, payload, created_at FROM firehose_events
+			 WHERE seq > $1 AND domain = $2 AND ($3 OR NOT withheld)
+			 ORDER BY seq ASC`, since, domainName, withheld)
+	}
 	if err != nil {
 		return fmt.Errorf("replay: query: %w", err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var seq int64
+		evt := &Event{}
+		var eventType string
 		var payload []byte
-		if err := rows.Scan(&seq, &payload); err != nil {
+		if err := rows.Scan(&evt.Seq, &eventType, &evt.DID, &evt.Domain, &evt.Withheld, &payload, &evt.Time); err != nil {
 			return fmt.Errorf("replay: scan: %w", err)
 		}
 
-		// Decode the stored commit payload.
-		var commit atproto.SyncSubscribeRepos_Commit
-		if err := commit.UnmarshalCBOR(bytes.NewReader(payload)); err != nil {
-			return fmt.Errorf("replay: unmarshal seq %d: %w", seq, err)
+		// Decode the stored payload and stamp it with its seq.
+		var msg cbg.CBORMarshaler
+		switch eventType {
+		case typeCommit:
+			var commit atproto.SyncSubscribeRepos_Commit
+			if err := commit.UnmarshalCBOR(bytes.NewReader(payload)); err != nil {
+				return fmt.Errorf("replay: unmarshal seq %d: %w", evt.Seq, err)
+			}
+			commit.Seq = evt.Seq
+			evt.Commit, msg = &commit, &commit
+		case typeAccount:
+			var acct atproto.SyncSubscribeRepos_Account
+			if err := acct.UnmarshalCBOR(bytes.NewReader(payload)); err != nil {
+				return fmt.Errorf("replay: unmarshal seq %d: %w", evt.Seq, err)
+			}
+			acct.Seq = evt.Seq
+			evt.Account, msg = &acct, &acct
+		case typeIdentity:
+			var ident atproto.SyncSubscribeRepos_Identity
+			if err := ident.UnmarshalCBOR(bytes.NewReader(payload)); err != nil {
+				return fmt.Errorf("replay: unmarshal seq %d: %w", evt.Seq, err)
+			}
+			ident.Seq = evt.Seq
+			evt.Identity, msg = &ident, &ident
+		default:
+			// Unknown types come from newer versions; skip them.
+			continue
 		}
-		commit.Seq = seq
 
-		// Re-serialize as wire frame: header + commit.
-		frame, err := encodeFrame(&commit)
+		// Re-serialize as wire frame: header + payload.
+		frame, err := encodeFrame(msg)
 		if err != nil {
-			return fmt.Errorf("replay: encode seq %d: %w", seq, err)
+			return fmt.Errorf("replay: encode seq %d: %w", evt.Seq, err)
 		}
+		evt.Frame = frame
 
-		if err := fn(frame); err != nil {
+		if err := fn(evt); err != nil {
 			return err
 		}
 	}
 	return rows.Err()
 }
 
-// encodeFrame serializes a commit as the AT Protocol firehose wire
-// format: CBOR(EventHeader) + CBOR(SyncSubscribeRepos_Commit).
-func encodeFrame(commit *atproto.SyncSubscribeRepos_Commit) ([]byte, error) {
+// encodeFrame serializes a message as the AT Protocol firehose wire
+// format: CBOR(EventHeader) + CBOR(payload).
+func encodeFrame(msg cbg.CBORMarshaler) ([]byte, error) {
+	var msgType string
+	switch msg.(type) {
+	case *atproto.SyncSubscribeRepos_Commit:
+		msgType = "#commit"
+	case *atproto.SyncSubscribeRepos_Account:
+		msgType = "#account"
+	case *atproto.SyncSubscribeRepos_Identity:
+		msgType = "#identity"
+	default:
+		return nil, fmt.Errorf("encode frame: unsupported message %T", msg)
+	}
+
 	var buf bytes.Buffer
 	w := cbg.NewCborWriter(&buf)
 
 	header := events.EventHeader{
 		Op:      events.EvtKindMessage,
-		MsgType: "#commit",
+		MsgType: msgType,
 	}
 	if err := header.MarshalCBOR(w); err != nil {
 		return nil, fmt.Errorf("encode frame: marshal header: %w", err)
 	}
-	if err := commit.MarshalCBOR(w); err != nil {
-		return nil, fmt.Errorf("encode frame: marshal commit: %w", err)
+	if err := msg.MarshalCBOR(w); err != nil {
+		return nil, fmt.Errorf("encode frame: marshal %s: %w", msgType, err)
 	}
 	return buf.Bytes(), nil
 }
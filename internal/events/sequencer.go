@@ -0,0 +1,152 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/primal-host/primal-pds/internal/account"
+	"github.com/primal-host/primal-pds/internal/database"
+	"github.com/primal-host/primal-pds/internal/repo"
+	"github.com/primal-host/primal-pds/internal/worker"
+)
+
+// Sequencer tuning.
+const (
+	// sequencerBatch is the number of outbox rows read per query.
+	sequencerBatch = 100
+
+	// sequencerInterval is how often every tenant outbox is polled when
+	// no Notify arrives. It bounds announcement latency after a crash or
+	// a missed wake-up.
+	sequencerInterval = 2 * time.Second
+)
+
+// Sequencer moves commits from each tenant's commit_outbox into the
+// management firehose_events table. Outbox rows are written in the same
+// transaction as the repo root update, so every applied commit is
+// eventually announced even if the process dies right after committing.
+//
+// A single goroutine drains the tenants one at a time and each outbox in
+// id order, so commits for a DID are always sequenced in the order they
+// were applied. A row is deleted only after Emit succeeds; if the delete
+// is lost, the re-delivered row is recognised by its (did, rev) and
+// skipped, so each commit is sequenced exactly once.
+type Sequencer struct {
+	mgr   *Manager
+	pools *database.PoolManager
+	wake  *worker.Waker
+}
+
+// NewSequencer creates a Sequencer that emits through mgr.
+func NewSequencer(mgr *Manager, pools *database.PoolManager) *Sequencer {
+	return &Sequencer{
+		mgr:   mgr,
+		pools: pools,
+		wake:  worker.NewWaker(),
+	}
+}
+
+// Notify wakes the sequencer after a commit so it is announced without
+// waiting for the next poll.
+func (s *Sequencer) Notify() {
+	s.wake.Notify()
+}
+
+// Run drains all tenant outboxes until ctx is cancelled.
+func (s *Sequencer) Run(ctx context.Context) {
+	s.wake.Loop(ctx, sequencerInterval, s.drainAll)
+}
+
+// drainAll drains every tenant outbox. Tenants are visited in a stable
+// order; a failing tenant is logged and retried on the next pass.
+func (s *Sequencer) drainAll(ctx context.Context) {
+	pools := s.pools.All()
+	domains := make([]string, 0, len(pools))
+	for d := range pools {
+		domains = append(domains, d)
+	}
+	sort.Strings(domains)
+
+	for _, d := range domains {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := s.drain(ctx, d, pools[d]); err != nil {
+			log.Printf("Warning: sequencer: %s: %v", d, err)
+		}
+	}
+}
+
+// drain emits queued commits from one tenant until its outbox is empty.
+// It stops at the first failure so later commits never overtake an
+// earlier one.
+func (s *Sequencer) drain(ctx context.Context, domainName string, pool *pgxpool.Pool) error {
+	for {
+		entries, err := repo.ReadOutbox(ctx, pool, sequencerBatch)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+
+		accounts := account.NewStore(&database.DB{Pool: pool})
+		for _, e := range entries {
+			info := commitInfo(domainName, &e)
+
+			// Commits from accounts that don't sync to relays are
+			// sequenced as withheld. So are commits whose account is
+			// already gone.
+			acct, err := accounts.GetByDID(ctx, e.DID)
+			switch {
+			case err == nil:
+				info.Withheld = !account.Syncs(acct.Status)
+			case errors.Is(err, account.ErrNotFound):
+				info.Withheld = true
+			default:
+				return err
+			}
+
+			if err := s.mgr.Emit(ctx, info); err != nil {
+				return fmt.Errorf("emit outbox %d: %w", e.ID, err)
+			}
+			if err := repo.DeleteOutbox(ctx, pool, e.ID); err != nil {
+				return err
+			}
+		}
+
+		if len(entries) < sequencerBatch {
+			return nil
+		}
+	}
+}
+
+// commitInfo converts an outbox entry to the CommitInfo used by Emit.
+func commitInfo(domainName string, e *repo.OutboxEntry) *CommitInfo {
+	ops := make([]OpInfo, len(e.Commit.Ops))
+	for i, op := range e.Commit.Ops {
+		ops[i] = OpInfo{
+			Action: op.Action,
+			Path:   op.Path,
+			CID:    op.CID,
+			Prev:   op.Prev,
+		}
+	}
+
+	return &CommitInfo{
+		DID:       e.DID,
+		Domain:    domainName,
+		Rev:       e.Commit.Rev,
+		PrevRev:   e.Commit.PrevRev,
+		CommitCID: e.Commit.CommitCID,
+		PrevData:  e.Commit.PrevData,
+		DiffCAR:   e.Commit.DiffCAR,
+		Ops:       ops,
+		Time:      e.Time,
+	}
+}
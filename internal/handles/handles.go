@@ -0,0 +1,225 @@
+package handles
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/primal-host/primal-pds/internal/database"
+)
+
+// HoldPeriod is how long a handle stays reserved for its previous owner
+// after the owner changes handle.
+const HoldPeriod = 30 * 24 * time.Hour
+
+// Handle statuses.
+const (
+	StatusValid   = "valid"
+	StatusInvalid = "invalid"
+)
+
+// Sentinel errors for the handle index.
+var (
+	ErrNotFound = errors.New("handles: not found")
+	ErrTaken    = errors.New("handles: handle claimed by another account")
+)
+
+// Entry is a custom handle claimed by an account hosted here.
+type Entry struct {
+	Handle     string    `json:"handle"`
+	DID        string    `json:"did"`
+	Domain     string    `json:"domain"`
+	Status     string    `json:"status"`
+	Failures   int       `json:"failures"`
+	LastError  string    `json:"lastError,omitempty"`
+	VerifiedAt time.Time `json:"verifiedAt"`
+	CheckedAt  time.Time `json:"checkedAt"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// Store is the handle→DID index of custom handles in the management DB.
+type Store struct {
+	db *database.ManagementDB
+}
+
+// NewStore creates a handle Store.
+func NewStore(db *database.ManagementDB) *Store {
+	return &Store{db: db}
+}
+
+const entryColumns = `handle, did, domain, status, failures, last_error,
+	verified_at, checked_at, created_at`
+
+func scanEntry(row pgx.Row) (*Entry, error) {
+	var e Entry
+	err := row.Scan(&e.Handle, &e.DID, &e.Domain, &e.Status, &e.Failures, &e.LastError,
+		&e.VerifiedAt, &e.CheckedAt, &e.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// Claim records that did, hosted under domain, has verified handle. Any
+// other custom handle the DID held is released. Returns ErrTaken if
+// another DID holds the handle.
+func (s *Store) Claim(ctx context.Context, handle, did, domainName string) error {
+	tx, err := s.db.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("handles: claim begin: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx,
+		`DELETE FROM custom_handles WHERE did = $1 AND handle <> $2`, did, handle)
+	if err != nil {
+		return fmt.Errorf("handles: claim %q: %w", handle, err)
+	}
+
+	tag, err := tx.Exec(ctx,
+		`INSERT INTO custom_handles (handle, did, domain)
+		 VALUES ($1, $2, $3)
+		 ON CONFLICT (handle) DO UPDATE
+		 SET domain = EXCLUDED.domain, status = 'valid', failures = 0, last_error = '',
+		     verified_at = NOW(), checked_at = NOW()
+		 WHERE custom_handles.did = EXCLUDED.did`,
+		handle, did, domainName)
+	if err != nil {
+		return fmt.Errorf("handles: claim %q: %w", handle, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: %s", ErrTaken, handle)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("handles: claim commit %q: %w", handle, err)
+	}
+	return nil
+}
+
+// Lookup returns the index entry for handle, whatever its status.
+// Returns ErrNotFound if the handle is not claimed.
+func (s *Store) Lookup(ctx context.Context, handle string) (*Entry, error) {
+	e, err := scanEntry(s.db.Pool.QueryRow(ctx,
+		`SELECT `+entryColumns+` FROM custom_handles WHERE handle = $1`, handle))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, handle)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("handles: lookup %q: %w", handle, err)
+	}
+	return e, nil
+}
+
+// Release drops any custom handle held by did.
+func (s *Store) Release(ctx context.Context, did string) error {
+	_, err := s.db.Pool.Exec(ctx, `DELETE FROM custom_handles WHERE did = $1`, did)
+	if err != nil {
+		return fmt.Errorf("handles: release %s: %w", did, err)
+	}
+	return nil
+}
+
+// List returns the custom handles of accounts under a domain.
+func (s *Store) List(ctx context.Context, domainName string) ([]Entry, error) {
+	return s.query(ctx,
+		`SELECT `+entryColumns+` FROM custom_handles WHERE domain = $1 ORDER BY handle`, domainName)
+}
+
+// Hold reserves handle for did, hosted under domain, until HoldPeriod
+// from now. An existing hold on the handle is replaced.
+func (s *Store) Hold(ctx context.Context, handle, did, domainName string) error {
+	_, err := s.db.Pool.Exec(ctx,
+		`INSERT INTO handle_holds (handle, did, domain, expires_at)
+		 VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (handle) DO UPDATE
+		 SET did = EXCLUDED.did, domain = EXCLUDED.domain, expires_at = EXCLUDED.expires_at,
+		     created_at = NOW()`,
+		handle, did, domainName, time.Now().Add(HoldPeriod))
+	if err != nil {
+		return fmt.Errorf("handles: hold %q: %w", handle, err)
+	}
+	return nil
+}
+
+// IsHeld reports whether handle is held for an account other than did.
+// did may be empty.
+func (s *Store) IsHeld(ctx context.Context, handle, did string) (bool, error) {
+	var held bool
+	err := s.db.Pool.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM handle_holds
+		 WHERE handle = $1 AND did <> $2 AND expires_at > NOW())`,
+		handle, did,
+	).Scan(&held)
+	if err != nil {
+		return false, fmt.Errorf("handles: check hold %q: %w", handle, err)
+	}
+	return held, nil
+}
+
+// pruneHolds removes expired holds.
+func (s *Store) pruneHolds(ctx context.Context) (int64, error) {
+	tag, err := s.db.Pool.Exec(ctx, `DELETE FROM handle_holds WHERE expires_at <= NOW()`)
+	if err != nil {
+		return 0, fmt.Errorf("handles: prune holds: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// due returns entries last checked before cutoff, oldest first.
+func (s *Store) due(ctx context.Context, cutoff time.Time, limit int) ([]Entry, error) {
+	return s.query(ctx,
+		`SELECT `+entryColumns+` FROM custom_handles
+		 WHERE checked_at < $1 ORDER BY checked_at LIMIT $2`, cutoff, limit)
+}
+
+func (s *Store) query(ctx context.Context, sql string, args ...any) ([]Entry, error) {
+	rows, err := s.db.Pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("handles: query: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		e, err := scanEntry(rows)
+		if err != nil {
+			return nil, fmt.Errorf("handles: scan: %w", err)
+		}
+		entries = append(entries, *e)
+	}
+	return entries, rows.Err()
+}
+
+// recordCheck stores the outcome of a re-verification. A handle becomes
+// invalid after maxFailures consecutive failures and valid again as soon
+// as it verifies.
+func (s *Store) recordCheck(ctx context.Context, e *Entry, cause error, maxFailures int) (*Entry, error) {
+	var sql string
+	args := []any{e.Handle, e.DID}
+	if cause == nil {
+		sql = `UPDATE custom_handles
+		       SET status = 'valid', failures = 0, last_error = '', verified_at = NOW(), checked_at = NOW()
+		       WHERE handle = $1 AND did = $2
+		       RETURNING ` + entryColumns
+	} else {
+		sql = `UPDATE custom_handles
+		       SET failures = failures + 1, last_error = $3, checked_at = NOW(),
+		           status = CASE WHEN failures + 1 >= $4 THEN 'invalid' ELSE status END
+		       WHERE handle = $1 AND did = $2
+		       RETURNING ` + entryColumns
+		args = append(args, cause.Error(), maxFailures)
+	}
+
+	updated, err := scanEntry(s.db.Pool.QueryRow(ctx, sql, args...))
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Released or reclaimed while being checked.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("handles: record check %q: %w", e.Handle, err)
+	}
+	return updated, nil
+}
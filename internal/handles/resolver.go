@@ -0,0 +1,134 @@
+// Package handles manages custom-domain handles: handles outside the
+// domains this PDS hosts, such as "alice.example.com", that an account
+// proves it controls. A domain proves it by publishing the account's DID
+// in a "_atproto.<handle>" DNS TXT record ("did=<did>") or at
+// https://<handle>/.well-known/atproto-did. Claimed handles are indexed
+// in the management database and re-verified periodically. The package
+// also keeps handle holds, which reserve a handle for its previous owner
+// for a while after a handle change.
+package handles
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/util/ssrf"
+)
+
+// Sentinel errors for handle verification.
+var (
+	ErrUnresolved = errors.New("handles: handle does not resolve to a DID")
+	ErrMismatch   = errors.New("handles: handle resolves to a different DID")
+)
+
+// Resolver looks up the DID a handle's domain declares. NetResolver
+// queries real DNS and HTTPS; tests can substitute their own.
+type Resolver interface {
+	// LookupDNS returns the DID in the handle's _atproto TXT record.
+	LookupDNS(ctx context.Context, handle string) (string, error)
+
+	// LookupHTTPS returns the DID served at
+	// https://<handle>/.well-known/atproto-did.
+	LookupHTTPS(ctx context.Context, handle string) (string, error)
+}
+
+// Verify checks that handle resolves to did by either method. It returns
+// ErrMismatch if the handle declares another DID and ErrUnresolved if it
+// declares none.
+func Verify(ctx context.Context, r Resolver, handle, did string) error {
+	dnsDID, dnsErr := r.LookupDNS(ctx, handle)
+	if dnsErr == nil && dnsDID == did {
+		return nil
+	}
+	httpsDID, httpsErr := r.LookupHTTPS(ctx, handle)
+	if httpsErr == nil && httpsDID == did {
+		return nil
+	}
+	if dnsErr == nil || httpsErr == nil {
+		return fmt.Errorf("%w: %s", ErrMismatch, handle)
+	}
+	return fmt.Errorf("%w: %s (dns: %v; https: %v)", ErrUnresolved, handle, dnsErr, httpsErr)
+}
+
+// NetResolver resolves handles with the system DNS resolver and an HTTPS
+// client. Handles come from users, so the client should only reach
+// public addresses.
+type NetResolver struct {
+	DNS  *net.Resolver
+	HTTP *http.Client
+}
+
+// NewNetResolver creates a NetResolver with default timeouts.
+func NewNetResolver() *NetResolver {
+	return &NetResolver{
+		DNS:  net.DefaultResolver,
+		HTTP: &http.Client{Timeout: 10 * time.Second, Transport: ssrf.PublicOnlyTransport()},
+	}
+}
+
+// LookupDNS implements Resolver. The TXT record must hold exactly one
+// "did=" value.
+func (r *NetResolver) LookupDNS(ctx context.Context, handle string) (string, error) {
+	records, err := r.DNS.LookupTXT(ctx, "_atproto."+handle)
+	if err != nil {
+		return "", fmt.Errorf("handles: lookup _atproto.%s: %w", handle, err)
+	}
+	did, err := didFromTXT(records)
+	if err != nil {
+		return "", fmt.Errorf("handles: _atproto.%s %w", handle, err)
+	}
+	return did, nil
+}
+
+// didFromTXT returns the DID in the "did=" values of TXT records, which
+// must all agree.
+func didFromTXT(records []string) (string, error) {
+	var did string
+	for _, rec := range records {
+		value, ok := strings.CutPrefix(strings.TrimSpace(rec), "did=")
+		if !ok {
+			continue
+		}
+		if did != "" && value != did {
+			return "", errors.New("has conflicting DIDs")
+		}
+		did = value
+	}
+	if !strings.HasPrefix(did, "did:") {
+		return "", errors.New("has no DID")
+	}
+	return did, nil
+}
+
+// LookupHTTPS implements Resolver.
+func (r *NetResolver) LookupHTTPS(ctx context.Context, handle string) (string, error) {
+	url := "https://" + handle + "/.well-known/atproto-did"
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", fmt.Errorf("handles: create request: %w", err)
+	}
+	resp, err := r.HTTP.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("handles: GET %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("handles: GET %s returned %d", url, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", fmt.Errorf("handles: read %s: %w", url, err)
+	}
+	did := strings.TrimSpace(string(body))
+	if !strings.HasPrefix(did, "did:") || strings.ContainsAny(did, " \n") {
+		return "", fmt.Errorf("handles: %s did not return a DID", url)
+	}
+	return did, nil
+}
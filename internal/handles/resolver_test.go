@@ -0,0 +1,146 @@
+package handles
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const (
+	testDID  = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	otherDID = "did:plc:aaaaaaaaaaaaaaaaaaaaaaaa"
+)
+
+// fakeResolver answers lookups from maps; a missing entry fails the way
+// an absent TXT record or .well-known file would.
+type fakeResolver struct {
+	dns, https map[string]string
+}
+
+func (f *fakeResolver) LookupDNS(ctx context.Context, handle string) (string, error) {
+	if did, ok := f.dns[handle]; ok {
+		return did, nil
+	}
+	return "", fmt.Errorf("handles: lookup _atproto.%s: no such host", handle)
+}
+
+func (f *fakeResolver) LookupHTTPS(ctx context.Context, handle string) (string, error) {
+	if did, ok := f.https[handle]; ok {
+		return did, nil
+	}
+	return "", fmt.Errorf("handles: GET https://%s/.well-known/atproto-did returned 404", handle)
+}
+
+func TestVerify(t *testing.T) {
+	r := &fakeResolver{
+		dns: map[string]string{
+			"txt.example.com":   testDID,
+			"split.example.com": otherDID,
+			"wrong.example.com": otherDID,
+		},
+		https: map[string]string{
+			"web.example.com":   testDID,
+			"split.example.com": testDID,
+		},
+	}
+	tests := []struct {
+		handle string
+		want   error
+	}{
+		{"txt.example.com", nil},
+		{"web.example.com", nil},
+		{"split.example.com", nil}, // the stale TXT record is outvoted by HTTPS
+		{"wrong.example.com", ErrMismatch},
+		{"none.example.com", ErrUnresolved},
+	}
+	for _, tt := range tests {
+		err := Verify(context.Background(), r, tt.handle, testDID)
+		if tt.want == nil && err != nil {
+			t.Errorf("Verify(%s) = %v, want nil", tt.handle, err)
+		}
+		if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("Verify(%s) = %v, want %v", tt.handle, err, tt.want)
+		}
+	}
+}
+
+func TestDIDFromTXT(t *testing.T) {
+	tests := []struct {
+		records []string
+		want    string
+	}{
+		{[]string{"did=" + testDID}, testDID},
+		{[]string{"v=spf1 -all", " did=" + testDID + " "}, testDID},
+		{[]string{"did=" + testDID, "did=" + testDID}, testDID},
+		{[]string{"did=" + testDID, "did=" + otherDID}, ""},
+		{[]string{"did=alice"}, ""},
+		{[]string{"v=spf1 -all"}, ""},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		got, err := didFromTXT(tt.records)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("didFromTXT(%q) = %s, want error", tt.records, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("didFromTXT(%q) = %q, %v; want %s", tt.records, got, err, tt.want)
+		}
+	}
+}
+
+// testNetResolver returns a NetResolver whose HTTPS requests for any
+// host reach h.
+func testNetResolver(t *testing.T, h http.Handler) *NetResolver {
+	t.Helper()
+	srv := httptest.NewTLSServer(h)
+	t.Cleanup(srv.Close)
+
+	client := srv.Client()
+	transport := client.Transport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+	}
+	// The test certificate is issued for example.com.
+	transport.TLSClientConfig = transport.TLSClientConfig.Clone()
+	transport.TLSClientConfig.ServerName = "example.com"
+	client.Transport = transport
+	return &NetResolver{DNS: net.DefaultResolver, HTTP: client}
+}
+
+func TestNetResolverLookupHTTPS(t *testing.T) {
+	bodies := map[string]string{
+		"good.example.com":    testDID + "\n",
+		"garbage.example.com": "<html>not a DID</html>",
+	}
+	r := testNetResolver(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/.well-known/atproto-did" {
+			http.NotFound(w, req)
+			return
+		}
+		body, ok := bodies[req.Host]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+	ctx := context.Background()
+
+	did, err := r.LookupHTTPS(ctx, "good.example.com")
+	if err != nil || did != testDID {
+		t.Fatalf("LookupHTTPS(good) = %q, %v; want %s", did, err, testDID)
+	}
+	if _, err := r.LookupHTTPS(ctx, "garbage.example.com"); err == nil {
+		t.Error("LookupHTTPS(garbage): want error")
+	}
+	if _, err := r.LookupHTTPS(ctx, "missing.example.com"); err == nil {
+		t.Error("LookupHTTPS(missing): want error")
+	}
+}
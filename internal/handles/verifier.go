@@ -0,0 +1,104 @@
+package handles
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Verifier tuning.
+const (
+	// verifierInterval is how often the index is scanned for handles due
+	// a check.
+	verifierInterval = 10 * time.Minute
+
+	// recheckAfter is how long a handle goes between checks.
+	recheckAfter = 24 * time.Hour
+
+	// verifierBatch is the number of handles checked per pass.
+	verifierBatch = 100
+
+	// maxFailures is the number of consecutive failed checks after which
+	// a handle is marked invalid and stops resolving here.
+	maxFailures = 3
+)
+
+// Verifier periodically re-verifies custom handles, so a handle whose
+// domain stops pointing at its account eventually stops resolving to it.
+// It also clears expired handle holds.
+// A single failed check (e.g. a DNS outage) is tolerated; the handle is
+// marked invalid after maxFailures in a row and valid again once it
+// verifies.
+type Verifier struct {
+	store    *Store
+	resolver Resolver
+}
+
+// NewVerifier creates a Verifier.
+func NewVerifier(store *Store, resolver Resolver) *Verifier {
+	return &Verifier{store: store, resolver: resolver}
+}
+
+// Run re-verifies due handles until ctx is cancelled.
+func (v *Verifier) Run(ctx context.Context) {
+	ticker := time.NewTicker(verifierInterval)
+	defer ticker.Stop()
+
+	for {
+		v.checkDue(ctx)
+		v.pruneHolds(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pruneHolds removes expired handle holds.
+func (v *Verifier) pruneHolds(ctx context.Context) {
+	n, err := v.store.pruneHolds(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Warning: handle verifier: %v", err)
+		}
+		return
+	}
+	if n > 0 {
+		log.Printf("Expired %d handle hold(s)", n)
+	}
+}
+
+// checkDue re-verifies one batch of handles.
+func (v *Verifier) checkDue(ctx context.Context) {
+	entries, err := v.store.due(ctx, time.Now().Add(-recheckAfter), verifierBatch)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Warning: handle verifier: %v", err)
+		}
+		return
+	}
+
+	for i := range entries {
+		e := &entries[i]
+		cause := Verify(ctx, v.resolver, e.Handle, e.DID)
+		if ctx.Err() != nil {
+			return
+		}
+
+		updated, err := v.store.recordCheck(ctx, e, cause, maxFailures)
+		if err != nil {
+			log.Printf("Warning: %v", err)
+			continue
+		}
+		if updated == nil || updated.Status == e.Status {
+			continue
+		}
+		if updated.Status == StatusInvalid {
+			log.Printf("Handle no longer verifies, marked invalid: %s (%s): %v", e.Handle, e.DID, cause)
+		} else {
+			log.Printf("Handle verifies again: %s (%s)", e.Handle, e.DID)
+		}
+	}
+}
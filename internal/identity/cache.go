@@ -0,0 +1,105 @@
+package identity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/primal-host/primal-pds/internal/database"
+)
+
+// Cache entry kinds.
+const (
+	cacheDID    = "did"    // key: DID, value: DID document JSON
+	cacheHandle = "handle" // key: handle, value: DID
+)
+
+// cachePruneInterval is how often Run drops expired entries.
+const cachePruneInterval = time.Hour
+
+// Cache keeps identity resolution results in the management database
+// until they expire.
+type Cache struct {
+	db *database.ManagementDB
+}
+
+// NewCache creates a Cache.
+func NewCache(db *database.ManagementDB) *Cache {
+	return &Cache{db: db}
+}
+
+// Get returns the unexpired value cached for key, and whether there
+// was one.
+func (c *Cache) Get(ctx context.Context, kind, key string) (string, bool, error) {
+	var value string
+	err := c.db.Pool.QueryRow(ctx,
+		`SELECT value FROM identity_cache
+		 WHERE kind = $1 AND key = $2 AND expires_at > NOW()`,
+		kind, key,
+	).Scan(&value)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("identity: cache get %s %s: %w", kind, key, err)
+	}
+	return value, true, nil
+}
+
+// Put caches value for key for ttl.
+func (c *Cache) Put(ctx context.Context, kind, key, value string, ttl time.Duration) error {
+	_, err := c.db.Pool.Exec(ctx,
+		`INSERT INTO identity_cache (kind, key, value, expires_at)
+		 VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (kind, key) DO UPDATE
+		 SET value = EXCLUDED.value, expires_at = EXCLUDED.expires_at, updated_at = NOW()`,
+		kind, key, value, time.Now().Add(ttl),
+	)
+	if err != nil {
+		return fmt.Errorf("identity: cache put %s %s: %w", kind, key, err)
+	}
+	return nil
+}
+
+// Delete drops the value cached for key.
+func (c *Cache) Delete(ctx context.Context, kind, key string) error {
+	_, err := c.db.Pool.Exec(ctx,
+		`DELETE FROM identity_cache WHERE kind = $1 AND key = $2`, kind, key)
+	if err != nil {
+		return fmt.Errorf("identity: cache delete %s %s: %w", kind, key, err)
+	}
+	return nil
+}
+
+// Run prunes expired entries periodically until ctx is cancelled.
+func (c *Cache) Run(ctx context.Context) {
+	ticker := time.NewTicker(cachePruneInterval)
+	defer ticker.Stop()
+
+	for {
+		n, err := c.Prune(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Warning: %v", err)
+		} else if n > 0 {
+			log.Printf("Identity cache: pruned %d expired entries", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Prune drops expired entries and returns how many there were.
+func (c *Cache) Prune(ctx context.Context) (int64, error) {
+	tag, err := c.db.Pool.Exec(ctx, `DELETE FROM identity_cache WHERE expires_at <= NOW()`)
+	if err != nil {
+		return 0, fmt.Errorf("identity: cache prune: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
@@ -1,11 +1,13 @@
-// Package identity provides PLC directory registration and relay
-// announcement for AT Protocol federation.
+// Package identity provides PLC directory registration, resolution of
+// other servers' DIDs and handles, and relay announcement for AT
+// Protocol federation.
 package identity
 
 import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -15,55 +17,159 @@ import (
 	"github.com/primal-host/primal-pds/internal/account"
 )
 
-// RegisterDID submits a signed genesis operation to the PLC directory
-// to register a DID. Non-fatal: logs errors rather than failing.
-func RegisterDID(ctx context.Context, plcEndpoint, did string, op *account.PLCOperation, signingKeyMultibase string) error {
-	sig, err := account.SignPLCOperation(op, signingKeyMultibase)
-	if err != nil {
-		return fmt.Errorf("identity: sign plc op: %w", err)
-	}
-
-	// Build the signed operation payload.
-	payload := map[string]any{
-		"type":                op.Type,
-		"rotationKeys":       op.RotationKeys,
-		"verificationMethods": op.VerificationMethod,
-		"alsoKnownAs":        op.AlsoKnownAs,
-		"services":           op.Services,
-		"sig":                sig,
-		"prev":               nil,
-	}
-
-	body, err := json.Marshal(payload)
-	if err != nil {
-		return fmt.Errorf("identity: marshal plc op: %w", err)
-	}
+// plcClient is the HTTP client for PLC directory requests.
+var plcClient = &http.Client{Timeout: 10 * time.Second}
 
+// SubmitOperation posts a signed PLC operation (its JSON form) for did
+// to the PLC directory.
+func SubmitOperation(ctx context.Context, plcEndpoint, did string, op []byte) error {
 	url := plcEndpoint + "/" + did
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(op))
 	if err != nil {
 		return fmt.Errorf("identity: create request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := plcClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("identity: POST %s: %w", url, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		log.Printf("PLC registered: %s at %s", did, plcEndpoint)
 		return nil
 	}
 
 	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-	return fmt.Errorf("identity: PLC register %s returned %d: %s", did, resp.StatusCode, string(respBody))
+	return fmt.Errorf("identity: PLC operation for %s returned %d: %s", did, resp.StatusCode, string(respBody))
+}
+
+// plcAuditEntry is one entry of a PLC directory audit log.
+type plcAuditEntry struct {
+	CID       string          `json:"cid"`
+	Nullified bool            `json:"nullified"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Operation json.RawMessage `json:"operation"`
+}
+
+// opType returns the entry's operation type, or "" if it can't be read.
+func (e *plcAuditEntry) opType() string {
+	var op struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(e.Operation, &op); err != nil {
+		return ""
+	}
+	return op.Type
+}
+
+// errDIDNotFound is returned by auditLog when the directory doesn't
+// know the DID.
+var errDIDNotFound = errors.New("identity: DID not registered")
+
+// auditLog fetches the PLC directory's audit log for did.
+func auditLog(ctx context.Context, plcEndpoint, did string) ([]plcAuditEntry, error) {
+	auditURL := plcEndpoint + "/" + did + "/log/audit"
+	req, err := http.NewRequestWithContext(ctx, "GET", auditURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("identity: create request: %w", err)
+	}
+	resp, err := plcClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("identity: GET %s: %w", auditURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errDIDNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("identity: PLC audit log %s returned %d: %s", did, resp.StatusCode, string(respBody))
+	}
+
+	var entries []plcAuditEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("identity: decode audit log %s: %w", did, err)
+	}
+	return entries, nil
+}
+
+// HasOperation reports whether the PLC directory's log for did contains
+// the operation with the given CID. It tells a submission that failed
+// in transit apart from one the directory never accepted.
+func HasOperation(ctx context.Context, plcEndpoint, did, opCID string) (bool, error) {
+	entries, err := auditLog(ctx, plcEndpoint, did)
+	if errors.Is(err, errDIDNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if e.CID == opCID && !e.Nullified {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// TombstoneDID submits a plc_tombstone operation for did, permanently
+// deactivating it in the PLC directory. The operation is chained to the
+// latest entry of the DID's audit log and signed with the first of
+// signers (multibase private keys) that is one of its rotation keys. A
+// DID that is already tombstoned, or was never registered, is left
+// alone.
+func TombstoneDID(ctx context.Context, plcEndpoint, did string, signers ...string) error {
+	entries, err := auditLog(ctx, plcEndpoint, did)
+	if errors.Is(err, errDIDNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var last *plcAuditEntry
+	for i := range entries {
+		if !entries[i].Nullified {
+			last = &entries[i]
+		}
+	}
+	if last == nil {
+		return fmt.Errorf("identity: PLC audit log for %s is empty", did)
+	}
+	if last.opType() == account.PLCOpTypeTombstone {
+		return nil
+	}
+
+	var prev account.PLCOperation
+	if err := json.Unmarshal(last.Operation, &prev); err != nil {
+		return fmt.Errorf("identity: decode plc op %s: %w", last.CID, err)
+	}
+	rotationKey, err := account.ChooseRotationKey(&prev, signers...)
+	if err != nil {
+		return fmt.Errorf("identity: tombstone %s: %w", did, err)
+	}
+
+	op := account.NewPLCTombstone(last.CID)
+	op.Sig, err = account.SignPLCOperation(op, rotationKey)
+	if err != nil {
+		return fmt.Errorf("identity: sign tombstone: %w", err)
+	}
+	body, err := json.Marshal(op)
+	if err != nil {
+		return fmt.Errorf("identity: marshal tombstone: %w", err)
+	}
+
+	if err := SubmitOperation(ctx, plcEndpoint, did, body); err != nil {
+		return err
+	}
+	log.Printf("PLC tombstoned: %s at %s", did, plcEndpoint)
+	return nil
 }
 
-// AnnounceToRelay sends a requestCrawl to a relay so it discovers this PDS.
-func AnnounceToRelay(ctx context.Context, relayURL, serviceURL string) error {
+// AnnounceToRelay sends a requestCrawl to a relay so it discovers this
+// PDS. With serviceKey set the request carries a service auth token
+// from the PDS's service DID, so the relay can tell who is asking.
+func AnnounceToRelay(ctx context.Context, relayURL, serviceURL, serviceKey string) error {
 	payload, _ := json.Marshal(map[string]string{
 		"hostname": serviceURL,
 	})
@@ -74,6 +180,14 @@ func AnnounceToRelay(ctx context.Context, relayURL, serviceURL string) error {
 		return fmt.Errorf("identity: create relay request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
+	if serviceKey != "" {
+		relayDID := ServiceDID(relayURL)
+		token, err := SignServiceAuth(ServiceDID(serviceURL), relayDID, "com.atproto.sync.requestCrawl", serviceKey, ServiceAuthTTL)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
 
 	client := &http.Client{Timeout: 10 * time.Second}
 	resp, err := client.Do(req)
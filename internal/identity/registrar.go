@@ -0,0 +1,132 @@
+package identity
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/primal-host/primal-pds/internal/account"
+	"github.com/primal-host/primal-pds/internal/database"
+	"github.com/primal-host/primal-pds/internal/worker"
+)
+
+// Registrar tuning.
+const (
+	// registrarInterval is how often tenants are checked for due
+	// operations when no Notify arrives.
+	registrarInterval = 30 * time.Second
+
+	// registrarBatch is the number of operations submitted per tenant
+	// per pass.
+	registrarBatch = 50
+
+	// registrarMaxAttempts is the number of failed submissions after
+	// which an operation is given up on until an operator resubmits it.
+	registrarMaxAttempts = 12
+
+	// registrarRetryBase and registrarRetryMax bound the delay between
+	// failed attempts.
+	registrarRetryBase = 30 * time.Second
+	registrarRetryMax  = time.Hour
+)
+
+// Registrar submits queued PLC operations from every tenant's
+// plc_operations table to the PLC directory. Operations are queued in the
+// same transaction as the account change they publish, so none is lost
+// if the directory is unreachable or the process restarts; failed
+// submissions are retried with exponential backoff.
+type Registrar struct {
+	pools       *database.PoolManager
+	plcEndpoint string
+	wake        *worker.Waker
+}
+
+// NewRegistrar creates a Registrar that submits to plcEndpoint.
+func NewRegistrar(pools *database.PoolManager, plcEndpoint string) *Registrar {
+	return &Registrar{
+		pools:       pools,
+		plcEndpoint: plcEndpoint,
+		wake:        worker.NewWaker(),
+	}
+}
+
+// Notify wakes the registrar after an operation is queued.
+func (r *Registrar) Notify() {
+	r.wake.Notify()
+}
+
+// Run submits due operations until ctx is cancelled.
+func (r *Registrar) Run(ctx context.Context) {
+	r.wake.Loop(ctx, registrarInterval, r.submitAll)
+}
+
+// submitAll submits due operations for every tenant.
+func (r *Registrar) submitAll(ctx context.Context) {
+	pools := r.pools.All()
+	domains := make([]string, 0, len(pools))
+	for d := range pools {
+		domains = append(domains, d)
+	}
+	sort.Strings(domains)
+
+	for _, d := range domains {
+		if ctx.Err() != nil {
+			return
+		}
+		r.submitTenant(ctx, d, pools[d])
+	}
+}
+
+// submitTenant submits one tenant's due operations.
+func (r *Registrar) submitTenant(ctx context.Context, domainName string, pool *pgxpool.Pool) {
+	accounts := account.NewStore(&database.DB{Pool: pool})
+	ops, err := accounts.DuePLCOps(ctx, registrarBatch)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Warning: plc registrar: %s: %v", domainName, err)
+		}
+		return
+	}
+
+	for i := range ops {
+		op := &ops[i]
+		err := r.submit(ctx, op)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			if err := accounts.MarkPLCOpSubmitted(ctx, op); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+			log.Printf("PLC operation accepted: %s (%s)", op.DID, op.CID)
+			continue
+		}
+
+		attempts := op.Attempts + 1
+		log.Printf("Warning: PLC submission for %s (attempt %d): %v", op.DID, attempts, err)
+		var next *time.Time
+		if attempts < registrarMaxAttempts {
+			t := time.Now().Add(worker.Backoff(attempts, registrarRetryBase, registrarRetryMax))
+			next = &t
+		}
+		if err := accounts.MarkPLCOpFailed(ctx, op, attempts, err, next); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+}
+
+// submit posts one operation. If the directory rejects it, its audit log
+// is checked: an operation that is already there (e.g. accepted just
+// before a lost response) counts as submitted.
+func (r *Registrar) submit(ctx context.Context, op *account.PLCOp) error {
+	err := SubmitOperation(ctx, r.plcEndpoint, op.DID, op.Operation)
+	if err == nil {
+		return nil
+	}
+	if ok, checkErr := HasOperation(ctx, r.plcEndpoint, op.DID, op.CID); checkErr == nil && ok {
+		return nil
+	}
+	return err
+}
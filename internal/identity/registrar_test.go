@@ -0,0 +1,181 @@
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/primal-host/primal-pds/internal/account"
+	"github.com/primal-host/primal-pds/internal/plcdir"
+	"github.com/primal-host/primal-pds/internal/repo"
+	"github.com/primal-host/primal-pds/internal/worker"
+)
+
+// testGenesis returns a new did:plc, its signed genesis operation and
+// the rotation key that controls it.
+func testGenesis(t *testing.T) (string, *account.PLCOperation, string) {
+	t.Helper()
+	rotation, err := repo.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	signing, err := repo.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	did, op, err := account.GeneratePLCDID(signing, rotation, "", "alice.example.com", "https://pds.example.com")
+	if err != nil {
+		t.Fatalf("GeneratePLCDID: %v", err)
+	}
+	return did, op, rotation
+}
+
+// testPLCOp returns op in the form the registrar reads it from the
+// queue.
+func testPLCOp(t *testing.T, did string, op *account.PLCOperation) *account.PLCOp {
+	t.Helper()
+	body, err := json.Marshal(op)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	cid, err := account.PLCOperationCID(op)
+	if err != nil {
+		t.Fatalf("PLCOperationCID: %v", err)
+	}
+	return &account.PLCOp{DID: did, CID: cid, Operation: body}
+}
+
+// testDirectory serves an in-memory PLC directory.
+func testDirectory(t *testing.T) (*plcdir.Store, *httptest.Server) {
+	t.Helper()
+	store := plcdir.NewMemoryStore()
+	srv := httptest.NewServer(plcdir.NewServer(store))
+	t.Cleanup(srv.Close)
+	return store, srv
+}
+
+func TestSubmitOperation(t *testing.T) {
+	ctx := context.Background()
+	store, srv := testDirectory(t)
+	did, genesis, _ := testGenesis(t)
+	op := testPLCOp(t, did, genesis)
+
+	if ok, err := HasOperation(ctx, srv.URL, did, op.CID); err != nil || ok {
+		t.Fatalf("HasOperation before submit = %v, %v; want false", ok, err)
+	}
+	if err := SubmitOperation(ctx, srv.URL, did, op.Operation); err != nil {
+		t.Fatalf("SubmitOperation: %v", err)
+	}
+	if ok, err := HasOperation(ctx, srv.URL, did, op.CID); err != nil || !ok {
+		t.Fatalf("HasOperation after submit = %v, %v; want true", ok, err)
+	}
+	if _, err := store.Document(ctx, did); err != nil {
+		t.Errorf("Document: %v", err)
+	}
+
+	_, other, _ := testGenesis(t)
+	if err := SubmitOperation(ctx, srv.URL, did, testPLCOp(t, did, other).Operation); err == nil {
+		t.Error("SubmitOperation of another DID's genesis: want error")
+	}
+}
+
+func TestRegistrarSubmit(t *testing.T) {
+	ctx := context.Background()
+	_, srv := testDirectory(t)
+	r := NewRegistrar(nil, srv.URL)
+
+	did, genesis, _ := testGenesis(t)
+	if err := r.submit(ctx, testPLCOp(t, did, genesis)); err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+
+	_, other, _ := testGenesis(t)
+	if err := r.submit(ctx, testPLCOp(t, did, other)); err == nil {
+		t.Error("submit of a rejected operation: want error")
+	}
+}
+
+func TestRegistrarSubmitLostResponse(t *testing.T) {
+	ctx := context.Background()
+	dir := plcdir.NewServer(plcdir.NewMemoryStore())
+	// The directory accepts operations, but the response never makes it
+	// back.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPost {
+			dir.ServeHTTP(httptest.NewRecorder(), req)
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+			return
+		}
+		dir.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+
+	did, genesis, _ := testGenesis(t)
+	op := testPLCOp(t, did, genesis)
+	if err := SubmitOperation(ctx, srv.URL, did, op.Operation); err == nil {
+		t.Fatal("SubmitOperation: want the gateway error")
+	}
+	if err := NewRegistrar(nil, srv.URL).submit(ctx, op); err != nil {
+		t.Errorf("submit of an accepted operation: %v", err)
+	}
+}
+
+func TestTombstoneDID(t *testing.T) {
+	ctx := context.Background()
+	store, srv := testDirectory(t)
+	did, genesis, rotation := testGenesis(t)
+
+	// A DID the directory doesn't know is left alone.
+	if err := TombstoneDID(ctx, srv.URL, did, rotation); err != nil {
+		t.Fatalf("TombstoneDID of an unregistered DID: %v", err)
+	}
+
+	if err := SubmitOperation(ctx, srv.URL, did, testPLCOp(t, did, genesis).Operation); err != nil {
+		t.Fatalf("SubmitOperation: %v", err)
+	}
+	stranger, err := repo.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	if err := TombstoneDID(ctx, srv.URL, did, stranger); !errors.Is(err, account.ErrNoRotationKey) {
+		t.Fatalf("TombstoneDID with a stranger's key: err = %v, want ErrNoRotationKey", err)
+	}
+	if err := TombstoneDID(ctx, srv.URL, did, stranger, rotation); err != nil {
+		t.Fatalf("TombstoneDID: %v", err)
+	}
+	if _, err := store.Document(ctx, did); !errors.Is(err, plcdir.ErrTombstoned) {
+		t.Errorf("Document after tombstone: err = %v, want ErrTombstoned", err)
+	}
+	if err := TombstoneDID(ctx, srv.URL, did, rotation); err != nil {
+		t.Errorf("TombstoneDID again: %v", err)
+	}
+	entries, err := store.AuditLog(ctx, did)
+	if err != nil {
+		t.Fatalf("AuditLog: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("audit log has %d entries, want 2", len(entries))
+	}
+}
+
+func TestRegistrarRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{8, time.Hour},
+		{registrarMaxAttempts, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := worker.Backoff(tt.attempts, registrarRetryBase, registrarRetryMax); got != tt.want {
+			t.Errorf("retry delay after %d failures = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
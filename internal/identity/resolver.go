@@ -0,0 +1,270 @@
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	atidentity "github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/util/ssrf"
+	"github.com/primal-host/primal-pds/internal/handles"
+)
+
+// Resolution cache lifetimes. Handles that don't resolve are
+// remembered for a shorter while, so a handle being set up is picked up
+// soon but repeated lookups of a dead one don't each hit DNS and HTTPS.
+const (
+	DIDCacheTTL            = time.Hour
+	HandleCacheTTL         = time.Hour
+	NegativeHandleCacheTTL = 5 * time.Minute
+)
+
+// maxDIDDocumentBytes bounds the size of a fetched DID document.
+const maxDIDDocumentBytes = 64 << 10
+
+// DIDTransport fetches raw DID documents. NetDIDTransport queries a PLC
+// directory and HTTPS; tests can substitute their own.
+type DIDTransport interface {
+	// FetchDID returns the JSON DID document of did. It returns an
+	// error wrapping atidentity.ErrDIDNotFound if the DID doesn't exist.
+	FetchDID(ctx context.Context, did string) ([]byte, error)
+}
+
+// NetDIDTransport fetches did:plc documents from a PLC directory and
+// did:web documents from https://<host>/.well-known/did.json. Anyone can
+// make the server resolve a did:web, so WebHTTP should only reach
+// public addresses; the PLC directory is configured and may be local.
+type NetDIDTransport struct {
+	PLCEndpoint string
+	HTTP        *http.Client
+	WebHTTP     *http.Client
+}
+
+// NewNetDIDTransport creates a NetDIDTransport for plcEndpoint, or for
+// plc.directory if it is empty.
+func NewNetDIDTransport(plcEndpoint string) *NetDIDTransport {
+	if plcEndpoint == "" {
+		plcEndpoint = atidentity.DefaultPLCURL
+	}
+	return &NetDIDTransport{
+		PLCEndpoint: strings.TrimSuffix(plcEndpoint, "/"),
+		HTTP:        &http.Client{Timeout: 10 * time.Second},
+		WebHTTP:     &http.Client{Timeout: 10 * time.Second, Transport: ssrf.PublicOnlyTransport()},
+	}
+}
+
+// FetchDID implements DIDTransport.
+func (t *NetDIDTransport) FetchDID(ctx context.Context, did string) ([]byte, error) {
+	var url string
+	client := t.HTTP
+	switch {
+	case strings.HasPrefix(did, "did:plc:"):
+		url = t.PLCEndpoint + "/" + did
+	case strings.HasPrefix(did, "did:web:"):
+		host := strings.TrimPrefix(did, "did:web:")
+		if _, err := syntax.ParseHandle(host); err != nil {
+			return nil, fmt.Errorf("identity: did:web host %q is not a hostname", host)
+		}
+		url = "https://" + host + "/.well-known/did.json"
+		client = t.WebHTTP
+	default:
+		return nil, fmt.Errorf("identity: unsupported DID method: %s", did)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("identity: create request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, fmt.Errorf("%w: %s: no such host", atidentity.ErrDIDNotFound, did)
+		}
+		return nil, fmt.Errorf("identity: GET %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return nil, fmt.Errorf("%w: %s: GET %s returned %d", atidentity.ErrDIDNotFound, did, url, resp.StatusCode)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("identity: GET %s returned %d", url, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDIDDocumentBytes))
+	if err != nil {
+		return nil, fmt.Errorf("identity: read %s: %w", url, err)
+	}
+	return body, nil
+}
+
+// Resolver resolves DIDs of any server to their documents and handles
+// to DIDs, keeping results in a Cache for a while. Handles are resolved
+// through a handles.Resolver (DNS, then HTTPS).
+//
+// It implements indigo's identity.Directory, so it can be given to
+// service auth validation. A DID's handle is only reported if the
+// handle resolves back to the DID; otherwise it is handle.invalid.
+type Resolver struct {
+	dids    DIDTransport
+	handles handles.Resolver
+	cache   resolverCache
+}
+
+var _ atidentity.Directory = (*Resolver)(nil)
+
+// resolverCache is the part of Cache a Resolver uses.
+type resolverCache interface {
+	Get(ctx context.Context, kind, key string) (string, bool, error)
+	Put(ctx context.Context, kind, key, value string, ttl time.Duration) error
+	Delete(ctx context.Context, kind, key string) error
+}
+
+// NewResolver creates a Resolver. cache may be nil to disable caching.
+func NewResolver(dids DIDTransport, handleResolver handles.Resolver, cache *Cache) *Resolver {
+	r := &Resolver{dids: dids, handles: handleResolver}
+	if cache != nil {
+		r.cache = cache
+	}
+	return r
+}
+
+// ResolveDID returns the DID document of did.
+func (r *Resolver) ResolveDID(ctx context.Context, did string) (*atidentity.DIDDocument, error) {
+	raw, cached := r.cached(ctx, cacheDID, did)
+	if !cached {
+		b, err := r.dids.FetchDID(ctx, did)
+		if err != nil {
+			return nil, err
+		}
+		raw = string(b)
+	}
+
+	var doc atidentity.DIDDocument
+	if err := json.Unmarshal([]byte(raw), &doc); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", atidentity.ErrDIDResolutionFailed, did, err)
+	}
+	if doc.DID.String() != did {
+		return nil, fmt.Errorf("%w: document for %s has id %s", atidentity.ErrDIDResolutionFailed, did, doc.DID)
+	}
+	if !cached {
+		r.store(ctx, cacheDID, did, raw, DIDCacheTTL)
+	}
+	return &doc, nil
+}
+
+// ResolveHandle returns the DID handle declares, by DNS TXT record or
+// at https://<handle>/.well-known/atproto-did. The DID's document is
+// not consulted. A handle that declares no DID is cached as such, with
+// an empty value.
+func (r *Resolver) ResolveHandle(ctx context.Context, handle string) (string, error) {
+	handle = strings.ToLower(handle)
+	if did, ok := r.cached(ctx, cacheHandle, handle); ok {
+		if did == "" {
+			return "", fmt.Errorf("%w: %s (cached)", atidentity.ErrHandleNotFound, handle)
+		}
+		return did, nil
+	}
+
+	did, dnsErr := r.handles.LookupDNS(ctx, handle)
+	if dnsErr != nil {
+		var httpsErr error
+		did, httpsErr = r.handles.LookupHTTPS(ctx, handle)
+		if httpsErr != nil {
+			r.store(ctx, cacheHandle, handle, "", NegativeHandleCacheTTL)
+			return "", fmt.Errorf("%w: %s (dns: %v; https: %v)", atidentity.ErrHandleNotFound, handle, dnsErr, httpsErr)
+		}
+	}
+	if _, err := syntax.ParseDID(did); err != nil {
+		return "", fmt.Errorf("%w: %s declares invalid DID %q", atidentity.ErrHandleResolutionFailed, handle, did)
+	}
+	r.store(ctx, cacheHandle, handle, did, HandleCacheTTL)
+	return did, nil
+}
+
+// LookupDID implements atidentity.Directory.
+func (r *Resolver) LookupDID(ctx context.Context, did syntax.DID) (*atidentity.Identity, error) {
+	doc, err := r.ResolveDID(ctx, did.String())
+	if err != nil {
+		return nil, err
+	}
+	ident := atidentity.ParseIdentity(doc)
+	if declared, err := ident.DeclaredHandle(); err == nil {
+		if resolved, err := r.ResolveHandle(ctx, declared.String()); err == nil && resolved == did.String() {
+			ident.Handle = declared
+		}
+	}
+	return &ident, nil
+}
+
+// LookupHandle implements atidentity.Directory.
+func (r *Resolver) LookupHandle(ctx context.Context, handle syntax.Handle) (*atidentity.Identity, error) {
+	handle = handle.Normalize()
+	did, err := r.ResolveHandle(ctx, handle.String())
+	if err != nil {
+		return nil, err
+	}
+	ident, err := r.LookupDID(ctx, syntax.DID(did))
+	if err != nil {
+		return nil, err
+	}
+	if ident.Handle != handle {
+		return nil, fmt.Errorf("%w: %s declares %s, which does not declare it back", atidentity.ErrHandleMismatch, handle, did)
+	}
+	return ident, nil
+}
+
+// Lookup implements atidentity.Directory.
+func (r *Resolver) Lookup(ctx context.Context, atid syntax.AtIdentifier) (*atidentity.Identity, error) {
+	if did, err := atid.AsDID(); err == nil {
+		return r.LookupDID(ctx, did)
+	}
+	handle, err := atid.AsHandle()
+	if err != nil {
+		return nil, err
+	}
+	return r.LookupHandle(ctx, handle)
+}
+
+// Purge implements atidentity.Directory, dropping any cached document
+// or DID for atid.
+func (r *Resolver) Purge(ctx context.Context, atid syntax.AtIdentifier) error {
+	if r.cache == nil {
+		return nil
+	}
+	if did, err := atid.AsDID(); err == nil {
+		return r.cache.Delete(ctx, cacheDID, did.String())
+	}
+	return r.cache.Delete(ctx, cacheHandle, strings.ToLower(atid.String()))
+}
+
+// cached returns a cached value. Cache failures are logged and treated
+// as misses: the cache only saves lookups.
+func (r *Resolver) cached(ctx context.Context, kind, key string) (string, bool) {
+	if r.cache == nil {
+		return "", false
+	}
+	value, ok, err := r.cache.Get(ctx, kind, key)
+	if err != nil {
+		log.Printf("Warning: identity cache: %v", err)
+		return "", false
+	}
+	return value, ok
+}
+
+func (r *Resolver) store(ctx context.Context, kind, key, value string, ttl time.Duration) {
+	if r.cache == nil {
+		return
+	}
+	if err := r.cache.Put(ctx, kind, key, value, ttl); err != nil {
+		log.Printf("Warning: identity cache: %v", err)
+	}
+}
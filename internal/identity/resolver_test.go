@@ -0,0 +1,226 @@
+package identity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	atidentity "github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+const testDID = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+
+func testDocument(did, handle string) string {
+	return fmt.Sprintf(`{
+		"@context": ["https://www.w3.org/ns/did/v1"],
+		"id": %q,
+		"alsoKnownAs": ["at://%s"],
+		"service": [{"id": "#atproto_pds", "type": "AtprotoPersonalDataServer", "serviceEndpoint": "https://pds.example.com"}]
+	}`, did, handle)
+}
+
+// fakeDIDs serves DID documents from a map and counts fetches.
+type fakeDIDs struct {
+	docs    map[string]string
+	fetches int
+}
+
+func (f *fakeDIDs) FetchDID(ctx context.Context, did string) ([]byte, error) {
+	f.fetches++
+	doc, ok := f.docs[did]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", atidentity.ErrDIDNotFound, did)
+	}
+	return []byte(doc), nil
+}
+
+// fakeHandles answers handle lookups from maps and counts them.
+type fakeHandles struct {
+	dns, https map[string]string
+	lookups    int
+}
+
+func (f *fakeHandles) LookupDNS(ctx context.Context, handle string) (string, error) {
+	f.lookups++
+	if did, ok := f.dns[handle]; ok {
+		return did, nil
+	}
+	return "", errors.New("no TXT record")
+}
+
+func (f *fakeHandles) LookupHTTPS(ctx context.Context, handle string) (string, error) {
+	f.lookups++
+	if did, ok := f.https[handle]; ok {
+		return did, nil
+	}
+	return "", errors.New("HTTP 404")
+}
+
+// memCache is an in-memory resolverCache.
+type memCache map[string]string
+
+func (m memCache) Get(ctx context.Context, kind, key string) (string, bool, error) {
+	v, ok := m[kind+" "+key]
+	return v, ok, nil
+}
+
+func (m memCache) Put(ctx context.Context, kind, key, value string, ttl time.Duration) error {
+	m[kind+" "+key] = value
+	return nil
+}
+
+func (m memCache) Delete(ctx context.Context, kind, key string) error {
+	delete(m, kind+" "+key)
+	return nil
+}
+
+func TestResolveDIDCaches(t *testing.T) {
+	ctx := context.Background()
+	dids := &fakeDIDs{docs: map[string]string{testDID: testDocument(testDID, "alice.example.com")}}
+	r := &Resolver{dids: dids, handles: &fakeHandles{}, cache: memCache{}}
+
+	for range 2 {
+		doc, err := r.ResolveDID(ctx, testDID)
+		if err != nil {
+			t.Fatalf("ResolveDID: %v", err)
+		}
+		if doc.DID.String() != testDID {
+			t.Fatalf("document id = %s, want %s", doc.DID, testDID)
+		}
+	}
+	if dids.fetches != 1 {
+		t.Errorf("fetches = %d, want 1", dids.fetches)
+	}
+
+	if err := r.Purge(ctx, syntax.DID(testDID).AtIdentifier()); err != nil {
+		t.Fatalf("Purge: %v", err)
+	}
+	if _, err := r.ResolveDID(ctx, testDID); err != nil {
+		t.Fatalf("ResolveDID after purge: %v", err)
+	}
+	if dids.fetches != 2 {
+		t.Errorf("fetches after purge = %d, want 2", dids.fetches)
+	}
+}
+
+func TestResolveDIDRejectsWrongID(t *testing.T) {
+	other := "did:plc:aaaaaaaaaaaaaaaaaaaaaaaa"
+	dids := &fakeDIDs{docs: map[string]string{testDID: testDocument(other, "alice.example.com")}}
+	r := NewResolver(dids, &fakeHandles{}, nil)
+
+	_, err := r.ResolveDID(context.Background(), testDID)
+	if !errors.Is(err, atidentity.ErrDIDResolutionFailed) {
+		t.Fatalf("err = %v, want ErrDIDResolutionFailed", err)
+	}
+}
+
+func TestResolveHandle(t *testing.T) {
+	ctx := context.Background()
+	h := &fakeHandles{
+		dns:   map[string]string{"dns.example.com": testDID},
+		https: map[string]string{"https.example.com": testDID},
+	}
+	r := NewResolver(&fakeDIDs{}, h, nil)
+
+	for _, handle := range []string{"dns.example.com", "HTTPS.example.com"} {
+		did, err := r.ResolveHandle(ctx, handle)
+		if err != nil {
+			t.Fatalf("ResolveHandle(%s): %v", handle, err)
+		}
+		if did != testDID {
+			t.Errorf("ResolveHandle(%s) = %s, want %s", handle, did, testDID)
+		}
+	}
+
+	h.dns["bad.example.com"] = "not-a-did"
+	if _, err := r.ResolveHandle(ctx, "bad.example.com"); !errors.Is(err, atidentity.ErrHandleResolutionFailed) {
+		t.Errorf("invalid DID: err = %v, want ErrHandleResolutionFailed", err)
+	}
+}
+
+func TestResolveHandleCachesNotFound(t *testing.T) {
+	ctx := context.Background()
+	h := &fakeHandles{dns: map[string]string{}, https: map[string]string{}}
+	r := &Resolver{dids: &fakeDIDs{}, handles: h, cache: memCache{}}
+
+	for range 2 {
+		if _, err := r.ResolveHandle(ctx, "gone.example.com"); !errors.Is(err, atidentity.ErrHandleNotFound) {
+			t.Fatalf("err = %v, want ErrHandleNotFound", err)
+		}
+	}
+	if h.lookups != 2 {
+		t.Errorf("lookups = %d, want 2 (DNS and HTTPS once)", h.lookups)
+	}
+
+	// Once the handle is set up, purging it makes it resolve.
+	h.dns["gone.example.com"] = testDID
+	if err := r.Purge(ctx, syntax.Handle("gone.example.com").AtIdentifier()); err != nil {
+		t.Fatalf("Purge: %v", err)
+	}
+	did, err := r.ResolveHandle(ctx, "gone.example.com")
+	if err != nil || did != testDID {
+		t.Fatalf("ResolveHandle after purge = %q, %v; want %s", did, err, testDID)
+	}
+}
+
+func TestLookupDIDChecksHandle(t *testing.T) {
+	ctx := context.Background()
+	dids := &fakeDIDs{docs: map[string]string{testDID: testDocument(testDID, "alice.example.com")}}
+	h := &fakeHandles{dns: map[string]string{}}
+	r := NewResolver(dids, h, nil)
+
+	ident, err := r.LookupDID(ctx, syntax.DID(testDID))
+	if err != nil {
+		t.Fatalf("LookupDID: %v", err)
+	}
+	if ident.Handle != syntax.HandleInvalid {
+		t.Errorf("unverified handle = %s, want %s", ident.Handle, syntax.HandleInvalid)
+	}
+
+	h.dns["alice.example.com"] = testDID
+	ident, err = r.LookupDID(ctx, syntax.DID(testDID))
+	if err != nil {
+		t.Fatalf("LookupDID: %v", err)
+	}
+	if ident.Handle != "alice.example.com" {
+		t.Errorf("verified handle = %s, want alice.example.com", ident.Handle)
+	}
+}
+
+func TestNetDIDTransportPLC(t *testing.T) {
+	doc := testDocument(testDID, "alice.example.com")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+testDID {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, doc)
+	}))
+	defer srv.Close()
+
+	tr := NewNetDIDTransport(srv.URL + "/")
+	ctx := context.Background()
+	got, err := tr.FetchDID(ctx, testDID)
+	if err != nil {
+		t.Fatalf("FetchDID: %v", err)
+	}
+	if string(got) != doc {
+		t.Errorf("FetchDID returned %q", got)
+	}
+
+	if _, err := tr.FetchDID(ctx, "did:plc:aaaaaaaaaaaaaaaaaaaaaaaa"); !errors.Is(err, atidentity.ErrDIDNotFound) {
+		t.Errorf("missing DID: err = %v, want ErrDIDNotFound", err)
+	}
+	if _, err := tr.FetchDID(ctx, "did:web:localhost%3A8080"); err == nil {
+		t.Error("did:web with a port: want error")
+	}
+	if _, err := tr.FetchDID(ctx, "did:key:zQ3sh"); err == nil {
+		t.Error("did:key: want error")
+	}
+}
@@ -0,0 +1,69 @@
+package identity
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/auth"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/primal-host/primal-pds/internal/repo"
+)
+
+// ServiceAuthTTL is the lifetime of the service auth tokens the server
+// signs for its own requests.
+const ServiceAuthTTL = time.Minute
+
+// ServiceDID returns the did:web a service is known by, derived from its
+// public URL, or "" if serviceURL is empty.
+func ServiceDID(serviceURL string) string {
+	if serviceURL == "" {
+		return ""
+	}
+	host := serviceURL
+	if u, err := url.Parse(serviceURL); err == nil && u.Host != "" {
+		host = u.Host
+	} else {
+		host = strings.TrimPrefix(host, "https://")
+		host = strings.TrimPrefix(host, "http://")
+		host = strings.TrimSuffix(host, "/")
+	}
+	return WebDIDForHost(host)
+}
+
+// WebDIDForHost returns the did:web for a host as found in a URL or Host
+// header. The host name is lower-cased and a port is percent-encoded,
+// as the did:web method requires.
+func WebDIDForHost(host string) string {
+	host = strings.ToLower(host)
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		host = h + "%3A" + port
+	}
+	return "did:web:" + host
+}
+
+// SignServiceAuth returns a service auth JWT issued by iss and signed
+// with key (multibase private key), authorizing a call to the lexicon
+// method lxm on the service aud for ttl. With an empty lxm the token is
+// not bound to a method.
+func SignServiceAuth(iss, aud string, lxm syntax.NSID, key string, ttl time.Duration) (string, error) {
+	did, err := syntax.ParseDID(iss)
+	if err != nil {
+		return "", fmt.Errorf("identity: service auth issuer: %w", err)
+	}
+	priv, err := repo.ParseKey(key)
+	if err != nil {
+		return "", fmt.Errorf("identity: service auth key: %w", err)
+	}
+	var method *syntax.NSID
+	if lxm != "" {
+		method = &lxm
+	}
+	token, err := auth.SignServiceAuth(did, aud, ttl, method, priv)
+	if err != nil {
+		return "", fmt.Errorf("identity: sign service auth: %w", err)
+	}
+	return token, nil
+}
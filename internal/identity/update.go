@@ -0,0 +1,97 @@
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/primal-host/primal-pds/internal/account"
+)
+
+// SyncLog copies the PLC directory's audit log for did into the local
+// operation log kept in the account's tenant database.
+func SyncLog(ctx context.Context, plcEndpoint string, accounts *account.Store, did string) error {
+	entries, err := auditLog(ctx, plcEndpoint, did)
+	if errors.Is(err, errDIDNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	log := make([]account.PLCLogEntry, len(entries))
+	for i, e := range entries {
+		log[i] = account.PLCLogEntry{
+			CID:       e.CID,
+			Operation: e.Operation,
+			Nullified: e.Nullified,
+			CreatedAt: e.CreatedAt,
+		}
+	}
+	return accounts.SyncPLCLog(ctx, did, log)
+}
+
+// PrepareUpdate builds and signs a plc_operation that follows the
+// latest operation of did and applies change to it. It returns nil if
+// change leaves the published DID document as it was.
+//
+// The new operation chains to the newest operation still queued locally
+// if there is one. Otherwise the local log is first refreshed from the
+// directory's audit log, so the update follows whatever the directory
+// currently holds, including operations submitted elsewhere (for
+// example with a user's own rotation key).
+//
+// The operation is signed with the first of signers (multibase private
+// keys) that is among the DID's current rotation keys; if none is,
+// account.ErrNoRotationKey is returned.
+func PrepareUpdate(ctx context.Context, plcEndpoint string, accounts *account.Store, did string, signers []string, change func(op *account.PLCOperation)) (*account.PLCOperation, error) {
+	last, err := accounts.LastPLCOp(ctx, did)
+	if errors.Is(err, account.ErrNoPLCLog) || (err == nil && last.Status == account.PLCOpSubmitted) {
+		if err := SyncLog(ctx, plcEndpoint, accounts, did); err != nil {
+			return nil, err
+		}
+		last, err = accounts.LastPLCOp(ctx, did)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var prev account.PLCOperation
+	if err := json.Unmarshal(last.Operation, &prev); err != nil {
+		return nil, fmt.Errorf("identity: decode plc op %s: %w", last.CID, err)
+	}
+	if prev.Type != account.PLCOpTypeOperation {
+		return nil, fmt.Errorf("identity: cannot update %s after a %q operation", did, prev.Type)
+	}
+
+	rotationKey, err := account.ChooseRotationKey(&prev, signers...)
+	if err != nil {
+		return nil, fmt.Errorf("identity: update %s: %w", did, err)
+	}
+
+	next := account.NextPLCOperation(&prev, last.CID)
+	change(next)
+	if account.SamePLCState(&prev, next) {
+		return nil, nil
+	}
+
+	next.Sig, err = account.SignPLCOperation(next, rotationKey)
+	if err != nil {
+		return nil, fmt.Errorf("identity: sign plc update: %w", err)
+	}
+	return next, nil
+}
+
+// QueueUpdate prepares an update with PrepareUpdate and queues it for
+// the Registrar. It reports whether an operation was queued.
+func QueueUpdate(ctx context.Context, plcEndpoint string, accounts *account.Store, did string, signers []string, change func(op *account.PLCOperation)) (bool, error) {
+	op, err := PrepareUpdate(ctx, plcEndpoint, accounts, did, signers, change)
+	if err != nil || op == nil {
+		return false, err
+	}
+	if err := accounts.QueuePLCOp(ctx, did, op); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,177 @@
+// Package keystore keeps server-held private keys, such as the PDS's
+// PLC rotation key and service key, in the management database. Keys are encrypted at
+// rest with AES-256-GCM under a key derived from a configured secret,
+// so a copy of the database alone does not reveal them.
+package keystore
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/primal-host/primal-pds/internal/database"
+	"github.com/primal-host/primal-pds/internal/repo"
+)
+
+// Well-known key names.
+const (
+	// RotationKey is the PDS's PLC rotation key. It is listed in the
+	// rotationKeys of every did:plc this server creates and signs the
+	// PLC operations the server submits for them.
+	RotationKey = "plc_rotation"
+
+	// ServiceKey is the key of the PDS's own did:web identity. It is
+	// published in the service DID document and signs the service auth
+	// tokens the PDS issues as itself.
+	ServiceKey = "service"
+)
+
+// Sentinel errors for keystore operations.
+var (
+	ErrNotFound    = errors.New("keystore: key not found")
+	ErrWrongSecret = errors.New("keystore: key cannot be decrypted with the configured secret")
+	ErrKeyMismatch = errors.New("keystore: configured key differs from the stored key")
+)
+
+// Store reads and writes encrypted keys in the server_keys table.
+type Store struct {
+	db   *database.ManagementDB
+	aead cipher.AEAD
+}
+
+// New creates a Store whose keys are encrypted under secret.
+func New(db *database.ManagementDB, secret string) (*Store, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("keystore: secret is required")
+	}
+	key, err := hkdf.Key(sha256.New, []byte(secret), nil, "primal-pds keystore", 32)
+	if err != nil {
+		return nil, fmt.Errorf("keystore: derive key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("keystore: cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("keystore: gcm: %w", err)
+	}
+	return &Store{db: db, aead: aead}, nil
+}
+
+// Get returns the multibase-encoded private key stored under name.
+// Returns ErrNotFound if there is none.
+func (s *Store) Get(ctx context.Context, name string) (string, error) {
+	var sealed []byte
+	err := s.db.Pool.QueryRow(ctx,
+		`SELECT ciphertext FROM server_keys WHERE name = $1`, name,
+	).Scan(&sealed)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("keystore: get %q: %w", name, err)
+	}
+
+	plain, err := s.Open(name, sealed)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// Seal encrypts plain under the store's secret, bound to name: the
+// result only opens under the same name. It is for keys kept outside
+// the server_keys table.
+func (s *Store) Seal(name string, plain []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("keystore: seal %q: nonce: %w", name, err)
+	}
+	return s.aead.Seal(nonce, nonce, plain, []byte(name)), nil
+}
+
+// Open decrypts a value sealed under name. Returns ErrWrongSecret if it
+// was sealed with another secret or name.
+func (s *Store) Open(name string, sealed []byte) ([]byte, error) {
+	n := s.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, fmt.Errorf("keystore: open %q: ciphertext too short", name)
+	}
+	plain, err := s.aead.Open(nil, sealed[:n], sealed[n:], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrWrongSecret, name)
+	}
+	return plain, nil
+}
+
+// Put encrypts and stores a multibase-encoded private key under name,
+// replacing any key already stored there.
+func (s *Store) Put(ctx context.Context, name, key string) error {
+	priv, err := repo.ParseKey(key)
+	if err != nil {
+		return fmt.Errorf("keystore: put %q: %w", name, err)
+	}
+	pub, err := priv.PublicKey()
+	if err != nil {
+		return fmt.Errorf("keystore: put %q: %w", name, err)
+	}
+
+	sealed, err := s.Seal(name, []byte(key))
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Pool.Exec(ctx,
+		`INSERT INTO server_keys (name, did_key, ciphertext)
+		 VALUES ($1, $2, $3)
+		 ON CONFLICT (name) DO UPDATE
+		 SET did_key = EXCLUDED.did_key, ciphertext = EXCLUDED.ciphertext, updated_at = NOW()`,
+		name, pub.DIDKey(), sealed)
+	if err != nil {
+		return fmt.Errorf("keystore: put %q: %w", name, err)
+	}
+	return nil
+}
+
+// Load returns the key stored under name. If configured is set and no
+// key is stored yet, it is imported; otherwise a key is generated and
+// stored on first use. A configured key that differs from the stored
+// one returns ErrKeyMismatch rather than replacing it, since the
+// stored key may be the only one able to sign for existing identities.
+func (s *Store) Load(ctx context.Context, name, configured string) (string, error) {
+	if configured != "" {
+		current, err := s.Get(ctx, name)
+		if err == nil {
+			if current != configured {
+				return "", fmt.Errorf("%w: %s", ErrKeyMismatch, name)
+			}
+			return current, nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return "", err
+		}
+		if err := s.Put(ctx, name, configured); err != nil {
+			return "", err
+		}
+		return configured, nil
+	}
+
+	key, err := s.Get(ctx, name)
+	if !errors.Is(err, ErrNotFound) {
+		return key, err
+	}
+	if key, err = repo.GenerateKey(); err != nil {
+		return "", fmt.Errorf("keystore: generate %q: %w", name, err)
+	}
+	if err := s.Put(ctx, name, key); err != nil {
+		return "", err
+	}
+	return key, nil
+}
@@ -0,0 +1,101 @@
+// Package mail sends transactional email such as account deletion
+// confirmations. For development, messages can be written to the log
+// instead of sent.
+package mail
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Mailer delivers a plain-text message to a single recipient.
+type Mailer interface {
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+// New returns an SMTP mailer for addr (host:port). user and pass enable
+// PLAIN auth when user is set. With addr empty it returns a LogMailer if
+// logMail is set, and nil otherwise: the emails carry codes that confirm
+// account deletion and identity changes, so they are only logged when
+// asked for.
+func New(addr, user, pass, from string, logMail bool) Mailer {
+	switch {
+	case addr != "":
+		return &SMTPMailer{addr: addr, user: user, pass: pass, from: from}
+	case logMail:
+		return LogMailer{}
+	}
+	return nil
+}
+
+// SMTPMailer sends mail through an SMTP relay, using STARTTLS when the
+// server offers it.
+type SMTPMailer struct {
+	addr string
+	user string
+	pass string
+	from string
+}
+
+// Send delivers the message. net/smtp has no context support, so ctx
+// only bounds the wait: a send still in progress when ctx ends finishes
+// in the background.
+func (m *SMTPMailer) Send(ctx context.Context, to, subject, body string) error {
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return fmt.Errorf("mail: invalid header value")
+	}
+
+	var auth smtp.Auth
+	if m.user != "" {
+		host, _, err := net.SplitHostPort(m.addr)
+		if err != nil {
+			return fmt.Errorf("mail: smtp addr %q: %w", m.addr, err)
+		}
+		auth = smtp.PlainAuth("", m.user, m.pass, host)
+	}
+
+	msg := "From: " + m.from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + strings.ReplaceAll(body, "\n", "\r\n")
+
+	// The envelope sender is the bare address from the From header.
+	sender := m.from
+	if a, err := netmail.ParseAddress(m.from); err == nil {
+		sender = a.Address
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(m.addr, auth, sender, []string{to}, []byte(msg))
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("mail: send to %s: %w", to, err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("mail: send to %s: %w", to, ctx.Err())
+	}
+}
+
+// LogMailer writes messages to the server log, for development servers
+// without an SMTP relay.
+type LogMailer struct{}
+
+// Send logs the message.
+func (LogMailer) Send(_ context.Context, to, subject, body string) error {
+	log.Printf("Mail to %s: %s\n%s", to, subject, body)
+	return nil
+}
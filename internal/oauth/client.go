@@ -0,0 +1,239 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	indigooauth "github.com/bluesky-social/indigo/atproto/auth/oauth"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ClientMetadata is a client's metadata document.
+type ClientMetadata = indigooauth.ClientMetadata
+
+// clientCacheTTL is how long a fetched metadata document is reused.
+const clientCacheTTL = 10 * time.Minute
+
+// ClientAssertionType is the only client_assertion_type accepted from
+// confidential clients.
+const ClientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// loopbackClientID is the client_id of development clients running on
+// the user's machine, which have no metadata document.
+const loopbackClientID = "http://localhost"
+
+type cachedClient struct {
+	meta    *ClientMetadata
+	fetched time.Time
+}
+
+// ClientResolver fetches the metadata documents that identify clients
+// and authenticates confidential clients.
+type ClientResolver struct {
+	resolver *indigooauth.Resolver
+	store    *Store
+
+	mu    sync.Mutex
+	cache map[string]cachedClient
+}
+
+// NewClientResolver creates a ClientResolver. Metadata and key sets are
+// only fetched from public addresses.
+func NewClientResolver(store *Store) *ClientResolver {
+	r := indigooauth.NewResolver()
+	r.UserAgent = "primal-pds"
+	return &ClientResolver{
+		resolver: r,
+		store:    store,
+		cache:    make(map[string]cachedClient),
+	}
+}
+
+// Resolve returns the metadata of the client identified by clientID.
+func (r *ClientResolver) Resolve(ctx context.Context, clientID string) (*ClientMetadata, error) {
+	if clientID == loopbackClientID || strings.HasPrefix(clientID, loopbackClientID+"?") {
+		return loopbackClient(clientID)
+	}
+
+	r.mu.Lock()
+	cached, ok := r.cache[clientID]
+	r.mu.Unlock()
+	if ok && time.Since(cached.fetched) < clientCacheTTL {
+		return cached.meta, nil
+	}
+
+	meta, err := r.resolver.ResolveClientMetadata(ctx, clientID)
+	if err != nil {
+		return nil, InvalidClient("client metadata: %v", err)
+	}
+	r.mu.Lock()
+	for id, c := range r.cache {
+		if time.Since(c.fetched) >= clientCacheTTL {
+			delete(r.cache, id)
+		}
+	}
+	r.cache[clientID] = cachedClient{meta: meta, fetched: time.Now()}
+	r.mu.Unlock()
+	return meta, nil
+}
+
+// loopbackClient builds the metadata of a loopback client. Its redirect
+// URIs and scope may be given as query parameters of the client_id.
+func loopbackClient(clientID string) (*ClientMetadata, error) {
+	u, err := url.Parse(clientID)
+	if err != nil || u.Path != "" || u.Fragment != "" {
+		return nil, InvalidClient("invalid loopback client_id")
+	}
+	q := u.Query()
+	redirects := q["redirect_uri"]
+	if len(redirects) == 0 {
+		redirects = []string{"http://127.0.0.1/", "http://[::1]/"}
+	}
+	for _, ru := range redirects {
+		if p, err := url.Parse(ru); err != nil || p.Scheme != "http" || !isLoopbackHost(p.Hostname()) {
+			return nil, InvalidClient("loopback redirect_uri must use 127.0.0.1 or [::1]")
+		}
+	}
+	scope := q.Get("scope")
+	if scope == "" {
+		scope = ScopeAtproto + " " + ScopeGeneric
+	}
+	native := "native"
+	return &ClientMetadata{
+		ClientID:                clientID,
+		ApplicationType:         &native,
+		GrantTypes:              []string{"authorization_code", "refresh_token"},
+		Scope:                   scope,
+		ResponseTypes:           []string{"code"},
+		RedirectURIs:            redirects,
+		TokenEndpointAuthMethod: "none",
+		DPoPBoundAccessTokens:   true,
+	}, nil
+}
+
+func isLoopbackHost(host string) bool {
+	return host == "127.0.0.1" || host == "::1"
+}
+
+// CheckRedirect checks redirectURI against the client's registered
+// redirect URIs. As RFC 8252 asks, the port of a loopback redirect is
+// not compared, since native apps pick one when they start.
+func CheckRedirect(meta *ClientMetadata, redirectURI string) error {
+	if slices.Contains(meta.RedirectURIs, redirectURI) {
+		return nil
+	}
+	u, err := url.Parse(redirectURI)
+	if err == nil && u.Scheme == "http" && isLoopbackHost(u.Hostname()) {
+		for _, registered := range meta.RedirectURIs {
+			ru, err := url.Parse(registered)
+			if err != nil || ru.Scheme != "http" || ru.Hostname() != u.Hostname() {
+				continue
+			}
+			if ru.EscapedPath() == u.EscapedPath() && ru.RawQuery == u.RawQuery {
+				return nil
+			}
+		}
+	}
+	return InvalidRequest("redirect_uri is not registered by the client")
+}
+
+// Authenticate checks the client authentication of a PAR or token
+// request. Public clients send none; confidential clients sign a
+// client_assertion for issuer with a key from their metadata.
+func (r *ClientResolver) Authenticate(ctx context.Context, meta *ClientMetadata, issuer string, form url.Values) error {
+	assertion := form.Get("client_assertion")
+	if !meta.IsConfidential() {
+		if assertion != "" {
+			return InvalidClient("public clients must not send client_assertion")
+		}
+		return nil
+	}
+	if form.Get("client_assertion_type") != ClientAssertionType || assertion == "" {
+		return InvalidClient("client_assertion is required")
+	}
+
+	keys, err := r.clientKeys(ctx, meta)
+	if err != nil {
+		return err
+	}
+	var claims jwt.RegisteredClaims
+	_, err = jwt.ParseWithClaims(assertion, &claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		var set jwt.VerificationKeySet
+		for _, k := range keys {
+			if kid == "" || (k.KeyID != nil && *k.KeyID == kid) {
+				pub, err := atcrypto.ParsePublicJWK(k)
+				if err != nil {
+					continue
+				}
+				set.Keys = append(set.Keys, pub)
+			}
+		}
+		if len(set.Keys) == 0 {
+			return nil, fmt.Errorf("no usable key %q", kid)
+		}
+		return set, nil
+	},
+		jwt.WithValidMethods([]string{"ES256", "ES256K"}),
+		jwt.WithIssuer(meta.ClientID),
+		jwt.WithSubject(meta.ClientID),
+		jwt.WithAudience(issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return InvalidClient("client_assertion: %v", err)
+	}
+	if claims.ID == "" {
+		return InvalidClient("client_assertion must have a jti")
+	}
+	if err := r.store.UseJTI(ctx, "client:"+meta.ClientID+":"+claims.ID, claims.ExpiresAt.Time); err != nil {
+		if errors.Is(err, ErrReplay) {
+			return InvalidClient("client_assertion was replayed")
+		}
+		return err
+	}
+	return nil
+}
+
+// clientKeys returns the client's signing keys, from its metadata or
+// its jwks_uri.
+func (r *ClientResolver) clientKeys(ctx context.Context, meta *ClientMetadata) ([]atcrypto.JWK, error) {
+	if meta.JWKS != nil && len(meta.JWKS.Keys) > 0 {
+		return meta.JWKS.Keys, nil
+	}
+	if meta.JWKSURI == nil {
+		return nil, InvalidClient("client has no keys")
+	}
+	u, err := url.Parse(*meta.JWKSURI)
+	if err != nil || u.Scheme != "https" {
+		return nil, InvalidClient("jwks_uri must be an https URL")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, InvalidClient("jwks_uri: %v", err)
+	}
+	req.Header.Set("User-Agent", r.resolver.UserAgent)
+	resp, err := r.resolver.Client.Do(req)
+	if err != nil {
+		return nil, InvalidClient("fetch jwks_uri: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, InvalidClient("fetch jwks_uri: HTTP %d", resp.StatusCode)
+	}
+	var set indigooauth.JWKS
+	if err := json.NewDecoder(http.MaxBytesReader(nil, resp.Body, 1<<16)).Decode(&set); err != nil {
+		return nil, InvalidClient("jwks_uri: %v", err)
+	}
+	return set.Keys, nil
+}
@@ -0,0 +1,164 @@
+package oauth
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	indigooauth "github.com/bluesky-social/indigo/atproto/auth/oauth"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestCheckRedirect(t *testing.T) {
+	meta := &ClientMetadata{RedirectURIs: []string{
+		"https://app.example.com/callback",
+		"http://127.0.0.1/callback",
+		"http://[::1]:8080/callback",
+	}}
+	tests := []struct {
+		uri string
+		ok  bool
+	}{
+		{"https://app.example.com/callback", true},
+		{"http://127.0.0.1/callback", true},
+		{"http://127.0.0.1:51234/callback", true},
+		{"http://[::1]:9999/callback", true},
+		{"https://app.example.com/other", false},
+		{"https://app.example.com:8443/callback", false},
+		{"https://evil.example.com/callback", false},
+		{"https://127.0.0.1:51234/callback", false},
+		{"http://127.0.0.1:51234/other", false},
+		{"http://127.0.0.1:51234/callback?x=1", false},
+		{"http://localhost:51234/callback", false},
+		{"http://[::1]:9999/other", false},
+	}
+	for _, tt := range tests {
+		err := CheckRedirect(meta, tt.uri)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.uri, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: want error", tt.uri)
+		}
+	}
+}
+
+const (
+	testClientID = "https://app.example.com/client-metadata.json"
+	testIssuer   = "https://pds.example.com"
+)
+
+// confidentialClient returns the metadata of a client that
+// authenticates with a key, and that key.
+func confidentialClient(t *testing.T) (*ClientMetadata, atcrypto.PrivateKey) {
+	t.Helper()
+	key, err := atcrypto.GeneratePrivateKeyP256()
+	if err != nil {
+		t.Fatalf("GeneratePrivateKeyP256: %v", err)
+	}
+	pub, err := key.PublicKey()
+	if err != nil {
+		t.Fatalf("PublicKey: %v", err)
+	}
+	jwk, err := pub.JWK()
+	if err != nil {
+		t.Fatalf("JWK: %v", err)
+	}
+	kid := "key-1"
+	jwk.KeyID = &kid
+	alg := "ES256"
+	return &ClientMetadata{
+		ClientID:                    testClientID,
+		RedirectURIs:                []string{"https://app.example.com/callback"},
+		TokenEndpointAuthMethod:     "private_key_jwt",
+		TokenEndpointAuthSigningAlg: &alg,
+		JWKS:                        &indigooauth.JWKS{Keys: []atcrypto.JWK{*jwk}},
+	}, key
+}
+
+func assertionForm(t *testing.T, key atcrypto.PrivateKey, claims jwt.RegisteredClaims) url.Values {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.GetSigningMethod("ES256"), claims)
+	token.Header["kid"] = "key-1"
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("sign assertion: %v", err)
+	}
+	return url.Values{
+		"client_assertion_type": {ClientAssertionType},
+		"client_assertion":      {s},
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	ctx := context.Background()
+	r := NewClientResolver(NewMemoryStore())
+	meta, key := confidentialClient(t)
+	other, err := atcrypto.GeneratePrivateKeyP256()
+	if err != nil {
+		t.Fatalf("GeneratePrivateKeyP256: %v", err)
+	}
+
+	claims := func(jti string, edit func(*jwt.RegisteredClaims)) jwt.RegisteredClaims {
+		c := jwt.RegisteredClaims{
+			ID:        jti,
+			Issuer:    testClientID,
+			Subject:   testClientID,
+			Audience:  jwt.ClaimStrings{testIssuer},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		}
+		if edit != nil {
+			edit(&c)
+		}
+		return c
+	}
+	valid := assertionForm(t, key, claims("jti-1", nil))
+
+	tests := []struct {
+		name string
+		form url.Values
+		ok   bool
+	}{
+		{"valid", valid, true},
+		{"replayed", valid, false},
+		{"wrong audience", assertionForm(t, key, claims("jti-2", func(c *jwt.RegisteredClaims) {
+			c.Audience = jwt.ClaimStrings{"https://other.example.com"}
+		})), false},
+		{"other issuer", assertionForm(t, key, claims("jti-3", func(c *jwt.RegisteredClaims) {
+			c.Issuer = "https://evil.example.com/client-metadata.json"
+		})), false},
+		{"expired", assertionForm(t, key, claims("jti-4", func(c *jwt.RegisteredClaims) {
+			c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+		})), false},
+		{"no exp", assertionForm(t, key, claims("jti-5", func(c *jwt.RegisteredClaims) {
+			c.ExpiresAt = nil
+		})), false},
+		{"no jti", assertionForm(t, key, claims("", nil)), false},
+		{"unregistered key", assertionForm(t, other, claims("jti-6", nil)), false},
+		{"no assertion", url.Values{}, false},
+		{"wrong assertion type", url.Values{
+			"client_assertion_type": {"urn:example:other"},
+			"client_assertion":      valid["client_assertion"],
+		}, false},
+	}
+	for _, tt := range tests {
+		err := r.Authenticate(ctx, meta, testIssuer, tt.form)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: want error", tt.name)
+		}
+	}
+
+	public := &ClientMetadata{ClientID: testClientID, TokenEndpointAuthMethod: "none"}
+	if err := r.Authenticate(ctx, public, testIssuer, url.Values{}); err != nil {
+		t.Errorf("public client: %v", err)
+	}
+	if err := r.Authenticate(ctx, public, testIssuer, assertionForm(t, key, claims("jti-7", nil))); err == nil {
+		t.Error("public client sending an assertion: want error")
+	}
+}
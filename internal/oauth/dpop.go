@@ -0,0 +1,186 @@
+package oauth
+
+import (
+	"context"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// DPoP proof limits.
+const (
+	// nonceWindow is how long a DPoP nonce is current. A nonce from the
+	// previous window is still accepted.
+	nonceWindow = 3 * time.Minute
+
+	// proofMaxAge is how old a proof's iat may be; proofMaxSkew is how
+	// far in the future.
+	proofMaxAge  = 5 * time.Minute
+	proofMaxSkew = 30 * time.Second
+)
+
+// DPoP verifies DPoP proofs (RFC 9449) and issues the nonces they must
+// carry.
+type DPoP struct {
+	store  *Store
+	secret []byte
+}
+
+// NewDPoP creates a DPoP verifier. Nonces are derived from secret, so
+// every instance sharing it accepts the others' nonces; with no secret a
+// random one is used.
+func NewDPoP(store *Store, secret string) *DPoP {
+	key := make([]byte, 32)
+	if secret != "" {
+		// HKDF-SHA256 can't fail for a 32-byte key.
+		key, _ = hkdf.Key(sha256.New, []byte(secret), nil, "primal-pds dpop nonce", 32)
+	} else {
+		_, _ = rand.Read(key)
+	}
+	return &DPoP{store: store, secret: key}
+}
+
+func (d *DPoP) nonceAt(window int64) string {
+	mac := hmac.New(sha256.New, d.secret)
+	_ = binary.Write(mac, binary.BigEndian, window)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Nonce returns the current nonce, to be sent in the DPoP-Nonce header.
+func (d *DPoP) Nonce() string {
+	return d.nonceAt(time.Now().Unix() / int64(nonceWindow/time.Second))
+}
+
+func (d *DPoP) validNonce(nonce string) bool {
+	w := time.Now().Unix() / int64(nonceWindow/time.Second)
+	return hmac.Equal([]byte(nonce), []byte(d.nonceAt(w))) ||
+		hmac.Equal([]byte(nonce), []byte(d.nonceAt(w-1)))
+}
+
+// dpopClaims are the claims of a DPoP proof.
+type dpopClaims struct {
+	jwt.RegisteredClaims
+	HTM   string `json:"htm"`
+	HTU   string `json:"htu"`
+	Nonce string `json:"nonce,omitempty"`
+	ATH   string `json:"ath,omitempty"`
+}
+
+// VerifyProof checks the DPoP proof sent with a request to method and
+// URL htu and returns the thumbprint of the key that signed it. When
+// the request carries an access token, the proof must be bound to it.
+func (d *DPoP) VerifyProof(ctx context.Context, proof, method, htu, accessToken string) (string, error) {
+	if proof == "" {
+		return "", errorf("invalid_dpop_proof", "DPoP proof is required")
+	}
+
+	var jwk atcrypto.JWK
+	var claims dpopClaims
+	_, err := jwt.ParseWithClaims(proof, &claims, func(t *jwt.Token) (any, error) {
+		if typ, _ := t.Header["typ"].(string); typ != "dpop+jwt" {
+			return nil, fmt.Errorf("typ must be dpop+jwt")
+		}
+		raw, err := json.Marshal(t.Header["jwk"])
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &jwk); err != nil {
+			return nil, fmt.Errorf("invalid jwk: %w", err)
+		}
+		return atcrypto.ParsePublicJWK(jwk)
+	},
+		jwt.WithValidMethods([]string{"ES256", "ES256K"}),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(proofMaxSkew),
+	)
+	if err != nil {
+		return "", errorf("invalid_dpop_proof", "%v", err)
+	}
+
+	switch {
+	case claims.ID == "":
+		return "", errorf("invalid_dpop_proof", "proof must have a jti")
+	case claims.IssuedAt == nil || time.Since(claims.IssuedAt.Time) > proofMaxAge:
+		return "", errorf("invalid_dpop_proof", "proof is too old")
+	case claims.HTM != method:
+		return "", errorf("invalid_dpop_proof", "htm does not match the request")
+	case stripQuery(claims.HTU) != stripQuery(htu):
+		return "", errorf("invalid_dpop_proof", "htu does not match the request")
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		if claims.ATH != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			return "", errorf("invalid_dpop_proof", "ath does not match the access token")
+		}
+	}
+	if !d.validNonce(claims.Nonce) {
+		return "", &Error{
+			Status:      http.StatusBadRequest,
+			Code:        "use_dpop_nonce",
+			Description: "DPoP proof must carry the server nonce",
+		}
+	}
+
+	jkt, err := Thumbprint(jwk)
+	if err != nil {
+		return "", errorf("invalid_dpop_proof", "%v", err)
+	}
+	if err := d.store.UseJTI(ctx, "dpop:"+jkt+":"+claims.ID, claims.IssuedAt.Add(proofMaxAge)); err != nil {
+		if errors.Is(err, ErrReplay) {
+			return "", errorf("invalid_dpop_proof", "proof was replayed")
+		}
+		return "", err
+	}
+	return jkt, nil
+}
+
+// IsNonceError reports whether err asks the client to retry with the
+// nonce from the DPoP-Nonce response header.
+func IsNonceError(err error) bool {
+	var oe *Error
+	return errors.As(err, &oe) && oe.Code == "use_dpop_nonce"
+}
+
+// stripQuery drops the query and fragment of a URL, which htu does not
+// cover.
+func stripQuery(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	u.RawQuery, u.Fragment = "", ""
+	return strings.ToLower(u.Scheme) + "://" + strings.ToLower(u.Host) + u.EscapedPath()
+}
+
+// Thumbprint returns the RFC 7638 thumbprint of an EC public key, which
+// binds tokens to it.
+func Thumbprint(jwk atcrypto.JWK) (string, error) {
+	if jwk.KeyType != "EC" || jwk.Curve == "" || jwk.X == "" || jwk.Y == "" {
+		return "", fmt.Errorf("unsupported jwk")
+	}
+	// The members in lexicographic order, as the RFC requires.
+	canonical, err := json.Marshal(struct {
+		Crv string `json:"crv"`
+		Kty string `json:"kty"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}{jwk.Curve, jwk.KeyType, jwk.X, jwk.Y})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,140 @@
+package oauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const tokenURL = "https://pds.example.com/oauth/token"
+
+// signProof signs a DPoP proof with key, carrying its public key.
+func signProof(t *testing.T, key atcrypto.PrivateKey, claims dpopClaims) string {
+	t.Helper()
+	pub, err := key.PublicKey()
+	if err != nil {
+		t.Fatalf("PublicKey: %v", err)
+	}
+	jwk, err := pub.JWK()
+	if err != nil {
+		t.Fatalf("JWK: %v", err)
+	}
+	token := jwt.NewWithClaims(jwt.GetSigningMethod("ES256"), claims)
+	token.Header["typ"] = "dpop+jwt"
+	token.Header["jwk"] = jwk
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("sign proof: %v", err)
+	}
+	return s
+}
+
+func TestVerifyProof(t *testing.T) {
+	ctx := context.Background()
+	d := NewDPoP(NewMemoryStore(), "secret")
+	key, err := atcrypto.GeneratePrivateKeyP256()
+	if err != nil {
+		t.Fatalf("GeneratePrivateKeyP256: %v", err)
+	}
+	const accessToken = "access-token"
+	sum := sha256.Sum256([]byte(accessToken))
+	ath := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	n := 0
+	claims := func(edit func(*dpopClaims)) dpopClaims {
+		n++
+		c := dpopClaims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:       fmt.Sprintf("jti-%d", n),
+				IssuedAt: jwt.NewNumericDate(time.Now()),
+			},
+			HTM:   "POST",
+			HTU:   tokenURL,
+			Nonce: d.Nonce(),
+		}
+		if edit != nil {
+			edit(&c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name        string
+		claims      dpopClaims
+		accessToken string
+		ok          bool
+	}{
+		{"valid", claims(nil), "", true},
+		{"query ignored", claims(func(c *dpopClaims) { c.HTU = tokenURL + "?x=1" }), "", true},
+		{"bound to the access token", claims(func(c *dpopClaims) { c.ATH = ath }), accessToken, true},
+		{"htm mismatch", claims(func(c *dpopClaims) { c.HTM = "GET" }), "", false},
+		{"htu mismatch", claims(func(c *dpopClaims) { c.HTU = "https://pds.example.com/oauth/par" }), "", false},
+		{"ath mismatch", claims(func(c *dpopClaims) { c.ATH = "wrong" }), accessToken, false},
+		{"ath missing", claims(nil), accessToken, false},
+		{"stale iat", claims(func(c *dpopClaims) { c.IssuedAt = jwt.NewNumericDate(time.Now().Add(-proofMaxAge - time.Minute)) }), "", false},
+		{"future iat", claims(func(c *dpopClaims) { c.IssuedAt = jwt.NewNumericDate(time.Now().Add(time.Hour)) }), "", false},
+		{"no jti", claims(func(c *dpopClaims) { c.ID = "" }), "", false},
+	}
+	for _, tt := range tests {
+		_, err := d.VerifyProof(ctx, signProof(t, key, tt.claims), "POST", tokenURL, tt.accessToken)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: want error", tt.name)
+		}
+	}
+
+	// A nonce the server didn't issue asks the client to retry.
+	wrongNonce := signProof(t, key, claims(func(c *dpopClaims) { c.Nonce = "stale" }))
+	if _, err := d.VerifyProof(ctx, wrongNonce, "POST", tokenURL, ""); !IsNonceError(err) {
+		t.Errorf("wrong nonce: err = %v, want use_dpop_nonce", err)
+	}
+	other := NewDPoP(NewMemoryStore(), "other-secret")
+	if _, err := other.VerifyProof(ctx, signProof(t, key, claims(nil)), "POST", tokenURL, ""); !IsNonceError(err) {
+		t.Errorf("nonce of another secret: err = %v, want use_dpop_nonce", err)
+	}
+}
+
+func TestVerifyProofReplay(t *testing.T) {
+	ctx := context.Background()
+	d := NewDPoP(NewMemoryStore(), "secret")
+	key, err := atcrypto.GeneratePrivateKeyP256()
+	if err != nil {
+		t.Fatalf("GeneratePrivateKeyP256: %v", err)
+	}
+	proof := signProof(t, key, dpopClaims{
+		RegisteredClaims: jwt.RegisteredClaims{ID: "jti", IssuedAt: jwt.NewNumericDate(time.Now())},
+		HTM:              "POST",
+		HTU:              tokenURL,
+		Nonce:            d.Nonce(),
+	})
+
+	jkt, err := d.VerifyProof(ctx, proof, "POST", tokenURL, "")
+	if err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	pub, err := key.PublicKey()
+	if err != nil {
+		t.Fatalf("PublicKey: %v", err)
+	}
+	jwk, err := pub.JWK()
+	if err != nil {
+		t.Fatalf("JWK: %v", err)
+	}
+	if want, _ := Thumbprint(*jwk); jkt != want {
+		t.Errorf("jkt = %s, want %s", jkt, want)
+	}
+	_, err = d.VerifyProof(ctx, proof, "POST", tokenURL, "")
+	var oe *Error
+	if !errors.As(err, &oe) || oe.Code != "invalid_dpop_proof" {
+		t.Errorf("replayed proof: err = %v, want invalid_dpop_proof", err)
+	}
+}
@@ -0,0 +1,146 @@
+// Package oauth implements the building blocks of an OAuth 2.1
+// authorization server following the atproto profile: pushed
+// authorization requests (PAR), PKCE with S256, DPoP-bound tokens and
+// clients identified by the URL of their metadata document.
+//
+// The server package serves the endpoints; sessions and tokens are
+// issued by auth.JWTManager.
+package oauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	indigooauth "github.com/bluesky-social/indigo/atproto/auth/oauth"
+)
+
+// Scopes of the atproto profile. Every client must ask for
+// ScopeAtproto; ScopeGeneric grants the access of an app password, and
+// ScopeChat adds direct messages.
+const (
+	ScopeAtproto = "atproto"
+	ScopeGeneric = "transition:generic"
+	ScopeChat    = "transition:chat.bsky"
+)
+
+// SupportedScopes lists the scopes the server grants.
+var SupportedScopes = []string{ScopeAtproto, ScopeGeneric, ScopeChat}
+
+// Lifetimes of authorization requests and codes.
+const (
+	// RequestTTL is how long a pushed authorization request may wait
+	// for the account holder to sign in.
+	RequestTTL = 5 * time.Minute
+
+	// CodeTTL is how long an authorization code may wait to be
+	// exchanged for tokens.
+	CodeTTL = time.Minute
+)
+
+// Error is an OAuth error response (RFC 6749 section 5.2).
+type Error struct {
+	Status      int    `json:"-"`
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return "oauth: " + e.Code + ": " + e.Description
+}
+
+// errorf returns an Error with status 400.
+func errorf(code, format string, args ...any) *Error {
+	return &Error{Status: http.StatusBadRequest, Code: code, Description: fmt.Sprintf(format, args...)}
+}
+
+// InvalidRequest returns an invalid_request Error.
+func InvalidRequest(format string, args ...any) *Error {
+	return errorf("invalid_request", format, args...)
+}
+
+// InvalidGrant returns an invalid_grant Error, for codes and refresh
+// tokens that can't be used.
+func InvalidGrant(format string, args ...any) *Error {
+	return errorf("invalid_grant", format, args...)
+}
+
+// InvalidClient returns an invalid_client Error.
+func InvalidClient(format string, args ...any) *Error {
+	e := errorf("invalid_client", format, args...)
+	e.Status = http.StatusUnauthorized
+	return e
+}
+
+// ParseScope splits a scope string, and checks that it asks for
+// ScopeAtproto and nothing unsupported or beyond allowed (the client's
+// registered scope).
+func ParseScope(scope, allowed string) ([]string, error) {
+	scopes := strings.Fields(scope)
+	if !slices.Contains(scopes, ScopeAtproto) {
+		return nil, errorf("invalid_scope", "scope must include %q", ScopeAtproto)
+	}
+	allowedScopes := strings.Fields(allowed)
+	for _, sc := range scopes {
+		if !slices.Contains(SupportedScopes, sc) {
+			return nil, errorf("invalid_scope", "unsupported scope %q", sc)
+		}
+		if !slices.Contains(allowedScopes, sc) {
+			return nil, errorf("invalid_scope", "scope %q is not registered by the client", sc)
+		}
+	}
+	return scopes, nil
+}
+
+// VerifyPKCE checks a PKCE code_verifier against the S256 challenge of
+// the authorization request.
+func VerifyPKCE(challenge, verifier string) error {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return InvalidGrant("code_verifier must be 43 to 128 characters")
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) != 1 {
+		return InvalidGrant("code_verifier does not match code_challenge")
+	}
+	return nil
+}
+
+// ServerMetadata returns the authorization server metadata of issuer,
+// served at /.well-known/oauth-authorization-server.
+func ServerMetadata(issuer string) *indigooauth.AuthServerMetadata {
+	return &indigooauth.AuthServerMetadata{
+		Issuer:                                     issuer,
+		AuthorizationEndpoint:                      issuer + "/oauth/authorize",
+		TokenEndpoint:                              issuer + "/oauth/token",
+		PushedAuthorizationRequestEndpoint:         issuer + "/oauth/par",
+		RevocationEndpoint:                         issuer + "/oauth/revoke",
+		ResponseTypesSupported:                     []string{"code"},
+		GrantTypesSupported:                        []string{"authorization_code", "refresh_token"},
+		CodeChallengeMethodsSupported:              []string{"S256"},
+		TokenEndpointAuthMethodsSupoorted:          []string{"none", "private_key_jwt"},
+		TokenEndpointAuthSigningAlgValuesSupported: []string{"ES256", "ES256K"},
+		DPoPSigningAlgValuesSupported:              []string{"ES256", "ES256K"},
+		ScopesSupported:                            SupportedScopes,
+		AuthorizationReponseISSParameterSupported:  true,
+		RequirePushedAuthorizationRequests:         true,
+		ClientIDMetadataDocumentSupported:          true,
+	}
+}
+
+// ResourceMetadata returns the protected resource metadata of a PDS
+// whose accounts authorize at issuer, served at
+// /.well-known/oauth-protected-resource.
+func ResourceMetadata(resource, issuer string) map[string]any {
+	return map[string]any{
+		"resource":                 resource,
+		"authorization_servers":    []string{issuer},
+		"scopes_supported":         SupportedScopes,
+		"bearer_methods_supported": []string{"header"},
+	}
+}
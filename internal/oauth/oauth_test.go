@@ -0,0 +1,37 @@
+package oauth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestVerifyPKCE(t *testing.T) {
+	verifier := strings.Repeat("v", 43)
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	tests := []struct {
+		name      string
+		challenge string
+		verifier  string
+		ok        bool
+	}{
+		{"match", challenge, verifier, true},
+		{"other verifier", challenge, strings.Repeat("w", 43), false},
+		{"plain challenge", verifier, verifier, false},
+		{"too short", challenge, verifier[:42], false},
+		{"too long", challenge, strings.Repeat("v", 129), false},
+		{"empty", challenge, "", false},
+	}
+	for _, tt := range tests {
+		err := VerifyPKCE(tt.challenge, tt.verifier)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: want error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/primal-host/primal-pds/internal/database"
+)
+
+// requestURIPrefix starts every request_uri the server hands out.
+const requestURIPrefix = "urn:ietf:params:oauth:request_uri:"
+
+// prunePeriod is how often Run drops expired requests and proof jtis.
+const prunePeriod = 10 * time.Minute
+
+// ErrReplay is returned by UseJTI for a jti that was seen before.
+var ErrReplay = errors.New("oauth: jti replayed")
+
+// Request is a pushed authorization request. Once the account holder
+// approves it, it names the account and carries the code the client
+// exchanges for tokens.
+type Request struct {
+	ID            string
+	ClientID      string
+	RedirectURI   string
+	Scope         string
+	State         string
+	CodeChallenge string
+	LoginHint     string
+	DPoPJKT       string // thumbprint of the DPoP key used at PAR, if any
+	DID           string
+	Code          string
+	ExpiresAt     time.Time
+}
+
+// RequestURI returns the request_uri naming the request.
+func (r *Request) RequestURI() string {
+	return requestURIPrefix + r.ID
+}
+
+// Store keeps authorization requests and used proof jtis in the
+// management database, or in memory for tests.
+type Store struct {
+	rows requestRows
+}
+
+// NewStore creates a Store.
+func NewStore(db *database.ManagementDB) *Store {
+	return &Store{rows: &dbRequests{db: db}}
+}
+
+// NewMemoryStore creates a Store kept in memory, for tests.
+func NewMemoryStore() *Store {
+	return &Store{rows: &memRequests{
+		requests: make(map[string]*Request),
+		jtis:     make(map[string]time.Time),
+	}}
+}
+
+// requestRows keeps authorization requests and used jtis.
+type requestRows interface {
+	create(ctx context.Context, r *Request) error
+
+	// pending returns the request id if it is neither approved nor
+	// expired, or nil.
+	pending(ctx context.Context, id string) (*Request, error)
+
+	// approve sets the account and code of the pending request id and
+	// reports whether there was one.
+	approve(ctx context.Context, id, did, code string, expiresAt time.Time) (bool, error)
+
+	delete(ctx context.Context, id string) error
+
+	// exchange deletes the request holding code and returns it, or nil
+	// if there is none.
+	exchange(ctx context.Context, code string) (*Request, error)
+
+	// useJTI records jti until expiresAt and reports whether it is new.
+	useJTI(ctx context.Context, jti string, expiresAt time.Time) (bool, error)
+
+	prune(ctx context.Context) error
+}
+
+// randomID returns n random bytes, base64url-encoded.
+func randomID(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// CreateRequest records r, setting its ID and expiry.
+func (s *Store) CreateRequest(ctx context.Context, r *Request) error {
+	r.ID = "req-" + randomID(16)
+	r.ExpiresAt = time.Now().Add(RequestTTL)
+	return s.rows.create(ctx, r)
+}
+
+// PendingRequest returns the request named by requestURI if it is still
+// waiting for the account holder.
+func (s *Store) PendingRequest(ctx context.Context, requestURI, clientID string) (*Request, error) {
+	id, ok := strings.CutPrefix(requestURI, requestURIPrefix)
+	if !ok {
+		return nil, InvalidRequest("invalid request_uri")
+	}
+	r, err := s.rows.pending(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, InvalidRequest("unknown or expired request_uri")
+	}
+	if r.ClientID != clientID {
+		return nil, InvalidRequest("request_uri was issued to another client")
+	}
+	return r, nil
+}
+
+// Approve records that did approved the pending request id and returns
+// the authorization code for it.
+func (s *Store) Approve(ctx context.Context, id, did string) (string, error) {
+	code := "cod-" + randomID(32)
+	ok, err := s.rows.approve(ctx, id, did, code, time.Now().Add(CodeTTL))
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", InvalidRequest("unknown or expired request_uri")
+	}
+	return code, nil
+}
+
+// DeleteRequest drops the request id, e.g. when it is denied.
+func (s *Store) DeleteRequest(ctx context.Context, id string) error {
+	return s.rows.delete(ctx, id)
+}
+
+// ExchangeCode consumes an authorization code and returns its request.
+// A code works once.
+func (s *Store) ExchangeCode(ctx context.Context, code string) (*Request, error) {
+	r, err := s.rows.exchange(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, InvalidGrant("unknown or used authorization code")
+	}
+	if !r.ExpiresAt.After(time.Now()) {
+		return nil, InvalidGrant("authorization code expired")
+	}
+	return r, nil
+}
+
+// UseJTI records the jti of a DPoP proof or client assertion until
+// expiresAt, and returns ErrReplay if it was recorded before.
+func (s *Store) UseJTI(ctx context.Context, jti string, expiresAt time.Time) error {
+	fresh, err := s.rows.useJTI(ctx, jti, expiresAt)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return ErrReplay
+	}
+	return nil
+}
+
+// Run prunes expired requests and jtis periodically until ctx is
+// cancelled.
+func (s *Store) Run(ctx context.Context) {
+	ticker := time.NewTicker(prunePeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.Prune(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+}
+
+// Prune drops expired requests and jtis.
+func (s *Store) Prune(ctx context.Context) error {
+	return s.rows.prune(ctx)
+}
+
+// dbRequests keeps requests and jtis in the management database's
+// oauth_requests and oauth_jtis tables.
+type dbRequests struct {
+	db *database.ManagementDB
+}
+
+const requestColumns = `id, client_id, redirect_uri, scope, state, code_challenge, login_hint, dpop_jkt, did, COALESCE(code, ''), expires_at`
+
+func scanRequest(row pgx.Row) (*Request, error) {
+	var r Request
+	err := row.Scan(&r.ID, &r.ClientID, &r.RedirectURI, &r.Scope, &r.State,
+		&r.CodeChallenge, &r.LoginHint, &r.DPoPJKT, &r.DID, &r.Code, &r.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (d *dbRequests) create(ctx context.Context, r *Request) error {
+	_, err := d.db.Pool.Exec(ctx,
+		`INSERT INTO oauth_requests
+		 (id, client_id, redirect_uri, scope, state, code_challenge, login_hint, dpop_jkt, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		r.ID, r.ClientID, r.RedirectURI, r.Scope, r.State, r.CodeChallenge, r.LoginHint, r.DPoPJKT, r.ExpiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("oauth: create request: %w", err)
+	}
+	return nil
+}
+
+func (d *dbRequests) pending(ctx context.Context, id string) (*Request, error) {
+	r, err := scanRequest(d.db.Pool.QueryRow(ctx,
+		`SELECT `+requestColumns+` FROM oauth_requests
+		 WHERE id = $1 AND code IS NULL AND expires_at > NOW()`,
+		id,
+	))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("oauth: get request: %w", err)
+	}
+	return r, nil
+}
+
+func (d *dbRequests) approve(ctx context.Context, id, did, code string, expiresAt time.Time) (bool, error) {
+	tag, err := d.db.Pool.Exec(ctx,
+		`UPDATE oauth_requests SET did = $2, code = $3, expires_at = $4
+		 WHERE id = $1 AND code IS NULL AND expires_at > NOW()`,
+		id, did, code, expiresAt,
+	)
+	if err != nil {
+		return false, fmt.Errorf("oauth: approve request: %w", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (d *dbRequests) delete(ctx context.Context, id string) error {
+	if _, err := d.db.Pool.Exec(ctx, `DELETE FROM oauth_requests WHERE id = $1`, id); err != nil {
+		return fmt.Errorf("oauth: delete request: %w", err)
+	}
+	return nil
+}
+
+func (d *dbRequests) exchange(ctx context.Context, code string) (*Request, error) {
+	r, err := scanRequest(d.db.Pool.QueryRow(ctx,
+		`DELETE FROM oauth_requests WHERE code = $1 RETURNING `+requestColumns,
+		code,
+	))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("oauth: exchange code: %w", err)
+	}
+	return r, nil
+}
+
+func (d *dbRequests) useJTI(ctx context.Context, jti string, expiresAt time.Time) (bool, error) {
+	tag, err := d.db.Pool.Exec(ctx,
+		`INSERT INTO oauth_jtis (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING`,
+		jti, expiresAt,
+	)
+	if err != nil {
+		return false, fmt.Errorf("oauth: record jti: %w", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (d *dbRequests) prune(ctx context.Context) error {
+	if _, err := d.db.Pool.Exec(ctx, `DELETE FROM oauth_requests WHERE expires_at <= NOW()`); err != nil {
+		return fmt.Errorf("oauth: prune requests: %w", err)
+	}
+	if _, err := d.db.Pool.Exec(ctx, `DELETE FROM oauth_jtis WHERE expires_at <= NOW()`); err != nil {
+		return fmt.Errorf("oauth: prune jtis: %w", err)
+	}
+	return nil
+}
+
+// memRequests keeps requests and jtis in memory.
+type memRequests struct {
+	mu       sync.Mutex
+	requests map[string]*Request
+	jtis     map[string]time.Time
+}
+
+func (m *memRequests) create(ctx context.Context, r *Request) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := *r
+	m.requests[r.ID] = &stored
+	return nil
+}
+
+func (m *memRequests) pending(ctx context.Context, id string) (*Request, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.requests[id]
+	if !ok || r.Code != "" || !r.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	out := *r
+	return &out, nil
+}
+
+func (m *memRequests) approve(ctx context.Context, id, did, code string, expiresAt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.requests[id]
+	if !ok || r.Code != "" || !r.ExpiresAt.After(time.Now()) {
+		return false, nil
+	}
+	r.DID, r.Code, r.ExpiresAt = did, code, expiresAt
+	return true, nil
+}
+
+func (m *memRequests) delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.requests, id)
+	return nil
+}
+
+func (m *memRequests) exchange(ctx context.Context, code string) (*Request, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, r := range m.requests {
+		if r.Code != "" && r.Code == code {
+			delete(m.requests, id)
+			return r, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *memRequests) useJTI(ctx context.Context, jti string, expiresAt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.jtis[jti]; ok {
+		return false, nil
+	}
+	m.jtis[jti] = expiresAt
+	return true, nil
+}
+
+func (m *memRequests) prune(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for id, r := range m.requests {
+		if !r.ExpiresAt.After(now) {
+			delete(m.requests, id)
+		}
+	}
+	for jti, exp := range m.jtis {
+		if !exp.After(now) {
+			delete(m.jtis, jti)
+		}
+	}
+	return nil
+}
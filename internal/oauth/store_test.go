@@ -0,0 +1,64 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestExchangeCode(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	r := &Request{ClientID: testClientID, RedirectURI: "https://app.example.com/callback", Scope: ScopeAtproto}
+	if err := s.CreateRequest(ctx, r); err != nil {
+		t.Fatalf("CreateRequest: %v", err)
+	}
+
+	if _, err := s.PendingRequest(ctx, r.RequestURI(), "https://other.example.com/client-metadata.json"); err == nil {
+		t.Error("PendingRequest for another client: want error")
+	}
+	if _, err := s.PendingRequest(ctx, r.RequestURI(), testClientID); err != nil {
+		t.Fatalf("PendingRequest: %v", err)
+	}
+	code, err := s.Approve(ctx, r.ID, "did:plc:ewvi7nxzyoun6zhxrhs64oiz")
+	if err != nil {
+		t.Fatalf("Approve: %v", err)
+	}
+	if _, err := s.PendingRequest(ctx, r.RequestURI(), testClientID); err == nil {
+		t.Error("PendingRequest after approval: want error")
+	}
+	if _, err := s.Approve(ctx, r.ID, "did:plc:ewvi7nxzyoun6zhxrhs64oiz"); err == nil {
+		t.Error("second Approve: want error")
+	}
+
+	got, err := s.ExchangeCode(ctx, code)
+	if err != nil {
+		t.Fatalf("ExchangeCode: %v", err)
+	}
+	if got.ID != r.ID || got.DID != "did:plc:ewvi7nxzyoun6zhxrhs64oiz" {
+		t.Errorf("ExchangeCode = %+v, want request %s approved by the account", got, r.ID)
+	}
+	var oe *Error
+	if _, err := s.ExchangeCode(ctx, code); !errors.As(err, &oe) || oe.Code != "invalid_grant" {
+		t.Errorf("second ExchangeCode: err = %v, want invalid_grant", err)
+	}
+	if _, err := s.ExchangeCode(ctx, ""); err == nil {
+		t.Error("ExchangeCode of no code: want error")
+	}
+}
+
+func TestUseJTI(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	exp := time.Now().Add(time.Minute)
+	if err := s.UseJTI(ctx, "jti", exp); err != nil {
+		t.Fatalf("UseJTI: %v", err)
+	}
+	if err := s.UseJTI(ctx, "jti", exp); !errors.Is(err, ErrReplay) {
+		t.Errorf("second UseJTI: err = %v, want ErrReplay", err)
+	}
+	if err := s.UseJTI(ctx, "other", exp); err != nil {
+		t.Errorf("UseJTI of another jti: %v", err)
+	}
+}
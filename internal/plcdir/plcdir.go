@@ -0,0 +1,480 @@
+// Package plcdir is an embedded did:plc directory: a stand-in for
+// plc.directory that runs inside the PDS for staging networks and tests
+// that can't reach the real one.
+//
+// It accepts plc_operation and plc_tombstone operations, checks their
+// signatures and chaining the way the public directory does (including
+// recovery: a higher-priority rotation key may override operations made
+// in the last 72 hours), and serves DID documents, operation logs and
+// audit logs over the same HTTP API, so the PDS can be pointed at it
+// through plcEndpoint. Operations are kept in the management database,
+// or in memory for tests.
+package plcdir
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/jackc/pgx/v5"
+	"github.com/primal-host/primal-pds/internal/account"
+	"github.com/primal-host/primal-pds/internal/database"
+)
+
+// Directory limits.
+const (
+	// MaxOperationBytes is the largest operation body accepted.
+	MaxOperationBytes = 4000
+
+	// RecoveryWindow is how long after an operation a higher-priority
+	// rotation key may still override it.
+	RecoveryWindow = 72 * time.Hour
+
+	maxRotationKeys        = 5
+	maxVerificationMethods = 10
+)
+
+// Sentinel errors for the directory.
+var (
+	ErrNotFound   = errors.New("plcdir: DID not registered")
+	ErrTombstoned = errors.New("plcdir: DID tombstoned")
+	ErrInvalid    = errors.New("plcdir: invalid operation")
+)
+
+// Entry is one operation in a DID's log.
+type Entry struct {
+	DID       string          `json:"did"`
+	Operation json.RawMessage `json:"operation"`
+	CID       string          `json:"cid"`
+	Nullified bool            `json:"nullified"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+// Data is the current state of a DID, as published by its latest
+// operation.
+type Data struct {
+	DID                 string                         `json:"did"`
+	VerificationMethods map[string]string              `json:"verificationMethods"`
+	RotationKeys        []string                       `json:"rotationKeys"`
+	AlsoKnownAs         []string                       `json:"alsoKnownAs"`
+	Services            map[string]account.PLCEndpoint `json:"services"`
+}
+
+// Store holds the directory's operation logs.
+type Store struct {
+	logs logs
+}
+
+// NewStore creates a directory Store kept in the management DB.
+func NewStore(db *database.ManagementDB) *Store {
+	return &Store{logs: &dbLogs{db: db}}
+}
+
+// NewMemoryStore creates a directory Store kept in memory, for tests
+// that need a PLC directory.
+func NewMemoryStore() *Store {
+	return &Store{logs: &memLogs{entries: make(map[string][]Entry)}}
+}
+
+// logs keeps the operation logs of every DID.
+type logs interface {
+	// auditLog returns every entry of did's log, oldest first.
+	auditLog(ctx context.Context, did string) ([]Entry, error)
+
+	// update calls apply with did's log while holding off other updates
+	// for did, then marks the entries with the CIDs apply returns as
+	// nullified and appends the entry it returns, if any.
+	update(ctx context.Context, did string, apply func([]Entry) (*Entry, []string, error)) error
+}
+
+// AuditLog returns every operation submitted for did, nullified ones
+// included, oldest first. Returns ErrNotFound if there are none.
+func (s *Store) AuditLog(ctx context.Context, did string) ([]Entry, error) {
+	entries, err := s.logs.auditLog(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, ErrNotFound
+	}
+	return entries, nil
+}
+
+// Log returns the operations in effect for did, oldest first.
+func (s *Store) Log(ctx context.Context, did string) ([]Entry, error) {
+	entries, err := s.AuditLog(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+	return active(entries), nil
+}
+
+// Last returns the latest operation in effect for did.
+func (s *Store) Last(ctx context.Context, did string) (*Entry, error) {
+	entries, err := s.Log(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+	return &entries[len(entries)-1], nil
+}
+
+// Data returns the current state of did. Returns ErrTombstoned if its
+// latest operation is a tombstone.
+func (s *Store) Data(ctx context.Context, did string) (*Data, error) {
+	last, err := s.Last(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+	op, err := decode(last.Operation)
+	if err != nil {
+		return nil, err
+	}
+	if op.Type == account.PLCOpTypeTombstone {
+		return nil, ErrTombstoned
+	}
+	return &Data{
+		DID:                 did,
+		VerificationMethods: op.VerificationMethods,
+		RotationKeys:        op.RotationKeys,
+		AlsoKnownAs:         op.AlsoKnownAs,
+		Services:            op.Services,
+	}, nil
+}
+
+// Document returns the DID document of did.
+func (s *Store) Document(ctx context.Context, did string) (*account.DIDDocument, error) {
+	data, err := s.Data(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+	doc := &account.DIDDocument{
+		Context: []string{
+			"https://www.w3.org/ns/did/v1",
+			"https://w3id.org/security/multikey/v1",
+			"https://w3id.org/security/suites/secp256k1-2019/v1",
+		},
+		ID:                 did,
+		AlsoKnownAs:        data.AlsoKnownAs,
+		VerificationMethod: []account.VerificationMethod{},
+		Service:            []account.Service{},
+	}
+	if doc.AlsoKnownAs == nil {
+		doc.AlsoKnownAs = []string{}
+	}
+	for _, id := range sortedKeys(data.VerificationMethods) {
+		doc.VerificationMethod = append(doc.VerificationMethod, account.VerificationMethod{
+			ID:                 did + "#" + id,
+			Type:               "Multikey",
+			Controller:         did,
+			PublicKeyMultibase: strings.TrimPrefix(data.VerificationMethods[id], "did:key:"),
+		})
+	}
+	for _, id := range sortedKeys(data.Services) {
+		svc := data.Services[id]
+		doc.Service = append(doc.Service, account.Service{
+			ID:              "#" + id,
+			Type:            svc.Type,
+			ServiceEndpoint: svc.Endpoint,
+		})
+	}
+	return doc, nil
+}
+
+// Submit validates a signed operation (its JSON form) for did and adds
+// it to the DID's log. A genesis operation must derive did and be
+// signed by one of its own rotation keys; any later operation must be
+// signed by a rotation key of the operation it follows. An operation
+// that follows one that is no longer the latest is a recovery: it
+// nullifies the operations after its prev if it is signed by a
+// higher-priority key than the first of them and that one is recent
+// enough. Submitting an operation already in effect is a no-op.
+func (s *Store) Submit(ctx context.Context, did string, body []byte) error {
+	if len(body) > MaxOperationBytes {
+		return fmt.Errorf("%w: operation exceeds %d bytes", ErrInvalid, MaxOperationBytes)
+	}
+	op, err := decode(body)
+	if err != nil {
+		return err
+	}
+	if err := validate(op); err != nil {
+		return err
+	}
+	cid, err := account.PLCOperationCID(op)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+
+	opJSON, err := json.Marshal(op)
+	if err != nil {
+		return fmt.Errorf("plcdir: marshal operation: %w", err)
+	}
+	return s.logs.update(ctx, did, func(entries []Entry) (*Entry, []string, error) {
+		nullify, err := chain(did, op, cid, entries)
+		if errors.Is(err, errInEffect) {
+			return nil, nil, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return &Entry{DID: did, Operation: opJSON, CID: cid, CreatedAt: time.Now()}, nullify, nil
+	})
+}
+
+// errInEffect is returned by chain for an operation already in effect.
+var errInEffect = errors.New("plcdir: operation already in effect")
+
+// chain checks that op, whose CID is cid, can follow the audit log
+// entries of did, and returns the CIDs of the operations it nullifies.
+func chain(did string, op *account.PLCOperation, cid string, entries []Entry) ([]string, error) {
+	ops := active(entries)
+	if indexOf(ops, cid) >= 0 {
+		return nil, errInEffect
+	}
+
+	if op.Prev == nil {
+		if len(entries) > 0 {
+			return nil, fmt.Errorf("%w: %s is already registered", ErrInvalid, did)
+		}
+		if op.Type != account.PLCOpTypeOperation {
+			return nil, fmt.Errorf("%w: genesis operation must be a %s", ErrInvalid, account.PLCOpTypeOperation)
+		}
+		if account.PLCSigner(op, op.RotationKeys) < 0 {
+			return nil, fmt.Errorf("%w: genesis operation is not signed by one of its rotation keys", ErrInvalid)
+		}
+		derived, err := account.PLCDIDFromGenesis(op)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+		if derived != did {
+			return nil, fmt.Errorf("%w: genesis operation is for %s, not %s", ErrInvalid, derived, did)
+		}
+		return nil, nil
+	}
+
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, did)
+	}
+	i := indexOf(ops, *op.Prev)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: prev %s is not an operation in effect for %s", ErrInvalid, *op.Prev, did)
+	}
+	prev, err := decode(ops[i].Operation)
+	if err != nil {
+		return nil, err
+	}
+	if prev.Type == account.PLCOpTypeTombstone {
+		return nil, fmt.Errorf("%w: %s", ErrTombstoned, did)
+	}
+	signer := account.PLCSigner(op, prev.RotationKeys)
+	if signer < 0 {
+		return nil, fmt.Errorf("%w: operation is not signed by a rotation key of its prev", ErrInvalid)
+	}
+	if i == len(ops)-1 {
+		return nil, nil
+	}
+
+	first := ops[i+1]
+	if time.Since(first.CreatedAt) > RecoveryWindow {
+		return nil, fmt.Errorf("%w: operation %s is past the recovery window", ErrInvalid, first.CID)
+	}
+	firstOp, err := decode(first.Operation)
+	if err != nil {
+		return nil, err
+	}
+	if firstSigner := account.PLCSigner(firstOp, prev.RotationKeys); signer >= firstSigner {
+		return nil, fmt.Errorf("%w: recovery must be signed by a higher-priority rotation key than %s", ErrInvalid, first.CID)
+	}
+	var nullify []string
+	for _, e := range ops[i+1:] {
+		nullify = append(nullify, e.CID)
+	}
+	return nullify, nil
+}
+
+// dbLogs keeps the logs in the management DB's plc_directory table.
+type dbLogs struct {
+	db *database.ManagementDB
+}
+
+func (l *dbLogs) auditLog(ctx context.Context, did string) ([]Entry, error) {
+	return auditLog(ctx, l.db.Pool, did)
+}
+
+func (l *dbLogs) update(ctx context.Context, did string, apply func([]Entry) (*Entry, []string, error)) error {
+	tx, err := l.db.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("plcdir: submit begin: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Serialize submissions per DID so two operations can't both chain
+	// to the same latest one.
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, did); err != nil {
+		return fmt.Errorf("plcdir: submit lock: %w", err)
+	}
+	entries, err := auditLog(ctx, tx, did)
+	if err != nil {
+		return err
+	}
+	add, nullify, err := apply(entries)
+	if err != nil {
+		return err
+	}
+
+	if len(nullify) > 0 {
+		_, err := tx.Exec(ctx, `UPDATE plc_directory SET nullified = TRUE WHERE cid = ANY($1)`, nullify)
+		if err != nil {
+			return fmt.Errorf("plcdir: nullify: %w", err)
+		}
+	}
+	if add != nil {
+		_, err = tx.Exec(ctx,
+			`INSERT INTO plc_directory (did, cid, operation) VALUES ($1, $2, $3)`,
+			did, add.CID, add.Operation,
+		)
+		if err != nil {
+			return fmt.Errorf("plcdir: insert %s: %w", add.CID, err)
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("plcdir: submit commit: %w", err)
+	}
+	return nil
+}
+
+// memLogs keeps the logs in memory.
+type memLogs struct {
+	mu      sync.Mutex
+	entries map[string][]Entry
+}
+
+func (l *memLogs) auditLog(ctx context.Context, did string) ([]Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.entries[did]), nil
+}
+
+func (l *memLogs) update(ctx context.Context, did string, apply func([]Entry) (*Entry, []string, error)) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := l.entries[did]
+	add, nullify, err := apply(slices.Clone(entries))
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		if slices.Contains(nullify, entries[i].CID) {
+			entries[i].Nullified = true
+		}
+	}
+	if add != nil {
+		entries = append(entries, *add)
+	}
+	l.entries[did] = entries
+	return nil
+}
+
+// querier is satisfied by both a pool and a transaction.
+type querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+func auditLog(ctx context.Context, q querier, did string) ([]Entry, error) {
+	rows, err := q.Query(ctx,
+		`SELECT did, operation, cid, nullified, created_at
+		 FROM plc_directory WHERE did = $1 ORDER BY seq`, did)
+	if err != nil {
+		return nil, fmt.Errorf("plcdir: log %s: %w", did, err)
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		var e Entry
+		if err := rows.Scan(&e.DID, &e.Operation, &e.CID, &e.Nullified, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("plcdir: log scan: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("plcdir: log %s: %w", did, err)
+	}
+	return entries, nil
+}
+
+// active returns the entries that are not nullified.
+func active(entries []Entry) []Entry {
+	var out []Entry
+	for _, e := range entries {
+		if !e.Nullified {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func indexOf(entries []Entry, cid string) int {
+	for i, e := range entries {
+		if e.CID == cid {
+			return i
+		}
+	}
+	return -1
+}
+
+func decode(body []byte) (*account.PLCOperation, error) {
+	var op account.PLCOperation
+	if err := json.Unmarshal(body, &op); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	return &op, nil
+}
+
+// validate checks the shape of an operation; signatures and chaining
+// are checked against the DID's log by Submit.
+func validate(op *account.PLCOperation) error {
+	if op.Sig == "" {
+		return fmt.Errorf("%w: operation is not signed", ErrInvalid)
+	}
+	switch op.Type {
+	case account.PLCOpTypeTombstone:
+		if op.Prev == nil {
+			return fmt.Errorf("%w: tombstone must have a prev", ErrInvalid)
+		}
+		return nil
+	case account.PLCOpTypeOperation:
+	default:
+		return fmt.Errorf("%w: unsupported operation type %q", ErrInvalid, op.Type)
+	}
+
+	if len(op.RotationKeys) == 0 || len(op.RotationKeys) > maxRotationKeys {
+		return fmt.Errorf("%w: must have 1 to %d rotation keys", ErrInvalid, maxRotationKeys)
+	}
+	for _, k := range op.RotationKeys {
+		if _, err := atcrypto.ParsePublicDIDKey(k); err != nil {
+			return fmt.Errorf("%w: rotation key %q: %v", ErrInvalid, k, err)
+		}
+	}
+	if len(op.VerificationMethods) > maxVerificationMethods {
+		return fmt.Errorf("%w: at most %d verification methods", ErrInvalid, maxVerificationMethods)
+	}
+	for id, k := range op.VerificationMethods {
+		if _, err := atcrypto.ParsePublicDIDKey(k); err != nil {
+			return fmt.Errorf("%w: verification method %s: %v", ErrInvalid, id, err)
+		}
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of m in order, so documents are stable.
+func sortedKeys[V any](m map[string]V) []string {
+	return slices.Sorted(maps.Keys(m))
+}
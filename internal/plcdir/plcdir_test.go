@@ -0,0 +1,281 @@
+package plcdir
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/primal-host/primal-pds/internal/account"
+	"github.com/primal-host/primal-pds/internal/repo"
+)
+
+func newKey(t *testing.T) string {
+	t.Helper()
+	key, err := repo.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	return key
+}
+
+func didKey(t *testing.T, key string) string {
+	t.Helper()
+	k, err := account.SigningDIDKey(key)
+	if err != nil {
+		t.Fatalf("SigningDIDKey: %v", err)
+	}
+	return k
+}
+
+// testDirectory serves a memory Store over HTTP.
+func testDirectory(t *testing.T) (*Store, *httptest.Server) {
+	t.Helper()
+	store := NewMemoryStore()
+	srv := httptest.NewServer(NewServer(store))
+	t.Cleanup(srv.Close)
+	return store, srv
+}
+
+func post(t *testing.T, srv *httptest.Server, did string, op *account.PLCOperation) int {
+	t.Helper()
+	body, err := json.Marshal(op)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	resp, err := http.Post(srv.URL+"/"+did, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST %s: %v", did, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func get(t *testing.T, srv *httptest.Server, path string, v any) int {
+	t.Helper()
+	resp, err := http.Get(srv.URL + path)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("GET %s: decode: %v", path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func sign(t *testing.T, op *account.PLCOperation, key string) *account.PLCOperation {
+	t.Helper()
+	sig, err := account.SignPLCOperation(op, key)
+	if err != nil {
+		t.Fatalf("SignPLCOperation: %v", err)
+	}
+	op.Sig = sig
+	return op
+}
+
+func cidOf(t *testing.T, op *account.PLCOperation) string {
+	t.Helper()
+	cid, err := account.PLCOperationCID(op)
+	if err != nil {
+		t.Fatalf("PLCOperationCID: %v", err)
+	}
+	return cid
+}
+
+func TestCreateUpdateTombstone(t *testing.T) {
+	_, srv := testDirectory(t)
+	rotation, signing := newKey(t), newKey(t)
+	did, genesis, err := account.GeneratePLCDID(signing, rotation, "", "alice.example.com", "https://pds.example.com")
+	if err != nil {
+		t.Fatalf("GeneratePLCDID: %v", err)
+	}
+
+	if code := get(t, srv, "/"+did, nil); code != http.StatusNotFound {
+		t.Fatalf("unregistered document: status %d, want 404", code)
+	}
+	if code := post(t, srv, did, genesis); code != http.StatusOK {
+		t.Fatalf("genesis: status %d", code)
+	}
+	if code := post(t, srv, did, genesis); code != http.StatusOK {
+		t.Fatalf("genesis again: status %d, want a no-op", code)
+	}
+
+	var doc account.DIDDocument
+	if code := get(t, srv, "/"+did, &doc); code != http.StatusOK {
+		t.Fatalf("document: status %d", code)
+	}
+	if doc.ID != did || len(doc.AlsoKnownAs) != 1 || doc.AlsoKnownAs[0] != "at://alice.example.com" {
+		t.Errorf("document = %+v", doc)
+	}
+
+	update := account.NextPLCOperation(genesis, cidOf(t, genesis))
+	update.AlsoKnownAs = []string{"at://bob.example.com"}
+	sign(t, update, rotation)
+	if code := post(t, srv, did, update); code != http.StatusOK {
+		t.Fatalf("update: status %d", code)
+	}
+
+	var data Data
+	if code := get(t, srv, "/"+did+"/data", &data); code != http.StatusOK {
+		t.Fatalf("data: status %d", code)
+	}
+	if len(data.AlsoKnownAs) != 1 || data.AlsoKnownAs[0] != "at://bob.example.com" {
+		t.Errorf("data alsoKnownAs = %v", data.AlsoKnownAs)
+	}
+	var last account.PLCOperation
+	if code := get(t, srv, "/"+did+"/log/last", &last); code != http.StatusOK {
+		t.Fatalf("last: status %d", code)
+	}
+	if cidOf(t, &last) != cidOf(t, update) {
+		t.Errorf("last operation is not the update")
+	}
+
+	tombstone := sign(t, account.NewPLCTombstone(cidOf(t, update)), rotation)
+	if code := post(t, srv, did, tombstone); code != http.StatusOK {
+		t.Fatalf("tombstone: status %d", code)
+	}
+	if code := get(t, srv, "/"+did, nil); code != http.StatusGone {
+		t.Errorf("tombstoned document: status %d, want 410", code)
+	}
+	after := account.NextPLCOperation(update, cidOf(t, tombstone))
+	if code := post(t, srv, did, sign(t, after, rotation)); code != http.StatusBadRequest {
+		t.Errorf("operation after tombstone: status %d, want 400", code)
+	}
+
+	var ops []json.RawMessage
+	if code := get(t, srv, "/"+did+"/log", &ops); code != http.StatusOK {
+		t.Fatalf("log: status %d", code)
+	}
+	if len(ops) != 3 {
+		t.Errorf("log has %d operations, want 3", len(ops))
+	}
+	var audit []Entry
+	if code := get(t, srv, "/"+did+"/log/audit", &audit); code != http.StatusOK {
+		t.Fatalf("audit log: status %d", code)
+	}
+	want := []string{cidOf(t, genesis), cidOf(t, update), cidOf(t, tombstone)}
+	if len(audit) != len(want) {
+		t.Fatalf("audit log has %d entries, want %d", len(audit), len(want))
+	}
+	for i, e := range audit {
+		if e.CID != want[i] || e.Nullified || e.DID != did {
+			t.Errorf("audit entry %d = %+v, want cid %s", i, e, want[i])
+		}
+	}
+}
+
+func TestSubmitRejects(t *testing.T) {
+	_, srv := testDirectory(t)
+	rotation, signing, other := newKey(t), newKey(t), newKey(t)
+	did, genesis, err := account.GeneratePLCDID(signing, rotation, "", "alice.example.com", "https://pds.example.com")
+	if err != nil {
+		t.Fatalf("GeneratePLCDID: %v", err)
+	}
+	otherDID, _, err := account.GeneratePLCDID(signing, other, "", "alice.example.com", "https://pds.example.com")
+	if err != nil {
+		t.Fatalf("GeneratePLCDID: %v", err)
+	}
+
+	if code := post(t, srv, otherDID, genesis); code != http.StatusBadRequest {
+		t.Errorf("genesis for another DID: status %d, want 400", code)
+	}
+	update := account.NextPLCOperation(genesis, cidOf(t, genesis))
+	if code := post(t, srv, did, sign(t, update, rotation)); code != http.StatusNotFound {
+		t.Errorf("update before genesis: status %d, want 404", code)
+	}
+	if code := post(t, srv, did, genesis); code != http.StatusOK {
+		t.Fatalf("genesis: status %d", code)
+	}
+
+	update = account.NextPLCOperation(genesis, cidOf(t, genesis))
+	update.AlsoKnownAs = []string{"at://bob.example.com"}
+	if code := post(t, srv, did, sign(t, update, other)); code != http.StatusBadRequest {
+		t.Errorf("update signed by a stranger: status %d, want 400", code)
+	}
+	unsigned := account.NextPLCOperation(genesis, cidOf(t, genesis))
+	if code := post(t, srv, did, unsigned); code != http.StatusBadRequest {
+		t.Errorf("unsigned update: status %d, want 400", code)
+	}
+	if code := get(t, srv, "/did:web:example.com", nil); code != http.StatusBadRequest {
+		t.Errorf("did:web: status %d, want 400", code)
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	store, srv := testDirectory(t)
+	recovery, rotation, signing := newKey(t), newKey(t), newKey(t)
+	did, genesis, err := account.GeneratePLCDID(signing, rotation, didKey(t, recovery), "alice.example.com", "https://pds.example.com")
+	if err != nil {
+		t.Fatalf("GeneratePLCDID: %v", err)
+	}
+	if code := post(t, srv, did, genesis); code != http.StatusOK {
+		t.Fatalf("genesis: status %d", code)
+	}
+	genesisCID := cidOf(t, genesis)
+
+	hijack := account.NextPLCOperation(genesis, genesisCID)
+	hijack.AlsoKnownAs = []string{"at://mallory.example.com"}
+	if code := post(t, srv, did, sign(t, hijack, rotation)); code != http.StatusOK {
+		t.Fatalf("hijack: status %d", code)
+	}
+
+	// The lower-priority key can't fork the log itself.
+	fork := account.NextPLCOperation(genesis, genesisCID)
+	fork.AlsoKnownAs = []string{"at://fork.example.com"}
+	if code := post(t, srv, did, sign(t, fork, rotation)); code != http.StatusBadRequest {
+		t.Errorf("fork by the same key: status %d, want 400", code)
+	}
+
+	recovered := account.NextPLCOperation(genesis, genesisCID)
+	recovered.AlsoKnownAs = []string{"at://alice.example.com"}
+	recovered.RotationKeys = []string{didKey(t, recovery)}
+	if code := post(t, srv, did, sign(t, recovered, recovery)); code != http.StatusOK {
+		t.Fatalf("recovery: status %d", code)
+	}
+
+	audit, err := store.AuditLog(t.Context(), did)
+	if err != nil {
+		t.Fatalf("AuditLog: %v", err)
+	}
+	if len(audit) != 3 || audit[0].Nullified || !audit[1].Nullified || audit[2].Nullified {
+		t.Fatalf("audit log nullification = %+v", audit)
+	}
+	effective, err := store.Log(t.Context(), did)
+	if err != nil {
+		t.Fatalf("Log: %v", err)
+	}
+	if len(effective) != 2 || effective[1].CID != cidOf(t, recovered) {
+		t.Errorf("log after recovery = %+v", effective)
+	}
+}
+
+func TestRecoveryWindow(t *testing.T) {
+	store, srv := testDirectory(t)
+	recovery, rotation, signing := newKey(t), newKey(t), newKey(t)
+	did, genesis, err := account.GeneratePLCDID(signing, rotation, didKey(t, recovery), "alice.example.com", "https://pds.example.com")
+	if err != nil {
+		t.Fatalf("GeneratePLCDID: %v", err)
+	}
+	if code := post(t, srv, did, genesis); code != http.StatusOK {
+		t.Fatalf("genesis: status %d", code)
+	}
+	genesisCID := cidOf(t, genesis)
+	hijack := account.NextPLCOperation(genesis, genesisCID)
+	hijack.AlsoKnownAs = []string{"at://mallory.example.com"}
+	if code := post(t, srv, did, sign(t, hijack, rotation)); code != http.StatusOK {
+		t.Fatalf("hijack: status %d", code)
+	}
+
+	logs := store.logs.(*memLogs)
+	logs.entries[did][1].CreatedAt = time.Now().Add(-RecoveryWindow - time.Minute)
+
+	recovered := account.NextPLCOperation(genesis, genesisCID)
+	if code := post(t, srv, did, sign(t, recovered, recovery)); code != http.StatusBadRequest {
+		t.Errorf("recovery past the window: status %d, want 400", code)
+	}
+}
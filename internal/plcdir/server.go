@@ -0,0 +1,186 @@
+package plcdir
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// Server serves a Store over the PLC directory HTTP API:
+//
+//	GET  /{did}               DID document
+//	GET  /{did}/data          current rotation keys, methods, handles, services
+//	GET  /{did}/log           operations in effect
+//	GET  /{did}/log/last      latest operation
+//	GET  /{did}/log/audit     all operations, with CIDs and nullification
+//	POST /{did}               submit a signed operation
+type Server struct {
+	store *Store
+	echo  *echo.Echo
+}
+
+// NewServer creates a Server for store.
+func NewServer(store *Store) *Server {
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	e.Use(middleware.Recover())
+
+	s := &Server{store: store, echo: e}
+	e.GET("/_health", s.handleHealth)
+	e.GET("/:did", s.handleDocument)
+	e.GET("/:did/data", s.handleData)
+	e.GET("/:did/log", s.handleLog)
+	e.GET("/:did/log/last", s.handleLast)
+	e.GET("/:did/log/audit", s.handleAuditLog)
+	e.POST("/:did", s.handleSubmit)
+	return s
+}
+
+// ServeHTTP serves the directory API, for running it under another
+// listener such as an httptest server.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.echo.ServeHTTP(w, r)
+}
+
+// Start runs the directory on addr until ctx is cancelled.
+func (s *Server) Start(ctx context.Context, addr string) error {
+	errCh := make(chan error, 1)
+	go func() {
+		log.Printf("PLC directory listening on %s", addr)
+		if err := s.echo.Start(addr); err != nil && err != http.ErrServerClosed {
+			errCh <- err
+		}
+		close(errCh)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return s.echo.Shutdown(context.Background())
+	}
+}
+
+func (s *Server) handleHealth(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]string{"version": "primal-pds"})
+}
+
+// handleDocument serves the DID document, with status 410 once the DID
+// is tombstoned.
+func (s *Server) handleDocument(c echo.Context) error {
+	did, err := didParam(c)
+	if err != nil {
+		return err
+	}
+	doc, err := s.store.Document(c.Request().Context(), did)
+	if err != nil {
+		return s.storeError(c, err, did)
+	}
+	c.Response().Header().Set(echo.HeaderContentType, "application/did+ld+json")
+	return c.JSON(http.StatusOK, doc)
+}
+
+func (s *Server) handleData(c echo.Context) error {
+	did, err := didParam(c)
+	if err != nil {
+		return err
+	}
+	data, err := s.store.Data(c.Request().Context(), did)
+	if err != nil {
+		return s.storeError(c, err, did)
+	}
+	return c.JSON(http.StatusOK, data)
+}
+
+func (s *Server) handleLog(c echo.Context) error {
+	did, err := didParam(c)
+	if err != nil {
+		return err
+	}
+	entries, err := s.store.Log(c.Request().Context(), did)
+	if err != nil {
+		return s.storeError(c, err, did)
+	}
+	ops := make([]any, len(entries))
+	for i, e := range entries {
+		ops[i] = e.Operation
+	}
+	return c.JSON(http.StatusOK, ops)
+}
+
+func (s *Server) handleLast(c echo.Context) error {
+	did, err := didParam(c)
+	if err != nil {
+		return err
+	}
+	last, err := s.store.Last(c.Request().Context(), did)
+	if err != nil {
+		return s.storeError(c, err, did)
+	}
+	return c.JSON(http.StatusOK, last.Operation)
+}
+
+func (s *Server) handleAuditLog(c echo.Context) error {
+	did, err := didParam(c)
+	if err != nil {
+		return err
+	}
+	entries, err := s.store.AuditLog(c.Request().Context(), did)
+	if err != nil {
+		return s.storeError(c, err, did)
+	}
+	return c.JSON(http.StatusOK, entries)
+}
+
+func (s *Server) handleSubmit(c echo.Context) error {
+	did, err := didParam(c)
+	if err != nil {
+		return err
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, MaxOperationBytes+1))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "Failed to read operation",
+		})
+	}
+	if err := s.store.Submit(c.Request().Context(), did, body); err != nil {
+		return s.storeError(c, err, did)
+	}
+	log.Printf("PLC directory: operation accepted for %s", did)
+	return c.NoContent(http.StatusOK)
+}
+
+// storeError maps Store errors to the responses the PLC directory
+// gives, which carry only a message.
+func (s *Server) storeError(c echo.Context, err error, did string) error {
+	switch {
+	case errors.Is(err, ErrInvalid):
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
+	case errors.Is(err, ErrNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{"message": "DID not registered: " + did})
+	case errors.Is(err, ErrTombstoned):
+		if c.Request().Method == http.MethodPost {
+			return c.JSON(http.StatusBadRequest, map[string]string{"message": "DID is tombstoned: " + did})
+		}
+		return c.JSON(http.StatusGone, map[string]string{"message": "DID not available: " + did})
+	}
+	log.Printf("PLC directory error for %s: %v", did, err)
+	return c.JSON(http.StatusInternalServerError, map[string]string{"message": "Internal server error"})
+}
+
+// didParam returns the did path parameter, or a 400 error if it is not
+// a did:plc.
+func didParam(c echo.Context) (string, error) {
+	did := c.Param("did")
+	if !strings.HasPrefix(did, "did:plc:") {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "Invalid DID: "+did)
+	}
+	return did, nil
+}
@@ -10,9 +10,17 @@ import (
 	ipld "github.com/ipfs/go-ipld-format"
 	car "github.com/ipld/go-car"
 	carutil "github.com/ipld/go-car/util"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// Executor is the subset of pgx shared by *pgxpool.Pool and pgx.Tx, so
+// block and root writes can run on their own or inside a commit
+// transaction.
+type Executor interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
 // MemBlockstore is an in-memory blockstore that implements the
 // blockstore.Blockstore interface required by indigo's MST. It wraps
 // an in-memory map and provides helpers to load from and persist to
@@ -120,10 +128,10 @@ func LoadBlocks(ctx context.Context, pool *pgxpool.Pool, did string) (*MemBlocks
 
 // PersistAll writes all in-memory blocks to Postgres. Uses ON CONFLICT
 // DO NOTHING since blocks are content-addressed (immutable).
-func (m *MemBlockstore) PersistAll(ctx context.Context, pool *pgxpool.Pool, did string) error {
+func (m *MemBlockstore) PersistAll(ctx context.Context, db Executor, did string) error {
 	for _, blk := range m.blocks {
 		cidStr := blk.Cid().String()
-		_, err := pool.Exec(ctx,
+		_, err := db.Exec(ctx,
 			`INSERT INTO repo_blocks (did, cid, data)
 			 VALUES ($1, $2, $3)
 			 ON CONFLICT DO NOTHING`,
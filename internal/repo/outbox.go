@@ -0,0 +1,128 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// OutboxEntry is a commit that has been applied to a repository but not
+// yet sequenced into the firehose. Entries are read from the tenant's
+// commit_outbox table in the order they were committed.
+type OutboxEntry struct {
+	ID     int64
+	DID    string
+	Time   time.Time
+	Commit CommitResult
+}
+
+// outboxOp is the JSON form of a RepoOp stored in commit_outbox.ops.
+type outboxOp struct {
+	Action string `json:"action"`
+	Path   string `json:"path"`
+	CID    string `json:"cid,omitempty"`
+	Prev   string `json:"prev,omitempty"`
+}
+
+// writeOutbox queues a commit for sequencing. It must run in the same
+// transaction as the repo_roots update so the two can never diverge.
+func writeOutbox(ctx context.Context, db Executor, did string, result *CommitResult) error {
+	ops := make([]outboxOp, len(result.Ops))
+	for i, op := range result.Ops {
+		ops[i] = outboxOp{Action: op.Action, Path: op.Path}
+		if op.CID != nil {
+			ops[i].CID = op.CID.String()
+		}
+		if op.Prev != nil {
+			ops[i].Prev = op.Prev.String()
+		}
+	}
+	opsJSON, err := json.Marshal(ops)
+	if err != nil {
+		return fmt.Errorf("repo: outbox marshal ops: %w", err)
+	}
+
+	prevData := ""
+	if result.PrevData != nil {
+		prevData = result.PrevData.String()
+	}
+
+	_, err = db.Exec(ctx,
+		`INSERT INTO commit_outbox (did, commit_cid, rev, prev_rev, prev_data, ops, diff_car)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		did, result.CommitCID, result.Rev, result.PrevRev, prevData, opsJSON, result.DiffCAR)
+	if err != nil {
+		return fmt.Errorf("repo: outbox insert: %w", err)
+	}
+	return nil
+}
+
+// ReadOutbox returns up to limit queued commits from a tenant database,
+// oldest first.
+func ReadOutbox(ctx context.Context, pool *pgxpool.Pool, limit int) ([]OutboxEntry, error) {
+	rows, err := pool.Query(ctx,
+		`SELECT id, did, commit_cid, rev, prev_rev, prev_data, ops, diff_car, created_at
+		 FROM commit_outbox ORDER BY id ASC LIMIT $1`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("repo: outbox query: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []OutboxEntry
+	for rows.Next() {
+		var e OutboxEntry
+		var prevData string
+		var opsJSON []byte
+		if err := rows.Scan(&e.ID, &e.DID, &e.Commit.CommitCID, &e.Commit.Rev, &e.Commit.PrevRev,
+			&prevData, &opsJSON, &e.Commit.DiffCAR, &e.Time); err != nil {
+			return nil, fmt.Errorf("repo: outbox scan: %w", err)
+		}
+
+		if prevData != "" {
+			c, err := cid.Decode(prevData)
+			if err != nil {
+				return nil, fmt.Errorf("repo: outbox %d decode prev data: %w", e.ID, err)
+			}
+			e.Commit.PrevData = &c
+		}
+
+		var ops []outboxOp
+		if err := json.Unmarshal(opsJSON, &ops); err != nil {
+			return nil, fmt.Errorf("repo: outbox %d unmarshal ops: %w", e.ID, err)
+		}
+		e.Commit.Ops = make([]RepoOp, len(ops))
+		for i, op := range ops {
+			e.Commit.Ops[i] = RepoOp{Action: op.Action, Path: op.Path}
+			if op.CID != "" {
+				c, err := cid.Decode(op.CID)
+				if err != nil {
+					return nil, fmt.Errorf("repo: outbox %d decode op cid: %w", e.ID, err)
+				}
+				e.Commit.Ops[i].CID = &c
+			}
+			if op.Prev != "" {
+				c, err := cid.Decode(op.Prev)
+				if err != nil {
+					return nil, fmt.Errorf("repo: outbox %d decode op prev: %w", e.ID, err)
+				}
+				e.Commit.Ops[i].Prev = &c
+			}
+		}
+
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// DeleteOutbox removes a queued commit once it has been sequenced.
+func DeleteOutbox(ctx context.Context, pool *pgxpool.Pool, id int64) error {
+	_, err := pool.Exec(ctx, `DELETE FROM commit_outbox WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("repo: outbox delete %d: %w", id, err)
+	}
+	return nil
+}
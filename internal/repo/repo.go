@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -16,10 +17,20 @@ import (
 
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// MaxCommitOps is the largest number of record operations allowed in a
+// single commit. It matches the ops limit of the subscribeRepos #commit
+// message, so every commit we produce can be described on the firehose.
+const MaxCommitOps = 200
+
+// ErrTooManyOps is returned when a write would produce a commit with more
+// than MaxCommitOps operations.
+var ErrTooManyOps = errors.New("repo: too many operations in one commit")
+
 // Manager orchestrates all repository operations for the PDS.
 // It is stateless — each method receives a tenant pool.
 type Manager struct{}
@@ -369,6 +380,74 @@ func (m *Manager) DescribeRepo(ctx context.Context, pool *pgxpool.Pool, did stri
 	return collections, nil
 }
 
+// Stats summarizes a repository's contents.
+type Stats struct {
+	CommitCID string
+	Rev       string
+	Blocks    int
+	Records   int
+
+	// BlobCIDs lists the distinct blobs referenced by the repo's records.
+	BlobCIDs []string
+
+	// BlobRecords maps each of BlobCIDs to the path (collection/rkey) of
+	// the first record found referencing it.
+	BlobRecords map[string]string
+}
+
+// Stats walks a repo and counts its blocks and records, and collects the
+// blobs its records reference.
+func (m *Manager) Stats(ctx context.Context, pool *pgxpool.Pool, did string) (*Stats, error) {
+	bs, tree, root, err := openRepo(ctx, pool, did)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &Stats{
+		CommitCID: root.CommitCID,
+		Rev:       root.Rev,
+		Blocks:    len(bs.blocks),
+	}
+	st.Records, st.BlobCIDs, st.BlobRecords, err = walkBlobRefs(ctx, bs, &tree)
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// walkBlobRefs decodes every record in tree and returns the record count,
+// the distinct blob CIDs referenced in first-seen order, and the path of
+// the first record referencing each.
+func walkBlobRefs(ctx context.Context, bs *TrackingBlockstore, tree *mst.Tree) (int, []string, map[string]string, error) {
+	var records int
+	seen := map[string]string{}
+	var cids []string
+
+	err := tree.Walk(func(key []byte, val cid.Cid) error {
+		records++
+		blk, err := bs.Get(ctx, val)
+		if err != nil {
+			return fmt.Errorf("get block %s: %w", val.String(), err)
+		}
+		rec, err := DecodeRecord(blk.RawData())
+		if err != nil {
+			return fmt.Errorf("decode %s: %w", key, err)
+		}
+		for _, b := range atdata.ExtractBlobs(rec) {
+			c := b.Ref.String()
+			if _, ok := seen[c]; !ok {
+				seen[c] = string(key)
+				cids = append(cids, c)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("repo: blob refs walk: %w", err)
+	}
+	return records, cids, seen, nil
+}
+
 // GetRoot returns the current commit CID and rev for a DID.
 func (m *Manager) GetRoot(ctx context.Context, pool *pgxpool.Pool, did string) (commitCID, rev string, err error) {
 	root, err := loadRoot(ctx, pool, did)
@@ -398,6 +477,156 @@ func (m *Manager) ExportRepo(ctx context.Context, pool *pgxpool.Pool, did string
 	return bs.ExportCAR(w, commitCID)
 }
 
+// MaxImportBytes is the largest repository CAR ImportRepo accepts. The
+// whole archive is held in memory while it is checked, so this bounds
+// what one import request can cost the server.
+const MaxImportBytes = 128 << 20
+
+// ErrInvalidImport is returned by ImportRepo for a CAR that does not
+// hold a complete repository for the DID.
+var ErrInvalidImport = errors.New("repo: invalid repository import")
+
+// ImportRepo replaces a repository with the contents of a CAR v1
+// archive, as served by com.atproto.sync.getRepo on another PDS. The
+// CAR's root must be a commit for did, and every MST node and record
+// it reaches must be present. Blocks from the previous repository are
+// dropped. The import is not announced on the firehose; it is meant for
+// accounts that are not yet active here, and AnnounceRoot publishes it
+// when the account is activated.
+func (m *Manager) ImportRepo(ctx context.Context, pool *pgxpool.Pool, did string, r io.Reader) (*Stats, error) {
+	cr, err := car.NewCarReader(io.LimitReader(r, MaxImportBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: read car header: %v", ErrInvalidImport, err)
+	}
+	if len(cr.Header.Roots) != 1 {
+		return nil, fmt.Errorf("%w: car must have exactly one root", ErrInvalidImport)
+	}
+	commitCID := cr.Header.Roots[0]
+
+	bs := NewMemBlockstore()
+	for {
+		blk, err := cr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: read block: %v", ErrInvalidImport, err)
+		}
+		// Blocks are addressed by their hash; reject any that don't match.
+		sum, err := blk.Cid().Prefix().Sum(blk.RawData())
+		if err != nil || !sum.Equals(blk.Cid()) {
+			return nil, fmt.Errorf("%w: block %s does not match its CID", ErrInvalidImport, blk.Cid())
+		}
+		bs.blocks[blk.Cid().KeyString()] = blk
+	}
+
+	commitBlk, err := bs.Get(ctx, commitCID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: commit block %s missing", ErrInvalidImport, commitCID)
+	}
+	var commit indigorepo.Commit
+	if err := commit.UnmarshalCBOR(bytes.NewReader(commitBlk.RawData())); err != nil {
+		return nil, fmt.Errorf("%w: decode commit: %v", ErrInvalidImport, err)
+	}
+	if commit.DID != did {
+		return nil, fmt.Errorf("%w: commit is for %s, not %s", ErrInvalidImport, commit.DID, did)
+	}
+	if _, err := syntax.ParseTID(commit.Rev); err != nil {
+		return nil, fmt.Errorf("%w: invalid commit rev %q", ErrInvalidImport, commit.Rev)
+	}
+
+	tbs := NewTrackingBlockstore(bs)
+	tree, err := mst.LoadTreeFromStore(ctx, tbs, commit.Data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: load mst: %v", ErrInvalidImport, err)
+	}
+	st := &Stats{
+		CommitCID: commitCID.String(),
+		Rev:       commit.Rev,
+		Blocks:    len(bs.blocks),
+	}
+	st.Records, st.BlobCIDs, st.BlobRecords, err = walkBlobRefs(ctx, tbs, tree)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImport, err)
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("repo: import begin: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `DELETE FROM repo_blocks WHERE did = $1`, did); err != nil {
+		return nil, fmt.Errorf("repo: import clear blocks: %w", err)
+	}
+	if err := bs.PersistAll(ctx, tx, did); err != nil {
+		return nil, fmt.Errorf("repo: import persist: %w", err)
+	}
+	if err := setRoot(ctx, tx, did, st.CommitCID, st.Rev); err != nil {
+		return nil, fmt.Errorf("repo: import root: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("repo: import tx: %w", err)
+	}
+	return st, nil
+}
+
+// AnnounceRoot queues a repository's current commit for the firehose
+// with no ops and no since, carrying only the commit block, so consumers
+// that don't hold the repository fetch it with getRepo. It is used when
+// an imported repository goes live. A commit that was already sequenced
+// is skipped by the sequencer.
+func (m *Manager) AnnounceRoot(ctx context.Context, pool *pgxpool.Pool, did string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("repo: announce begin: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock the root so a concurrent commit is queued after this one.
+	var root repoRoot
+	var data []byte
+	err = tx.QueryRow(ctx,
+		`SELECT r.commit_cid, r.rev, b.data FROM repo_roots r
+		 JOIN repo_blocks b ON b.did = r.did AND b.cid = r.commit_cid
+		 WHERE r.did = $1 FOR UPDATE OF r`, did,
+	).Scan(&root.CommitCID, &root.Rev, &data)
+	if err == pgx.ErrNoRows {
+		return fmt.Errorf("repo: no repository for %s", did)
+	}
+	if err != nil {
+		return fmt.Errorf("repo: announce load root: %w", err)
+	}
+
+	commitCID, err := cid.Decode(root.CommitCID)
+	if err != nil {
+		return fmt.Errorf("repo: announce decode commit cid: %w", err)
+	}
+	blk, err := blocks.NewBlockWithCid(data, commitCID)
+	if err != nil {
+		return fmt.Errorf("repo: announce commit block: %w", err)
+	}
+	bs := NewMemBlockstore()
+	bs.blocks[commitCID.KeyString()] = blk
+	var diffBuf bytes.Buffer
+	if err := bs.ExportCAR(&diffBuf, commitCID); err != nil {
+		return fmt.Errorf("repo: announce car: %w", err)
+	}
+
+	result := &CommitResult{
+		CommitCID: root.CommitCID,
+		Rev:       root.Rev,
+		DiffCAR:   diffBuf.Bytes(),
+	}
+	if err := writeOutbox(ctx, tx, did, result); err != nil {
+		return fmt.Errorf("repo: announce outbox: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("repo: announce tx: %w", err)
+	}
+	return nil
+}
+
 // openRepo loads blocks from Postgres, rebuilds the MST tree, and
 // returns a TrackingBlockstore that can distinguish new blocks from
 // preloaded ones.
@@ -439,9 +668,14 @@ func openRepo(ctx context.Context, pool *pgxpool.Pool, did string) (*TrackingBlo
 }
 
 // commitRepo signs a new commit, writes MST blocks, generates a diff
-// CAR from the TrackingBlockstore, and persists to Postgres. Returns a
-// CommitResult containing everything the firehose needs.
+// CAR from the TrackingBlockstore, and persists to Postgres together
+// with a commit_outbox row for the sequencer. Returns a CommitResult
+// containing everything the firehose needs.
 func commitRepo(ctx context.Context, pool *pgxpool.Pool, did string, privKey atcrypto.PrivateKey, tbs *TrackingBlockstore, tree *mst.Tree, prevRoot *repoRoot, ops []RepoOp) (*CommitResult, error) {
+	if len(ops) > MaxCommitOps {
+		return nil, fmt.Errorf("%w: %d (max %d)", ErrTooManyOps, len(ops), MaxCommitOps)
+	}
+
 	// Write dirty MST nodes to blockstore.
 	mstRoot, err := tree.WriteDiffBlocks(ctx, tbs)
 	if err != nil {
@@ -495,22 +729,37 @@ func commitRepo(ctx context.Context, pool *pgxpool.Pool, did string, privKey atc
 		return nil, fmt.Errorf("repo: commit diff car: %w", err)
 	}
 
-	// Persist all blocks and update root.
-	if err := tbs.MemBlockstore.PersistAll(ctx, pool, did); err != nil {
-		return nil, fmt.Errorf("repo: commit persist: %w", err)
-	}
-	if err := setRoot(ctx, pool, did, commitCID.String(), rev); err != nil {
-		return nil, fmt.Errorf("repo: commit root: %w", err)
-	}
-
-	return &CommitResult{
+	result := &CommitResult{
 		CommitCID: commitCID.String(),
 		Rev:       rev,
 		PrevRev:   prevRev,
 		PrevData:  prevData,
 		Ops:       ops,
 		DiffCAR:   diffBuf.Bytes(),
-	}, nil
+	}
+
+	// Persist all blocks, update root, and queue the commit for the
+	// firehose in one transaction so the event can't be lost.
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("repo: commit begin: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := tbs.MemBlockstore.PersistAll(ctx, tx, did); err != nil {
+		return nil, fmt.Errorf("repo: commit persist: %w", err)
+	}
+	if err := setRoot(ctx, tx, did, commitCID.String(), rev); err != nil {
+		return nil, fmt.Errorf("repo: commit root: %w", err)
+	}
+	if err := writeOutbox(ctx, tx, did, result); err != nil {
+		return nil, fmt.Errorf("repo: commit outbox: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("repo: commit tx: %w", err)
+	}
+
+	return result, nil
 }
 
 // storeCommitBlock encodes a commit as CBOR and stores it in the blockstore.
@@ -551,8 +800,8 @@ func loadRoot(ctx context.Context, pool *pgxpool.Pool, did string) (*repoRoot, e
 }
 
 // setRoot inserts or updates the repo root in Postgres.
-func setRoot(ctx context.Context, pool *pgxpool.Pool, did, commitCID, rev string) error {
-	_, err := pool.Exec(ctx,
+func setRoot(ctx context.Context, db Executor, did, commitCID, rev string) error {
+	_, err := db.Exec(ctx,
 		`INSERT INTO repo_roots (did, commit_cid, rev)
 		 VALUES ($1, $2, $3)
 		 ON CONFLICT (did) DO UPDATE SET commit_cid = $2, rev = $3, updated_at = NOW()`,
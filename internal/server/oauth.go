@@ -0,0 +1,589 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/primal-host/primal-pds/internal/account"
+	"github.com/primal-host/primal-pds/internal/auth"
+	"github.com/primal-host/primal-pds/internal/oauth"
+)
+
+// The OAuth authorization server. Each hosted domain is its own issuer,
+// https://<domain>, matching the PDS endpoint in its accounts' DID
+// documents; an account can only authorize at its own domain.
+
+// oauthIssuer returns the issuer for the request's host, or "" if the
+// host is not a hosted domain.
+func (s *Server) oauthIssuer(c echo.Context) string {
+	host := stripPort(c.Request().Host)
+	if s.pools.Get(host) == nil {
+		return ""
+	}
+	return "https://" + host
+}
+
+// requestURL returns the URL a client addressed the request to, as
+// DPoP proofs name it. TLS is terminated in front of the server.
+func requestURL(c echo.Context) string {
+	return "https://" + c.Request().Host + c.Request().URL.Path
+}
+
+// oauthError writes an OAuth error response.
+func oauthError(c echo.Context, err error) error {
+	var oe *oauth.Error
+	if errors.As(err, &oe) {
+		return c.JSON(oe.Status, oe)
+	}
+	log.Printf("Error in OAuth request %s: %v", c.Request().URL.Path, err)
+	return c.JSON(http.StatusInternalServerError, &oauth.Error{
+		Code:        "server_error",
+		Description: "Internal error",
+	})
+}
+
+// oauthHeaders sets the headers every OAuth endpoint sends: the current
+// DPoP nonce, and no caching of tokens.
+func (s *Server) oauthHeaders(c echo.Context) {
+	h := c.Response().Header()
+	h.Set("DPoP-Nonce", s.dpop.Nonce())
+	h.Set("Cache-Control", "no-store")
+}
+
+// oauthCORS lets browser-based clients call the OAuth metadata, PAR,
+// token and revocation endpoints from any origin and read the DPoP
+// nonce they return. The authorization page is navigated to, not
+// fetched, and gets no CORS headers.
+var oauthCORS = middleware.CORSWithConfig(middleware.CORSConfig{
+	Skipper: func(c echo.Context) bool {
+		p := c.Request().URL.Path
+		switch {
+		case strings.HasPrefix(p, "/.well-known/oauth-"):
+			return false
+		case strings.HasPrefix(p, "/oauth/"):
+			return p == "/oauth/authorize"
+		}
+		return true
+	},
+	AllowOrigins:  []string{"*"},
+	AllowMethods:  []string{http.MethodGet, http.MethodPost},
+	AllowHeaders:  []string{"Content-Type", "DPoP"},
+	ExposeHeaders: []string{"DPoP-Nonce", "WWW-Authenticate"},
+})
+
+// oauthAccountCheck refuses tokens for an account that no longer exists
+// or may not sign in.
+func (s *Server) oauthAccountCheck(ctx context.Context, did string) error {
+	domainName, err := s.mgmtDB.LookupDIDDomain(ctx, did)
+	if err != nil {
+		return oauth.InvalidGrant("account not found")
+	}
+	pool := s.pools.Get(domainName)
+	if pool == nil {
+		return oauth.InvalidGrant("account not found")
+	}
+	acct, err := s.tenantStore(pool).GetByDID(ctx, did)
+	if errors.Is(err, account.ErrNotFound) {
+		return oauth.InvalidGrant("account not found")
+	}
+	if err != nil {
+		return err
+	}
+	if err := account.CanLogin(acct.Status); err != nil {
+		return oauth.InvalidGrant("%v", err)
+	}
+	return nil
+}
+
+// handleOAuthProtectedResource serves the protected resource metadata,
+// naming the domain's authorization server.
+// GET /.well-known/oauth-protected-resource
+func (s *Server) handleOAuthProtectedResource(c echo.Context) error {
+	issuer := s.oauthIssuer(c)
+	if issuer == "" {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error":   "NotFound",
+			"message": "Unknown domain",
+		})
+	}
+	return c.JSON(http.StatusOK, oauth.ResourceMetadata(issuer, issuer))
+}
+
+// handleOAuthAuthorizationServer serves the authorization server
+// metadata of the domain.
+// GET /.well-known/oauth-authorization-server
+func (s *Server) handleOAuthAuthorizationServer(c echo.Context) error {
+	issuer := s.oauthIssuer(c)
+	if issuer == "" {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error":   "NotFound",
+			"message": "Unknown domain",
+		})
+	}
+	return c.JSON(http.StatusOK, oauth.ServerMetadata(issuer))
+}
+
+// handleOAuthPAR records a pushed authorization request, the only way
+// to start an authorization here.
+// POST /oauth/par
+func (s *Server) handleOAuthPAR(c echo.Context) error {
+	s.oauthHeaders(c)
+	issuer := s.oauthIssuer(c)
+	if issuer == "" {
+		return oauthError(c, oauth.InvalidRequest("unknown authorization server"))
+	}
+	form, err := c.FormParams()
+	if err != nil {
+		return oauthError(c, oauth.InvalidRequest("invalid form body"))
+	}
+
+	ctx := c.Request().Context()
+	meta, err := s.oauthClients.Resolve(ctx, form.Get("client_id"))
+	if err != nil {
+		return oauthError(c, err)
+	}
+	if err := s.oauthClients.Authenticate(ctx, meta, issuer, form); err != nil {
+		return oauthError(c, err)
+	}
+	jkt, err := s.dpop.VerifyProof(ctx, c.Request().Header.Get("DPoP"), http.MethodPost, requestURL(c), "")
+	if err != nil {
+		return oauthError(c, err)
+	}
+
+	if form.Get("response_type") != "code" {
+		return oauthError(c, oauth.InvalidRequest("response_type must be code"))
+	}
+	redirectURI := form.Get("redirect_uri")
+	if redirectURI == "" && len(meta.RedirectURIs) == 1 {
+		redirectURI = meta.RedirectURIs[0]
+	}
+	if err := oauth.CheckRedirect(meta, redirectURI); err != nil {
+		return oauthError(c, err)
+	}
+	if form.Get("code_challenge") == "" || form.Get("code_challenge_method") != "S256" {
+		return oauthError(c, oauth.InvalidRequest("a PKCE code_challenge with method S256 is required"))
+	}
+	scopes, err := oauth.ParseScope(form.Get("scope"), meta.Scope)
+	if err != nil {
+		return oauthError(c, err)
+	}
+
+	req := &oauth.Request{
+		ClientID:      meta.ClientID,
+		RedirectURI:   redirectURI,
+		Scope:         strings.Join(scopes, " "),
+		State:         form.Get("state"),
+		CodeChallenge: form.Get("code_challenge"),
+		LoginHint:     form.Get("login_hint"),
+		DPoPJKT:       jkt,
+	}
+	if err := s.oauthRequests.CreateRequest(ctx, req); err != nil {
+		return oauthError(c, err)
+	}
+	return c.JSON(http.StatusCreated, map[string]any{
+		"request_uri": req.RequestURI(),
+		"expires_in":  int(oauth.RequestTTL.Seconds()),
+	})
+}
+
+// authorizePage is the sign-in and consent page of /oauth/authorize.
+var authorizePage = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Sign in to {{.Domain}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 26rem; margin: 3rem auto; padding: 0 1rem; color: #222; }
+label { display: block; margin-top: 1rem; font-size: .9rem; }
+input { width: 100%; box-sizing: border-box; padding: .5rem; margin-top: .25rem; }
+.buttons { display: flex; gap: .5rem; margin-top: 1.5rem; }
+button { flex: 1; padding: .6rem; }
+.error { color: #b00020; }
+.client { font-weight: 600; word-break: break-all; }
+</style>
+</head>
+<body>
+<h1>Sign in to {{.Domain}}</h1>
+<p><span class="client">{{.ClientName}}</span> is asking to access your account:</p>
+<ul>{{range .Scopes}}<li>{{.}}</li>{{end}}</ul>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<form method="post" action="/oauth/authorize">
+<input type="hidden" name="request_uri" value="{{.RequestURI}}">
+<input type="hidden" name="client_id" value="{{.ClientID}}">
+<label>Handle <input name="handle" value="{{.Handle}}" autocomplete="username" autocapitalize="none" required></label>
+<label>Password <input name="password" type="password" autocomplete="current-password"></label>
+<div class="buttons">
+<button type="submit" name="action" value="deny" formnovalidate>Deny</button>
+<button type="submit" name="action" value="approve">Allow</button>
+</div>
+</form>
+</body>
+</html>
+`))
+
+// scopeDescriptions explains the scopes on the consent page.
+var scopeDescriptions = map[string]string{
+	oauth.ScopeAtproto: "Know your account's identity",
+	oauth.ScopeGeneric: "Read and write your posts and other records",
+	oauth.ScopeChat:    "Read and send your direct messages",
+}
+
+// authorizeData is the data of authorizePage.
+type authorizeData struct {
+	Domain     string
+	ClientID   string
+	ClientName string
+	Scopes     []string
+	RequestURI string
+	Handle     string
+	Error      string
+}
+
+// renderAuthorize writes the sign-in page for a pending request.
+func (s *Server) renderAuthorize(c echo.Context, status int, req *oauth.Request, meta *oauth.ClientMetadata, handle, message string) error {
+	data := authorizeData{
+		Domain:     stripPort(c.Request().Host),
+		ClientID:   req.ClientID,
+		ClientName: req.ClientID,
+		RequestURI: req.RequestURI(),
+		Handle:     handle,
+		Error:      message,
+	}
+	if meta.ClientName != nil && *meta.ClientName != "" {
+		data.ClientName = *meta.ClientName + " (" + req.ClientID + ")"
+	}
+	for _, sc := range strings.Fields(req.Scope) {
+		data.Scopes = append(data.Scopes, scopeDescriptions[sc])
+	}
+
+	var sb strings.Builder
+	if err := authorizePage.Execute(&sb, data); err != nil {
+		return err
+	}
+	h := c.Response().Header()
+	h.Set("X-Frame-Options", "DENY")
+	h.Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors 'none'")
+	h.Set("Cache-Control", "no-store")
+	return c.HTML(status, sb.String())
+}
+
+// authorizeRequest loads the pending request and client of an
+// authorization page request, writing an error page if that fails.
+func (s *Server) authorizeRequest(c echo.Context, requestURI, clientID string) (*oauth.Request, *oauth.ClientMetadata, error) {
+	if s.oauthIssuer(c) == "" {
+		return nil, nil, c.String(http.StatusNotFound, "Unknown authorization server")
+	}
+	ctx := c.Request().Context()
+	req, err := s.oauthRequests.PendingRequest(ctx, requestURI, clientID)
+	if err != nil {
+		var oe *oauth.Error
+		if errors.As(err, &oe) {
+			return nil, nil, c.String(http.StatusBadRequest, "This sign-in request is invalid or has expired. Return to the app and try again.")
+		}
+		log.Printf("Error loading OAuth request: %v", err)
+		return nil, nil, c.String(http.StatusInternalServerError, "Internal error")
+	}
+	meta, err := s.oauthClients.Resolve(ctx, clientID)
+	if err != nil {
+		return nil, nil, c.String(http.StatusBadRequest, "The app's client metadata could not be loaded.")
+	}
+	return req, meta, nil
+}
+
+// handleOAuthAuthorizePage shows the sign-in and consent page for a
+// pushed request.
+// GET /oauth/authorize
+func (s *Server) handleOAuthAuthorizePage(c echo.Context) error {
+	req, meta, err := s.authorizeRequest(c, c.QueryParam("request_uri"), c.QueryParam("client_id"))
+	if req == nil {
+		return err
+	}
+	return s.renderAuthorize(c, http.StatusOK, req, meta, strings.TrimPrefix(req.LoginHint, "@"), "")
+}
+
+// handleOAuthAuthorize signs the account holder in with the account
+// password and redirects back to the client with an authorization code,
+// or with access_denied if they declined.
+// POST /oauth/authorize
+func (s *Server) handleOAuthAuthorize(c echo.Context) error {
+	// The form is only ever posted by the page itself.
+	if origin := c.Request().Header.Get("Origin"); origin != "" && origin != s.oauthIssuer(c) {
+		return c.String(http.StatusForbidden, "Cross-origin request refused")
+	}
+	req, meta, err := s.authorizeRequest(c, c.FormValue("request_uri"), c.FormValue("client_id"))
+	if req == nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	if c.FormValue("action") != "approve" {
+		if err := s.oauthRequests.DeleteRequest(ctx, req.ID); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+		return s.oauthRedirect(c, req, url.Values{
+			"error":             {"access_denied"},
+			"error_description": {"The account holder declined the request"},
+		})
+	}
+
+	handle := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(c.FormValue("handle")), "@"))
+	password := c.FormValue("password")
+	domainName := s.handleDomain(ctx, handle)
+	if domainName == "" || domainName != stripPort(c.Request().Host) {
+		return s.renderAuthorize(c, http.StatusUnauthorized, req, meta, handle,
+			"No account with this handle is hosted on "+stripPort(c.Request().Host)+".")
+	}
+	acct, err := s.tenantStore(s.pools.Get(domainName)).VerifyPassword(ctx, handle, password)
+	if err != nil {
+		return s.renderAuthorize(c, http.StatusUnauthorized, req, meta, handle, "Invalid handle or password.")
+	}
+	if err := account.CanLogin(acct.Status); err != nil {
+		return s.renderAuthorize(c, http.StatusForbidden, req, meta, handle, "This account can't sign in.")
+	}
+
+	code, err := s.oauthRequests.Approve(ctx, req.ID, acct.DID)
+	if err != nil {
+		return s.renderAuthorize(c, http.StatusBadRequest, req, meta, handle,
+			"This sign-in request has expired. Return to the app and try again.")
+	}
+	log.Printf("OAuth authorization: %s for %s (%s)", acct.Handle, req.ClientID, req.Scope)
+	return s.oauthRedirect(c, req, url.Values{"code": {code}})
+}
+
+// oauthRedirect sends the browser back to the client's redirect URI
+// with the given parameters, plus state and iss.
+func (s *Server) oauthRedirect(c echo.Context, req *oauth.Request, params url.Values) error {
+	u, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid redirect_uri")
+	}
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	if req.State != "" {
+		q.Set("state", req.State)
+	}
+	q.Set("iss", s.oauthIssuer(c))
+	u.RawQuery = q.Encode()
+	return c.Redirect(http.StatusSeeOther, u.String())
+}
+
+// oauthRefreshSession returns the session of an OAuth refresh token,
+// which only the client it was issued to may use, with the same DPoP key.
+func (s *Server) oauthRefreshSession(ctx context.Context, token, clientID, jkt string) (*auth.Session, error) {
+	did, jti, err := s.jwt.ValidateRefreshToken(ctx, token)
+	if err != nil || jti == "" {
+		return nil, oauth.InvalidGrant("invalid refresh token")
+	}
+	sess, err := s.jwt.Session(ctx, jti)
+	if err != nil || sess.DID != did {
+		return nil, oauth.InvalidGrant("invalid refresh token")
+	}
+	if sess.ClientID != clientID || sess.DPoPJKT != jkt {
+		return nil, oauth.InvalidGrant("refresh token was issued to another client or DPoP key")
+	}
+	return sess, nil
+}
+
+// handleOAuthToken exchanges an authorization code or refresh token for
+// DPoP-bound tokens.
+// POST /oauth/token
+func (s *Server) handleOAuthToken(c echo.Context) error {
+	s.oauthHeaders(c)
+	issuer := s.oauthIssuer(c)
+	if issuer == "" {
+		return oauthError(c, oauth.InvalidRequest("unknown authorization server"))
+	}
+	form, err := c.FormParams()
+	if err != nil {
+		return oauthError(c, oauth.InvalidRequest("invalid form body"))
+	}
+
+	ctx := c.Request().Context()
+	meta, err := s.oauthClients.Resolve(ctx, form.Get("client_id"))
+	if err != nil {
+		return oauthError(c, err)
+	}
+	if err := s.oauthClients.Authenticate(ctx, meta, issuer, form); err != nil {
+		return oauthError(c, err)
+	}
+	jkt, err := s.dpop.VerifyProof(ctx, c.Request().Header.Get("DPoP"), http.MethodPost, requestURL(c), "")
+	if err != nil {
+		return oauthError(c, err)
+	}
+
+	var did, scope string
+	var tokens *auth.TokenPair
+	switch form.Get("grant_type") {
+	case "authorization_code":
+		req, err := s.oauthRequests.ExchangeCode(ctx, form.Get("code"))
+		if err != nil {
+			return oauthError(c, err)
+		}
+		switch {
+		case req.ClientID != meta.ClientID:
+			return oauthError(c, oauth.InvalidGrant("code was issued to another client"))
+		case form.Get("redirect_uri") != "" && form.Get("redirect_uri") != req.RedirectURI:
+			return oauthError(c, oauth.InvalidGrant("redirect_uri does not match the request"))
+		case req.DPoPJKT != "" && req.DPoPJKT != jkt:
+			return oauthError(c, oauth.InvalidGrant("DPoP key does not match the request"))
+		}
+		if err := oauth.VerifyPKCE(req.CodeChallenge, form.Get("code_verifier")); err != nil {
+			return oauthError(c, err)
+		}
+		// The account may have been taken down since it approved.
+		if err := s.oauthAccountCheck(ctx, req.DID); err != nil {
+			return oauthError(c, err)
+		}
+		did, scope = req.DID, req.Scope
+		tokens, err = s.jwt.CreateSession(ctx, &auth.Session{
+			DID:      did,
+			Scope:    scope,
+			ClientID: meta.ClientID,
+			DPoPJKT:  jkt,
+		})
+		if err != nil {
+			return oauthError(c, err)
+		}
+
+	case "refresh_token":
+		if !slices.Contains(meta.GrantTypes, "refresh_token") {
+			return oauthError(c, oauth.InvalidGrant("client may not use refresh tokens"))
+		}
+		sess, err := s.oauthRefreshSession(ctx, form.Get("refresh_token"), meta.ClientID, jkt)
+		if err != nil {
+			return oauthError(c, err)
+		}
+		if err := s.oauthAccountCheck(ctx, sess.DID); err != nil {
+			return oauthError(c, err)
+		}
+		did, scope = sess.DID, sess.Scope
+		tokens, err = s.jwt.RefreshSession(ctx, did, sess.JTI)
+		switch {
+		case errors.Is(err, auth.ErrTokenReused):
+			log.Printf("Refresh token reuse for %s by %s; session revoked", did, meta.ClientID)
+			fallthrough
+		case errors.Is(err, auth.ErrSessionRevoked):
+			return oauthError(c, oauth.InvalidGrant("refresh token has been revoked"))
+		case err != nil:
+			return oauthError(c, err)
+		}
+
+	default:
+		return oauthError(c, &oauth.Error{
+			Status:      http.StatusBadRequest,
+			Code:        "unsupported_grant_type",
+			Description: "grant_type must be authorization_code or refresh_token",
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"access_token":  tokens.AccessJwt,
+		"token_type":    "DPoP",
+		"expires_in":    int(auth.OAuthAccessTTL.Seconds()),
+		"refresh_token": tokens.RefreshJwt,
+		"scope":         scope,
+		"sub":           did,
+	})
+}
+
+// handleOAuthRevoke ends the session of an access or refresh token
+// issued to the client. As RFC 7009 asks, unknown tokens are not an
+// error.
+// POST /oauth/revoke
+func (s *Server) handleOAuthRevoke(c echo.Context) error {
+	s.oauthHeaders(c)
+	issuer := s.oauthIssuer(c)
+	if issuer == "" {
+		return oauthError(c, oauth.InvalidRequest("unknown authorization server"))
+	}
+	form, err := c.FormParams()
+	if err != nil {
+		return oauthError(c, oauth.InvalidRequest("invalid form body"))
+	}
+
+	ctx := c.Request().Context()
+	meta, err := s.oauthClients.Resolve(ctx, form.Get("client_id"))
+	if err != nil {
+		return oauthError(c, err)
+	}
+	if err := s.oauthClients.Authenticate(ctx, meta, issuer, form); err != nil {
+		return oauthError(c, err)
+	}
+
+	token := form.Get("token")
+	var jti string
+	if _, id, err := s.jwt.ValidateRefreshToken(ctx, token); err == nil {
+		jti = id
+	} else if claims, err := s.jwt.ValidateOAuthToken(ctx, token); err == nil {
+		jti = claims.ID
+	}
+	if jti != "" {
+		if sess, err := s.jwt.Session(ctx, jti); err == nil && sess.ClientID == meta.ClientID {
+			if err := s.jwt.RevokeSession(ctx, jti); err != nil {
+				return oauthError(c, err)
+			}
+		}
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// dpopAuth identifies the caller of a resource request made with a
+// DPoP-bound OAuth access token. The token must come with a proof from
+// its key and grant at least transition:generic.
+func (s *Server) dpopAuth(c echo.Context, token string) (*authContext, error) {
+	ctx := c.Request().Context()
+	claims, err := s.jwt.ValidateOAuthToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	jkt, err := s.dpop.VerifyProof(ctx, c.Request().Header.Get("DPoP"), c.Request().Method, requestURL(c), token)
+	if err != nil {
+		return nil, err
+	}
+	if jkt != claims.Confirmation.JKT {
+		return nil, errors.New("DPoP key does not match the access token")
+	}
+	if !slices.Contains(strings.Fields(claims.Scope), oauth.ScopeGeneric) {
+		return nil, errInsufficientScope
+	}
+	return &authContext{DID: claims.Subject, Scope: claims.Scope, ClientID: claims.ClientID}, nil
+}
+
+// errInsufficientScope is returned by dpopAuth for a token that doesn't
+// grant repository access.
+var errInsufficientScope = errors.New("token scope does not grant access")
+
+// dpopAuthError writes the response for a DPoP request rejected by
+// dpopAuth. A stale or missing nonce is reported the way DPoP clients
+// expect, so they retry with the one in the DPoP-Nonce header.
+func dpopAuthError(c echo.Context, err error) error {
+	if oauth.IsNonceError(err) {
+		c.Response().Header().Set("WWW-Authenticate", `DPoP error="use_dpop_nonce", error_description="Resource server requires nonce in DPoP proof"`)
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error":   "use_dpop_nonce",
+			"message": "Resource server requires nonce in DPoP proof",
+		})
+	}
+	if errors.Is(err, errInsufficientScope) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidToken",
+			"message": "Bad token scope: " + oauth.ScopeGeneric + " is required",
+		})
+	}
+	c.Response().Header().Set("WWW-Authenticate", `DPoP error="invalid_token"`)
+	return c.JSON(http.StatusUnauthorized, map[string]string{
+		"error":   "InvalidToken",
+		"message": "Invalid or expired access token",
+	})
+}
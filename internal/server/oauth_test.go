@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/primal-host/primal-pds/internal/auth"
+	"github.com/primal-host/primal-pds/internal/oauth"
+)
+
+func TestOAuthRefreshSession(t *testing.T) {
+	ctx := context.Background()
+	jwt, err := auth.NewJWTManager(ctx, nil, auth.NewMemorySessionStore(), auth.AlgES256K,
+		"https://pds.example.com", "did:web:pds.example.com", "")
+	if err != nil {
+		t.Fatalf("NewJWTManager: %v", err)
+	}
+	s := &Server{jwt: jwt}
+
+	const (
+		clientID = "https://app.example.com/client-metadata.json"
+		jkt      = "dpop-key-thumbprint"
+	)
+	oauthPair, err := jwt.CreateSession(ctx, &auth.Session{
+		DID:      aliceDID,
+		Scope:    "atproto transition:generic",
+		ClientID: clientID,
+		DPoPJKT:  jkt,
+	})
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	// A session from createSession, with no client.
+	legacyPair, err := jwt.CreateSession(ctx, &auth.Session{DID: aliceDID, Scope: auth.ScopeAccess})
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		clientID string
+		jkt      string
+		ok       bool
+	}{
+		{"same client and key", oauthPair.RefreshJwt, clientID, jkt, true},
+		{"other client", oauthPair.RefreshJwt, "https://evil.example.com/client-metadata.json", jkt, false},
+		{"other DPoP key", oauthPair.RefreshJwt, clientID, "other-thumbprint", false},
+		{"session without a client", legacyPair.RefreshJwt, clientID, jkt, false},
+		{"access token", oauthPair.AccessJwt, clientID, jkt, false},
+		{"garbage", "garbage", clientID, jkt, false},
+	}
+	for _, tt := range tests {
+		sess, err := s.oauthRefreshSession(ctx, tt.token, tt.clientID, tt.jkt)
+		if !tt.ok {
+			var oe *oauth.Error
+			if !errors.As(err, &oe) || oe.Code != "invalid_grant" {
+				t.Errorf("%s: err = %v, want invalid_grant", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if sess.DID != aliceDID || sess.ClientID != clientID {
+			t.Errorf("%s: session = %+v", tt.name, sess)
+		}
+	}
+}
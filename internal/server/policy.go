@@ -0,0 +1,151 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/labstack/echo/v4"
+	"github.com/primal-host/primal-pds/internal/account"
+)
+
+// Authorization errors returned by the repo write checks.
+var (
+	errAuthRequired = errors.New("authentication required")
+	errNotRepoOwner = errors.New("cannot modify another account's repository")
+)
+
+// repoUnavailableError reports that a repo is not served to the caller
+// because of its account status. Reason is the atproto hosting status.
+type repoUnavailableError struct {
+	reason string
+}
+
+func (e *repoUnavailableError) Error() string {
+	return "repository is " + e.reason
+}
+
+// checkRepoAuth verifies that the authenticated caller is allowed to
+// modify the given repo. Admins can modify any repo; JWT users can only
+// modify their own.
+func checkRepoAuth(c echo.Context, repoDID string) error {
+	ac := getAuth(c)
+	if ac == nil {
+		return errAuthRequired
+	}
+	if ac.IsAdmin {
+		return nil
+	}
+	if ac.DID != repoDID {
+		return errNotRepoOwner
+	}
+	return nil
+}
+
+// checkRepoWrite combines checkRepoAuth with the account status policy:
+// disabled and removed accounts cannot change their repository.
+func checkRepoWrite(c echo.Context, acct *account.Account) error {
+	if err := checkRepoAuth(c, acct.DID); err != nil {
+		return err
+	}
+	return account.CanWrite(acct.Status)
+}
+
+// checkRepoAvailable enforces the sync policy for a repo: accounts that
+// don't sync to relays are hidden from external consumers, but remain
+// visible to the admin key, the account itself, its domain's operators
+// and the configured moderation services. Public endpoints don't run
+// auth middleware, so the caller is identified from the optional Bearer
+// token here.
+func (s *Server) checkRepoAvailable(c echo.Context, acct *account.Account) error {
+	if account.Syncs(acct.Status) {
+		return nil
+	}
+
+	if ac := s.optionalAuth(c); ac != nil {
+		if ac.IsAdmin || ac.DID == acct.DID {
+			return nil
+		}
+		if ac.Service && slices.Contains(s.cfg.ModerationDIDs, ac.DID) {
+			return nil
+		}
+		ctx := c.Request().Context()
+		if domainName, err := s.mgmtDB.LookupDIDDomain(ctx, acct.DID); err == nil && s.canManageDomain(ctx, ac, domainName) {
+			return nil
+		}
+	}
+
+	_, reason := account.HostingStatus(acct.Status)
+	return &repoUnavailableError{reason: reason}
+}
+
+// optionalAuth identifies the caller from a Bearer admin key or access
+// token, or a DPoP-bound OAuth token, if one is present and valid.
+// Service auth tokens are only accepted on serviceAuthMethods. It
+// returns nil otherwise.
+func (s *Server) optionalAuth(c echo.Context) *authContext {
+	if token := extractDPoP(c); token != "" {
+		ac, _ := s.dpopAuth(c, token)
+		return ac
+	}
+	token := extractBearer(c)
+	if token == "" {
+		return nil
+	}
+	if token == s.cfg.AdminKey {
+		return &authContext{IsAdmin: true}
+	}
+	if isServiceAuthToken(token) {
+		ac, _ := s.serviceAuth(c, token, s.hostDomain(c))
+		return ac
+	}
+	if did, scope, err := s.jwt.ValidateAccessToken(c.Request().Context(), token); err == nil {
+		return &authContext{DID: did, Scope: scope}
+	}
+	return nil
+}
+
+// policyError maps authorization and account status errors to XRPC
+// error responses.
+func policyError(c echo.Context, err error) error {
+	var unavailable *repoUnavailableError
+	switch {
+	case errors.Is(err, errAuthRequired):
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error":   "AuthRequired",
+			"message": "Authentication required",
+		})
+	case errors.Is(err, errNotRepoOwner):
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error":   "Forbidden",
+			"message": "Cannot modify another account's repository",
+		})
+	case errors.Is(err, account.ErrAccountDeactivated):
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "AccountDeactivated",
+			"message": "Account is deactivated",
+		})
+	case errors.Is(err, account.ErrAccountTakedown):
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "AccountTakedown",
+			"message": "Account has been taken down",
+		})
+	case errors.As(err, &unavailable):
+		name := "RepoTakendown"
+		switch unavailable.reason {
+		case "suspended":
+			name = "RepoSuspended"
+		case "deactivated":
+			name = "RepoDeactivated"
+		}
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   name,
+			"message": "Repository is " + unavailable.reason,
+		})
+	default:
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error":   "Forbidden",
+			"message": err.Error(),
+		})
+	}
+}
@@ -1,7 +1,9 @@
 package server
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"strings"
@@ -10,7 +12,9 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/primal-host/primal-pds/internal/account"
 	"github.com/primal-host/primal-pds/internal/database"
+	"github.com/primal-host/primal-pds/internal/deletion"
 	"github.com/primal-host/primal-pds/internal/domain"
+	"github.com/primal-host/primal-pds/internal/handles"
 )
 
 // registerRoutes sets up all HTTP routes with proper auth groupings.
@@ -18,9 +22,23 @@ func (s *Server) registerRoutes() {
 	// --- Public endpoints (no auth) ---
 	s.echo.GET("/xrpc/_health", s.handleHealth)
 	s.echo.GET("/.well-known/atproto-did", s.handleAtprotoDID)
+	s.echo.GET("/.well-known/did.json", s.handleWebDIDDocument)
+
+	// OAuth authorization server (client authentication, PKCE and DPoP
+	// are checked by the handlers)
+	s.echo.GET("/.well-known/oauth-protected-resource", s.handleOAuthProtectedResource)
+	s.echo.GET("/.well-known/oauth-authorization-server", s.handleOAuthAuthorizationServer)
+	s.echo.POST("/oauth/par", s.handleOAuthPAR)
+	s.echo.GET("/oauth/authorize", s.handleOAuthAuthorizePage)
+	s.echo.POST("/oauth/authorize", s.handleOAuthAuthorize)
+	s.echo.POST("/oauth/token", s.handleOAuthToken)
+	s.echo.POST("/oauth/revoke", s.handleOAuthRevoke)
 
 	// AT Protocol server discovery
 	s.echo.POST("/xrpc/com.atproto.server.createSession", s.handleCreateSession)
+	// createAccount checks its own bearer token: the admin key, or a
+	// service auth token for an account moving in.
+	s.echo.POST("/xrpc/com.atproto.server.createAccount", s.handleCreateAccountXRPC)
 	s.echo.GET("/xrpc/com.atproto.server.describeServer", s.handleDescribeServer)
 
 	// AT Protocol identity
@@ -38,19 +56,52 @@ func (s *Server) registerRoutes() {
 	s.echo.GET("/xrpc/com.atproto.sync.getBlob", s.handleGetBlob)
 	s.echo.POST("/xrpc/com.atproto.sync.requestCrawl", s.handleRequestCrawl)
 
+	// Self-service deletion (password + emailed token, no session)
+	s.echo.POST("/xrpc/com.atproto.server.deleteAccount", s.handleDeleteOwnAccount)
+
+	// JSON firehose for internal tools (public)
+	s.echo.GET("/xrpc/host.primal.pds.jetstream", s.handleJetstream)
+
 	// --- Refresh token auth ---
 	refresh := s.echo.Group("", s.requireRefresh)
 	refresh.POST("/xrpc/com.atproto.server.refreshSession", s.handleRefreshSession)
 	refresh.POST("/xrpc/com.atproto.server.deleteSession", s.handleDeleteSession)
 
 	// --- Access token or admin key (requireAuth) ---
+	// Routes with requireFullAccess manage the account or its domain and
+	// refuse sessions started with an app password.
 	authed := s.echo.Group("", s.requireAuth)
+	full := s.requireFullAccess
 	authed.GET("/xrpc/com.atproto.server.getSession", s.handleGetSession)
-	authed.POST("/xrpc/com.atproto.server.createAccount", s.handleCreateAccountXRPC)
+	authed.POST("/xrpc/com.atproto.server.deactivateAccount", s.handleDeactivateAccount, full)
+	authed.POST("/xrpc/com.atproto.server.activateAccount", s.handleActivateAccount, full)
+	authed.GET("/xrpc/com.atproto.server.checkAccountStatus", s.handleCheckAccountStatus)
+	authed.GET("/xrpc/com.atproto.server.getServiceAuth", s.handleGetServiceAuth)
+	authed.POST("/xrpc/com.atproto.server.createAppPassword", s.handleCreateAppPassword, full)
+	authed.GET("/xrpc/com.atproto.server.listAppPasswords", s.handleListAppPasswords, full)
+	authed.POST("/xrpc/com.atproto.server.revokeAppPassword", s.handleRevokeAppPassword, full)
+	authed.POST("/xrpc/com.atproto.identity.updateHandle", s.handleUpdateHandle, full)
+	authed.GET("/xrpc/com.atproto.identity.getRecommendedDidCredentials", s.handleGetRecommendedDIDCredentials, full)
+	authed.POST("/xrpc/com.atproto.identity.requestPlcOperationSignature", s.handleRequestPLCOperationSignature, full)
+	authed.POST("/xrpc/com.atproto.identity.signPlcOperation", s.handleSignPLCOperation, full)
+	authed.POST("/xrpc/com.atproto.identity.submitPlcOperation", s.handleSubmitPLCOperation, full)
+	authed.POST("/xrpc/com.atproto.server.requestAccountDelete", s.handleRequestAccountDelete, full)
 	authed.POST("/xrpc/com.atproto.repo.createRecord", s.handleCreateRecord)
 	authed.POST("/xrpc/com.atproto.repo.deleteRecord", s.handleDeleteRecord)
 	authed.POST("/xrpc/com.atproto.repo.putRecord", s.handlePutRecord)
 	authed.POST("/xrpc/com.atproto.repo.uploadBlob", s.handleUploadBlob)
+	authed.POST("/xrpc/com.atproto.repo.importRepo", s.handleImportRepo, full)
+	authed.GET("/xrpc/com.atproto.repo.listMissingBlobs", s.handleListMissingBlobs)
+	authed.GET("/xrpc/host.primal.pds.subscribeDomain", s.handleSubscribeDomain, full)
+	authed.POST("/xrpc/host.primal.pds.updateHandle", s.handleRenameAccount, full)
+
+	// Webhooks (admin key or the domain's owner/admin accounts)
+	authed.POST("/xrpc/host.primal.pds.createWebhook", s.handleCreateWebhook, full)
+	authed.GET("/xrpc/host.primal.pds.listWebhooks", s.handleListWebhooks, full)
+	authed.POST("/xrpc/host.primal.pds.updateWebhook", s.handleUpdateWebhook, full)
+	authed.POST("/xrpc/host.primal.pds.deleteWebhook", s.handleDeleteWebhook, full)
+	authed.GET("/xrpc/host.primal.pds.listWebhookDeliveries", s.handleListWebhookDeliveries, full)
+	authed.POST("/xrpc/host.primal.pds.retryWebhookDelivery", s.handleRetryWebhookDelivery, full)
 
 	// --- Admin key only (management API) ---
 	admin := s.echo.Group("", s.adminAuth)
@@ -67,6 +118,15 @@ func (s *Server) registerRoutes() {
 	admin.GET("/xrpc/host.primal.pds.getAccount", s.handleGetAccount)
 	admin.POST("/xrpc/host.primal.pds.updateAccount", s.handleUpdateAccount)
 	admin.POST("/xrpc/host.primal.pds.deleteAccount", s.handleDeleteAccount)
+	admin.GET("/xrpc/host.primal.pds.listDeletions", s.handleListDeletions)
+	admin.POST("/xrpc/host.primal.pds.resubmitPlc", s.handleResubmitPLC)
+	admin.POST("/xrpc/host.primal.pds.updatePlc", s.handleUpdatePLC)
+	admin.GET("/xrpc/host.primal.pds.getPlcLog", s.handleGetPLCLog)
+	admin.GET("/xrpc/host.primal.pds.listCustomHandles", s.handleListCustomHandles)
+
+	// Server keys
+	admin.POST("/xrpc/host.primal.pds.rotateJwtKey", s.handleRotateJWTKey)
+	admin.POST("/xrpc/host.primal.pds.revokeSessions", s.handleRevokeSessions)
 }
 
 // tenantStore creates an ephemeral account.Store backed by a tenant pool.
@@ -96,40 +156,22 @@ func (s *Server) handleHealth(c echo.Context) error {
 
 // handleAtprotoDID resolves a DID for the handle implied by the Host
 // header. The Host header (e.g., "alice.1440.news") is looked up in the
-// tenant database to find the corresponding DID.
+// tenant database to find the corresponding DID. Custom-domain handles
+// whose domain routes this path here resolve too.
 func (s *Server) handleAtprotoDID(c echo.Context) error {
-	handle := stripPort(c.Request().Host)
+	handle := strings.ToLower(stripPort(c.Request().Host))
 	ctx := c.Request().Context()
 
-	// Extract domain from handle by trying progressively shorter suffixes.
-	// e.g., "alice.1440.news" → try "1440.news", then "news"
-	domainName := ""
-	parts := strings.Split(handle, ".")
-	for i := 1; i < len(parts); i++ {
-		candidate := strings.Join(parts[i:], ".")
-		pool := s.pools.Get(candidate)
-		if pool != nil {
-			domainName = candidate
-			break
-		}
-	}
-
-	if domainName == "" {
-		// Maybe the handle IS the domain (bare domain handle like "1440.news").
-		pool := s.pools.Get(handle)
-		if pool != nil {
-			domainName = handle
-		}
-	}
-
-	if domainName == "" {
+	// Find the tenant: by domain suffix (e.g., "alice.1440.news" →
+	// "1440.news"), the bare domain itself, or the custom handle index.
+	domainName := s.handleDomain(ctx, handle)
+	pool := s.pools.Get(domainName)
+	if domainName == "" || pool == nil {
 		return c.JSON(http.StatusNotFound, map[string]string{
 			"error":   "AccountNotFound",
 			"message": "No account found for handle: " + handle,
 		})
 	}
-
-	pool := s.pools.Get(domainName)
 	accounts := s.tenantStore(pool)
 
 	did, err := accounts.ResolveHandle(ctx, handle)
@@ -155,7 +197,8 @@ func (s *Server) handleAtprotoDID(c echo.Context) error {
 // =====================================================================
 
 type addDomainRequest struct {
-	Domain string `json:"domain"`
+	Domain    string `json:"domain"`
+	DIDMethod string `json:"didMethod"`
 }
 
 // addDomainResponse includes the domain and its auto-created owner account.
@@ -167,7 +210,8 @@ type addDomainResponse struct {
 
 // handleAddDomain creates a new hosted domain, provisions a tenant
 // database, auto-creates the domain admin (owner) account, and
-// regenerates the Traefik routing config.
+// regenerates the Traefik routing config. With didMethod "web" the owner
+// is identified by did:web:<domain> instead of a did:plc.
 func (s *Server) handleAddDomain(c echo.Context) error {
 	var req addDomainRequest
 	if err := c.Bind(&req); err != nil {
@@ -184,6 +228,12 @@ func (s *Server) handleAddDomain(c echo.Context) error {
 			"message": "domain is required",
 		})
 	}
+	if !validDIDMethod(req.DIDMethod) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "didMethod must be 'plc' or 'web'",
+		})
+	}
 
 	ctx := c.Request().Context()
 
@@ -238,7 +288,9 @@ func (s *Server) handleAddDomain(c echo.Context) error {
 		Handle:          req.Domain,
 		Password:        adminPass,
 		Role:            account.RoleOwner,
+		DIDMethod:       req.DIDMethod,
 		ServiceEndpoint: s.serviceEndpointForDomain(req.Domain),
+		RotationKey:     s.rotationKey,
 	})
 	if err != nil {
 		log.Printf("Error creating admin account for domain %q: %v", req.Domain, err)
@@ -257,6 +309,7 @@ func (s *Server) handleAddDomain(c echo.Context) error {
 	if err := s.repos.InitRepo(ctx, pool, adminAcct.DID, adminAcct.SigningKey); err != nil {
 		log.Printf("Warning: failed to init repo for admin %s: %v", adminAcct.DID, err)
 	}
+	s.notifyRegistrar()
 
 	s.refreshTraefik(c)
 	log.Printf("Domain added: %s (admin: %s, did: %s, db: %s)", req.Domain, adminAcct.Handle, adminAcct.DID, d.DBName)
@@ -394,17 +447,21 @@ func (s *Server) handleRemoveDomain(c echo.Context) error {
 // =====================================================================
 
 type createAccountRequest struct {
-	Domain   string `json:"domain"`
-	Handle   string `json:"handle"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
-	Role     string `json:"role"`
+	Domain      string `json:"domain"`
+	Handle      string `json:"handle"`
+	Email       string `json:"email"`
+	Password    string `json:"password"`
+	Role        string `json:"role"`
+	DIDMethod   string `json:"didMethod"`
+	RecoveryKey string `json:"recoveryKey"`
 }
 
 // handleCreateAccount creates a new account under a domain. The handle
 // is automatically suffixed with the domain if not already (e.g.,
 // "alice" under "1440.news" becomes "alice.1440.news"). If password is
-// omitted, one is auto-generated and returned.
+// omitted, one is auto-generated and returned. didMethod "web" gives the
+// account did:web:<handle> instead of a did:plc. recoveryKey optionally
+// adds a user-held did:key to the new did:plc's rotation keys.
 func (s *Server) handleCreateAccount(c echo.Context) error {
 	var req createAccountRequest
 	if err := c.Bind(&req); err != nil {
@@ -430,6 +487,29 @@ func (s *Server) handleCreateAccount(c echo.Context) error {
 		})
 	}
 
+	if !validDIDMethod(req.DIDMethod) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "didMethod must be 'plc' or 'web'",
+		})
+	}
+
+	req.RecoveryKey = strings.TrimSpace(req.RecoveryKey)
+	if req.RecoveryKey != "" {
+		if req.DIDMethod == account.DIDMethodWeb {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error":   "InvalidRequest",
+				"message": "recoveryKey only applies to did:plc accounts",
+			})
+		}
+		if err := account.ValidateRecoveryKey(req.RecoveryKey); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error":   "InvalidRequest",
+				"message": "recoveryKey must be a did:key",
+			})
+		}
+	}
+
 	// Validate role if provided.
 	switch req.Role {
 	case "", account.RoleUser, account.RoleAdmin:
@@ -496,12 +576,34 @@ func (s *Server) handleCreateAccount(c echo.Context) error {
 		autoGenerated = true
 	}
 
+	var webDID string
+	if req.DIDMethod == account.DIDMethodWeb {
+		webDID = account.WebDID(fullHandle)
+	}
+	reserved, err := s.handleReserved(ctx, fullHandle, webDID)
+	if err != nil {
+		log.Printf("Error checking deleted handles for %q: %v", fullHandle, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to create account",
+		})
+	}
+	if reserved {
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error":   "HandleTaken",
+			"message": "Handle is reserved: " + fullHandle,
+		})
+	}
+
 	acct, err := accounts.Create(ctx, account.CreateParams{
 		Handle:          fullHandle,
 		Email:           req.Email,
 		Password:        password,
 		Role:            req.Role,
+		DIDMethod:       req.DIDMethod,
 		ServiceEndpoint: s.serviceEndpointForDomain(req.Domain),
+		RotationKey:     s.rotationKey,
+		RecoveryKey:     req.RecoveryKey,
 	})
 	if err != nil {
 		if isDuplicateKey(err) {
@@ -526,6 +628,7 @@ func (s *Server) handleCreateAccount(c echo.Context) error {
 	if err := s.repos.InitRepo(ctx, pool, acct.DID, acct.SigningKey); err != nil {
 		log.Printf("Warning: failed to init repo for %s: %v", acct.DID, err)
 	}
+	s.notifyRegistrar()
 
 	log.Printf("Account created: %s (did: %s, role: %s, domain: %s)", acct.Handle, acct.DID, acct.Role, req.Domain)
 
@@ -592,7 +695,7 @@ func (s *Server) handleListAccounts(c echo.Context) error {
 func (s *Server) handleGetAccount(c echo.Context) error {
 	ctx := c.Request().Context()
 	handle := c.QueryParam("handle")
-	did := c.QueryParam("did")
+	did := account.NormalizeDID(c.QueryParam("did"))
 
 	if handle == "" && did == "" {
 		return c.JSON(http.StatusBadRequest, map[string]string{
@@ -616,7 +719,7 @@ func (s *Server) handleGetAccount(c echo.Context) error {
 		}
 	} else {
 		// Extract domain from handle suffix.
-		domainName = extractDomainFromHandle(handle, s.pools)
+		domainName = s.handleDomain(ctx, handle)
 		if domainName == "" {
 			return c.JSON(http.StatusNotFound, map[string]string{
 				"error":   "AccountNotFound",
@@ -658,13 +761,15 @@ func (s *Server) handleGetAccount(c echo.Context) error {
 }
 
 type updateAccountRequest struct {
-	Handle string `json:"handle"`
-	Status string `json:"status"`
-	Role   string `json:"role"`
+	Handle    string `json:"handle"`
+	Status    string `json:"status"`
+	Role      string `json:"role"`
+	NewHandle string `json:"newHandle"`
 }
 
-// handleUpdateAccount modifies an account's status and/or role.
-// At least one of status or role must be provided.
+// handleUpdateAccount modifies an account's status, role and/or handle.
+// At least one of status, role or newHandle must be provided. A handle
+// change follows the rules of com.atproto.identity.updateHandle.
 func (s *Server) handleUpdateAccount(c echo.Context) error {
 	var req updateAccountRequest
 	if err := c.Bind(&req); err != nil {
@@ -682,17 +787,28 @@ func (s *Server) handleUpdateAccount(c echo.Context) error {
 		})
 	}
 
-	if req.Status == "" && req.Role == "" {
+	if req.Status == "" && req.Role == "" && req.NewHandle == "" {
 		return c.JSON(http.StatusBadRequest, map[string]string{
 			"error":   "InvalidRequest",
-			"message": "at least one of status or role is required",
+			"message": "at least one of status, role or newHandle is required",
 		})
 	}
 
+	var newHandle string
+	if req.NewHandle != "" {
+		var err error
+		if newHandle, err = normalizeHandle(req.NewHandle); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error":   "InvalidHandle",
+				"message": err.Error(),
+			})
+		}
+	}
+
 	ctx := c.Request().Context()
 
 	// Resolve domain from handle.
-	domainName := extractDomainFromHandle(req.Handle, s.pools)
+	domainName := s.handleDomain(ctx, req.Handle)
 	if domainName == "" {
 		return c.JSON(http.StatusNotFound, map[string]string{
 			"error":   "AccountNotFound",
@@ -708,53 +824,70 @@ func (s *Server) handleUpdateAccount(c echo.Context) error {
 		})
 	}
 
+	switch req.Status {
+	case "", account.StatusActive, account.StatusSuspended, account.StatusDisabled, account.StatusDeactivated, account.StatusRemoved:
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "status must be 'active', 'suspended', 'disabled', 'deactivated', or 'removed'",
+		})
+	}
+	switch req.Role {
+	case "", account.RoleAdmin, account.RoleUser:
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "role must be 'admin' or 'user'",
+		})
+	}
+
 	accounts := s.tenantStore(pool)
-	var result *account.Account
+	result, err := accounts.GetByHandle(ctx, req.Handle)
+	if err != nil {
+		return accountError(c, err, req.Handle)
+	}
 
-	// Update status if provided.
-	if req.Status != "" {
-		switch req.Status {
-		case account.StatusActive, account.StatusSuspended, account.StatusDisabled, account.StatusRemoved:
-		default:
-			return c.JSON(http.StatusBadRequest, map[string]string{
-				"error":   "InvalidRequest",
-				"message": "status must be 'active', 'suspended', 'disabled', or 'removed'",
-			})
+	// Change the handle first: it is the update most likely to be
+	// refused, and a refusal then leaves the account untouched.
+	if newHandle != "" {
+		acct := result
+		if result, err = s.changeHandle(ctx, domainName, pool, acct, newHandle); err != nil {
+			return handleChangeError(c, err, acct, newHandle)
 		}
+	}
 
-		result, err = accounts.UpdateStatus(ctx, req.Handle, req.Status)
+	// Update status if provided.
+	if req.Status != "" {
+		before := result.Status
+		result, err = accounts.UpdateStatus(ctx, result.Handle, req.Status)
 		if err != nil {
 			return accountError(c, err, req.Handle)
 		}
+		s.announceStatus(ctx, domainName, before, result)
 	}
 
 	// Update role if provided.
 	if req.Role != "" {
-		switch req.Role {
-		case account.RoleAdmin, account.RoleUser:
-		default:
-			return c.JSON(http.StatusBadRequest, map[string]string{
-				"error":   "InvalidRequest",
-				"message": "role must be 'admin' or 'user'",
-			})
-		}
-
-		result, err = accounts.UpdateRole(ctx, req.Handle, req.Role)
+		result, err = accounts.UpdateRole(ctx, result.Handle, req.Role)
 		if err != nil {
 			return accountError(c, err, req.Handle)
 		}
 	}
 
-	log.Printf("Account updated: %s (status=%s, role=%s)", req.Handle, req.Status, req.Role)
+	log.Printf("Account updated: %s (status=%s, role=%s, newHandle=%s)", req.Handle, req.Status, req.Role, newHandle)
 	return c.JSON(http.StatusOK, result)
 }
 
 type deleteAccountRequest struct {
-	Handle string `json:"handle"`
+	Handle      string `json:"handle"`
+	PurgeEvents bool   `json:"purgeEvents"`
 }
 
-// handleDeleteAccount permanently removes an account. Owner accounts
-// cannot be deleted — remove the domain instead.
+// handleDeleteAccount permanently deletes an account. The account row and
+// DID routing are removed immediately; repo blocks, blobs and, with
+// purgeEvents, the account's commit events are purged by the deletion
+// worker, which also announces the deletion and tombstones the DID.
+// Owner accounts cannot be deleted — remove the domain instead.
 func (s *Server) handleDeleteAccount(c echo.Context) error {
 	var req deleteAccountRequest
 	if err := c.Bind(&req); err != nil {
@@ -775,7 +908,7 @@ func (s *Server) handleDeleteAccount(c echo.Context) error {
 	ctx := c.Request().Context()
 
 	// Resolve domain from handle.
-	domainName := extractDomainFromHandle(req.Handle, s.pools)
+	domainName := s.handleDomain(ctx, req.Handle)
 	if domainName == "" {
 		return c.JSON(http.StatusNotFound, map[string]string{
 			"error":   "AccountNotFound",
@@ -791,26 +924,160 @@ func (s *Server) handleDeleteAccount(c echo.Context) error {
 		})
 	}
 
-	accounts := s.tenantStore(pool)
-
-	// Get the account first to find the DID for routing cleanup.
-	acct, err := accounts.GetByHandle(ctx, req.Handle)
+	acct, err := s.tenantStore(pool).GetByHandle(ctx, req.Handle)
 	if err != nil {
 		return accountError(c, err, req.Handle)
 	}
 
-	if err := accounts.Delete(ctx, req.Handle); err != nil {
+	if err := s.deleteAccount(ctx, domainName, pool, acct, req.PurgeEvents); err != nil {
 		return accountError(c, err, req.Handle)
 	}
 
-	// Remove DID routing.
+	log.Printf("Account deleted: %s", req.Handle)
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Account deleted: " + req.Handle,
+	})
+}
+
+// deleteAccount queues the deletion job, then removes the account row and
+// DID routing so the account stops working at once. The job is written
+// first: if anything after it fails, the worker still finishes the job.
+func (s *Server) deleteAccount(ctx context.Context, domainName string, pool *pgxpool.Pool, acct *account.Account, purgeEvents bool) error {
+	if acct.Role == account.RoleOwner {
+		return fmt.Errorf("%w: cannot delete owner account directly, remove the domain instead", account.ErrOwnerProtected)
+	}
+
+	err := s.deletions.Queue(ctx, &deletion.Job{
+		DID:         acct.DID,
+		Handle:      acct.Handle,
+		Domain:      domainName,
+		SigningKey:  acct.SigningKey,
+		PurgeEvents: purgeEvents,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := s.tenantStore(pool).Delete(ctx, acct.Handle); err != nil && !errors.Is(err, account.ErrNotFound) {
+		return err
+	}
 	if err := s.mgmtDB.DeleteDIDRouting(ctx, acct.DID); err != nil {
 		log.Printf("Warning: failed to delete DID routing for %s: %v", acct.DID, err)
 	}
+	if err := s.handles.Release(ctx, acct.DID); err != nil {
+		log.Printf("Warning: failed to release custom handle of %s: %v", acct.DID, err)
+	}
+	if _, err := s.jwt.RevokeAll(ctx, acct.DID); err != nil {
+		log.Printf("Warning: failed to revoke sessions of %s: %v", acct.DID, err)
+	}
 
-	log.Printf("Account deleted: %s", req.Handle)
+	if s.deleter != nil {
+		s.deleter.Notify()
+	}
+	return nil
+}
+
+// handleListDeletions returns a domain's account deletion records,
+// including jobs that are still being processed.
+// GET /xrpc/host.primal.pds.listDeletions?domain=...
+func (s *Server) handleListDeletions(c echo.Context) error {
+	domainName := strings.TrimSpace(strings.ToLower(c.QueryParam("domain")))
+	if domainName == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "domain query parameter is required",
+		})
+	}
+
+	jobs, err := s.deletions.List(c.Request().Context(), domainName)
+	if err != nil {
+		log.Printf("Error listing deletions for %q: %v", domainName, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to list deletions",
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"deletions": jobs,
+	})
+}
+
+// handleRotateJWTKey makes a new key the session signing key. Tokens
+// signed by the previous key stay valid until they expire.
+// POST /xrpc/host.primal.pds.rotateJwtKey
+func (s *Server) handleRotateJWTKey(c echo.Context) error {
+	kid, err := s.jwt.Rotate(c.Request().Context())
+	if err != nil {
+		log.Printf("Error rotating JWT key: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to rotate key",
+		})
+	}
+	log.Printf("JWT key rotated: now signing with %s", kid)
 	return c.JSON(http.StatusOK, map[string]string{
-		"message": "Account deleted: " + req.Handle,
+		"kid": kid,
+	})
+}
+
+// revokeSessionsRequest is the JSON body for revokeSessions.
+type revokeSessionsRequest struct {
+	Handle string `json:"handle"`
+}
+
+// handleRevokeSessions signs an account out everywhere: every session
+// is revoked, with its access and refresh tokens.
+// POST /xrpc/host.primal.pds.revokeSessions
+func (s *Server) handleRevokeSessions(c echo.Context) error {
+	var req revokeSessionsRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "Invalid JSON body",
+		})
+	}
+
+	req.Handle = strings.TrimSpace(strings.ToLower(req.Handle))
+	if req.Handle == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "handle is required",
+		})
+	}
+
+	ctx := c.Request().Context()
+	domainName := s.handleDomain(ctx, req.Handle)
+	if domainName == "" {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error":   "AccountNotFound",
+			"message": "Account not found: " + req.Handle,
+		})
+	}
+	pool, err := s.resolveDomainPool(c, domainName)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error":   "AccountNotFound",
+			"message": "Account not found: " + req.Handle,
+		})
+	}
+	acct, err := s.tenantStore(pool).GetByHandle(ctx, req.Handle)
+	if err != nil {
+		return accountError(c, err, req.Handle)
+	}
+
+	n, err := s.jwt.RevokeAll(ctx, acct.DID)
+	if err != nil {
+		log.Printf("Error revoking sessions of %s: %v", acct.DID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to revoke sessions",
+		})
+	}
+
+	log.Printf("Sessions revoked: %s (%d)", req.Handle, n)
+	return c.JSON(http.StatusOK, map[string]any{
+		"did":     acct.DID,
+		"revoked": n,
 	})
 }
 
@@ -827,6 +1094,50 @@ func (s *Server) serviceEndpointForDomain(domainName string) string {
 	return "https://" + domainName
 }
 
+// canManageDomain reports whether the caller may act for a hosted
+// domain: the admin key always can, and accounts with the owner or admin
+// role can for the domain they belong to.
+func (s *Server) canManageDomain(ctx context.Context, ac *authContext, domainName string) bool {
+	if ac == nil {
+		return false
+	}
+	if ac.IsAdmin {
+		return true
+	}
+
+	home, err := s.mgmtDB.LookupDIDDomain(ctx, ac.DID)
+	if err != nil || home != domainName {
+		return false
+	}
+	pool := s.pools.Get(domainName)
+	if pool == nil {
+		return false
+	}
+	acct, err := s.tenantStore(pool).GetByDID(ctx, ac.DID)
+	if err != nil {
+		return false
+	}
+	return acct.Role == account.RoleOwner || acct.Role == account.RoleAdmin
+}
+
+// announceStatus emits an #account event when a status change alters
+// whether the account's repo is served, so relays and other consumers
+// stop or resume syncing it. Failures are logged; the status change
+// itself has already been applied.
+func (s *Server) announceStatus(ctx context.Context, domainName, oldStatus string, acct *account.Account) {
+	if s.events == nil {
+		return
+	}
+	wasActive, oldReason := account.HostingStatus(oldStatus)
+	active, reason := account.HostingStatus(acct.Status)
+	if wasActive == active && oldReason == reason {
+		return
+	}
+	if err := s.events.EmitAccount(ctx, acct.DID, domainName, active, reason); err != nil {
+		log.Printf("Warning: failed to emit account event for %s: %v", acct.DID, err)
+	}
+}
+
 // refreshTraefik regenerates the Traefik dynamic config file.
 func (s *Server) refreshTraefik(c echo.Context) {
 	if err := s.domains.WriteTraefikConfig(c.Request().Context(), s.cfg.TraefikConfigDir); err != nil {
@@ -856,6 +1167,28 @@ func accountError(c echo.Context, err error, handle string) error {
 	}
 }
 
+// handleDomain returns the hosted domain whose tenant holds the account
+// with the given handle: the domain the handle ends with, or for a
+// custom-domain handle the domain recorded in the handle index. Custom
+// handles that no longer verify are not resolved. Returns "" if the
+// handle is not hosted here.
+func (s *Server) handleDomain(ctx context.Context, handle string) string {
+	if domainName := extractDomainFromHandle(handle, s.pools); domainName != "" {
+		return domainName
+	}
+	entry, err := s.handles.Lookup(ctx, handle)
+	if err != nil {
+		if !errors.Is(err, handles.ErrNotFound) {
+			log.Printf("Warning: handle index lookup for %q: %v", handle, err)
+		}
+		return ""
+	}
+	if entry.Status != handles.StatusValid {
+		return ""
+	}
+	return entry.Domain
+}
+
 // extractDomainFromHandle extracts the domain name from a handle by
 // trying progressively shorter suffixes against the pool manager.
 // e.g., "alice.1440.news" → "1440.news" if that pool exists.
@@ -7,6 +7,7 @@ import (
 	"context"
 	"log"
 	"net/http"
+	"slices"
 	"strings"
 
 	"github.com/labstack/echo/v4"
@@ -15,43 +16,82 @@ import (
 	"github.com/primal-host/primal-pds/internal/blob"
 	"github.com/primal-host/primal-pds/internal/config"
 	"github.com/primal-host/primal-pds/internal/database"
+	"github.com/primal-host/primal-pds/internal/deletion"
 	"github.com/primal-host/primal-pds/internal/domain"
 	"github.com/primal-host/primal-pds/internal/events"
+	"github.com/primal-host/primal-pds/internal/handles"
+	"github.com/primal-host/primal-pds/internal/identity"
+	"github.com/primal-host/primal-pds/internal/mail"
+	"github.com/primal-host/primal-pds/internal/oauth"
 	"github.com/primal-host/primal-pds/internal/repo"
+	"github.com/primal-host/primal-pds/internal/webhook"
 )
 
 // Server wraps the Echo instance and application dependencies.
 type Server struct {
-	echo    *echo.Echo
-	cfg     *config.Config
-	mgmtDB  *database.ManagementDB
-	pools   *database.PoolManager
-	domains *domain.Store
-	repos   *repo.Manager
-	events  *events.Manager
-	jwt     *auth.JWTManager
-	blobs   *blob.Store
+	echo        *echo.Echo
+	cfg         *config.Config
+	mgmtDB      *database.ManagementDB
+	pools       *database.PoolManager
+	domains     *domain.Store
+	repos       *repo.Manager
+	events      *events.Manager
+	sequencer   *events.Sequencer
+	dispatcher  *webhook.Dispatcher
+	webhooks    *webhook.Store
+	deleter     *deletion.Worker
+	deletions   *deletion.Store
+	registrar   *identity.Registrar
+	rotationKey string // PLC rotation key (multibase); empty without a PLC directory
+	serviceKey  string // service DID key (multibase); empty without keySecret
+	handles     *handles.Store
+	resolver    handles.Resolver
+	dir         *identity.Resolver // resolves other servers' DIDs and handles
+	jwt         *auth.JWTManager
+	blobs       *blob.Store
+	mailer      mail.Mailer
+
+	oauthRequests *oauth.Store
+	oauthClients  *oauth.ClientResolver
+	dpop          *oauth.DPoP
 }
 
 // New creates a configured Echo server with all routes registered.
-func New(cfg *config.Config, mgmtDB *database.ManagementDB, pools *database.PoolManager, domains *domain.Store, repos *repo.Manager, evts *events.Manager, jwtMgr *auth.JWTManager) *Server {
+func New(cfg *config.Config, mgmtDB *database.ManagementDB, pools *database.PoolManager, domains *domain.Store, repos *repo.Manager, evts *events.Manager, seq *events.Sequencer, hooks *webhook.Dispatcher, deletions *deletion.Store, deleter *deletion.Worker, registrar *identity.Registrar, rotationKey, serviceKey string, resolver handles.Resolver, dir *identity.Resolver, jwtMgr *auth.JWTManager, oauthStore *oauth.Store) *Server {
 	e := echo.New()
 	e.HideBanner = true
 	e.HidePort = true // We log the listen address ourselves.
 
 	e.Use(middleware.Recover())
 	e.Use(middleware.Logger())
+	e.Use(oauthCORS)
 
 	s := &Server{
-		echo:    e,
-		cfg:     cfg,
-		mgmtDB:  mgmtDB,
-		pools:   pools,
-		domains: domains,
-		repos:   repos,
-		events:  evts,
-		jwt:     jwtMgr,
-		blobs:   blob.NewStore(),
+		echo:        e,
+		cfg:         cfg,
+		mgmtDB:      mgmtDB,
+		pools:       pools,
+		domains:     domains,
+		repos:       repos,
+		events:      evts,
+		sequencer:   seq,
+		dispatcher:  hooks,
+		webhooks:    webhook.NewStore(mgmtDB),
+		deleter:     deleter,
+		deletions:   deletions,
+		registrar:   registrar,
+		rotationKey: rotationKey,
+		serviceKey:  serviceKey,
+		handles:     handles.NewStore(mgmtDB),
+		resolver:    resolver,
+		dir:         dir,
+		jwt:         jwtMgr,
+		blobs:       blob.NewStore(),
+		mailer:      mail.New(cfg.SMTPAddr, cfg.SMTPUser, cfg.SMTPPass, cfg.MailFrom, cfg.MailLog),
+
+		oauthRequests: oauthStore,
+		oauthClients:  oauth.NewClientResolver(oauthStore),
+		dpop:          oauth.NewDPoP(oauthStore, cfg.KeySecret),
 	}
 
 	s.registerRoutes()
@@ -62,6 +102,53 @@ func New(cfg *config.Config, mgmtDB *database.ManagementDB, pools *database.Pool
 type authContext struct {
 	DID     string
 	IsAdmin bool
+
+	// TokenID is the jti of a refresh token, naming its session.
+	TokenID string
+
+	// Scope is the scope of an access token: auth.ScopeAccess, an app
+	// password scope, or the OAuth scopes granted to ClientID.
+	Scope string
+
+	// ClientID is the OAuth client the access token was issued to.
+	ClientID string
+
+	// Service is set for another service calling with a service auth
+	// token issued by DID.
+	Service bool
+}
+
+// isAppPassword reports whether the caller signed in with an app
+// password rather than the account password.
+func (ac *authContext) isAppPassword() bool {
+	return ac.Scope == auth.ScopeAppPass || ac.Scope == auth.ScopeAppPassPrivileged
+}
+
+// isOAuth reports whether the caller is an OAuth client acting for the
+// account.
+func (ac *authContext) isOAuth() bool {
+	return ac.ClientID != ""
+}
+
+// isRestricted reports whether the caller holds less than the account
+// password: an app password, an OAuth client or a service auth token.
+func (ac *authContext) isRestricted() bool {
+	return ac.isAppPassword() || ac.isOAuth() || ac.Service
+}
+
+// isPrivileged reports whether the caller may reach private data such
+// as direct messages: the account password, a privileged app password,
+// or an OAuth client granted transition:chat.bsky.
+func (ac *authContext) isPrivileged() bool {
+	switch {
+	case ac.Service:
+		return false
+	case ac.isOAuth():
+		return slices.Contains(strings.Fields(ac.Scope), oauth.ScopeChat)
+	case ac.isAppPassword():
+		return ac.Scope == auth.ScopeAppPassPrivileged
+	}
+	return true
 }
 
 const authContextKey = "auth"
@@ -74,10 +161,22 @@ func getAuth(c echo.Context) *authContext {
 	return nil
 }
 
-// requireAuth is middleware that validates a Bearer token as either an
-// admin key or a JWT access token. Sets authContext on the request.
+// requireAuth is middleware that validates a Bearer token as an admin
+// key or a JWT access token, or a DPoP-bound OAuth access token. Sets
+// authContext on the request. Service auth tokens are not accepted
+// here; see serviceAuthMethods.
 func (s *Server) requireAuth(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
+		if token := extractDPoP(c); token != "" {
+			c.Response().Header().Set("DPoP-Nonce", s.dpop.Nonce())
+			ac, err := s.dpopAuth(c, token)
+			if err != nil {
+				return dpopAuthError(c, err)
+			}
+			c.Set(authContextKey, ac)
+			return next(c)
+		}
+
 		token := extractBearer(c)
 		if token == "" {
 			return c.JSON(http.StatusUnauthorized, map[string]string{
@@ -93,7 +192,7 @@ func (s *Server) requireAuth(next echo.HandlerFunc) echo.HandlerFunc {
 		}
 
 		// Try JWT access token.
-		did, err := s.jwt.ValidateAccessToken(token)
+		did, scope, err := s.jwt.ValidateAccessToken(c.Request().Context(), token)
 		if err != nil {
 			return c.JSON(http.StatusUnauthorized, map[string]string{
 				"error":   "InvalidToken",
@@ -101,13 +200,30 @@ func (s *Server) requireAuth(next echo.HandlerFunc) echo.HandlerFunc {
 			})
 		}
 
-		c.Set(authContextKey, &authContext{DID: did})
+		c.Set(authContextKey, &authContext{DID: did, Scope: scope})
+		return next(c)
+	}
+}
+
+// requireFullAccess is route middleware, after requireAuth, for
+// endpoints that manage the account itself. Sessions started with an
+// app password, OAuth clients and service auth tokens are refused.
+func (s *Server) requireFullAccess(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if ac := getAuth(c); ac != nil && ac.isRestricted() {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error":   "InvalidToken",
+				"message": "Bad token scope: this action requires the account password",
+			})
+		}
 		return next(c)
 	}
 }
 
 // requireRefresh is middleware that validates a Bearer token as a JWT
-// refresh token. Sets authContext on the request.
+// refresh token. Refresh tokens of OAuth sessions are refused: they are
+// bound to a client and DPoP key and only rotate at /oauth/token. Sets
+// authContext on the request.
 func (s *Server) requireRefresh(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		token := extractBearer(c)
@@ -118,15 +234,25 @@ func (s *Server) requireRefresh(next echo.HandlerFunc) echo.HandlerFunc {
 			})
 		}
 
-		did, err := s.jwt.ValidateRefreshToken(token)
+		ctx := c.Request().Context()
+		did, jti, err := s.jwt.ValidateRefreshToken(ctx, token)
 		if err != nil {
 			return c.JSON(http.StatusUnauthorized, map[string]string{
 				"error":   "InvalidToken",
 				"message": "Invalid or expired refresh token",
 			})
 		}
+		if jti != "" {
+			sess, err := s.jwt.Session(ctx, jti)
+			if err == nil && sess.ClientID != "" {
+				return c.JSON(http.StatusBadRequest, map[string]string{
+					"error":   "InvalidToken",
+					"message": "OAuth refresh tokens must be used at the token endpoint",
+				})
+			}
+		}
 
-		c.Set(authContextKey, &authContext{DID: did})
+		c.Set(authContextKey, &authContext{DID: did, TokenID: jti})
 		return next(c)
 	}
 }
@@ -141,10 +267,25 @@ func extractBearer(c echo.Context) string {
 	return ""
 }
 
+// extractDPoP extracts the token from a DPoP Authorization header.
+func extractDPoP(c echo.Context) string {
+	h := c.Request().Header.Get("Authorization")
+	const prefix = "DPoP "
+	if len(h) > len(prefix) && strings.EqualFold(h[:len(prefix)], prefix) {
+		return h[len(prefix):]
+	}
+	return ""
+}
+
 // Start begins listening for HTTP requests. It blocks until the context
 // is cancelled, then performs a graceful shutdown allowing in-flight
-// requests to complete.
+// requests to complete. With a PLC directory configured it first starts
+// publishing the identities that changed while the server was down.
 func (s *Server) Start(ctx context.Context) error {
+	if s.cfg.PLCEndpoint != "" {
+		go s.publishIdentities(ctx)
+	}
+
 	errCh := make(chan error, 1)
 	go func() {
 		log.Printf("Listening on %s", s.cfg.ListenAddr)
@@ -0,0 +1,282 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/auth"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/primal-host/primal-pds/internal/account"
+	"github.com/primal-host/primal-pds/internal/identity"
+)
+
+// Lifetimes of the service auth tokens getServiceAuth signs for
+// accounts.
+const (
+	// maxServiceAuthTTL caps the exp a caller may ask for.
+	maxServiceAuthTTL = time.Hour
+
+	// maxUnboundServiceAuthTTL caps tokens not bound to a method, which
+	// any endpoint of the audience would accept.
+	maxUnboundServiceAuthTTL = time.Minute
+)
+
+// protectedMethods manage the account on its own PDS. getServiceAuth
+// refuses to sign tokens for them, or for any method under
+// protectedMethodPrefix, so a service holding one can't act as the
+// account here.
+var protectedMethods = []string{
+	"com.atproto.identity.getRecommendedDidCredentials",
+	"com.atproto.identity.requestPlcOperationSignature",
+	"com.atproto.identity.signPlcOperation",
+	"com.atproto.identity.submitPlcOperation",
+	"com.atproto.identity.updateHandle",
+	"com.atproto.repo.importRepo",
+	"com.atproto.server.activateAccount",
+	"com.atproto.server.createAppPassword",
+	"com.atproto.server.deactivateAccount",
+	"com.atproto.server.getServiceAuth",
+	"com.atproto.server.getSession",
+	"com.atproto.server.listAppPasswords",
+	"com.atproto.server.requestAccountDelete",
+	"com.atproto.server.revokeAppPassword",
+}
+
+// protectedMethodPrefix starts this server's management methods.
+const protectedMethodPrefix = "host.primal.pds."
+
+// privilegedMethods can only be signed for by privileged sessions, as
+// can every method under privilegedMethodPrefix (direct messages).
+// createAccount is among them since a token for it moves the account.
+var privilegedMethods = []string{
+	"com.atproto.server.createAccount",
+}
+
+// privilegedMethodPrefix starts the methods of direct messages.
+const privilegedMethodPrefix = "chat.bsky."
+
+// serviceAuthMethods are the only methods that accept service auth
+// tokens: getBlob, so moderation services can fetch blobs of accounts
+// that were taken down, and createAccount, for accounts moving here.
+// Everything else needs a session of this server.
+var serviceAuthMethods = []string{
+	"com.atproto.server.createAccount",
+	"com.atproto.sync.getBlob",
+}
+
+// errServiceAuth is returned for a service auth token that is missing,
+// malformed or fails verification.
+var errServiceAuth = errors.New("invalid service auth token")
+
+// serviceDID returns this server's did:web, derived from serviceURL, or
+// "" if no service URL is configured.
+func (s *Server) serviceDID() string {
+	return identity.ServiceDID(s.cfg.ServiceURL)
+}
+
+// verifyServiceAuth checks a service auth JWT: a short-lived token that
+// another server signs with the issuer DID's atproto key to call an
+// endpoint here on its behalf. The token must be scoped to the lexicon
+// method lxm and addressed to this server, either by its service DID or
+// as did:web:<domainName>. It returns the issuer.
+func (s *Server) verifyServiceAuth(ctx context.Context, token, domainName string, lxm syntax.NSID) (syntax.DID, error) {
+	var claims jwt.RegisteredClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(token, &claims); err != nil {
+		return "", fmt.Errorf("%w: %v", errServiceAuth, err)
+	}
+	var allowed []string
+	if domainName != "" {
+		allowed = append(allowed, "did:web:"+domainName)
+	}
+	if did := s.serviceDID(); did != "" {
+		allowed = append(allowed, did)
+	}
+	if len(claims.Audience) != 1 || !slices.Contains(allowed, claims.Audience[0]) {
+		return "", fmt.Errorf("%w: audience must be one of %s", errServiceAuth, strings.Join(allowed, ", "))
+	}
+
+	// A signature that doesn't verify makes the validator refetch the
+	// issuer's DID document once, in case its key was rotated.
+	v := auth.ServiceAuthValidator{Audience: claims.Audience[0], Dir: s.dir}
+	did, err := v.Validate(ctx, token, &lxm)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errServiceAuth, err)
+	}
+	return did, nil
+}
+
+// isServiceAuthToken reports whether token is shaped like a service auth
+// token, issued by a DID, rather than a session token of this server.
+func isServiceAuthToken(token string) bool {
+	var claims jwt.RegisteredClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(token, &claims); err != nil {
+		return false
+	}
+	return strings.HasPrefix(claims.Issuer, "did:")
+}
+
+// serviceAuth identifies the caller of an XRPC request made with a
+// service auth token, as the DID that issued it. The method called
+// must be one of serviceAuthMethods, and the token must be bound to it
+// and addressed to this server's service DID or to
+// did:web:<domainName>.
+func (s *Server) serviceAuth(c echo.Context, token, domainName string) (*authContext, error) {
+	method, ok := strings.CutPrefix(c.Request().URL.Path, "/xrpc/")
+	lxm, err := syntax.ParseNSID(method)
+	if !ok || err != nil {
+		return nil, fmt.Errorf("%w: not an XRPC method", errServiceAuth)
+	}
+	if !slices.Contains(serviceAuthMethods, method) {
+		return nil, fmt.Errorf("%w: not accepted for %s", errServiceAuth, method)
+	}
+	did, err := s.verifyServiceAuth(c.Request().Context(), token, domainName, lxm)
+	if err != nil {
+		return nil, err
+	}
+	return &authContext{DID: did.String(), Service: true}, nil
+}
+
+// migrationCaller identifies the caller of createAccount for an
+// existing DID, which must present a service auth token issued by that
+// DID and addressed to this server or did:web:<domainName>.
+func (s *Server) migrationCaller(c echo.Context, domainName, did string) (*authContext, error) {
+	caller, err := s.serviceAuth(c, extractBearer(c), domainName)
+	if err != nil {
+		return nil, err
+	}
+	if caller.DID != did {
+		return nil, fmt.Errorf("%w: issued by %s, not %s", errServiceAuth, caller.DID, did)
+	}
+	return caller, nil
+}
+
+// hostDomain returns the hosted domain a request was sent to, or "".
+func (s *Server) hostDomain(c echo.Context) string {
+	return extractDomainFromHandle(strings.ToLower(stripPort(c.Request().Host)), s.pools)
+}
+
+// isOwnAudience reports whether aud names this server, by its service
+// DID or the did:web of a hosted domain. Tokens addressed to it would
+// let their holder act as the account here.
+func (s *Server) isOwnAudience(aud syntax.DID) bool {
+	did := strings.ToLower(aud.String())
+	if did == strings.ToLower(s.serviceDID()) {
+		return true
+	}
+	host, ok := strings.CutPrefix(did, "did:web:")
+	return ok && s.pools.Get(host) != nil
+}
+
+// handleGetServiceAuth signs a service auth token with the caller's
+// signing key, for the caller to present to another service (a feed
+// generator, labeler or chat service) as itself.
+// GET /xrpc/com.atproto.server.getServiceAuth
+func (s *Server) handleGetServiceAuth(c echo.Context) error {
+	_, _, acct, err := s.sessionAccount(c)
+	if acct == nil {
+		return err
+	}
+	if err := account.CanLogin(acct.Status); err != nil {
+		return policyError(c, err)
+	}
+
+	aud, err := syntax.ParseDID(c.QueryParam("aud"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "aud must be a DID",
+		})
+	}
+	if s.isOwnAudience(aud) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "Cannot request a service auth token for this server",
+		})
+	}
+
+	var lxm syntax.NSID
+	if v := c.QueryParam("lxm"); v != "" {
+		if lxm, err = syntax.ParseNSID(v); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error":   "InvalidRequest",
+				"message": "lxm must be an NSID",
+			})
+		}
+	}
+
+	now := time.Now()
+	ttl := maxUnboundServiceAuthTTL
+	if v := c.QueryParam("exp"); v != "" {
+		exp, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error":   "InvalidRequest",
+				"message": "exp must be a unix timestamp",
+			})
+		}
+		ttl = time.Unix(exp, 0).Sub(now)
+	}
+	switch {
+	case ttl <= 0:
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "BadExpiration",
+			"message": "exp is in the past",
+		})
+	case ttl > maxServiceAuthTTL:
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "BadExpiration",
+			"message": "exp is too far in the future (at most one hour)",
+		})
+	case lxm == "" && ttl > maxUnboundServiceAuthTTL:
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "BadExpiration",
+			"message": "Tokens without lxm may last at most 60 seconds",
+		})
+	}
+
+	ac := getAuth(c)
+	switch {
+	case slices.Contains(protectedMethods, lxm.String()), strings.HasPrefix(lxm.String(), protectedMethodPrefix):
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "Cannot request a service auth token for " + lxm.String(),
+		})
+	case lxm == "" && ac.isRestricted():
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidToken",
+			"message": "Bad token scope: tokens without lxm require the account password",
+		})
+	case (slices.Contains(privilegedMethods, lxm.String()) || strings.HasPrefix(lxm.String(), privilegedMethodPrefix)) && !ac.isPrivileged():
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidToken",
+			"message": "Bad token scope: " + lxm.String() + " requires a privileged session",
+		})
+	}
+
+	if acct.SigningKey == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "Account has no signing key on this server",
+		})
+	}
+	token, err := identity.SignServiceAuth(acct.DID, aud.String(), lxm, acct.SigningKey, ttl)
+	if err != nil {
+		log.Printf("Error signing service auth for %s: %v", acct.DID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to sign service auth token",
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]string{
+		"token": token,
+	})
+}
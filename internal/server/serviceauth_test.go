@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/labstack/echo/v4"
+	"github.com/primal-host/primal-pds/internal/account"
+	"github.com/primal-host/primal-pds/internal/config"
+	"github.com/primal-host/primal-pds/internal/identity"
+	"github.com/primal-host/primal-pds/internal/repo"
+)
+
+const (
+	aliceDID = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	bobDID   = "did:plc:aaaaaaaaaaaaaaaaaaaaaaaa"
+)
+
+// fakeDIDs serves DID documents from a map.
+type fakeDIDs map[string]string
+
+func (f fakeDIDs) FetchDID(ctx context.Context, did string) ([]byte, error) {
+	doc, ok := f[did]
+	if !ok {
+		return nil, fmt.Errorf("no document for %s", did)
+	}
+	return []byte(doc), nil
+}
+
+// noHandles resolves no handle.
+type noHandles struct{}
+
+func (noHandles) LookupDNS(ctx context.Context, handle string) (string, error) {
+	return "", errors.New("no TXT record")
+}
+
+func (noHandles) LookupHTTPS(ctx context.Context, handle string) (string, error) {
+	return "", errors.New("HTTP 404")
+}
+
+// testIdentity returns a new signing key and a DID document for did
+// that publishes it.
+func testIdentity(t *testing.T, did string) (string, string) {
+	t.Helper()
+	key, err := repo.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	didKey, err := account.SigningDIDKey(key)
+	if err != nil {
+		t.Fatalf("SigningDIDKey: %v", err)
+	}
+	doc := fmt.Sprintf(`{
+		"id": %q,
+		"alsoKnownAs": ["at://alice.example.com"],
+		"verificationMethod": [{"id": "%s#atproto", "type": "Multikey", "controller": %q, "publicKeyMultibase": %q}],
+		"service": [{"id": "#atproto_pds", "type": "AtprotoPersonalDataServer", "serviceEndpoint": "https://old.example.net"}]
+	}`, did, did, did, strings.TrimPrefix(didKey, "did:key:"))
+	return key, doc
+}
+
+// testServiceAuthServer returns a Server known as did:web:pds.example.com
+// that resolves alice and bob to the returned signing keys.
+func testServiceAuthServer(t *testing.T) (*Server, map[string]string) {
+	t.Helper()
+	keys := map[string]string{}
+	docs := fakeDIDs{}
+	for _, did := range []string{aliceDID, bobDID} {
+		keys[did], docs[did] = testIdentity(t, did)
+	}
+	s := &Server{
+		cfg: &config.Config{ServiceURL: "https://pds.example.com"},
+		dir: identity.NewResolver(docs, noHandles{}, nil),
+	}
+	return s, keys
+}
+
+func signToken(t *testing.T, iss, aud, lxm, key string) string {
+	t.Helper()
+	token, err := identity.SignServiceAuth(iss, aud, syntax.NSID(lxm), key, time.Minute)
+	if err != nil {
+		t.Fatalf("SignServiceAuth: %v", err)
+	}
+	return token
+}
+
+func xrpcContext(method, token string) echo.Context {
+	req := httptest.NewRequest(http.MethodPost, "/xrpc/"+method, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return echo.New().NewContext(req, httptest.NewRecorder())
+}
+
+func TestServiceAuth(t *testing.T) {
+	s, keys := testServiceAuthServer(t)
+	const (
+		createAccount = "com.atproto.server.createAccount"
+		getBlob       = "com.atproto.sync.getBlob"
+		createRecord  = "com.atproto.repo.createRecord"
+	)
+	tests := []struct {
+		name   string
+		method string // called
+		aud    string
+		lxm    string // signed for
+		ok     bool
+	}{
+		{"service DID", createAccount, "did:web:pds.example.com", createAccount, true},
+		{"domain did:web", createAccount, "did:web:example.com", createAccount, true},
+		{"getBlob", getBlob, "did:web:pds.example.com", getBlob, true},
+		{"other domain", createAccount, "did:web:other.example.com", createAccount, false},
+		{"other service", createAccount, "did:web:feed.example.net", createAccount, false},
+		{"wrong lxm", createAccount, "did:web:pds.example.com", getBlob, false},
+		{"unbound", createAccount, "did:web:pds.example.com", "", false},
+		{"method not accepted", createRecord, "did:web:pds.example.com", createRecord, false},
+	}
+	for _, tt := range tests {
+		token := signToken(t, aliceDID, tt.aud, tt.lxm, keys[aliceDID])
+		ac, err := s.serviceAuth(xrpcContext(tt.method, token), token, "example.com")
+		if !tt.ok {
+			if !errors.Is(err, errServiceAuth) {
+				t.Errorf("%s: err = %v, want errServiceAuth", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if ac.DID != aliceDID || !ac.Service {
+			t.Errorf("%s: auth = %+v, want service caller %s", tt.name, ac, aliceDID)
+		}
+	}
+}
+
+func TestServiceAuthSignature(t *testing.T) {
+	s, keys := testServiceAuthServer(t)
+	const method = "com.atproto.server.createAccount"
+
+	// Signed with bob's key but claiming to come from alice.
+	token := signToken(t, aliceDID, "did:web:pds.example.com", method, keys[bobDID])
+	if _, err := s.serviceAuth(xrpcContext(method, token), token, ""); !errors.Is(err, errServiceAuth) {
+		t.Errorf("forged token: err = %v, want errServiceAuth", err)
+	}
+	if _, err := s.serviceAuth(xrpcContext(method, "garbage"), "garbage", ""); !errors.Is(err, errServiceAuth) {
+		t.Errorf("malformed token: err = %v, want errServiceAuth", err)
+	}
+}
+
+func TestMigrationCaller(t *testing.T) {
+	s, keys := testServiceAuthServer(t)
+	const method = "com.atproto.server.createAccount"
+	token := signToken(t, aliceDID, "did:web:example.com", method, keys[aliceDID])
+
+	ac, err := s.migrationCaller(xrpcContext(method, token), "example.com", aliceDID)
+	if err != nil || ac.DID != aliceDID {
+		t.Fatalf("migrationCaller(alice) = %+v, %v", ac, err)
+	}
+	if _, err := s.migrationCaller(xrpcContext(method, token), "example.com", bobDID); !errors.Is(err, errServiceAuth) {
+		t.Errorf("migrationCaller for another DID: err = %v, want errServiceAuth", err)
+	}
+	if _, err := s.migrationCaller(xrpcContext(method, ""), "example.com", aliceDID); !errors.Is(err, errServiceAuth) {
+		t.Errorf("migrationCaller without a token: err = %v, want errServiceAuth", err)
+	}
+}
@@ -0,0 +1,348 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/labstack/echo/v4"
+	"github.com/primal-host/primal-pds/internal/account"
+	"github.com/primal-host/primal-pds/internal/identity"
+)
+
+// handleDeactivateAccount lets an account holder take their account
+// offline. The repo stops syncing and writes are refused until
+// activateAccount is called. Deactivated accounts are kept until their
+// holder deletes them, so deleteAfter is refused rather than ignored.
+// POST /xrpc/com.atproto.server.deactivateAccount
+func (s *Server) handleDeactivateAccount(c echo.Context) error {
+	var req struct {
+		DeleteAfter string `json:"deleteAfter"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "Invalid JSON body",
+		})
+	}
+	if req.DeleteAfter != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "deleteAfter is not supported; use com.atproto.server.deleteAccount",
+		})
+	}
+
+	domainName, pool, acct, err := s.sessionAccount(c)
+	if acct == nil {
+		return err
+	}
+
+	switch acct.Status {
+	case account.StatusDeactivated:
+		return c.NoContent(http.StatusOK)
+	case account.StatusActive:
+	default:
+		return statusTransitionError(c, acct.Status)
+	}
+
+	if err := s.setStatus(c.Request().Context(), domainName, pool, acct, account.StatusDeactivated); err != nil {
+		return accountError(c, err, acct.Handle)
+	}
+	log.Printf("Account deactivated by holder: %s", acct.Handle)
+	return c.NoContent(http.StatusOK)
+}
+
+// handleActivateAccount reactivates an account its holder deactivated.
+// Accounts disabled or suspended by an operator can't be reactivated
+// this way. This also completes a move from another PDS, so the
+// account's DID document must already point here; an #identity event
+// tells consumers to refresh it, and a #commit for the current root lets
+// relays pick up an imported repository.
+// POST /xrpc/com.atproto.server.activateAccount
+func (s *Server) handleActivateAccount(c echo.Context) error {
+	domainName, pool, acct, err := s.sessionAccount(c)
+	if acct == nil {
+		return err
+	}
+
+	switch acct.Status {
+	case account.StatusActive:
+		return c.NoContent(http.StatusOK)
+	case account.StatusDeactivated:
+	default:
+		return statusTransitionError(c, acct.Status)
+	}
+
+	ctx := c.Request().Context()
+	if err := s.didHostedHere(ctx, domainName, acct); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "DID document does not point to this server: " + err.Error(),
+		})
+	}
+	if s.plcAccountProblem(acct) == "" && acct.PLCStatus == account.PLCStatusRegistered {
+		if err := identity.SyncLog(ctx, s.cfg.PLCEndpoint, s.tenantStore(pool), acct.DID); err != nil {
+			log.Printf("Warning: syncing PLC log for %s: %v", acct.DID, err)
+		}
+	}
+	if err := s.setStatus(ctx, domainName, pool, acct, account.StatusActive); err != nil {
+		return accountError(c, err, acct.Handle)
+	}
+	if s.events != nil {
+		if err := s.events.EmitIdentity(ctx, acct.DID, domainName, acct.Handle); err != nil {
+			log.Printf("Warning: identity event for %s: %v", acct.DID, err)
+		}
+	}
+	// Announce the current commit, so relays pick up a repository
+	// imported while the account was deactivated. It is queued only now
+	// that the account is active, or it would be sequenced as withheld.
+	if err := s.repos.AnnounceRoot(ctx, pool, acct.DID); err != nil {
+		log.Printf("Warning: announcing repo for %s: %v", acct.DID, err)
+	} else {
+		s.notifyCommit()
+	}
+	log.Printf("Account activated by holder: %s", acct.Handle)
+	return c.NoContent(http.StatusOK)
+}
+
+// handleCheckAccountStatus reports the state of the caller's account and
+// repository. validDid reports whether the account's DID document names
+// this server and the account's signing key. expectedBlobs counts the blobs referenced by records and
+// importedBlobs how many of those are stored, which lets a migrating
+// account see what is still missing.
+// GET /xrpc/com.atproto.server.checkAccountStatus
+func (s *Server) handleCheckAccountStatus(c echo.Context) error {
+	domainName, pool, acct, err := s.sessionAccount(c)
+	if acct == nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	stats, err := s.repos.Stats(ctx, pool, acct.DID)
+	if err != nil {
+		log.Printf("Error reading repo stats for %s: %v", acct.DID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to read repository",
+		})
+	}
+
+	imported, err := s.blobs.CountPresent(ctx, pool, acct.DID, stats.BlobCIDs)
+	if err != nil {
+		log.Printf("Error counting blobs for %s: %v", acct.DID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to read blobs",
+		})
+	}
+
+	didErr := s.didHostedHere(ctx, domainName, acct)
+	active, _ := account.HostingStatus(acct.Status)
+	return c.JSON(http.StatusOK, map[string]any{
+		"activated":          active,
+		"validDid":           didErr == nil,
+		"repoCommit":         stats.CommitCID,
+		"repoRev":            stats.Rev,
+		"repoBlocks":         stats.Blocks,
+		"indexedRecords":     stats.Records,
+		"privateStateValues": 0,
+		"expectedBlobs":      len(stats.BlobCIDs),
+		"importedBlobs":      imported,
+	})
+}
+
+// handleRequestAccountDelete emails the caller a token that confirms a
+// deleteAccount request.
+// POST /xrpc/com.atproto.server.requestAccountDelete
+func (s *Server) handleRequestAccountDelete(c echo.Context) error {
+	_, pool, acct, err := s.sessionAccount(c)
+	if acct == nil {
+		return err
+	}
+	if acct.Email == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "Account has no email address",
+		})
+	}
+	if s.mailer == nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "This server cannot send email",
+		})
+	}
+
+	ctx := c.Request().Context()
+	token, err := s.tenantStore(pool).CreateEmailToken(ctx, acct.DID, account.PurposeDeleteAccount)
+	if err != nil {
+		log.Printf("Error creating deletion token for %s: %v", acct.DID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to request account deletion",
+		})
+	}
+
+	body := fmt.Sprintf("A request was made to delete the account %s.\n\n"+
+		"To confirm, enter this code: %s\n\n"+
+		"The code expires in %d minutes. If you did not make this request, "+
+		"you can ignore this email.\n",
+		acct.Handle, token, int(account.EmailTokenTTL.Minutes()))
+	if err := s.mailer.Send(ctx, acct.Email, "Confirm account deletion", body); err != nil {
+		log.Printf("Error sending deletion token to %s: %v", acct.DID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to send confirmation email",
+		})
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+type deleteOwnAccountRequest struct {
+	DID      string `json:"did"`
+	Password string `json:"password"`
+	Token    string `json:"token"`
+}
+
+// handleDeleteOwnAccount permanently deletes an account on its holder's
+// request. It needs the account password and the token emailed by
+// requestAccountDelete; no session is required. Deletion then proceeds
+// as for host.primal.pds.deleteAccount.
+// POST /xrpc/com.atproto.server.deleteAccount
+func (s *Server) handleDeleteOwnAccount(c echo.Context) error {
+	var req deleteOwnAccountRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "Invalid JSON body",
+		})
+	}
+
+	req.DID = strings.TrimSpace(req.DID)
+	if req.DID == "" || req.Password == "" || req.Token == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "did, password and token are required",
+		})
+	}
+
+	ctx := c.Request().Context()
+	invalid := func() error {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error":   "AuthenticationRequired",
+			"message": "Invalid did or password",
+		})
+	}
+
+	domainName, err := s.mgmtDB.LookupDIDDomain(ctx, req.DID)
+	if err != nil {
+		return invalid()
+	}
+	pool := s.pools.Get(domainName)
+	if pool == nil {
+		return invalid()
+	}
+	accounts := s.tenantStore(pool)
+	acct, err := accounts.GetByDID(ctx, req.DID)
+	if err != nil {
+		return invalid()
+	}
+	if _, err := accounts.VerifyPassword(ctx, acct.Handle, req.Password); err != nil {
+		return invalid()
+	}
+
+	if err := accounts.ConsumeEmailToken(ctx, acct.DID, account.PurposeDeleteAccount, req.Token); err != nil {
+		return emailTokenError(c, err, acct.DID)
+	}
+
+	if err := s.deleteAccount(ctx, domainName, pool, acct, false); err != nil {
+		return accountError(c, err, acct.Handle)
+	}
+
+	log.Printf("Account deleted by holder: %s", acct.Handle)
+	return c.NoContent(http.StatusOK)
+}
+
+// sessionAccount loads the account behind the caller's access token.
+// The admin key has no account, so it is refused. On failure it returns
+// a nil account after writing the error response; the returned error is
+// the result of that write.
+func (s *Server) sessionAccount(c echo.Context) (string, *pgxpool.Pool, *account.Account, error) {
+	ac := getAuth(c)
+	if ac == nil || ac.DID == "" {
+		return "", nil, nil, c.JSON(http.StatusUnauthorized, map[string]string{
+			"error":   "AuthRequired",
+			"message": "Account access token required",
+		})
+	}
+
+	ctx := c.Request().Context()
+	domainName, err := s.mgmtDB.LookupDIDDomain(ctx, ac.DID)
+	if err != nil {
+		return "", nil, nil, c.JSON(http.StatusNotFound, map[string]string{
+			"error":   "AccountNotFound",
+			"message": "Account not found for DID",
+		})
+	}
+	pool := s.pools.Get(domainName)
+	if pool == nil {
+		return "", nil, nil, c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Account domain unavailable",
+		})
+	}
+
+	acct, err := s.tenantStore(pool).GetByDID(ctx, ac.DID)
+	if err != nil {
+		return "", nil, nil, accountError(c, err, ac.DID)
+	}
+	return domainName, pool, acct, nil
+}
+
+// emailTokenError writes the response for a token rejected by
+// ConsumeEmailToken.
+func emailTokenError(c echo.Context, err error, did string) error {
+	switch {
+	case errors.Is(err, account.ErrInvalidToken):
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidToken",
+			"message": "Token is invalid",
+		})
+	case errors.Is(err, account.ErrExpiredToken):
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "ExpiredToken",
+			"message": "Token has expired",
+		})
+	}
+	log.Printf("Error checking email token for %s: %v", did, err)
+	return c.JSON(http.StatusInternalServerError, map[string]string{
+		"error":   "InternalError",
+		"message": "Failed to check token",
+	})
+}
+
+// setStatus applies a holder-initiated status change and announces it.
+func (s *Server) setStatus(ctx context.Context, domainName string, pool *pgxpool.Pool, acct *account.Account, status string) error {
+	updated, err := s.tenantStore(pool).UpdateStatus(ctx, acct.Handle, status)
+	if err != nil {
+		return err
+	}
+	s.announceStatus(ctx, domainName, acct.Status, updated)
+	return nil
+}
+
+// statusTransitionError writes the response for an account whose status
+// was set by an operator and so can't be changed by its holder.
+func statusTransitionError(c echo.Context, status string) error {
+	if err := account.CanWrite(status); err != nil {
+		return policyError(c, err)
+	}
+	return c.JSON(http.StatusBadRequest, map[string]string{
+		"error":   "InvalidRequest",
+		"message": "Account is " + status + " and can only be changed by an operator",
+	})
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/primal-host/primal-pds/internal/account"
+)
+
+// createAppPasswordRequest is the JSON body for createAppPassword.
+type createAppPasswordRequest struct {
+	Name       string `json:"name"`
+	Privileged bool   `json:"privileged"`
+}
+
+// handleCreateAppPassword adds an app password to the caller's account.
+// The password is only ever returned here.
+// POST /xrpc/com.atproto.server.createAppPassword
+func (s *Server) handleCreateAppPassword(c echo.Context) error {
+	_, pool, acct, err := s.sessionAccount(c)
+	if acct == nil {
+		return err
+	}
+
+	var req createAppPasswordRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "Invalid JSON body",
+		})
+	}
+	if err := account.CanLogin(acct.Status); err != nil {
+		return policyError(c, err)
+	}
+
+	ap, password, err := s.tenantStore(pool).CreateAppPassword(c.Request().Context(), acct.DID, req.Name, req.Privileged)
+	switch {
+	case errors.Is(err, account.ErrAppPasswordInvalid):
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "name is required and must be at most 100 characters",
+		})
+	case errors.Is(err, account.ErrAppPasswordExists):
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "An app password with this name already exists",
+		})
+	case errors.Is(err, account.ErrAppPasswordLimit):
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "Too many app passwords; revoke one first",
+		})
+	case err != nil:
+		log.Printf("Error creating app password for %s: %v", acct.DID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to create app password",
+		})
+	}
+
+	log.Printf("App password created: %s (%q, privileged: %v)", acct.Handle, ap.Name, ap.Privileged)
+	return c.JSON(http.StatusOK, map[string]any{
+		"name":       ap.Name,
+		"password":   password,
+		"createdAt":  ap.CreatedAt,
+		"privileged": ap.Privileged,
+	})
+}
+
+// handleListAppPasswords lists the caller's app passwords, without the
+// passwords themselves.
+// GET /xrpc/com.atproto.server.listAppPasswords
+func (s *Server) handleListAppPasswords(c echo.Context) error {
+	_, pool, acct, err := s.sessionAccount(c)
+	if acct == nil {
+		return err
+	}
+
+	passwords, err := s.tenantStore(pool).ListAppPasswords(c.Request().Context(), acct.DID)
+	if err != nil {
+		log.Printf("Error listing app passwords for %s: %v", acct.DID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to list app passwords",
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"passwords": passwords,
+	})
+}
+
+// revokeAppPasswordRequest is the JSON body for revokeAppPassword.
+type revokeAppPasswordRequest struct {
+	Name string `json:"name"`
+}
+
+// handleRevokeAppPassword deletes one of the caller's app passwords and
+// revokes the sessions started with it.
+// POST /xrpc/com.atproto.server.revokeAppPassword
+func (s *Server) handleRevokeAppPassword(c echo.Context) error {
+	_, pool, acct, err := s.sessionAccount(c)
+	if acct == nil {
+		return err
+	}
+
+	var req revokeAppPasswordRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "Invalid JSON body",
+		})
+	}
+	if req.Name == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "name is required",
+		})
+	}
+
+	ctx := c.Request().Context()
+	if err := s.tenantStore(pool).RevokeAppPassword(ctx, acct.DID, req.Name); err != nil {
+		if errors.Is(err, account.ErrNotFound) {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error":   "InvalidRequest",
+				"message": "App password not found: " + req.Name,
+			})
+		}
+		log.Printf("Error revoking app password for %s: %v", acct.DID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to revoke app password",
+		})
+	}
+	if _, err := s.jwt.RevokeAppPassword(ctx, acct.DID, req.Name); err != nil {
+		log.Printf("Warning: failed to revoke app password sessions of %s: %v", acct.DID, err)
+	}
+
+	log.Printf("App password revoked: %s (%q)", acct.Handle, req.Name)
+	return c.NoContent(http.StatusOK)
+}
@@ -10,6 +10,8 @@ import (
 )
 
 // handleUploadBlob handles media uploads and returns a blob reference.
+// Deactivated accounts may upload, so an account moving here can bring
+// its blobs before it is activated.
 // POST /xrpc/com.atproto.repo.uploadBlob
 func (s *Server) handleUploadBlob(c echo.Context) error {
 	ac := getAuth(c)
@@ -23,7 +25,7 @@ func (s *Server) handleUploadBlob(c echo.Context) error {
 	// Determine the DID for storage. Admin uploads require a repo param.
 	did := ac.DID
 	if did == "" && ac.IsAdmin {
-		did = c.QueryParam("did")
+		did = account.NormalizeDID(c.QueryParam("did"))
 		if did == "" {
 			return c.JSON(http.StatusBadRequest, map[string]string{
 				"error":   "InvalidRequest",
@@ -51,6 +53,17 @@ func (s *Server) handleUploadBlob(c echo.Context) error {
 		})
 	}
 
+	acct, err := s.tenantStore(pool).GetByDID(ctx, did)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error":   "RepoNotFound",
+			"message": "Account not found for DID: " + did,
+		})
+	}
+	if err := account.CanImport(acct.Status); err != nil {
+		return policyError(c, err)
+	}
+
 	mimeType := c.Request().Header.Get("Content-Type")
 	if mimeType == "" {
 		mimeType = "application/octet-stream"
@@ -78,7 +91,7 @@ func (s *Server) handleUploadBlob(c echo.Context) error {
 // handleGetBlob retrieves a blob by DID and CID.
 // GET /xrpc/com.atproto.sync.getBlob?did=...&cid=...
 func (s *Server) handleGetBlob(c echo.Context) error {
-	did := c.QueryParam("did")
+	did := account.NormalizeDID(c.QueryParam("did"))
 	cidStr := c.QueryParam("cid")
 
 	if did == "" || cidStr == "" {
@@ -113,6 +126,17 @@ func (s *Server) handleGetBlob(c echo.Context) error {
 		})
 	}
 
+	acct, err := s.tenantStore(pool).GetByDID(ctx, did)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error":   "BlobNotFound",
+			"message": "Blob not found",
+		})
+	}
+	if err := s.checkRepoAvailable(c, acct); err != nil {
+		return policyError(c, err)
+	}
+
 	data, mimeType, err := s.blobs.Get(ctx, pool, did, cidStr)
 	if err != nil {
 		return c.JSON(http.StatusNotFound, map[string]string{
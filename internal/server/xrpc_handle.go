@@ -0,0 +1,331 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/labstack/echo/v4"
+	"github.com/primal-host/primal-pds/internal/account"
+	"github.com/primal-host/primal-pds/internal/handles"
+)
+
+type updateHandleRequest struct {
+	Handle string `json:"handle"`
+}
+
+// errForeignDomain is returned by changeHandle for a handle under a
+// hosted domain other than the account's own.
+var errForeignDomain = errors.New("handle is under another hosted domain")
+
+// errWebDIDHandle is returned by changeHandle for a did:web account. Its
+// DID document is published under the hostname it was created with, so
+// releasing that handle would let another account take over the DID.
+var errWebDIDHandle = errors.New("did:web accounts cannot change their handle")
+
+// handleUpdateHandle changes the caller's handle. The new handle is
+// either under the account's own hosted domain or a custom-domain
+// handle, such as "alice.example.com", whose domain already declares the
+// account's DID in a _atproto DNS TXT record or at
+// /.well-known/atproto-did.
+// POST /xrpc/com.atproto.identity.updateHandle
+func (s *Server) handleUpdateHandle(c echo.Context) error {
+	domainName, pool, acct, err := s.sessionAccount(c)
+	if acct == nil {
+		return err
+	}
+
+	var req updateHandleRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "Invalid JSON body",
+		})
+	}
+
+	handle, err := normalizeHandle(req.Handle)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidHandle",
+			"message": err.Error(),
+		})
+	}
+	if err := account.CanWrite(acct.Status); err != nil {
+		return policyError(c, err)
+	}
+
+	if _, err := s.changeHandle(c.Request().Context(), domainName, pool, acct, handle); err != nil {
+		return handleChangeError(c, err, acct, handle)
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+type renameAccountRequest struct {
+	Handle    string `json:"handle"`
+	NewHandle string `json:"newHandle"`
+}
+
+// handleRenameAccount changes an account's handle on behalf of the
+// admin key or the domain's owner or admins. Only the admin key and the
+// owner itself can rename the owner. The rules are those of
+// com.atproto.identity.updateHandle.
+// POST /xrpc/host.primal.pds.updateHandle
+func (s *Server) handleRenameAccount(c echo.Context) error {
+	var req renameAccountRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "Invalid JSON body",
+		})
+	}
+
+	req.Handle = strings.TrimSpace(strings.ToLower(req.Handle))
+	if req.Handle == "" || req.NewHandle == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "handle and newHandle are required",
+		})
+	}
+	newHandle, err := normalizeHandle(req.NewHandle)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidHandle",
+			"message": err.Error(),
+		})
+	}
+
+	ctx := c.Request().Context()
+	ac := getAuth(c)
+	domainName := s.handleDomain(ctx, req.Handle)
+	if !s.canManageDomain(ctx, ac, domainName) {
+		return renameForbidden(c)
+	}
+	pool := s.pools.Get(domainName)
+	if domainName == "" || pool == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error":   "AccountNotFound",
+			"message": "Account not found: " + req.Handle,
+		})
+	}
+	acct, err := s.tenantStore(pool).GetByHandle(ctx, req.Handle)
+	if err != nil {
+		return accountError(c, err, req.Handle)
+	}
+	if acct.Role == account.RoleOwner && !ac.IsAdmin && ac.DID != acct.DID {
+		return renameForbidden(c)
+	}
+
+	updated, err := s.changeHandle(ctx, domainName, pool, acct, newHandle)
+	if err != nil {
+		return handleChangeError(c, err, acct, newHandle)
+	}
+	return c.JSON(http.StatusOK, updated)
+}
+
+func renameForbidden(c echo.Context) error {
+	return c.JSON(http.StatusForbidden, map[string]string{
+		"error":   "Forbidden",
+		"message": "Only the domain owner or an admin can rename its accounts",
+	})
+}
+
+// changeHandle gives acct a new handle. A handle under acct's hosted
+// domain only has to be free; any other handle must verify as a custom
+// handle. did:web accounts keep their handle. The old handle is held
+// for the account for handles.HoldPeriod, the change is published to the account's did:plc
+// and an #identity event is emitted. Publishing failures are logged;
+// the handle has already changed.
+func (s *Server) changeHandle(ctx context.Context, domainName string, pool *pgxpool.Pool, acct *account.Account, handle string) (*account.Account, error) {
+	if handle == acct.Handle {
+		return acct, nil
+	}
+	if strings.HasPrefix(acct.DID, "did:web:") {
+		return nil, fmt.Errorf("%w: %s", errWebDIDHandle, acct.DID)
+	}
+
+	hosted := extractDomainFromHandle(handle, s.pools)
+	switch {
+	case hosted == "":
+		if err := s.claimCustomHandle(ctx, handle, acct.DID, domainName); err != nil {
+			return nil, err
+		}
+	case hosted != domainName:
+		return nil, fmt.Errorf("%w: %s", errForeignDomain, handle)
+	default:
+		reserved, err := s.handleReserved(ctx, handle, acct.DID)
+		if err != nil {
+			return nil, err
+		}
+		if reserved {
+			return nil, fmt.Errorf("%w: %s", handles.ErrTaken, handle)
+		}
+	}
+
+	updated, err := s.tenantStore(pool).UpdateHandle(ctx, acct.DID, handle)
+	if err != nil {
+		if hosted == "" {
+			s.restoreCustomHandle(ctx, acct, domainName)
+		}
+		return nil, err
+	}
+
+	if hosted != "" {
+		if err := s.handles.Release(ctx, acct.DID); err != nil {
+			log.Printf("Warning: releasing custom handle of %s: %v", acct.DID, err)
+		}
+	}
+	if err := s.handles.Hold(ctx, acct.Handle, acct.DID, domainName); err != nil {
+		log.Printf("Warning: holding old handle %s: %v", acct.Handle, err)
+	}
+	if _, err := s.publishIdentity(ctx, domainName, pool, updated); err != nil {
+		log.Printf("Warning: PLC update for %s after handle change: %v", updated.DID, err)
+	}
+	if s.events != nil {
+		if err := s.events.EmitIdentity(ctx, updated.DID, domainName, updated.Handle); err != nil {
+			log.Printf("Warning: identity event for %s: %v", updated.DID, err)
+		}
+	}
+
+	log.Printf("Handle changed: %s -> %s (%s)", acct.Handle, updated.Handle, updated.DID)
+	return updated, nil
+}
+
+// handleChangeError writes the response for a failed changeHandle.
+func handleChangeError(c echo.Context, err error, acct *account.Account, handle string) error {
+	switch {
+	case errors.Is(err, errWebDIDHandle):
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "did:web accounts cannot change their handle",
+		})
+	case errors.Is(err, errForeignDomain):
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidHandle",
+			"message": "Handle must be under the account's own domain or a custom domain: " + handle,
+		})
+	case errors.Is(err, account.ErrHandleTaken):
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "HandleNotAvailable",
+			"message": "Handle already taken: " + handle,
+		})
+	case errors.Is(err, handles.ErrTaken), errors.Is(err, handles.ErrMismatch), errors.Is(err, handles.ErrUnresolved):
+		return customHandleError(c, err, handle)
+	}
+	return accountError(c, err, acct.Handle)
+}
+
+// handleListCustomHandles returns the custom-domain handles claimed by
+// a domain's accounts with their verification state.
+// GET /xrpc/host.primal.pds.listCustomHandles?domain=...
+func (s *Server) handleListCustomHandles(c echo.Context) error {
+	domainName := strings.TrimSpace(strings.ToLower(c.QueryParam("domain")))
+	if domainName == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "domain query parameter is required",
+		})
+	}
+
+	entries, err := s.handles.List(c.Request().Context(), domainName)
+	if err != nil {
+		log.Printf("Error listing custom handles for %q: %v", domainName, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to list handles",
+		})
+	}
+	if entries == nil {
+		entries = []handles.Entry{}
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"handles": entries,
+	})
+}
+
+// claimCustomHandle verifies that handle resolves to did and records it
+// in the handle index for the account's domain. Reserved handles can't
+// be claimed.
+func (s *Server) claimCustomHandle(ctx context.Context, handle, did, domainName string) error {
+	reserved, err := s.handleReserved(ctx, handle, did)
+	if err != nil {
+		return err
+	}
+	if reserved {
+		return fmt.Errorf("%w: %s", handles.ErrTaken, handle)
+	}
+	if err := handles.Verify(ctx, s.resolver, handle, did); err != nil {
+		return err
+	}
+	return s.handles.Claim(ctx, handle, did, domainName)
+}
+
+// handleReserved reports whether handle is unavailable to did: it, or
+// did itself, belonged to a deleted account, or it is held for another
+// account after a recent handle change.
+func (s *Server) handleReserved(ctx context.Context, handle, did string) (bool, error) {
+	reserved, err := s.deletions.IsReserved(ctx, handle, did)
+	if err != nil || reserved {
+		return reserved, err
+	}
+	return s.handles.IsHeld(ctx, handle, did)
+}
+
+// restoreCustomHandle puts the handle index back to match acct after a
+// failed handle change.
+func (s *Server) restoreCustomHandle(ctx context.Context, acct *account.Account, domainName string) {
+	var err error
+	if extractDomainFromHandle(acct.Handle, s.pools) == "" {
+		err = s.handles.Claim(ctx, acct.Handle, acct.DID, domainName)
+	} else {
+		err = s.handles.Release(ctx, acct.DID)
+	}
+	if err != nil {
+		log.Printf("Warning: restoring handle index for %s: %v", acct.DID, err)
+	}
+}
+
+// customHandleError writes the response for a failed custom handle
+// claim.
+func customHandleError(c echo.Context, err error, handle string) error {
+	switch {
+	case errors.Is(err, handles.ErrTaken):
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "HandleNotAvailable",
+			"message": "Handle already taken: " + handle,
+		})
+	case errors.Is(err, handles.ErrMismatch):
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidHandle",
+			"message": "Handle's domain declares a different DID: " + handle,
+		})
+	case errors.Is(err, handles.ErrUnresolved):
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidHandle",
+			"message": "Handle's domain does not declare a DID (set a _atproto TXT record or serve /.well-known/atproto-did): " + handle,
+		})
+	}
+	log.Printf("Error claiming handle %q: %v", handle, err)
+	return c.JSON(http.StatusInternalServerError, map[string]string{
+		"error":   "InternalError",
+		"message": "Failed to update handle",
+	})
+}
+
+// normalizeHandle checks handle syntax and returns the handle in lower
+// case.
+func normalizeHandle(raw string) (string, error) {
+	h, err := syntax.ParseHandle(strings.TrimSpace(raw))
+	if err != nil {
+		return "", fmt.Errorf("invalid handle: %s", raw)
+	}
+	h = h.Normalize()
+	if !h.AllowedTLD() {
+		return "", fmt.Errorf("handle TLD is not allowed: %s", h)
+	}
+	return h.String(), nil
+}
@@ -4,15 +4,22 @@ import (
 	"errors"
 	"log"
 	"net/http"
+	"strings"
 
+	atidentity "github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/labstack/echo/v4"
 	"github.com/primal-host/primal-pds/internal/account"
+	"github.com/primal-host/primal-pds/internal/identity"
 )
 
-// handleResolveHandle resolves a handle to a DID.
+// handleResolveHandle resolves a handle to a DID. Handles of accounts
+// hosted here are answered from the database; any other handle is
+// resolved by DNS or HTTPS like a client would, with the result cached
+// for a while.
 // GET /xrpc/com.atproto.identity.resolveHandle?handle=...
 func (s *Server) handleResolveHandle(c echo.Context) error {
-	handle := c.QueryParam("handle")
+	handle := strings.ToLower(strings.TrimSpace(c.QueryParam("handle")))
 	if handle == "" {
 		return c.JSON(http.StatusBadRequest, map[string]string{
 			"error":   "InvalidRequest",
@@ -23,11 +30,26 @@ func (s *Server) handleResolveHandle(c echo.Context) error {
 	ctx := c.Request().Context()
 
 	// Extract domain from handle.
-	domainName := extractDomainFromHandle(handle, s.pools)
+	domainName := s.handleDomain(ctx, handle)
 	if domainName == "" {
-		return c.JSON(http.StatusNotFound, map[string]string{
-			"error":   "HandleNotFound",
-			"message": "Unable to resolve handle: " + handle,
+		if _, err := syntax.ParseHandle(handle); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error":   "InvalidRequest",
+				"message": "Invalid handle: " + handle,
+			})
+		}
+		did, err := s.dir.ResolveHandle(ctx, handle)
+		if err != nil {
+			if !errors.Is(err, atidentity.ErrHandleNotFound) {
+				log.Printf("Warning: resolving handle %q: %v", handle, err)
+			}
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"error":   "HandleNotFound",
+				"message": "Unable to resolve handle: " + handle,
+			})
+		}
+		return c.JSON(http.StatusOK, map[string]string{
+			"did": did,
 		})
 	}
 
@@ -58,3 +80,91 @@ func (s *Server) handleResolveHandle(c echo.Context) error {
 		"did": did,
 	})
 }
+
+// handleWebDIDDocument serves the DID document of the did:web named by
+// the Host header: a request to https://1440.news is answered for
+// did:web:1440.news. On the service's own host that is the service DID
+// document; on any other it is an account's, built from the account's
+// current handle and signing key.
+// GET /.well-known/did.json
+func (s *Server) handleWebDIDDocument(c echo.Context) error {
+	if identity.WebDIDForHost(c.Request().Host) == s.serviceDID() {
+		return s.serviceDIDDocument(c)
+	}
+
+	host := strings.ToLower(stripPort(c.Request().Host))
+	did := account.WebDID(host)
+	ctx := c.Request().Context()
+
+	notFound := func() error {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error":   "NotFound",
+			"message": "No DID document for " + host,
+		})
+	}
+
+	domainName, err := s.mgmtDB.LookupDIDDomain(ctx, did)
+	if err != nil {
+		return notFound()
+	}
+	pool := s.pools.Get(domainName)
+	if pool == nil {
+		return notFound()
+	}
+	acct, err := s.tenantStore(pool).GetByDID(ctx, did)
+	if err != nil {
+		if errors.Is(err, account.ErrNotFound) {
+			return notFound()
+		}
+		log.Printf("Error loading account %s: %v", did, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to load DID document",
+		})
+	}
+	if acct.SigningKey == "" || acct.Status == account.StatusRemoved {
+		return notFound()
+	}
+
+	doc, err := account.BuildDIDDocument(acct.DID, acct.Handle, acct.SigningKey, domainName)
+	if err != nil {
+		log.Printf("Error building DID document for %s: %v", did, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to build DID document",
+		})
+	}
+	return c.JSON(http.StatusOK, doc)
+}
+
+// serviceDIDDocument serves the DID document of the PDS itself, which
+// publishes its service key and endpoint. Without a service key there
+// is nothing to serve.
+func (s *Server) serviceDIDDocument(c echo.Context) error {
+	did := s.serviceDID()
+	if s.serviceKey == "" {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error":   "NotFound",
+			"message": "No DID document for " + did,
+		})
+	}
+	doc, err := account.BuildServiceDIDDocument(did, s.serviceKey, strings.TrimSuffix(s.cfg.ServiceURL, "/"))
+	if err != nil {
+		log.Printf("Error building service DID document: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to build DID document",
+		})
+	}
+	return c.JSON(http.StatusOK, doc)
+}
+
+// validDIDMethod reports whether method names a DID method accounts
+// can be created with. Empty selects the default.
+func validDIDMethod(method string) bool {
+	switch method {
+	case "", account.DIDMethodPLC, account.DIDMethodWeb:
+		return true
+	}
+	return false
+}
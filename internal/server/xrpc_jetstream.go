@@ -0,0 +1,150 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/primal-host/primal-pds/internal/account"
+	"github.com/primal-host/primal-pds/internal/events"
+)
+
+// Jetstream filter limits, matching Bluesky's Jetstream service.
+const (
+	maxWantedCollections = 100
+	maxWantedDIDs        = 10000
+)
+
+// jetstreamFilter selects which events a Jetstream client receives.
+// Empty filters match everything.
+type jetstreamFilter struct {
+	collections map[string]bool // exact NSIDs
+	prefixes    []string        // from "app.bsky.feed.*" style entries
+	dids        map[string]bool
+	domain      string
+}
+
+// matchRepo reports whether events for the event's DID are wanted.
+func (f *jetstreamFilter) matchRepo(evt *events.Event) bool {
+	if len(f.dids) > 0 && !f.dids[evt.DID] {
+		return false
+	}
+	if f.domain != "" && evt.Domain != f.domain {
+		return false
+	}
+	return true
+}
+
+// matchCollection reports whether records in collection are wanted.
+func (f *jetstreamFilter) matchCollection(collection string) bool {
+	if len(f.collections) == 0 && len(f.prefixes) == 0 {
+		return true
+	}
+	if f.collections[collection] {
+		return true
+	}
+	for _, p := range f.prefixes {
+		if strings.HasPrefix(collection, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleJetstream streams commits as JSON, one message per record
+// operation, with each record decoded from the commit's diff CAR.
+// wantedCollections (exact NSIDs or "prefix.*"), wantedDids and domain
+// narrow the stream; cursor is a time_us value to resume after.
+// GET /xrpc/host.primal.pds.jetstream?wantedCollections=...&wantedDids=...&domain=...&cursor=...
+func (s *Server) handleJetstream(c echo.Context) error {
+	if s.events == nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{
+			"error":   "ServiceUnavailable",
+			"message": "Firehose not available",
+		})
+	}
+
+	q := c.QueryParams()
+	filter := &jetstreamFilter{
+		collections: map[string]bool{},
+		dids:        map[string]bool{},
+		domain:      strings.TrimSpace(strings.ToLower(c.QueryParam("domain"))),
+	}
+
+	if len(q["wantedCollections"]) > maxWantedCollections {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "too many wantedCollections (max " + strconv.Itoa(maxWantedCollections) + ")",
+		})
+	}
+	for _, col := range q["wantedCollections"] {
+		if prefix, ok := strings.CutSuffix(col, "*"); ok {
+			filter.prefixes = append(filter.prefixes, prefix)
+		} else {
+			filter.collections[col] = true
+		}
+	}
+
+	if len(q["wantedDids"]) > maxWantedDIDs {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "too many wantedDids (max " + strconv.Itoa(maxWantedDIDs) + ")",
+		})
+	}
+	for _, did := range q["wantedDids"] {
+		if !strings.HasPrefix(did, "did:") {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error":   "InvalidRequest",
+				"message": "invalid DID in wantedDids: " + did,
+			})
+		}
+		filter.dids[account.NormalizeDID(did)] = true
+	}
+
+	// Parse optional cursor (unix microseconds) and map it to a seq.
+	var since *int64
+	if cursorStr := c.QueryParam("cursor"); cursorStr != "" {
+		us, err := strconv.ParseInt(cursorStr, 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error":   "InvalidRequest",
+				"message": "cursor must be a unix timestamp in microseconds",
+			})
+		}
+		seq, err := s.events.CursorAt(c.Request().Context(), time.UnixMicro(us))
+		if err != nil {
+			log.Printf("Error resolving jetstream cursor %d: %v", us, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error":   "InternalError",
+				"message": "Failed to resolve cursor",
+			})
+		}
+		since = &seq
+	}
+
+	return s.serveEventStream(c, since, func(ws *websocket.Conn, evt *events.Event) error {
+		if !filter.matchRepo(evt) {
+			return nil
+		}
+
+		jevts, err := events.JetstreamEvents(evt)
+		if err != nil {
+			// A bad event shouldn't end the stream; skip it.
+			log.Printf("Warning: jetstream decode seq %d: %v", evt.Seq, err)
+			return nil
+		}
+		for _, je := range jevts {
+			if je.Commit != nil && !filter.matchCollection(je.Commit.Collection) {
+				continue
+			}
+			if err := ws.WriteJSON(je); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,490 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/labstack/echo/v4"
+	"github.com/primal-host/primal-pds/internal/account"
+	"github.com/primal-host/primal-pds/internal/identity"
+	"github.com/primal-host/primal-pds/internal/repo"
+)
+
+// didCredentials are the parts of a DID document a PDS controls: the
+// keys, handle and endpoint it needs published for an account it hosts.
+type didCredentials struct {
+	RotationKeys        []string                       `json:"rotationKeys"`
+	AlsoKnownAs         []string                       `json:"alsoKnownAs"`
+	VerificationMethods map[string]string              `json:"verificationMethods"`
+	Services            map[string]account.PLCEndpoint `json:"services"`
+}
+
+// credentialsFor returns the DID credentials this server recommends for
+// an account in domainName.
+func (s *Server) credentialsFor(domainName string, acct *account.Account) (*didCredentials, error) {
+	didKey, err := account.SigningDIDKey(acct.SigningKey)
+	if err != nil {
+		return nil, err
+	}
+	creds := &didCredentials{
+		RotationKeys: []string{},
+		AlsoKnownAs:  []string{"at://" + acct.Handle},
+		VerificationMethods: map[string]string{
+			account.PLCVerificationAtproto: didKey,
+		},
+		Services: map[string]account.PLCEndpoint{
+			account.PLCServiceAtprotoPDS: {
+				Type:     "AtprotoPersonalDataServer",
+				Endpoint: s.serviceEndpointForDomain(domainName),
+			},
+		},
+	}
+	if s.rotationKey != "" {
+		rotationDIDKey, err := account.SigningDIDKey(s.rotationKey)
+		if err != nil {
+			return nil, err
+		}
+		creds.RotationKeys = append(creds.RotationKeys, rotationDIDKey)
+	}
+	return creds, nil
+}
+
+// handleGetRecommendedDIDCredentials returns the rotation key, handle,
+// signing key and endpoint an account's DID should publish to be hosted
+// here. A migrating account asks its new PDS for these and has its old
+// PDS sign them with signPlcOperation.
+// GET /xrpc/com.atproto.identity.getRecommendedDidCredentials
+func (s *Server) handleGetRecommendedDIDCredentials(c echo.Context) error {
+	domainName, _, acct, err := s.sessionAccount(c)
+	if acct == nil {
+		return err
+	}
+	if acct.SigningKey == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "Account has no signing key",
+		})
+	}
+
+	creds, err := s.credentialsFor(domainName, acct)
+	if err != nil {
+		log.Printf("Error building DID credentials for %s: %v", acct.DID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to build DID credentials",
+		})
+	}
+	return c.JSON(http.StatusOK, creds)
+}
+
+// handleRequestPLCOperationSignature emails the account a token that
+// authorizes signPlcOperation.
+// POST /xrpc/com.atproto.identity.requestPlcOperationSignature
+func (s *Server) handleRequestPLCOperationSignature(c echo.Context) error {
+	_, pool, acct, err := s.sessionAccount(c)
+	if acct == nil {
+		return err
+	}
+	if msg := s.plcAccountProblem(acct); msg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": msg,
+		})
+	}
+	if acct.Email == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "Account has no email address",
+		})
+	}
+	if s.mailer == nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "This server cannot send email",
+		})
+	}
+
+	ctx := c.Request().Context()
+	token, err := s.tenantStore(pool).CreateEmailToken(ctx, acct.DID, account.PurposePLCOperation)
+	if err != nil {
+		log.Printf("Error creating PLC operation token for %s: %v", acct.DID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to request PLC operation signature",
+		})
+	}
+
+	body := fmt.Sprintf("A request was made to change the identity of the account %s, "+
+		"for example to move it to another server.\n\n"+
+		"To confirm, enter this code: %s\n\n"+
+		"The code expires in %d minutes. If you did not make this request, "+
+		"do not share the code and consider changing your password.\n",
+		acct.Handle, token, int(account.EmailTokenTTL.Minutes()))
+	if err := s.mailer.Send(ctx, acct.Email, "Confirm identity change", body); err != nil {
+		log.Printf("Error sending PLC operation token to %s: %v", acct.DID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to send confirmation email",
+		})
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+type signPLCOperationRequest struct {
+	Token               string                         `json:"token"`
+	RotationKeys        []string                       `json:"rotationKeys"`
+	AlsoKnownAs         []string                       `json:"alsoKnownAs"`
+	VerificationMethods map[string]string              `json:"verificationMethods"`
+	Services            map[string]account.PLCEndpoint `json:"services"`
+}
+
+// handleSignPLCOperation signs, with this server's rotation key, a PLC
+// operation that follows the account's latest one and replaces whichever
+// of rotationKeys, alsoKnownAs, verificationMethods and services the
+// request gives. It needs the token emailed by
+// requestPlcOperationSignature. The operation is returned, not
+// submitted; a new PDS submits it with submitPlcOperation.
+// POST /xrpc/com.atproto.identity.signPlcOperation
+func (s *Server) handleSignPLCOperation(c echo.Context) error {
+	_, pool, acct, err := s.sessionAccount(c)
+	if acct == nil {
+		return err
+	}
+
+	var req signPLCOperationRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "Invalid JSON body",
+		})
+	}
+	if strings.TrimSpace(req.Token) == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "token is required",
+		})
+	}
+	if msg := s.plcAccountProblem(acct); msg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": msg,
+		})
+	}
+
+	ctx := c.Request().Context()
+	accounts := s.tenantStore(pool)
+	if err := accounts.ConsumeEmailToken(ctx, acct.DID, account.PurposePLCOperation, req.Token); err != nil {
+		return emailTokenError(c, err, acct.DID)
+	}
+
+	signers := []string{s.rotationKey, acct.SigningKey}
+	op, err := identity.PrepareUpdate(ctx, s.cfg.PLCEndpoint, accounts, acct.DID, signers,
+		func(op *account.PLCOperation) {
+			if req.RotationKeys != nil {
+				op.RotationKeys = req.RotationKeys
+			}
+			if req.AlsoKnownAs != nil {
+				op.AlsoKnownAs = req.AlsoKnownAs
+			}
+			if req.VerificationMethods != nil {
+				op.VerificationMethods = req.VerificationMethods
+			}
+			if req.Services != nil {
+				op.Services = req.Services
+			}
+		})
+	if err != nil {
+		if errors.Is(err, account.ErrNoRotationKey) {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error":   "InvalidRequest",
+				"message": "This server no longer holds a rotation key for " + acct.DID,
+			})
+		}
+		log.Printf("Error signing PLC operation for %s: %v", acct.DID, err)
+		return c.JSON(http.StatusBadGateway, map[string]string{
+			"error":   "PlcUpdateFailed",
+			"message": err.Error(),
+		})
+	}
+	if op == nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "Operation would not change the DID document",
+		})
+	}
+
+	log.Printf("PLC operation signed for %s", acct.DID)
+	return c.JSON(http.StatusOK, map[string]any{
+		"operation": op,
+	})
+}
+
+type submitPLCOperationRequest struct {
+	Operation json.RawMessage `json:"operation"`
+}
+
+// handleSubmitPLCOperation submits a signed PLC operation for the
+// account to the PLC directory, typically one its previous PDS signed
+// with signPlcOperation. The operation must publish this server's
+// credentials for the account, so the account can't lock itself out by
+// accident. The local operation log is refreshed and an #identity event
+// emitted afterwards.
+// POST /xrpc/com.atproto.identity.submitPlcOperation
+func (s *Server) handleSubmitPLCOperation(c echo.Context) error {
+	domainName, pool, acct, err := s.sessionAccount(c)
+	if acct == nil {
+		return err
+	}
+
+	var req submitPLCOperationRequest
+	if err := c.Bind(&req); err != nil || len(req.Operation) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "operation is required",
+		})
+	}
+	if msg := s.plcAccountProblem(acct); msg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": msg,
+		})
+	}
+
+	var op account.PLCOperation
+	if err := json.Unmarshal(req.Operation, &op); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "operation is not a PLC operation",
+		})
+	}
+	creds, err := s.credentialsFor(domainName, acct)
+	if err != nil {
+		log.Printf("Error building DID credentials for %s: %v", acct.DID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to check operation",
+		})
+	}
+	if err := checkCredentials(&op, creds); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": err.Error(),
+		})
+	}
+
+	ctx := c.Request().Context()
+	if err := identity.SubmitOperation(ctx, s.cfg.PLCEndpoint, acct.DID, req.Operation); err != nil {
+		log.Printf("Error submitting PLC operation for %s: %v", acct.DID, err)
+		return c.JSON(http.StatusBadGateway, map[string]string{
+			"error":   "PlcUpdateFailed",
+			"message": err.Error(),
+		})
+	}
+	if err := s.dir.Purge(ctx, syntax.DID(acct.DID).AtIdentifier()); err != nil {
+		log.Printf("Warning: purging cached DID document of %s: %v", acct.DID, err)
+	}
+	if err := identity.SyncLog(ctx, s.cfg.PLCEndpoint, s.tenantStore(pool), acct.DID); err != nil {
+		log.Printf("Warning: syncing PLC log for %s: %v", acct.DID, err)
+	}
+	if s.events != nil {
+		if err := s.events.EmitIdentity(ctx, acct.DID, domainName, acct.Handle); err != nil {
+			log.Printf("Warning: identity event for %s: %v", acct.DID, err)
+		}
+	}
+
+	log.Printf("PLC operation submitted for %s", acct.DID)
+	return c.NoContent(http.StatusOK)
+}
+
+// handleImportRepo replaces the caller's repository with a CAR archive,
+// typically one exported from its previous PDS with getRepo. Only
+// deactivated accounts may import, so a repo can't be swapped under
+// consumers that already follow it.
+// POST /xrpc/com.atproto.repo.importRepo
+func (s *Server) handleImportRepo(c echo.Context) error {
+	_, pool, acct, err := s.sessionAccount(c)
+	if acct == nil {
+		return err
+	}
+	if acct.Status != account.StatusDeactivated {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "A repository can only be imported while the account is deactivated",
+		})
+	}
+
+	ctx := c.Request().Context()
+	body := http.MaxBytesReader(c.Response(), c.Request().Body, repo.MaxImportBytes)
+	stats, err := s.repos.ImportRepo(ctx, pool, acct.DID, body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) || errors.Is(err, repo.ErrInvalidImport) {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error":   "InvalidRequest",
+				"message": err.Error(),
+			})
+		}
+		log.Printf("Error importing repo for %s: %v", acct.DID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to import repository",
+		})
+	}
+
+	log.Printf("Repo imported for %s: %d blocks, %d records, rev %s",
+		acct.DID, stats.Blocks, stats.Records, stats.Rev)
+	return c.NoContent(http.StatusOK)
+}
+
+// handleListMissingBlobs lists the blobs the caller's records reference
+// that have not been uploaded yet, ordered by CID. Each comes with the
+// URI of a record that references it.
+// GET /xrpc/com.atproto.repo.listMissingBlobs?limit=...&cursor=...
+func (s *Server) handleListMissingBlobs(c echo.Context) error {
+	_, pool, acct, err := s.sessionAccount(c)
+	if acct == nil {
+		return err
+	}
+
+	limit := 500
+	if l := c.QueryParam("limit"); l != "" {
+		if n, err := strconv.Atoi(l); err == nil && n > 0 && n <= 1000 {
+			limit = n
+		}
+	}
+	cursor := c.QueryParam("cursor")
+
+	ctx := c.Request().Context()
+	stats, err := s.repos.Stats(ctx, pool, acct.DID)
+	if err != nil {
+		log.Printf("Error reading repo stats for %s: %v", acct.DID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to read repository",
+		})
+	}
+
+	cids := slices.Sorted(slices.Values(stats.BlobCIDs))
+	cids = slices.DeleteFunc(cids, func(cid string) bool { return cid <= cursor })
+	missing, err := s.blobs.Missing(ctx, pool, acct.DID, cids)
+	if err != nil {
+		log.Printf("Error listing missing blobs for %s: %v", acct.DID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to read blobs",
+		})
+	}
+
+	resp := map[string]any{}
+	if len(missing) > limit {
+		missing = missing[:limit]
+		resp["cursor"] = missing[limit-1]
+	}
+	blobs := make([]map[string]string, 0, len(missing))
+	for _, cid := range missing {
+		blobs = append(blobs, map[string]string{
+			"cid":       cid,
+			"recordUri": "at://" + acct.DID + "/" + stats.BlobRecords[cid],
+		})
+	}
+	resp["blobs"] = blobs
+	return c.JSON(http.StatusOK, resp)
+}
+
+// didHostedHere reports, as an error, how the account's published DID
+// document fails to name this server as its PDS with the account's
+// signing key, or nil if it does. A did:plc this server has not
+// registered yet can't be resolved and is taken on trust.
+func (s *Server) didHostedHere(ctx context.Context, domainName string, acct *account.Account) error {
+	if acct.SigningKey == "" {
+		return errors.New("account has no signing key")
+	}
+	if strings.HasPrefix(acct.DID, "did:plc:") && acct.PLCStatus != account.PLCStatusRegistered {
+		return nil
+	}
+
+	did, err := syntax.ParseDID(acct.DID)
+	if err != nil {
+		return err
+	}
+	// The document is expected to have just changed, so any cached copy
+	// is dropped first.
+	if err := s.dir.Purge(ctx, did.AtIdentifier()); err != nil {
+		log.Printf("Warning: purging cached DID document of %s: %v", did, err)
+	}
+	ident, err := s.dir.LookupDID(ctx, did)
+	if err != nil {
+		return fmt.Errorf("resolving %s: %w", acct.DID, err)
+	}
+	endpoint := "https://" + domainName
+	if got := strings.TrimSuffix(ident.PDSEndpoint(), "/"); got != endpoint {
+		return fmt.Errorf("DID document lists PDS %q, not %s", got, endpoint)
+	}
+	didKey, err := account.SigningDIDKey(acct.SigningKey)
+	if err != nil {
+		return err
+	}
+	pub, err := ident.PublicKey()
+	if err != nil {
+		return fmt.Errorf("DID document has no atproto signing key: %w", err)
+	}
+	if pub.DIDKey() != didKey {
+		return fmt.Errorf("DID document signing key is %s, not this server's %s", pub.DIDKey(), didKey)
+	}
+	return nil
+}
+
+// plcAccountProblem returns why this server can't publish PLC
+// operations for acct, or "" if it can.
+func (s *Server) plcAccountProblem(acct *account.Account) string {
+	switch {
+	case s.cfg.PLCEndpoint == "":
+		return "No PLC directory is configured"
+	case !strings.HasPrefix(acct.DID, "did:plc:"):
+		return "Account does not have a did:plc"
+	case acct.PLCStatus == account.PLCStatusUnregistered:
+		return "Account's did:plc is not registered with a PLC directory"
+	case acct.SigningKey == "":
+		return "Account has no signing key"
+	}
+	return ""
+}
+
+// checkCredentials reports how op fails to publish creds, or nil if it
+// lists every rotation key and the handle of creds and carries its
+// signing key and PDS endpoint.
+func checkCredentials(op *account.PLCOperation, creds *didCredentials) error {
+	if op.Type != account.PLCOpTypeOperation {
+		return fmt.Errorf("operation type must be %q", account.PLCOpTypeOperation)
+	}
+	for _, k := range creds.RotationKeys {
+		if !slices.Contains(op.RotationKeys, k) {
+			return fmt.Errorf("rotationKeys must include this server's rotation key %s", k)
+		}
+	}
+	for _, aka := range creds.AlsoKnownAs {
+		if !slices.Contains(op.AlsoKnownAs, aka) {
+			return fmt.Errorf("alsoKnownAs must include %s", aka)
+		}
+	}
+	for id, key := range creds.VerificationMethods {
+		if op.VerificationMethods[id] != key {
+			return fmt.Errorf("verificationMethods.%s must be the account's signing key %s", id, key)
+		}
+	}
+	for id, svc := range creds.Services {
+		if op.Services[id] != svc {
+			return fmt.Errorf("services.%s must be %s at %s", id, svc.Type, svc.Endpoint)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,388 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/labstack/echo/v4"
+	"github.com/primal-host/primal-pds/internal/account"
+	"github.com/primal-host/primal-pds/internal/identity"
+)
+
+type resubmitPLCRequest struct {
+	Handle string `json:"handle"`
+}
+
+// handleResubmitPLC requeues an account's unsubmitted PLC operations,
+// including ones the registrar gave up on, and returns the account with
+// its operation log.
+// POST /xrpc/host.primal.pds.resubmitPlc
+func (s *Server) handleResubmitPLC(c echo.Context) error {
+	var req resubmitPLCRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "Invalid JSON body",
+		})
+	}
+
+	req.Handle = strings.TrimSpace(strings.ToLower(req.Handle))
+	if req.Handle == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "handle is required",
+		})
+	}
+	if s.cfg.PLCEndpoint == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "No PLC directory is configured",
+		})
+	}
+
+	ctx := c.Request().Context()
+	domainName := s.handleDomain(ctx, req.Handle)
+	if domainName == "" {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error":   "AccountNotFound",
+			"message": "Account not found: " + req.Handle,
+		})
+	}
+	pool, err := s.resolveDomainPool(c, domainName)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error":   "AccountNotFound",
+			"message": "Account not found: " + req.Handle,
+		})
+	}
+
+	accounts := s.tenantStore(pool)
+	acct, err := accounts.GetByHandle(ctx, req.Handle)
+	if err != nil {
+		return accountError(c, err, req.Handle)
+	}
+
+	acct, err = accounts.ResubmitPLC(ctx, acct.DID)
+	if err != nil {
+		if errors.Is(err, account.ErrNothingToSubmit) {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error":   "NothingToSubmit",
+				"message": "Account has no unsubmitted PLC operations",
+			})
+		}
+		return accountError(c, err, req.Handle)
+	}
+	s.notifyRegistrar()
+
+	ops, err := accounts.ListPLCOps(ctx, acct.DID)
+	if err != nil {
+		log.Printf("Error listing PLC operations for %s: %v", acct.DID, err)
+	}
+
+	log.Printf("PLC operations resubmitted: %s", req.Handle)
+	return c.JSON(http.StatusOK, map[string]any{
+		"account":       acct,
+		"plcOperations": ops,
+	})
+}
+
+type updatePLCRequest struct {
+	Handle string `json:"handle"`
+}
+
+// handleUpdatePLC publishes an account's current handle, signing key
+// and PDS endpoint to its did:plc, queuing an update operation if the
+// DID document the directory holds differs. It returns the account with
+// its operation log.
+// POST /xrpc/host.primal.pds.updatePlc
+func (s *Server) handleUpdatePLC(c echo.Context) error {
+	var req updatePLCRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "Invalid JSON body",
+		})
+	}
+
+	req.Handle = strings.TrimSpace(strings.ToLower(req.Handle))
+	if req.Handle == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "handle is required",
+		})
+	}
+	if s.cfg.PLCEndpoint == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "No PLC directory is configured",
+		})
+	}
+
+	ctx := c.Request().Context()
+	domainName := s.handleDomain(ctx, req.Handle)
+	if domainName == "" {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error":   "AccountNotFound",
+			"message": "Account not found: " + req.Handle,
+		})
+	}
+	pool, err := s.resolveDomainPool(c, domainName)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error":   "AccountNotFound",
+			"message": "Account not found: " + req.Handle,
+		})
+	}
+
+	accounts := s.tenantStore(pool)
+	acct, err := accounts.GetByHandle(ctx, req.Handle)
+	if err != nil {
+		return accountError(c, err, req.Handle)
+	}
+	if !strings.HasPrefix(acct.DID, "did:plc:") {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "Account does not have a did:plc",
+		})
+	}
+
+	queued, err := s.publishIdentity(ctx, domainName, pool, acct)
+	if err != nil {
+		log.Printf("Error updating PLC identity for %s: %v", acct.DID, err)
+		return c.JSON(http.StatusBadGateway, map[string]string{
+			"error":   "PlcUpdateFailed",
+			"message": err.Error(),
+		})
+	}
+
+	if acct, err = accounts.GetByDID(ctx, acct.DID); err != nil {
+		return accountError(c, err, req.Handle)
+	}
+	ops, err := accounts.ListPLCOps(ctx, acct.DID)
+	if err != nil {
+		log.Printf("Error listing PLC operations for %s: %v", acct.DID, err)
+	}
+
+	log.Printf("PLC identity checked: %s (update queued: %v)", req.Handle, queued)
+	return c.JSON(http.StatusOK, map[string]any{
+		"account":       acct,
+		"queued":        queued,
+		"plcOperations": ops,
+	})
+}
+
+// handleGetPLCLog returns the local copy of an account's PLC operation
+// log, oldest first. With sync=true it is first refreshed from the PLC
+// directory's audit log.
+// GET /xrpc/host.primal.pds.getPlcLog?handle=...&sync=true
+func (s *Server) handleGetPLCLog(c echo.Context) error {
+	handle := strings.TrimSpace(strings.ToLower(c.QueryParam("handle")))
+	if handle == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "handle query parameter is required",
+		})
+	}
+
+	ctx := c.Request().Context()
+	domainName := s.handleDomain(ctx, handle)
+	if domainName == "" {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error":   "AccountNotFound",
+			"message": "Account not found: " + handle,
+		})
+	}
+	pool, err := s.resolveDomainPool(c, domainName)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error":   "AccountNotFound",
+			"message": "Account not found: " + handle,
+		})
+	}
+
+	accounts := s.tenantStore(pool)
+	acct, err := accounts.GetByHandle(ctx, handle)
+	if err != nil {
+		return accountError(c, err, handle)
+	}
+
+	if c.QueryParam("sync") == "true" && s.cfg.PLCEndpoint != "" && strings.HasPrefix(acct.DID, "did:plc:") {
+		if err := identity.SyncLog(ctx, s.cfg.PLCEndpoint, accounts, acct.DID); err != nil {
+			log.Printf("Error syncing PLC log for %s: %v", acct.DID, err)
+			return c.JSON(http.StatusBadGateway, map[string]string{
+				"error":   "PlcSyncFailed",
+				"message": err.Error(),
+			})
+		}
+	}
+
+	ops, err := accounts.ListPLCOps(ctx, acct.DID)
+	if err != nil {
+		log.Printf("Error listing PLC operations for %s: %v", acct.DID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to list PLC operations",
+		})
+	}
+	if ops == nil {
+		ops = []account.PLCOp{}
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"did":           acct.DID,
+		"plcStatus":     acct.PLCStatus,
+		"plcOperations": ops,
+	})
+}
+
+// publishIdentity queues a PLC update when an account's handle, signing
+// key or PDS endpoint differ from what its did:plc publishes. The update
+// is signed with the PDS rotation key, and also makes sure that key is
+// among the DID's rotation keys and the account's repo signing key is
+// not. DIDs created before the server held a rotation key list only the
+// signing key, which then signs the update that hands control over.
+// Accounts without a did:plc, or servers without a PLC directory, are
+// skipped. It reports whether an update was queued.
+func (s *Server) publishIdentity(ctx context.Context, domainName string, pool *pgxpool.Pool, acct *account.Account) (bool, error) {
+	if s.cfg.PLCEndpoint == "" || !strings.HasPrefix(acct.DID, "did:plc:") || acct.SigningKey == "" {
+		return false, nil
+	}
+	change, err := s.identityChange(domainName, acct)
+	if err != nil {
+		return false, err
+	}
+
+	signers := []string{s.rotationKey, acct.SigningKey}
+	queued, err := identity.QueueUpdate(ctx, s.cfg.PLCEndpoint, s.tenantStore(pool), acct.DID, signers, change)
+	if err != nil {
+		return false, err
+	}
+	if queued {
+		s.notifyRegistrar()
+	}
+	return queued, nil
+}
+
+// identityChange returns the change that makes a PLC operation publish
+// acct's current handle, signing key and PDS endpoint.
+func (s *Server) identityChange(domainName string, acct *account.Account) (func(op *account.PLCOperation), error) {
+	didKey, err := account.SigningDIDKey(acct.SigningKey)
+	if err != nil {
+		return nil, err
+	}
+	rotationDIDKey, err := account.SigningDIDKey(s.rotationKey)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := s.serviceEndpointForDomain(domainName)
+
+	return func(op *account.PLCOperation) {
+		op.RotationKeys = withRotationKey(op.RotationKeys, rotationDIDKey, didKey)
+		op.AlsoKnownAs = withHandle(op.AlsoKnownAs, acct.Handle)
+		op.VerificationMethods[account.PLCVerificationAtproto] = didKey
+		op.Services[account.PLCServiceAtprotoPDS] = account.PLCEndpoint{
+			Type:     "AtprotoPersonalDataServer",
+			Endpoint: endpoint,
+		}
+	}, nil
+}
+
+// publishIdentities runs publishIdentity for every active did:plc
+// account whose local operation log no longer matches its signing key,
+// PDS endpoint or handle, as after a key was replaced or the endpoint
+// moved while the server was down. Accounts that are up to date are
+// checked against the local log only, without asking the directory;
+// accounts with no local log yet are published, which fetches it.
+func (s *Server) publishIdentities(ctx context.Context) {
+	for domainName, pool := range s.pools.All() {
+		accounts := s.tenantStore(pool)
+		accts, err := accounts.List(ctx)
+		if err != nil {
+			log.Printf("Warning: publishing identities for %s: %v", domainName, err)
+			continue
+		}
+		for i := range accts {
+			acct := &accts[i]
+			if ctx.Err() != nil {
+				return
+			}
+			if acct.Status != account.StatusActive || s.plcAccountProblem(acct) != "" {
+				continue
+			}
+			if !s.identityOutdated(ctx, domainName, accounts, acct) {
+				continue
+			}
+			queued, err := s.publishIdentity(ctx, domainName, pool, acct)
+			if err != nil {
+				log.Printf("Warning: publishing identity of %s: %v", acct.DID, err)
+			} else if queued {
+				log.Printf("PLC update queued for %s", acct.DID)
+			}
+		}
+	}
+}
+
+// identityOutdated reports whether the latest operation in acct's local
+// PLC log publishes something other than its current identity, or
+// there is no local log to tell.
+func (s *Server) identityOutdated(ctx context.Context, domainName string, accounts *account.Store, acct *account.Account) bool {
+	last, err := accounts.LastPLCOp(ctx, acct.DID)
+	if err != nil {
+		return errors.Is(err, account.ErrNoPLCLog)
+	}
+	var prev account.PLCOperation
+	if err := json.Unmarshal(last.Operation, &prev); err != nil || prev.Type != account.PLCOpTypeOperation {
+		return false
+	}
+	change, err := s.identityChange(domainName, acct)
+	if err != nil {
+		return false
+	}
+	next := account.NextPLCOperation(&prev, last.CID)
+	change(next)
+	return !account.SamePLCState(&prev, next)
+}
+
+// withRotationKey returns rotationKeys with the signing key removed and
+// the PDS rotation key appended if it is missing. Other keys, such as a
+// user's recovery key, keep their place.
+func withRotationKey(rotationKeys []string, rotationDIDKey, signingDIDKey string) []string {
+	out := make([]string, 0, len(rotationKeys)+1)
+	for _, k := range rotationKeys {
+		if k != signingDIDKey {
+			out = append(out, k)
+		}
+	}
+	if !slices.Contains(out, rotationDIDKey) {
+		out = append(out, rotationDIDKey)
+	}
+	return out
+}
+
+// withHandle returns alsoKnownAs with its first at:// entry replaced by
+// the given handle (or the handle prepended if there is none), keeping
+// any other entries.
+func withHandle(alsoKnownAs []string, handle string) []string {
+	out := []string{"at://" + handle}
+	replaced := false
+	for _, aka := range alsoKnownAs {
+		if !replaced && strings.HasPrefix(aka, "at://") {
+			replaced = true
+			continue
+		}
+		out = append(out, aka)
+	}
+	return out
+}
+
+// notifyRegistrar wakes the PLC registrar after operations are queued.
+func (s *Server) notifyRegistrar() {
+	if s.registrar != nil {
+		s.registrar.Notify()
+	}
+}
@@ -1,27 +1,24 @@
 package server
 
 import (
-	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/labstack/echo/v4"
 	"github.com/primal-host/primal-pds/internal/account"
-	"github.com/primal-host/primal-pds/internal/events"
 	"github.com/primal-host/primal-pds/internal/repo"
-
-	"github.com/ipfs/go-cid"
 )
 
 // resolveRepo resolves a "repo" parameter (handle or DID) to an Account
 // and the tenant pool where that account lives.
 func (s *Server) resolveRepo(c echo.Context, repoID string) (*account.Account, *pgxpool.Pool, error) {
 	ctx := c.Request().Context()
+	repoID = account.NormalizeDID(repoID)
 
 	var domainName string
 	var err error
@@ -34,7 +31,7 @@ func (s *Server) resolveRepo(c echo.Context, repoID string) (*account.Account, *
 		}
 	} else {
 		// Extract domain from handle suffix.
-		domainName = extractDomainFromHandle(repoID, s.pools)
+		domainName = s.handleDomain(ctx, repoID)
 		if domainName == "" {
 			return nil, nil, account.ErrNotFound
 		}
@@ -67,6 +64,21 @@ func repoNotFound(c echo.Context, repoID string) error {
 	})
 }
 
+// commitError returns the response for a failed repo write, reporting
+// commits the repo refuses as client errors.
+func commitError(c echo.Context, err error, message string) error {
+	if errors.Is(err, repo.ErrTooManyOps) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": fmt.Sprintf("Too many operations in one commit (max %d)", repo.MaxCommitOps),
+		})
+	}
+	return c.JSON(http.StatusInternalServerError, map[string]string{
+		"error":   "InternalError",
+		"message": message,
+	})
+}
+
 // --- createRecord ---
 
 type createRecordRequest struct {
@@ -104,8 +116,8 @@ func (s *Server) handleCreateRecord(c echo.Context) error {
 		})
 	}
 
-	if err := checkRepoAuth(c, acct.DID); err != nil {
-		return err
+	if err := checkRepoWrite(c, acct); err != nil {
+		return policyError(c, err)
 	}
 
 	ctx := c.Request().Context()
@@ -119,13 +131,10 @@ func (s *Server) handleCreateRecord(c echo.Context) error {
 	}
 	if err != nil {
 		log.Printf("Error creating record for %s: %v", acct.DID, err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error":   "InternalError",
-			"message": "Failed to create record",
-		})
+		return commitError(c, err, "Failed to create record")
 	}
 
-	s.emitCommitEvent(ctx, acct.DID, result)
+	s.notifyCommit()
 
 	return c.JSON(http.StatusOK, map[string]any{
 		"uri": uri,
@@ -163,6 +172,10 @@ func (s *Server) handleGetRecord(c echo.Context) error {
 		})
 	}
 
+	if err := s.checkRepoAvailable(c, acct); err != nil {
+		return policyError(c, err)
+	}
+
 	cidStr, record, err := s.repos.GetRecord(c.Request().Context(), pool, acct.DID, collection, rkey)
 	if err != nil {
 		if strings.Contains(err.Error(), "not found") {
@@ -222,8 +235,8 @@ func (s *Server) handleDeleteRecord(c echo.Context) error {
 		})
 	}
 
-	if err := checkRepoAuth(c, acct.DID); err != nil {
-		return err
+	if err := checkRepoWrite(c, acct); err != nil {
+		return policyError(c, err)
 	}
 
 	result, err := s.repos.DeleteRecord(c.Request().Context(), pool, acct.DID, acct.SigningKey, req.Collection, req.RKey)
@@ -235,13 +248,10 @@ func (s *Server) handleDeleteRecord(c echo.Context) error {
 			})
 		}
 		log.Printf("Error deleting record %s/%s for %s: %v", req.Collection, req.RKey, acct.DID, err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error":   "InternalError",
-			"message": "Failed to delete record",
-		})
+		return commitError(c, err, "Failed to delete record")
 	}
 
-	s.emitCommitEvent(c.Request().Context(), acct.DID, result)
+	s.notifyCommit()
 
 	return c.JSON(http.StatusOK, map[string]any{
 		"commit": map[string]string{
@@ -288,20 +298,17 @@ func (s *Server) handlePutRecord(c echo.Context) error {
 		})
 	}
 
-	if err := checkRepoAuth(c, acct.DID); err != nil {
-		return err
+	if err := checkRepoWrite(c, acct); err != nil {
+		return policyError(c, err)
 	}
 
 	uri, result, err := s.repos.PutRecord(c.Request().Context(), pool, acct.DID, acct.SigningKey, req.Collection, req.RKey, req.Record)
 	if err != nil {
 		log.Printf("Error putting record %s/%s for %s: %v", req.Collection, req.RKey, acct.DID, err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error":   "InternalError",
-			"message": "Failed to put record",
-		})
+		return commitError(c, err, "Failed to put record")
 	}
 
-	s.emitCommitEvent(c.Request().Context(), acct.DID, result)
+	s.notifyCommit()
 
 	return c.JSON(http.StatusOK, map[string]any{
 		"uri": uri,
@@ -348,6 +355,10 @@ func (s *Server) handleListRecords(c echo.Context) error {
 		})
 	}
 
+	if err := s.checkRepoAvailable(c, acct); err != nil {
+		return policyError(c, err)
+	}
+
 	records, nextCursor, err := s.repos.ListRecords(c.Request().Context(), pool, acct.DID, collection, limit, cursor, reverse)
 	if err != nil {
 		log.Printf("Error listing records for %s/%s: %v", acct.DID, collection, err)
@@ -389,6 +400,10 @@ func (s *Server) handleDescribeRepo(c echo.Context) error {
 		})
 	}
 
+	if err := s.checkRepoAvailable(c, acct); err != nil {
+		return policyError(c, err)
+	}
+
 	collections, err := s.repos.DescribeRepo(c.Request().Context(), pool, acct.DID)
 	if err != nil {
 		log.Printf("Error describing repo for %s: %v", acct.DID, err)
@@ -398,8 +413,8 @@ func (s *Server) handleDescribeRepo(c echo.Context) error {
 		})
 	}
 
-	// Extract domain from handle to build DID document.
-	domainName := extractDomainFromHandle(acct.Handle, s.pools)
+	// The DID document's service endpoint is the account's home domain.
+	domainName, _ := s.mgmtDB.LookupDIDDomain(c.Request().Context(), acct.DID)
 	didDoc := map[string]any{}
 	if domainName != "" && acct.SigningKey != "" {
 		doc, err := account.BuildDIDDocument(acct.DID, acct.Handle, acct.SigningKey, domainName)
@@ -407,7 +422,7 @@ func (s *Server) handleDescribeRepo(c echo.Context) error {
 			didDoc = map[string]any{
 				"@context":           doc.Context,
 				"id":                 doc.ID,
-				"alsoKnownAs":       doc.AlsoKnownAs,
+				"alsoKnownAs":        doc.AlsoKnownAs,
 				"verificationMethod": doc.VerificationMethod,
 				"service":            doc.Service,
 			}
@@ -425,65 +440,11 @@ func (s *Server) handleDescribeRepo(c echo.Context) error {
 	})
 }
 
-// checkRepoAuth verifies that the authenticated caller is allowed to
-// modify the given repo. Admins can modify any repo; JWT users can only
-// modify their own.
-func checkRepoAuth(c echo.Context, repoDID string) error {
-	ac := getAuth(c)
-	if ac == nil {
-		return c.JSON(http.StatusUnauthorized, map[string]string{
-			"error":   "AuthRequired",
-			"message": "Authentication required",
-		})
-	}
-	if ac.IsAdmin {
-		return nil
-	}
-	if ac.DID != repoDID {
-		return c.JSON(http.StatusForbidden, map[string]string{
-			"error":   "Forbidden",
-			"message": "Cannot modify another account's repository",
-		})
-	}
-	return nil
-}
-
-// emitCommitEvent converts a CommitResult to a CommitInfo and emits it
-// through the EventManager. Errors are logged but not returned — event
-// emission is best-effort and must not break the mutation path.
-func (s *Server) emitCommitEvent(ctx context.Context, did string, result *repo.CommitResult) {
-	if s.events == nil || result == nil {
-		return
-	}
-
-	commitCID, err := cid.Decode(result.CommitCID)
-	if err != nil {
-		log.Printf("Warning: emit event: decode commit cid: %v", err)
-		return
-	}
-
-	ops := make([]events.OpInfo, len(result.Ops))
-	for i, op := range result.Ops {
-		ops[i] = events.OpInfo{
-			Action: op.Action,
-			Path:   op.Path,
-			CID:    op.CID,
-			Prev:   op.Prev,
-		}
-	}
-
-	info := &events.CommitInfo{
-		DID:       did,
-		Rev:       result.Rev,
-		PrevRev:   result.PrevRev,
-		CommitCID: commitCID.String(),
-		PrevData:  result.PrevData,
-		DiffCAR:   result.DiffCAR,
-		Ops:       ops,
-		Time:      time.Now(),
-	}
-
-	if err := s.events.Emit(ctx, info); err != nil {
-		log.Printf("Warning: emit event for %s: %v", did, err)
+// notifyCommit wakes the sequencer after a successful write. The commit
+// itself was already queued in the tenant outbox by the repo package, so
+// this only shortens the time until it reaches the firehose.
+func (s *Server) notifyCommit() {
+	if s.sequencer != nil {
+		s.sequencer.Notify()
 	}
 }
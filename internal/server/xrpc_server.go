@@ -8,21 +8,14 @@ import (
 
 	"github.com/labstack/echo/v4"
 	"github.com/primal-host/primal-pds/internal/account"
+	"github.com/primal-host/primal-pds/internal/auth"
 )
 
 // handleDescribeServer returns server metadata including the service DID
 // and available user domains.
 // GET /xrpc/com.atproto.server.describeServer
 func (s *Server) handleDescribeServer(c echo.Context) error {
-	// Derive did:web from serviceURL.
-	serviceDID := ""
-	if s.cfg.ServiceURL != "" {
-		host := s.cfg.ServiceURL
-		host = strings.TrimPrefix(host, "https://")
-		host = strings.TrimPrefix(host, "http://")
-		host = strings.TrimSuffix(host, "/")
-		serviceDID = "did:web:" + host
-	}
+	serviceDID := s.serviceDID()
 
 	// Collect active domain names.
 	domains, err := s.domains.ListActive(c.Request().Context())
@@ -41,8 +34,8 @@ func (s *Server) handleDescribeServer(c echo.Context) error {
 	})
 }
 
-// handleCreateSession authenticates a user by handle/DID + password and
-// returns a JWT token pair.
+// handleCreateSession authenticates a user by handle/DID and the account
+// password or one of its app passwords, and returns a JWT token pair.
 // POST /xrpc/com.atproto.server.createSession
 func (s *Server) handleCreateSession(c echo.Context) error {
 	var req struct {
@@ -95,7 +88,7 @@ func (s *Server) handleCreateSession(c echo.Context) error {
 		handle = acct.Handle
 	} else {
 		handle = strings.ToLower(strings.TrimSpace(req.Identifier))
-		domainName = extractDomainFromHandle(handle, s.pools)
+		domainName = s.handleDomain(ctx, handle)
 		if domainName == "" {
 			return c.JSON(http.StatusUnauthorized, map[string]string{
 				"error":   "AuthenticationRequired",
@@ -112,15 +105,34 @@ func (s *Server) handleCreateSession(c echo.Context) error {
 		})
 	}
 
-	acct, err := s.tenantStore(pool).VerifyPassword(ctx, handle, req.Password)
+	// The account password grants full access; an app password, tried
+	// if it isn't the account password, a restricted session.
+	scope, appPassword := auth.ScopeAccess, ""
+	accounts := s.tenantStore(pool)
+	acct, err := accounts.VerifyPassword(ctx, handle, req.Password)
 	if err != nil {
-		return c.JSON(http.StatusUnauthorized, map[string]string{
-			"error":   "AuthenticationRequired",
-			"message": "Invalid identifier or password",
-		})
+		var ap *account.AppPassword
+		acct, ap, err = accounts.VerifyAppPassword(ctx, handle, req.Password)
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, map[string]string{
+				"error":   "AuthenticationRequired",
+				"message": "Invalid identifier or password",
+			})
+		}
+		scope, appPassword = auth.ScopeAppPass, ap.Name
+		if ap.Privileged {
+			scope = auth.ScopeAppPassPrivileged
+		}
+	}
+	if err := account.CanLogin(acct.Status); err != nil {
+		return policyError(c, err)
 	}
 
-	tokens, err := s.jwt.CreateTokenPair(acct.DID)
+	tokens, err := s.jwt.CreateSession(ctx, &auth.Session{
+		DID:         acct.DID,
+		Scope:       scope,
+		AppPassword: appPassword,
+	})
 	if err != nil {
 		log.Printf("Error creating tokens for %s: %v", acct.DID, err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{
@@ -138,7 +150,9 @@ func (s *Server) handleCreateSession(c echo.Context) error {
 	})
 }
 
-// handleRefreshSession issues a new token pair from a valid refresh token.
+// handleRefreshSession exchanges a refresh token for the next token
+// pair of its session. A refresh token can be exchanged once; using it
+// again revokes the session.
 // POST /xrpc/com.atproto.server.refreshSession
 func (s *Server) handleRefreshSession(c echo.Context) error {
 	ac := getAuth(c)
@@ -174,9 +188,21 @@ func (s *Server) handleRefreshSession(c echo.Context) error {
 			"message": "Account not found",
 		})
 	}
+	if err := account.CanLogin(acct.Status); err != nil {
+		return policyError(c, err)
+	}
 
-	tokens, err := s.jwt.CreateTokenPair(ac.DID)
-	if err != nil {
+	tokens, err := s.jwt.RefreshSession(ctx, ac.DID, ac.TokenID)
+	switch {
+	case errors.Is(err, auth.ErrTokenReused):
+		log.Printf("Refresh token reused for %s: session revoked", ac.DID)
+		fallthrough
+	case errors.Is(err, auth.ErrSessionRevoked):
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "ExpiredToken",
+			"message": "Token has been revoked",
+		})
+	case err != nil:
 		log.Printf("Error refreshing tokens for %s: %v", ac.DID, err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{
 			"error":   "InternalError",
@@ -248,6 +274,11 @@ func (s *Server) handleGetSession(c echo.Context) error {
 		"handle": acct.Handle,
 		"email":  acct.Email,
 	}
+	active, reason := account.HostingStatus(acct.Status)
+	resp["active"] = active
+	if !active {
+		resp["status"] = reason
+	}
 
 	// Include DID document if possible.
 	if acct.SigningKey != "" {
@@ -266,22 +297,42 @@ func (s *Server) handleGetSession(c echo.Context) error {
 	return c.JSON(http.StatusOK, resp)
 }
 
-// handleDeleteSession is a no-op for the stateless JWT MVP. Clients
-// should discard tokens locally.
+// handleDeleteSession revokes the session of the refresh token, ending
+// its access tokens too.
 // POST /xrpc/com.atproto.server.deleteSession
 func (s *Server) handleDeleteSession(c echo.Context) error {
+	ac := getAuth(c)
+	if ac == nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error":   "AuthRequired",
+			"message": "Refresh token required",
+		})
+	}
+	if err := s.jwt.RevokeSession(c.Request().Context(), ac.TokenID); err != nil {
+		log.Printf("Error revoking session of %s: %v", ac.DID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to delete session",
+		})
+	}
 	return c.NoContent(http.StatusOK)
 }
 
 // handleCreateAccountXRPC handles public account creation via the standard
 // AT Protocol endpoint. Gated by registrationOpen config or admin key.
+// The handle is either under a hosted domain or a custom-domain handle
+// that already declares the new account's DID. With did set, the
+// account moves here from another PDS: it keeps that DID, needs a
+// service auth token from it (unless the admin key is used), and starts
+// deactivated until activateAccount completes the move.
 // POST /xrpc/com.atproto.server.createAccount
 func (s *Server) handleCreateAccountXRPC(c echo.Context) error {
-	ac := getAuth(c)
+	ac := s.optionalAuth(c)
+	isAdmin := ac != nil && ac.IsAdmin
 
 	// Gate: require admin key or open registration.
 	if !s.cfg.RegistrationOpen {
-		if ac == nil || !ac.IsAdmin {
+		if !isAdmin {
 			return c.JSON(http.StatusForbidden, map[string]string{
 				"error":   "RegistrationClosed",
 				"message": "Public registration is not available on this server",
@@ -290,9 +341,11 @@ func (s *Server) handleCreateAccountXRPC(c echo.Context) error {
 	}
 
 	var req struct {
-		Handle   string `json:"handle"`
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Handle      string `json:"handle"`
+		Email       string `json:"email"`
+		Password    string `json:"password"`
+		RecoveryKey string `json:"recoveryKey"`
+		DID         string `json:"did"`
 	}
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{
@@ -309,13 +362,60 @@ func (s *Server) handleCreateAccountXRPC(c echo.Context) error {
 		})
 	}
 
-	// Extract domain from handle suffix.
+	req.RecoveryKey = strings.TrimSpace(req.RecoveryKey)
+	if req.RecoveryKey != "" {
+		if err := account.ValidateRecoveryKey(req.RecoveryKey); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error":   "InvalidRequest",
+				"message": "recoveryKey must be a did:key",
+			})
+		}
+	}
+
+	// An account moving here from another PDS keeps its DID. The old
+	// PDS vouches for the move with a service auth token, signed with
+	// the DID's key, that the client passes as its bearer token.
+	req.DID = strings.TrimSpace(req.DID)
+	if req.DID != "" {
+		if !strings.HasPrefix(req.DID, "did:plc:") && !strings.HasPrefix(req.DID, "did:web:") {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error":   "InvalidRequest",
+				"message": "did must be a did:plc or did:web",
+			})
+		}
+		req.DID = account.NormalizeDID(req.DID)
+	}
+
+	// A handle under a hosted domain puts the account in that domain's
+	// tenant. Any other handle is a custom-domain handle: the account is
+	// created under the hosted domain the request was sent to, and the
+	// handle must already declare the account's DID. Only an account
+	// moving here has a DID its handle can declare in advance; a new one
+	// signs up under the hosted domain and switches with updateHandle.
 	domainName := extractDomainFromHandle(req.Handle, s.pools)
-	if domainName == "" {
-		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error":   "InvalidHandle",
-			"message": "Handle must end with a hosted domain suffix",
-		})
+	custom := domainName == ""
+	if custom {
+		handle, err := normalizeHandle(req.Handle)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error":   "InvalidHandle",
+				"message": err.Error(),
+			})
+		}
+		req.Handle = handle
+		domainName = extractDomainFromHandle(strings.ToLower(stripPort(c.Request().Host)), s.pools)
+		if domainName == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error":   "InvalidHandle",
+				"message": "Handle must end with a hosted domain suffix",
+			})
+		}
+		if req.DID == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error":   "InvalidHandle",
+				"message": "A custom-domain handle can't declare a DID that doesn't exist yet: sign up with a handle under " + domainName + ", then switch to " + req.Handle + " with updateHandle",
+			})
+		}
 	}
 
 	ctx := c.Request().Context()
@@ -327,14 +427,64 @@ func (s *Server) handleCreateAccountXRPC(c echo.Context) error {
 		})
 	}
 
+	if req.DID != "" {
+		if !isAdmin {
+			// The account moving here asks for itself, with a service
+			// auth token addressed to the domain of its new handle.
+			caller, err := s.migrationCaller(c, domainName, req.DID)
+			if err != nil {
+				return c.JSON(http.StatusUnauthorized, map[string]string{
+					"error":   "InvalidToken",
+					"message": err.Error(),
+				})
+			}
+			c.Set(authContextKey, caller)
+		}
+		if _, err := s.mgmtDB.LookupDIDDomain(ctx, req.DID); err == nil {
+			return c.JSON(http.StatusConflict, map[string]string{
+				"error":   "AlreadyExists",
+				"message": "An account already exists for " + req.DID,
+			})
+		}
+	}
+
+	reserved, err := s.handleReserved(ctx, req.Handle, req.DID)
+	if err != nil {
+		log.Printf("Error checking deleted handles for %q: %v", req.Handle, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to create account",
+		})
+	}
+	if reserved {
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error":   "HandleTaken",
+			"message": "Handle already taken: " + req.Handle,
+		})
+	}
+
+	if custom {
+		if err := s.claimCustomHandle(ctx, req.Handle, req.DID, domainName); err != nil {
+			return customHandleError(c, err, req.Handle)
+		}
+	}
+
 	accounts := s.tenantStore(pool)
 	acct, err := accounts.Create(ctx, account.CreateParams{
 		Handle:          req.Handle,
 		Email:           req.Email,
 		Password:        req.Password,
 		ServiceEndpoint: s.serviceEndpointForDomain(domainName),
+		RotationKey:     s.rotationKey,
+		RecoveryKey:     req.RecoveryKey,
+		DID:             req.DID,
 	})
 	if err != nil {
+		if custom {
+			if err := s.handles.Release(ctx, req.DID); err != nil {
+				log.Printf("Warning: failed to release custom handle of %s: %v", req.DID, err)
+			}
+		}
 		if isDuplicateKey(err) {
 			return c.JSON(http.StatusConflict, map[string]string{
 				"error":   "HandleTaken",
@@ -353,13 +503,14 @@ func (s *Server) handleCreateAccountXRPC(c echo.Context) error {
 		log.Printf("Error inserting DID routing for %q: %v", acct.DID, err)
 	}
 
-	// Init repo.
+	// Init repo. An account moving in replaces it with importRepo.
 	if err := s.repos.InitRepo(ctx, pool, acct.DID, acct.SigningKey); err != nil {
 		log.Printf("Warning: failed to init repo for %s: %v", acct.DID, err)
 	}
+	s.notifyRegistrar()
 
 	// Create tokens.
-	tokens, err := s.jwt.CreateTokenPair(acct.DID)
+	tokens, err := s.jwt.CreateSession(ctx, &auth.Session{DID: acct.DID, Scope: auth.ScopeAccess})
 	if err != nil {
 		log.Printf("Error creating tokens for new account %s: %v", acct.DID, err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{
@@ -6,10 +6,12 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
 	"github.com/primal-host/primal-pds/internal/account"
+	"github.com/primal-host/primal-pds/internal/events"
 	"github.com/primal-host/primal-pds/internal/identity"
 )
 
@@ -21,7 +23,7 @@ var wsUpgrader = websocket.Upgrader{
 // handleGetRepo streams the full repository as a CAR v1 archive.
 // GET /xrpc/com.atproto.sync.getRepo?did=...
 func (s *Server) handleGetRepo(c echo.Context) error {
-	did := c.QueryParam("did")
+	did := account.NormalizeDID(c.QueryParam("did"))
 	if did == "" {
 		return c.JSON(http.StatusBadRequest, map[string]string{
 			"error":   "InvalidRequest",
@@ -29,7 +31,7 @@ func (s *Server) handleGetRepo(c echo.Context) error {
 		})
 	}
 
-	_, pool, err := s.resolveRepo(c, did)
+	acct, pool, err := s.resolveRepo(c, did)
 	if err != nil {
 		if errors.Is(err, account.ErrNotFound) {
 			return c.JSON(http.StatusNotFound, map[string]string{
@@ -44,6 +46,10 @@ func (s *Server) handleGetRepo(c echo.Context) error {
 		})
 	}
 
+	if err := s.checkRepoAvailable(c, acct); err != nil {
+		return policyError(c, err)
+	}
+
 	ctx := c.Request().Context()
 	c.Response().Header().Set("Content-Type", "application/vnd.ipld.car")
 	c.Response().WriteHeader(http.StatusOK)
@@ -59,7 +65,7 @@ func (s *Server) handleGetRepo(c echo.Context) error {
 // handleGetLatestCommit returns the current commit CID and rev.
 // GET /xrpc/com.atproto.sync.getLatestCommit?did=...
 func (s *Server) handleGetLatestCommit(c echo.Context) error {
-	did := c.QueryParam("did")
+	did := account.NormalizeDID(c.QueryParam("did"))
 	if did == "" {
 		return c.JSON(http.StatusBadRequest, map[string]string{
 			"error":   "InvalidRequest",
@@ -82,6 +88,10 @@ func (s *Server) handleGetLatestCommit(c echo.Context) error {
 		})
 	}
 
+	if err := s.checkRepoAvailable(c, acct); err != nil {
+		return policyError(c, err)
+	}
+
 	commitCID, rev, err := s.repos.GetRoot(c.Request().Context(), pool, acct.DID)
 	if err != nil {
 		log.Printf("Error getting root for %s: %v", did, err)
@@ -123,6 +133,90 @@ func (s *Server) handleSubscribeRepos(c echo.Context) error {
 		since = &n
 	}
 
+	return s.serveEventStream(c, since, func(ws *websocket.Conn, evt *events.Event) error {
+		return ws.WriteMessage(websocket.BinaryMessage, evt.Frame)
+	})
+}
+
+// handleSubscribeDomain is a firehose restricted to one hosted domain,
+// for tenant operators who should only see their own accounts' commits.
+// The caller must be the admin key or an owner/admin of the domain.
+// cursor is a firehose seq; replay covers events for DIDs currently
+// routed to the domain, and a cursor ahead of the stream is rejected.
+// GET /xrpc/host.primal.pds.subscribeDomain?domain=...&cursor=...
+func (s *Server) handleSubscribeDomain(c echo.Context) error {
+	if s.events == nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{
+			"error":   "ServiceUnavailable",
+			"message": "Firehose not available",
+		})
+	}
+
+	domainName := strings.TrimSpace(strings.ToLower(c.QueryParam("domain")))
+	if domainName == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "domain query parameter is required",
+		})
+	}
+
+	ctx := c.Request().Context()
+	if s.pools.Get(domainName) == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error":   "DomainNotFound",
+			"message": "Domain not found: " + domainName,
+		})
+	}
+	if !s.canManageDomain(ctx, getAuth(c), domainName) {
+		return c.JSON(http.StatusForbidden, map[string]string{
+			"error":   "Forbidden",
+			"message": "Only the domain owner or an admin can subscribe to this domain",
+		})
+	}
+
+	var since *int64
+	if cursorStr := c.QueryParam("cursor"); cursorStr != "" {
+		n, err := strconv.ParseInt(cursorStr, 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error":   "InvalidRequest",
+				"message": "cursor must be an integer",
+			})
+		}
+		latest, err := s.events.LatestSeq(ctx)
+		if err != nil {
+			log.Printf("Error reading latest seq: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"error":   "InternalError",
+				"message": "Failed to read firehose position",
+			})
+		}
+		if n > latest {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error":   "FutureCursor",
+				"message": "Cursor is ahead of the current stream position",
+			})
+		}
+		since = &n
+	}
+
+	return s.serveEventStreamFor(c, domainName, since, func(ws *websocket.Conn, evt *events.Event) error {
+		return ws.WriteMessage(websocket.BinaryMessage, evt.Frame)
+	})
+}
+
+// serveEventStream upgrades the request to a WebSocket, subscribes to
+// the EventManager from the optional cursor, and calls send for every
+// event until the client disconnects, the subscription is dropped, or
+// send returns an error.
+func (s *Server) serveEventStream(c echo.Context, since *int64, send func(ws *websocket.Conn, evt *events.Event) error) error {
+	return s.serveEventStreamFor(c, "", since, send)
+}
+
+// serveEventStreamFor is serveEventStream restricted to one domain's
+// events, withheld ones included, when domainName is set. Callers must
+// have checked that the client may see them.
+func (s *Server) serveEventStreamFor(c echo.Context, domainName string, since *int64, send func(ws *websocket.Conn, evt *events.Event) error) error {
 	// Upgrade to WebSocket.
 	ws, err := wsUpgrader.Upgrade(c.Response(), c.Request(), nil)
 	if err != nil {
@@ -133,8 +227,15 @@ func (s *Server) handleSubscribeRepos(c echo.Context) error {
 
 	ctx := c.Request().Context()
 
-	// Subscribe to event stream.
-	ch, cancel, err := s.events.Subscribe(ctx, since)
+	// Subscribe to event stream. Only a domain's own stream, which is
+	// authenticated, carries withheld events.
+	var ch <-chan *events.Event
+	var cancel func()
+	if domainName == "" {
+		ch, cancel, err = s.events.Subscribe(ctx, since)
+	} else {
+		ch, cancel, err = s.events.SubscribeDomain(ctx, domainName, since)
+	}
 	if err != nil {
 		log.Printf("Subscribe error: %v", err)
 		return nil
@@ -152,15 +253,15 @@ func (s *Server) handleSubscribeRepos(c echo.Context) error {
 		}
 	}()
 
-	// Write loop: send frames to client.
+	// Write loop: send events to client.
 	for {
 		select {
-		case frame, ok := <-ch:
+		case evt, ok := <-ch:
 			if !ok {
 				// Channel closed — slow consumer or shutdown.
 				return nil
 			}
-			if err := ws.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+			if err := send(ws, evt); err != nil {
 				return nil
 			}
 		case <-disconnected:
@@ -191,7 +292,7 @@ func (s *Server) handleRequestCrawl(c echo.Context) error {
 	// If we have a serviceURL, announce ourselves to the Bluesky relay.
 	if s.cfg.ServiceURL != "" {
 		go func() {
-			if err := identity.AnnounceToRelay(context.Background(), "https://bsky.network", s.cfg.ServiceURL); err != nil {
+			if err := identity.AnnounceToRelay(context.Background(), "https://bsky.network", s.cfg.ServiceURL, s.serviceKey); err != nil {
 				log.Printf("Warning: relay announcement failed: %v", err)
 			}
 		}()
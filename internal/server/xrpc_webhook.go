@@ -0,0 +1,308 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/primal-host/primal-pds/internal/webhook"
+)
+
+// maxWebhookCollections bounds the collection filter on a webhook.
+const maxWebhookCollections = 100
+
+type createWebhookRequest struct {
+	Domain      string   `json:"domain"`
+	URL         string   `json:"url"`
+	Collections []string `json:"collections"`
+}
+
+// handleCreateWebhook subscribes a URL to a domain's commits. The
+// response carries the signing secret; it is not returned again.
+// POST /xrpc/host.primal.pds.createWebhook
+func (s *Server) handleCreateWebhook(c echo.Context) error {
+	var req createWebhookRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "Invalid JSON body",
+		})
+	}
+
+	req.Domain = strings.TrimSpace(strings.ToLower(req.Domain))
+	req.URL = strings.TrimSpace(req.URL)
+	if req.Domain == "" || req.URL == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "domain and url are required",
+		})
+	}
+	if err := webhook.ValidateURL(req.URL); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": err.Error(),
+		})
+	}
+	if len(req.Collections) > maxWebhookCollections {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "too many collections (max " + strconv.Itoa(maxWebhookCollections) + ")",
+		})
+	}
+
+	ctx := c.Request().Context()
+	if s.pools.Get(req.Domain) == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error":   "DomainNotFound",
+			"message": "Domain not found: " + req.Domain,
+		})
+	}
+	if !s.canManageDomain(ctx, getAuth(c), req.Domain) {
+		return webhookForbidden(c)
+	}
+
+	hook, err := s.webhooks.Create(ctx, req.Domain, req.URL, req.Collections)
+	if err != nil {
+		log.Printf("Error creating webhook for %q: %v", req.Domain, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to create webhook",
+		})
+	}
+	return c.JSON(http.StatusOK, hook)
+}
+
+// handleListWebhooks returns a domain's webhooks (without secrets).
+// GET /xrpc/host.primal.pds.listWebhooks?domain=...
+func (s *Server) handleListWebhooks(c echo.Context) error {
+	domainName := strings.TrimSpace(strings.ToLower(c.QueryParam("domain")))
+	if domainName == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "domain query parameter is required",
+		})
+	}
+
+	ctx := c.Request().Context()
+	if !s.canManageDomain(ctx, getAuth(c), domainName) {
+		return webhookForbidden(c)
+	}
+
+	hooks, err := s.webhooks.List(ctx, domainName)
+	if err != nil {
+		log.Printf("Error listing webhooks for %q: %v", domainName, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to list webhooks",
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"webhooks": hooks,
+	})
+}
+
+type updateWebhookRequest struct {
+	ID     int    `json:"id"`
+	Status string `json:"status"`
+}
+
+// handleUpdateWebhook enables or disables a webhook.
+// POST /xrpc/host.primal.pds.updateWebhook
+func (s *Server) handleUpdateWebhook(c echo.Context) error {
+	var req updateWebhookRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "Invalid JSON body",
+		})
+	}
+	if req.Status != webhook.StatusActive && req.Status != webhook.StatusDisabled {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "status must be 'active' or 'disabled'",
+		})
+	}
+
+	if hook, err := s.manageableWebhook(c, req.ID); hook == nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	if err := s.webhooks.SetStatus(ctx, req.ID, req.Status); err != nil {
+		return webhookError(c, err, req.ID)
+	}
+	hook, err := s.webhooks.Get(ctx, req.ID)
+	if err != nil {
+		return webhookError(c, err, req.ID)
+	}
+	return c.JSON(http.StatusOK, hook)
+}
+
+type deleteWebhookRequest struct {
+	ID int `json:"id"`
+}
+
+// handleDeleteWebhook removes a webhook and its delivery history.
+// POST /xrpc/host.primal.pds.deleteWebhook
+func (s *Server) handleDeleteWebhook(c echo.Context) error {
+	var req deleteWebhookRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "Invalid JSON body",
+		})
+	}
+
+	if hook, err := s.manageableWebhook(c, req.ID); hook == nil {
+		return err
+	}
+
+	if err := s.webhooks.Delete(c.Request().Context(), req.ID); err != nil {
+		return webhookError(c, err, req.ID)
+	}
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Webhook deleted",
+	})
+}
+
+// handleListWebhookDeliveries returns a webhook's delivery history,
+// newest first. status narrows to pending, delivered or dead; cursor is
+// the last delivery id of the previous page.
+// GET /xrpc/host.primal.pds.listWebhookDeliveries?id=...&status=...&limit=...&cursor=...
+func (s *Server) handleListWebhookDeliveries(c echo.Context) error {
+	id, err := strconv.Atoi(c.QueryParam("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "id query parameter is required",
+		})
+	}
+
+	status := c.QueryParam("status")
+	switch status {
+	case "", webhook.DeliveryPending, webhook.DeliveryDelivered, webhook.DeliveryDead:
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "status must be 'pending', 'delivered' or 'dead'",
+		})
+	}
+
+	limit := 50
+	if l := c.QueryParam("limit"); l != "" {
+		if n, err := strconv.Atoi(l); err == nil && n > 0 && n <= 100 {
+			limit = n
+		}
+	}
+
+	var before int64
+	if cursorStr := c.QueryParam("cursor"); cursorStr != "" {
+		before, err = strconv.ParseInt(cursorStr, 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error":   "InvalidRequest",
+				"message": "cursor must be an integer",
+			})
+		}
+	}
+
+	if hook, err := s.manageableWebhook(c, id); hook == nil {
+		return err
+	}
+
+	deliveries, err := s.webhooks.ListDeliveries(c.Request().Context(), id, status, before, limit)
+	if err != nil {
+		log.Printf("Error listing deliveries for webhook %d: %v", id, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error":   "InternalError",
+			"message": "Failed to list deliveries",
+		})
+	}
+
+	resp := map[string]any{
+		"deliveries": deliveries,
+	}
+	if len(deliveries) == limit {
+		resp["cursor"] = strconv.FormatInt(deliveries[len(deliveries)-1].ID, 10)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+type retryWebhookDeliveryRequest struct {
+	ID       int   `json:"id"`
+	Delivery int64 `json:"delivery"`
+}
+
+// handleRetryWebhookDelivery requeues a dead delivery.
+// POST /xrpc/host.primal.pds.retryWebhookDelivery
+func (s *Server) handleRetryWebhookDelivery(c echo.Context) error {
+	var req retryWebhookDeliveryRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error":   "InvalidRequest",
+			"message": "Invalid JSON body",
+		})
+	}
+
+	if hook, err := s.manageableWebhook(c, req.ID); hook == nil {
+		return err
+	}
+
+	if err := s.webhooks.RetryDelivery(c.Request().Context(), req.ID, req.Delivery); err != nil {
+		return webhookError(c, err, req.ID)
+	}
+	if s.dispatcher != nil {
+		s.dispatcher.Notify()
+	}
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "Delivery requeued",
+	})
+}
+
+// manageableWebhook loads a webhook and checks that the caller may
+// manage its domain. On failure it returns a nil webhook after writing
+// the error response; the returned error is the result of that write.
+func (s *Server) manageableWebhook(c echo.Context, id int) (*webhook.Webhook, error) {
+	ctx := c.Request().Context()
+	hook, err := s.webhooks.Get(ctx, id)
+	if err != nil {
+		// Don't reveal other domains' webhooks to non-admins.
+		if ac := getAuth(c); ac == nil || !ac.IsAdmin {
+			if errors.Is(err, webhook.ErrNotFound) {
+				return nil, webhookForbidden(c)
+			}
+		}
+		return nil, webhookError(c, err, id)
+	}
+	if !s.canManageDomain(ctx, getAuth(c), hook.Domain) {
+		return nil, webhookForbidden(c)
+	}
+	return hook, nil
+}
+
+// webhookForbidden writes the response for callers that may not manage
+// a domain's webhooks.
+func webhookForbidden(c echo.Context) error {
+	return c.JSON(http.StatusForbidden, map[string]string{
+		"error":   "Forbidden",
+		"message": "Only the domain owner or an admin can manage its webhooks",
+	})
+}
+
+// webhookError maps webhook package errors to HTTP responses.
+func webhookError(c echo.Context, err error, id int) error {
+	if errors.Is(err, webhook.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{
+			"error":   "NotFound",
+			"message": err.Error(),
+		})
+	}
+	log.Printf("Error with webhook %d: %v", id, err)
+	return c.JSON(http.StatusInternalServerError, map[string]string{
+		"error":   "InternalError",
+		"message": "Webhook operation failed",
+	})
+}
@@ -0,0 +1,471 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/util/ssrf"
+	"github.com/jackc/pgx/v5"
+	"github.com/primal-host/primal-pds/internal/events"
+	"github.com/primal-host/primal-pds/internal/worker"
+)
+
+// Delivery tuning.
+const (
+	// MaxAttempts is the number of failed attempts after which a delivery
+	// is moved to the dead-letter status.
+	MaxAttempts = 10
+
+	// backoffBase is the delay before the first retry; each further retry
+	// doubles it, up to backoffMax.
+	backoffBase = 30 * time.Second
+	backoffMax  = time.Hour
+
+	// deliveryBatch is the number of due deliveries sent per pass.
+	deliveryBatch = 50
+
+	// deliveryTimeout bounds a single POST, including reading the reply.
+	deliveryTimeout = 10 * time.Second
+
+	// pollInterval is how often the firehose and the delivery queue are
+	// checked when nothing wakes the dispatcher sooner.
+	pollInterval = 2 * time.Second
+
+	// seqGapGrace is how long fanout waits at a hole in the firehose seq
+	// before skipping it. seq is assigned when an insert starts, so a
+	// lower seq can still commit after a higher one is visible; holes left
+	// by rolled-back or conflicting inserts never fill and are skipped
+	// once the event after them is older than this.
+	seqGapGrace = 30 * time.Second
+)
+
+// errSeqGap stops a fanout pass at a seq hole that may still fill.
+var errSeqGap = errors.New("webhook: seq gap")
+
+// Request headers set on every delivery. The signature is
+// "sha256=" + hex(HMAC-SHA256(secret, timestamp + "." + body)); receivers
+// should recompute it and reject stale timestamps.
+const (
+	HeaderEvent     = "X-Primal-Event"
+	HeaderDelivery  = "X-Primal-Delivery"
+	HeaderTimestamp = "X-Primal-Timestamp"
+	HeaderSignature = "X-Primal-Signature"
+)
+
+// Payload is the JSON body POSTed for a commit.
+type Payload struct {
+	Seq    int64     `json:"seq"`
+	Time   time.Time `json:"time"`
+	DID    string    `json:"did"`
+	Domain string    `json:"domain"`
+	Rev    string    `json:"rev"`
+	Commit string    `json:"commit"`
+	TooBig bool      `json:"tooBig,omitempty"`
+	Ops    []Op      `json:"ops"`
+}
+
+// Op is a single record operation in a Payload. Record is omitted for
+// deletes and for tooBig commits.
+type Op struct {
+	Action     string         `json:"action"`
+	Collection string         `json:"collection"`
+	RKey       string         `json:"rkey"`
+	CID        string         `json:"cid,omitempty"`
+	Record     map[string]any `json:"record,omitempty"`
+}
+
+// Sign returns the signature header value for a delivery body.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatcher fans firehose commits out to webhook deliveries and sends
+// them. It reads events from the persisted firehose starting at a cursor
+// kept in webhook_cursor, so no commit is skipped across restarts; the
+// cursor and the deliveries for an event are written in one transaction.
+type Dispatcher struct {
+	store  *Store
+	events *events.Manager
+	client *http.Client
+	wake   *worker.Waker
+}
+
+// NewDispatcher creates a Dispatcher reading from mgr.
+func NewDispatcher(store *Store, mgr *events.Manager) *Dispatcher {
+	return &Dispatcher{
+		store:  store,
+		events: mgr,
+		// Deliveries only dial public addresses, whatever the URL's
+		// host resolves to or redirects to.
+		client: &http.Client{Timeout: deliveryTimeout, Transport: ssrf.PublicOnlyTransport()},
+		wake:   worker.NewWaker(),
+	}
+}
+
+// Run queues and sends deliveries until ctx is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	go d.deliverLoop(ctx)
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	// Live events only serve as a wake-up; the events themselves are
+	// re-read from the database in seq order.
+	live, cancel := d.subscribe(ctx)
+	defer func() { cancel() }()
+
+	for {
+		if err := d.fanout(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Warning: webhook fanout: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-live:
+			if !ok {
+				// Dropped as a slow consumer; resubscribe.
+				cancel()
+				live, cancel = d.subscribe(ctx)
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+// subscribe opens a live firehose subscription, or returns a nil channel
+// (which never fires) if that fails; polling still picks up events.
+func (d *Dispatcher) subscribe(ctx context.Context) (<-chan *events.Event, func()) {
+	ch, cancel, err := d.events.Subscribe(ctx, nil)
+	if err != nil {
+		log.Printf("Warning: webhook subscribe: %v", err)
+		return nil, func() {}
+	}
+	return ch, cancel
+}
+
+// fanout turns every firehose event after the cursor into deliveries for
+// the matching webhooks. On first start the cursor is set to the current
+// head, so existing history is not replayed to new installations. The
+// cursor only moves past a seq hole once it is older than seqGapGrace, so
+// an event committed late is not skipped.
+func (d *Dispatcher) fanout(ctx context.Context) error {
+	pool := d.store.db.Pool
+
+	var cursor int64
+	err := pool.QueryRow(ctx, `SELECT seq FROM webhook_cursor`).Scan(&cursor)
+	if errors.Is(err, pgx.ErrNoRows) {
+		cursor, err = d.events.LatestSeq(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = pool.Exec(ctx,
+			`INSERT INTO webhook_cursor (seq) VALUES ($1) ON CONFLICT (id) DO NOTHING`, cursor)
+		if err != nil {
+			return fmt.Errorf("webhook: init cursor: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("webhook: read cursor: %w", err)
+	}
+
+	hooks, err := d.activeHooks(ctx)
+	if err != nil {
+		return err
+	}
+
+	queued := false
+	next := cursor + 1
+	err = d.events.Replay(ctx, cursor, func(evt *events.Event) error {
+		if evt.Seq != next && time.Since(evt.Time) < seqGapGrace {
+			return errSeqGap
+		}
+		next = evt.Seq + 1
+		n, err := d.enqueue(ctx, hooks[evt.Domain], evt)
+		if n > 0 {
+			queued = true
+		}
+		return err
+	})
+	if queued {
+		d.Notify()
+	}
+	if errors.Is(err, errSeqGap) {
+		return nil
+	}
+	return err
+}
+
+// activeHooks returns the active webhooks keyed by domain.
+func (d *Dispatcher) activeHooks(ctx context.Context) (map[string][]Webhook, error) {
+	rows, err := d.store.db.Pool.Query(ctx,
+		`SELECT id, domain, url, collections FROM webhooks WHERE status = $1`, StatusActive)
+	if err != nil {
+		return nil, fmt.Errorf("webhook: load active: %w", err)
+	}
+	defer rows.Close()
+
+	hooks := map[string][]Webhook{}
+	for rows.Next() {
+		var w Webhook
+		if err := rows.Scan(&w.ID, &w.Domain, &w.URL, &w.Collections); err != nil {
+			return nil, fmt.Errorf("webhook: load active scan: %w", err)
+		}
+		hooks[w.Domain] = append(hooks[w.Domain], w)
+	}
+	return hooks, rows.Err()
+}
+
+// enqueue writes one delivery per matching webhook for evt and advances
+// the cursor past it, atomically. It returns the number of deliveries
+// queued.
+func (d *Dispatcher) enqueue(ctx context.Context, hooks []Webhook, evt *events.Event) (int, error) {
+	// Only commits are delivered; other events just advance the cursor.
+	if evt.Commit == nil {
+		hooks = nil
+	}
+
+	var ops []Op
+	if len(hooks) > 0 {
+		var err error
+		if ops, err = payloadOps(evt); err != nil {
+			// Undecodable events are skipped rather than blocking the queue.
+			log.Printf("Warning: webhook: decode seq %d: %v", evt.Seq, err)
+			hooks = nil
+		}
+	}
+
+	tx, err := d.store.db.Pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("webhook: begin: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	n := 0
+	for _, w := range hooks {
+		matched := filterOps(ops, w.Collections)
+		if len(matched) == 0 && !evt.Commit.TooBig {
+			continue
+		}
+
+		body, err := json.Marshal(&Payload{
+			Seq:    evt.Seq,
+			Time:   evt.Time,
+			DID:    evt.DID,
+			Domain: evt.Domain,
+			Rev:    evt.Commit.Rev,
+			Commit: evt.Commit.Commit.String(),
+			TooBig: evt.Commit.TooBig,
+			Ops:    matched,
+		})
+		if err != nil {
+			return 0, fmt.Errorf("webhook: marshal seq %d: %w", evt.Seq, err)
+		}
+
+		_, err = tx.Exec(ctx,
+			`INSERT INTO webhook_deliveries (webhook_id, seq, payload) VALUES ($1, $2, $3)
+			 ON CONFLICT (webhook_id, seq) DO NOTHING`,
+			w.ID, evt.Seq, body)
+		if err != nil {
+			return 0, fmt.Errorf("webhook: queue seq %d for %d: %w", evt.Seq, w.ID, err)
+		}
+		n++
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE webhook_cursor SET seq = $1`, evt.Seq); err != nil {
+		return 0, fmt.Errorf("webhook: advance cursor: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("webhook: commit: %w", err)
+	}
+	return n, nil
+}
+
+// payloadOps decodes the record operations of a commit event.
+func payloadOps(evt *events.Event) ([]Op, error) {
+	jevts, err := events.JetstreamEvents(evt)
+	if err != nil {
+		return nil, err
+	}
+	ops := make([]Op, len(jevts))
+	for i, je := range jevts {
+		ops[i] = Op{
+			Action:     je.Commit.Operation,
+			Collection: je.Commit.Collection,
+			RKey:       je.Commit.RKey,
+			CID:        je.Commit.CID,
+			Record:     je.Commit.Record,
+		}
+	}
+	return ops, nil
+}
+
+// filterOps returns the ops whose collection matches one of collections.
+// An empty filter matches everything.
+func filterOps(ops []Op, collections []string) []Op {
+	if len(collections) == 0 {
+		return ops
+	}
+	out := []Op{}
+	for _, op := range ops {
+		for _, c := range collections {
+			if prefix, ok := strings.CutSuffix(c, "*"); (ok && strings.HasPrefix(op.Collection, prefix)) || c == op.Collection {
+				out = append(out, op)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// Notify wakes the delivery loop, e.g. after a delivery is requeued.
+func (d *Dispatcher) Notify() {
+	d.wake.Notify()
+}
+
+// deliverLoop sends due deliveries until ctx is cancelled.
+func (d *Dispatcher) deliverLoop(ctx context.Context) {
+	d.wake.Loop(ctx, pollInterval, d.deliverAll)
+}
+
+// deliverAll sends due deliveries in batches until none is left.
+func (d *Dispatcher) deliverAll(ctx context.Context) {
+	for {
+		n, err := d.deliverDue(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Warning: webhook delivery: %v", err)
+		}
+		if err != nil || n < deliveryBatch {
+			return
+		}
+	}
+}
+
+// dueDelivery is a pending delivery joined with its webhook's target.
+type dueDelivery struct {
+	id       int64
+	attempts int
+	payload  []byte
+	url      string
+	secret   string
+}
+
+// deliverDue sends one batch of due deliveries concurrently and records
+// the outcome of each. It returns the number of deliveries attempted.
+func (d *Dispatcher) deliverDue(ctx context.Context) (int, error) {
+	rows, err := d.store.db.Pool.Query(ctx,
+		`SELECT d.id, d.attempts, d.payload, w.url, w.secret
+		 FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+		 WHERE d.status = $1 AND d.next_attempt_at <= NOW() AND w.status = $2
+		 ORDER BY d.id LIMIT $3`,
+		DeliveryPending, StatusActive, deliveryBatch)
+	if err != nil {
+		return 0, fmt.Errorf("webhook: query due: %w", err)
+	}
+	var due []dueDelivery
+	for rows.Next() {
+		var dd dueDelivery
+		if err := rows.Scan(&dd.id, &dd.attempts, &dd.payload, &dd.url, &dd.secret); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("webhook: scan due: %w", err)
+		}
+		due = append(due, dd)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("webhook: query due: %w", err)
+	}
+
+	var wg sync.WaitGroup
+	for _, dd := range due {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code, sendErr := d.send(ctx, &dd)
+			if err := d.record(ctx, &dd, code, sendErr); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	return len(due), nil
+}
+
+// send POSTs a delivery and returns the response status. Any non-2xx
+// status is reported as an error.
+func (d *Dispatcher) send(ctx context.Context, dd *dueDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dd.url, bytes.NewReader(dd.payload))
+	if err != nil {
+		return 0, err
+	}
+	ts := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "primal-pds-webhook")
+	req.Header.Set(HeaderEvent, "commit")
+	req.Header.Set(HeaderDelivery, strconv.FormatInt(dd.id, 10))
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(ts, 10))
+	req.Header.Set(HeaderSignature, Sign(dd.secret, ts, dd.payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// record stores the outcome of an attempt: delivered on success,
+// otherwise rescheduled with backoff or, once MaxAttempts is reached,
+// marked dead.
+func (d *Dispatcher) record(ctx context.Context, dd *dueDelivery, code int, sendErr error) error {
+	attempts := dd.attempts + 1
+
+	var err error
+	switch {
+	case sendErr == nil:
+		_, err = d.store.db.Pool.Exec(ctx,
+			`UPDATE webhook_deliveries
+			 SET status = $1, attempts = $2, response_code = $3, last_error = '', updated_at = NOW()
+			 WHERE id = $4`,
+			DeliveryDelivered, attempts, code, dd.id)
+	case attempts >= MaxAttempts:
+		_, err = d.store.db.Pool.Exec(ctx,
+			`UPDATE webhook_deliveries
+			 SET status = $1, attempts = $2, response_code = $3, last_error = $4, updated_at = NOW()
+			 WHERE id = $5`,
+			DeliveryDead, attempts, code, sendErr.Error(), dd.id)
+	default:
+		_, err = d.store.db.Pool.Exec(ctx,
+			`UPDATE webhook_deliveries
+			 SET attempts = $1, response_code = $2, last_error = $3, next_attempt_at = $4, updated_at = NOW()
+			 WHERE id = $5`,
+			attempts, code, sendErr.Error(), time.Now().Add(worker.Backoff(attempts, backoffBase, backoffMax)), dd.id)
+	}
+	if err != nil {
+		return fmt.Errorf("webhook: record delivery %d: %w", dd.id, err)
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+// Package webhook delivers repository commits to external HTTP endpoints.
+// Subscriptions are kept per domain in the management database; every
+// firehose commit for a subscribed domain is queued as a delivery, POSTed
+// as signed JSON, and retried with exponential backoff until it succeeds
+// or is moved to the dead-letter status.
+package webhook
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/util/ssrf"
+	"github.com/jackc/pgx/v5"
+	"github.com/primal-host/primal-pds/internal/database"
+)
+
+// Webhook statuses.
+const (
+	StatusActive   = "active"
+	StatusDisabled = "disabled"
+)
+
+// Delivery statuses. A dead delivery has exhausted its retries and is
+// kept for inspection until it is retried by hand.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+var (
+	// ErrNotFound is returned when a webhook or delivery lookup finds no row.
+	ErrNotFound = errors.New("webhook: not found")
+
+	// ErrInvalidURL is returned when a webhook URL is not an absolute
+	// http or https URL.
+	ErrInvalidURL = errors.New("webhook: url must be an absolute http or https URL")
+
+	// ErrPrivateURL is returned when a webhook URL names a loopback,
+	// private or link-local host, or a port other than 80 or 443.
+	// Deliveries are only ever sent to public addresses.
+	ErrPrivateURL = errors.New("webhook: url must point to a public host on port 80 or 443")
+)
+
+// Webhook is a subscription to a domain's commits. Collections, when
+// non-empty, limits deliveries to ops in those collections; an entry
+// ending in ".*" matches every collection under that prefix.
+type Webhook struct {
+	ID          int       `json:"id"`
+	Domain      string    `json:"domain"`
+	URL         string    `json:"url"`
+	Secret      string    `json:"secret,omitempty"` // only returned on create
+	Collections []string  `json:"collections"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// Delivery is one attempt record for sending an event to a webhook.
+type Delivery struct {
+	ID            int64           `json:"id"`
+	WebhookID     int             `json:"webhookId"`
+	Seq           int64           `json:"seq"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt time.Time       `json:"nextAttemptAt"`
+	ResponseCode  int             `json:"responseCode,omitempty"`
+	LastError     string          `json:"lastError,omitempty"`
+	CreatedAt     time.Time       `json:"createdAt"`
+	UpdatedAt     time.Time       `json:"updatedAt"`
+}
+
+// Store provides webhook and delivery persistence in the management DB.
+type Store struct {
+	db *database.ManagementDB
+}
+
+// NewStore creates a webhook Store.
+func NewStore(db *database.ManagementDB) *Store {
+	return &Store{db: db}
+}
+
+// ValidateURL checks that raw is an absolute http or https URL on the
+// default port whose host is not a loopback, private or link-local
+// address. Host names that resolve to such addresses are refused when
+// a delivery dials them.
+func ValidateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return ErrInvalidURL
+	}
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		return ErrPrivateURL
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrPrivateURL
+	}
+	if ip := net.ParseIP(host); ip != nil && !ssrf.IsPublicIPAddress(ip) {
+		return ErrPrivateURL
+	}
+	return nil
+}
+
+// Create adds a webhook for a domain with a freshly generated signing
+// secret. The returned Webhook is the only one that carries the secret.
+func (s *Store) Create(ctx context.Context, domainName, rawURL string, collections []string) (*Webhook, error) {
+	if err := ValidateURL(rawURL); err != nil {
+		return nil, err
+	}
+	if collections == nil {
+		collections = []string{}
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, fmt.Errorf("webhook: generate secret: %w", err)
+	}
+	secret := hex.EncodeToString(buf)
+
+	var w Webhook
+	err := s.db.Pool.QueryRow(ctx,
+		`INSERT INTO webhooks (domain, url, secret, collections) VALUES ($1, $2, $3, $4)
+		 RETURNING id, domain, url, secret, collections, status, created_at, updated_at`,
+		domainName, rawURL, secret, collections,
+	).Scan(&w.ID, &w.Domain, &w.URL, &w.Secret, &w.Collections, &w.Status, &w.CreatedAt, &w.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("webhook: create: %w", err)
+	}
+	return &w, nil
+}
+
+// List returns a domain's webhooks, without their secrets.
+func (s *Store) List(ctx context.Context, domainName string) ([]Webhook, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT id, domain, url, collections, status, created_at, updated_at
+		 FROM webhooks WHERE domain = $1 ORDER BY id`, domainName)
+	if err != nil {
+		return nil, fmt.Errorf("webhook: list: %w", err)
+	}
+	defer rows.Close()
+
+	hooks := []Webhook{}
+	for rows.Next() {
+		var w Webhook
+		if err := rows.Scan(&w.ID, &w.Domain, &w.URL, &w.Collections, &w.Status, &w.CreatedAt, &w.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("webhook: list scan: %w", err)
+		}
+		hooks = append(hooks, w)
+	}
+	return hooks, rows.Err()
+}
+
+// Get returns a webhook by ID, without its secret.
+func (s *Store) Get(ctx context.Context, id int) (*Webhook, error) {
+	var w Webhook
+	err := s.db.Pool.QueryRow(ctx,
+		`SELECT id, domain, url, collections, status, created_at, updated_at
+		 FROM webhooks WHERE id = $1`, id,
+	).Scan(&w.ID, &w.Domain, &w.URL, &w.Collections, &w.Status, &w.CreatedAt, &w.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %d", ErrNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("webhook: get %d: %w", id, err)
+	}
+	return &w, nil
+}
+
+// SetStatus enables or disables a webhook. A disabled webhook gets no
+// new deliveries; ones already pending are held until it is re-enabled.
+func (s *Store) SetStatus(ctx context.Context, id int, status string) error {
+	tag, err := s.db.Pool.Exec(ctx,
+		`UPDATE webhooks SET status = $1, updated_at = NOW() WHERE id = $2`, status, id)
+	if err != nil {
+		return fmt.Errorf("webhook: set status %d: %w", id, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: %d", ErrNotFound, id)
+	}
+	return nil
+}
+
+// Delete removes a webhook and its delivery history.
+func (s *Store) Delete(ctx context.Context, id int) error {
+	tag, err := s.db.Pool.Exec(ctx, `DELETE FROM webhooks WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("webhook: delete %d: %w", id, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: %d", ErrNotFound, id)
+	}
+	return nil
+}
+
+// ListDeliveries returns a webhook's deliveries, newest first. status
+// filters by delivery status when non-empty; before, when non-zero,
+// returns only deliveries with a smaller ID (for paging).
+func (s *Store) ListDeliveries(ctx context.Context, webhookID int, status string, before int64, limit int) ([]Delivery, error) {
+	rows, err := s.db.Pool.Query(ctx,
+		`SELECT id, webhook_id, seq, payload, status, attempts, next_attempt_at,
+		        response_code, last_error, created_at, updated_at
+		 FROM webhook_deliveries
+		 WHERE webhook_id = $1
+		   AND ($2 = '' OR status = $2)
+		   AND ($3 = 0 OR id < $3)
+		 ORDER BY id DESC LIMIT $4`,
+		webhookID, status, before, limit)
+	if err != nil {
+		return nil, fmt.Errorf("webhook: list deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	deliveries := []Delivery{}
+	for rows.Next() {
+		var d Delivery
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Seq, &d.Payload, &d.Status, &d.Attempts,
+			&d.NextAttemptAt, &d.ResponseCode, &d.LastError, &d.CreatedAt, &d.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("webhook: list deliveries scan: %w", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// RetryDelivery puts a dead delivery back in the queue with a fresh
+// attempt budget. It returns ErrNotFound unless the delivery belongs to
+// the webhook and is dead.
+func (s *Store) RetryDelivery(ctx context.Context, webhookID int, id int64) error {
+	tag, err := s.db.Pool.Exec(ctx,
+		`UPDATE webhook_deliveries
+		 SET status = $1, attempts = 0, next_attempt_at = NOW(), updated_at = NOW()
+		 WHERE id = $2 AND webhook_id = $3 AND status = $4`,
+		DeliveryPending, id, webhookID, DeliveryDead)
+	if err != nil {
+		return fmt.Errorf("webhook: retry delivery %d: %w", id, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: dead delivery %d", ErrNotFound, id)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// Package worker holds the plumbing shared by the background workers
+// that drain a database queue: a poll loop that can be woken early, and
+// the exponential backoff used between failed attempts.
+package worker
+
+import (
+	"context"
+	"time"
+)
+
+// Waker runs a pass on a fixed interval, or sooner when notified.
+type Waker struct {
+	wake chan struct{}
+}
+
+// NewWaker creates a Waker.
+func NewWaker() *Waker {
+	return &Waker{wake: make(chan struct{}, 1)}
+}
+
+// Notify makes a running Loop start its next pass without waiting for
+// the interval. It never blocks; notifications that arrive during a pass
+// are coalesced into one.
+func (w *Waker) Notify() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Loop calls pass immediately and then after every interval or Notify,
+// until ctx is cancelled.
+func (w *Waker) Loop(ctx context.Context, interval time.Duration, pass func(context.Context)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		pass(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Backoff returns the delay before the attempt that follows the given
+// number of failures: base after the first, doubling each time, capped
+// at max.
+func Backoff(attempts int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	return min(delay, max)
+}
@@ -0,0 +1,60 @@
+package worker
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{8, time.Hour},
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := Backoff(tt.attempts, 30*time.Second, time.Hour); got != tt.want {
+			t.Errorf("Backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestWakerLoop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := NewWaker()
+	w.Notify()
+	w.Notify() // coalesced with the one above
+	passes := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.Loop(ctx, time.Hour, func(context.Context) { passes <- struct{}{} })
+	}()
+
+	<-passes // the first pass runs immediately
+	select {
+	case <-passes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Notify did not start a pass")
+	}
+	select {
+	case <-passes:
+		t.Fatal("two Notify calls started two passes")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Loop did not return after cancel")
+	}
+}